@@ -5,7 +5,11 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"hash/fnv"
+	"log"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,41 +21,185 @@ import (
 
 // Backend is the interface for a cache backend. All write operations in a Cache are forwarded to a Backend.
 type Backend interface {
-	Set(key uint32, value Value)
-	Evict(key uint32)
+	Set(key uint64, value Value)
+	Evict(key uint64)
 	Read() []Value
 	Reset()
 }
 
+// task is an operation run asynchronously by the workers of a queue.
+type task struct {
+	id   int64
+	name string
+	fn   func()
+}
+
 type queue struct {
-	tasks chan func()
-	wg    sync.WaitGroup
+	tasks     chan task
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	workers   int
+	nextID    int64
+	pending   map[int64]string
+	processed int64
+	duration  time.Duration
 }
 
 // Cache is a cache of DNS messages.
 type Cache struct {
-	client   dnsutil.Client
-	backend  Backend
-	capacity int
-	entries  map[uint32]*list.Element
-	values   *list.List
-	mu       sync.RWMutex
-	now      func() time.Time
-	queue    *queue
+	client     dnsutil.Client
+	backend    Backend
+	capacity   int
+	entries    map[uint64]*list.Element
+	values     *list.List
+	mu         sync.RWMutex
+	now        func() time.Time
+	queue      *queue
+	closed     bool
+	options    Options
+	evictions  Evictions
+	prefetches Prefetches
+	statsMu    sync.Mutex
+}
+
+// Options configures optional behaviour of a Cache.
+type Options struct {
+	// PrefetchTypes restricts prefetching to entries of the given query types. Expired entries of other types are
+	// evicted. If empty, entries of all types are prefetched.
+	PrefetchTypes []uint16
+	// FailureTTL is the duration to cache SERVFAIL and REFUSED responses for. Zero means that such responses are not
+	// cached.
+	FailureTTL time.Duration
+	// ZoneTTLs maps zones to the maximum duration to cache entries within that zone for. The longest zone matching the
+	// question name of an entry applies.
+	ZoneTTLs map[string]time.Duration
+	// TTLFactor multiplies the TTL of entries to determine how long they are cached for, trading freshness for fewer
+	// upstream queries. Stretched TTLs are still limited by MaxTTL, FailureTTL and ZoneTTLs. Zero means a factor of
+	// one.
+	TTLFactor float64
+	// MaxTTL is the maximum duration to cache entries for. Zero means no maximum.
+	MaxTTL time.Duration
+	// KeyHash is the hash function used to compute keys by Key and KeySubnet. Persisted values with keys computed by
+	// a different hash function are discarded when the cache is loaded.
+	KeyHash int
+	// CloseTimeout is the maximum duration Close waits for outstanding cache operations, such as a refresh stuck on a
+	// slow upstream, after which the remaining operations are abandoned. Zero means no timeout.
+	CloseTimeout time.Duration
+}
+
+const (
+	// KeyFNV32 computes keys using the 32-bit FNV-1a hash. This is the default.
+	KeyFNV32 = iota
+	// KeyFNV64 computes keys using the 64-bit FNV-1a hash, which makes key collisions unlikely in large caches.
+	KeyFNV64
+)
+
+// Source describes how a value was added to the cache.
+type Source int
+
+const (
+	// SourceUpstream is a value set from an upstream response.
+	SourceUpstream Source = iota
+	// SourceBackend is a value loaded from the cache backend.
+	SourceBackend
+	// SourcePrefetch is a value refreshed by prefetching.
+	SourcePrefetch
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceUpstream:
+		return "upstream"
+	case SourceBackend:
+		return "backend"
+	case SourcePrefetch:
+		return "prefetch"
+	}
+	return "unknown"
+}
+
+// State describes the outcome of looking up a key in the cache.
+type State int
+
+const (
+	// StateMiss means that the key was not found.
+	StateMiss State = iota
+	// StateHit means that an unexpired value was found.
+	StateHit
+	// StateBackendHit means that an unexpired value loaded from the cache backend was found.
+	StateBackendHit
+	// StateStale means that an expired value was found and returned, and that prefetching of a fresh value was
+	// triggered.
+	StateStale
+	// StateExpired means that an expired value was found, but not returned because it cannot be prefetched. The
+	// value is evicted.
+	StateExpired
+)
+
+func (s State) String() string {
+	switch s {
+	case StateMiss:
+		return "miss"
+	case StateHit:
+		return "hit"
+	case StateBackendHit:
+		return "backend hit"
+	case StateStale:
+		return "stale"
+	case StateExpired:
+		return "expired"
+	}
+	return "unknown"
 }
 
 // Value wraps a DNS message stored in the cache.
 type Value struct {
-	Key       uint32
+	Key       uint64
 	CreatedAt time.Time
-	msg       *dns.Msg
+	// ExpiresAt is the time at which the value expires. It is computed when the value is added to the cache.
+	ExpiresAt time.Time
+	// Source is how the value was added to the cache. It is not included when the value is packed, as values are
+	// always loaded from the backend.
+	Source  Source
+	msg     *dns.Msg
+	keyHash int
 }
 
 // Stats contains cache statistics.
 type Stats struct {
-	Size         int
-	Capacity     int
-	PendingTasks int
+	Size            int
+	Capacity        int
+	PendingTasks    int
+	Workers         int
+	ProcessedTasks  int64
+	AvgTaskDuration time.Duration
+	Evictions       Evictions
+	Prefetches      Prefetches
+}
+
+// Evictions counts the values removed from the cache, by the reason for their removal.
+type Evictions struct {
+	// Capacity is the number of values evicted to make room for a new value.
+	Capacity int64
+	// Expired is the number of values evicted because their TTL passed.
+	Expired int64
+	// Flushed is the number of values removed by resetting the cache.
+	Flushed int64
+	// Refresh is the number of values evicted because their refreshed message could not be cached.
+	Refresh int64
+}
+
+// Prefetches counts the activity of prefetching, for judging its cost and benefit.
+type Prefetches struct {
+	// Attempts is the number of refreshes scheduled for expired values.
+	Attempts int64
+	// Queries is the number of upstream queries made to refresh values.
+	Queries int64
+	// Successes is the number of refreshed messages that were cached.
+	Successes int64
+	// Hits is the number of lookups answered by a fresh value that was cached by prefetching, i.e. lookups that would
+	// otherwise have waited for an upstream query.
+	Hits int64
 }
 
 // Rcode returns the response code of the cached value v.
@@ -66,13 +214,31 @@ func (v *Value) Qtype() uint16 { return v.msg.Question[0].Qtype }
 // Answers returns the answers of the cached value v.
 func (v *Value) Answers() []string { return dnsutil.Answers(v.msg) }
 
+// matches returns whether cached value v answers question q. Names are compared case-insensitively.
+func (v *Value) matches(q dns.Question) bool {
+	if len(v.msg.Question) == 0 {
+		return false
+	}
+	vq := v.msg.Question[0]
+	return vq.Qtype == q.Qtype && vq.Qclass == q.Qclass && strings.EqualFold(vq.Name, q.Name)
+}
+
 // TTL returns the time to live of the cached value v.
 func (v *Value) TTL() time.Duration { return dnsutil.MinTTL(v.msg) }
 
+// packVersion is the version of the format written by Pack. Version 0 is the legacy format, which has no version
+// prefix. Version 2 adds the hash function used to compute the key, which is KeyFNV32 for earlier versions.
+const packVersion = 2
+
 // Pack returns a string representation of Value v.
 func (v *Value) Pack() (string, error) {
 	var sb strings.Builder
-	sb.WriteString(strconv.FormatUint(uint64(v.Key), 10))
+	sb.WriteString("v")
+	sb.WriteString(strconv.Itoa(packVersion))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Itoa(v.keyHash))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatUint(v.Key, 10))
 	sb.WriteString(" ")
 	sb.WriteString(strconv.FormatInt(v.CreatedAt.Unix(), 10))
 	sb.WriteString(" ")
@@ -84,13 +250,37 @@ func (v *Value) Pack() (string, error) {
 	return sb.String(), nil
 }
 
-// Unpack converts a string value into a Value type.
+// Unpack converts a string value into a Value type. Values in both the current and legacy formats are accepted.
 func Unpack(value string) (Value, error) {
 	fields := strings.Fields(value)
+	version := 0
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "v") {
+		var err error
+		version, err = strconv.Atoi(fields[0][1:])
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid version: %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	if version > packVersion {
+		return Value{}, fmt.Errorf("unsupported version: %d", version)
+	}
+	keyHash := KeyFNV32
+	if version >= 2 {
+		if len(fields) < 1 {
+			return Value{}, fmt.Errorf("invalid number of fields: %q", value)
+		}
+		var err error
+		keyHash, err = strconv.Atoi(fields[0])
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid key hash: %q", fields[0])
+		}
+		fields = fields[1:]
+	}
 	if len(fields) < 3 {
 		return Value{}, fmt.Errorf("invalid number of fields: %q", value)
 	}
-	key, err := strconv.ParseUint(fields[0], 10, 32)
+	key, err := strconv.ParseUint(fields[0], 10, 64)
 	if err != nil {
 		return Value{}, err
 	}
@@ -107,9 +297,10 @@ func Unpack(value string) (Value, error) {
 		return Value{}, err
 	}
 	return Value{
-		Key:       uint32(key),
+		Key:       key,
 		CreatedAt: time.Unix(secs, 0),
 		msg:       msg,
+		keyHash:   keyHash,
 	}, nil
 }
 
@@ -127,12 +318,20 @@ func New(capacity int, client dnsutil.Client) *Cache {
 
 // NewWithBackend creates a new cache that forwards entries to backend.
 func NewWithBackend(capacity int, client dnsutil.Client, backend Backend) *Cache {
-	return newCache(capacity, client, backend, time.Now)
+	return NewWithOptions(capacity, client, backend, Options{})
 }
 
-func newQueue(capacity int) *queue { return &queue{tasks: make(chan func(), capacity)} }
+// NewWithOptions creates a new cache that forwards entries to backend and behaves according to options. Backend may be
+// nil.
+func NewWithOptions(capacity int, client dnsutil.Client, backend Backend, options Options) *Cache {
+	return newCache(capacity, client, backend, options, time.Now)
+}
 
-func newCache(capacity int, client dnsutil.Client, backend Backend, now func() time.Time) *Cache {
+func newQueue(capacity int) *queue {
+	return &queue{tasks: make(chan task, capacity), pending: make(map[int64]string)}
+}
+
+func newCache(capacity int, client dnsutil.Client, backend Backend, options Options, now func() time.Time) *Cache {
 	if capacity < 0 {
 		capacity = 0
 	}
@@ -140,24 +339,73 @@ func newCache(capacity int, client dnsutil.Client, backend Backend, now func() t
 		client:   client,
 		now:      now,
 		capacity: capacity,
-		entries:  make(map[uint32]*list.Element, capacity),
+		entries:  make(map[uint64]*list.Element, capacity),
 		values:   list.New(),
 		queue:    newQueue(1024),
+		options:  options,
+	}
+	if options.ZoneTTLs != nil {
+		zoneTTLs := make(map[string]time.Duration, len(options.ZoneTTLs))
+		for zone, ttl := range options.ZoneTTLs {
+			zoneTTLs[dns.CanonicalName(zone)] = ttl
+		}
+		c.options.ZoneTTLs = zoneTTLs
 	}
 	if backend != nil {
 		c.load(backend)
 	}
-	go c.queue.consume()
+	c.queue.start()
 	return c
 }
 
-// NewKey creates a new cache key for the DNS name, qtype and qclass
-func NewKey(name string, qtype, qclass uint16) uint32 {
-	h := fnv.New32a()
+// NewKey creates a new cache key for the DNS name, qtype and qclass, using the default hash function.
+func NewKey(name string, qtype, qclass uint16) uint64 {
+	return newKey(KeyFNV32, name, qtype, qclass, nil)
+}
+
+// NewKeySubnet creates a new cache key for the DNS name, qtype and qclass, specific to answers for clients in subnet,
+// using the default hash function.
+func NewKeySubnet(name string, qtype, qclass uint16, subnet *net.IPNet) uint64 {
+	return newKey(KeyFNV32, name, qtype, qclass, subnet)
+}
+
+// Key creates a new cache key for the DNS name, qtype and qclass, using the hash function of cache c. A nil cache uses
+// the default hash function.
+func (c *Cache) Key(name string, qtype, qclass uint16) uint64 {
+	return newKey(c.keyHash(), name, qtype, qclass, nil)
+}
+
+// KeySubnet creates a new cache key for the DNS name, qtype and qclass, specific to answers for clients in subnet,
+// using the hash function of cache c. A nil cache uses the default hash function.
+func (c *Cache) KeySubnet(name string, qtype, qclass uint16, subnet *net.IPNet) uint64 {
+	return newKey(c.keyHash(), name, qtype, qclass, subnet)
+}
+
+func (c *Cache) keyHash() int {
+	if c == nil {
+		return KeyFNV32
+	}
+	return c.options.KeyHash
+}
+
+func newKey(keyHash int, name string, qtype, qclass uint16, subnet *net.IPNet) uint64 {
+	var h hash.Hash
+	if keyHash == KeyFNV64 {
+		h = fnv.New64a()
+	} else {
+		h = fnv.New32a()
+	}
 	h.Write([]byte(name))
 	binary.Write(h, binary.BigEndian, qtype)
 	binary.Write(h, binary.BigEndian, qclass)
-	return h.Sum32()
+	if subnet != nil {
+		h.Write(subnet.IP)
+		h.Write(subnet.Mask)
+	}
+	if h64, ok := h.(hash.Hash64); ok {
+		return h64.Sum64()
+	}
+	return uint64(h.(hash.Hash32).Sum32())
 }
 
 func (c *Cache) load(backend Backend) {
@@ -165,13 +413,21 @@ func (c *Cache) load(backend Backend) {
 		backend.Reset()
 		return
 	}
-	values := backend.Read()
+	var values []Value
+	for _, v := range backend.Read() {
+		if v.keyHash != c.options.KeyHash {
+			backend.Evict(v.Key) // Key computed by a different hash function
+			continue
+		}
+		values = append(values, v)
+	}
 	n := 0
 	if c.capacity < len(values) {
 		n = c.capacity
 	}
 	// Add the last n values from backend
 	for _, v := range values[n:] {
+		v.Source = SourceBackend
 		c.setValue(v)
 	}
 	if c.capacity < len(values) {
@@ -183,37 +439,145 @@ func (c *Cache) load(backend Backend) {
 	c.backend = backend
 }
 
-// Close consumes any outstanding cache operations.
+// Close consumes any outstanding cache operations. If the CloseTimeout option is set, operations that are still
+// outstanding when the timeout expires are abandoned. Values are no longer forwarded to the backend after Close
+// returns, even by abandoned operations.
 func (c *Cache) Close() error {
-	c.queue.wg.Wait()
+	defer c.close()
+	if c.options.CloseTimeout == 0 {
+		c.queue.wg.Wait()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.queue.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(c.options.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		tasks := c.queue.outstanding()
+		log.Printf("abandoned %d outstanding cache tasks after %s: %s", len(tasks), c.options.CloseTimeout,
+			strings.Join(tasks, ", "))
+	}
 	return nil
 }
 
-// Get returns the DNS message associated with key.
-func (c *Cache) Get(key uint32) (*dns.Msg, bool) {
-	v, ok := c.getValue(key)
-	if !ok {
+// close stops forwarding values to the backend, which may be closed after the cache. Abandoned tasks may still modify
+// the cache itself.
+func (c *Cache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// Get returns the DNS message associated with key. Unlike GetWithState, the question of the message is not verified.
+func (c *Cache) Get(key uint64) (*dns.Msg, bool) {
+	v, _ := c.lookup(key, nil)
+	if v == nil {
 		return nil, false
 	}
 	return v.msg, true
 }
 
-func (c *Cache) getValue(key uint32) (*Value, bool) {
+// GetWithState returns the DNS message associated with key, and the outcome of the lookup. The message is nil unless
+// the state is StateHit, StateBackendHit or StateStale. A message cached for another question than q, i.e. under a
+// colliding key, is never returned and the lookup is reported as StateMiss.
+func (c *Cache) GetWithState(key uint64, q dns.Question) (*dns.Msg, State) {
+	v, state := c.lookup(key, &q)
+	if v == nil {
+		return nil, state
+	}
+	return v.msg, state
+}
+
+// Peek returns the DNS message associated with key, and the outcome of the lookup, without side effects. Expired
+// messages are neither prefetched nor evicted, and are reported as StateExpired. As in GetWithState, a message cached
+// for another question than q is reported as StateMiss.
+func (c *Cache) Peek(key uint64, q dns.Question) (*dns.Msg, State) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	v, ok := c.entries[key]
 	if !ok {
-		return nil, false
+		return nil, StateMiss
+	}
+	value := v.Value.(Value)
+	if !value.matches(q) {
+		return nil, StateMiss
+	}
+	if c.isExpired(&value) {
+		return nil, StateExpired
+	}
+	if value.Source == SourceBackend {
+		return value.msg, StateBackendHit
+	}
+	return value.msg, StateHit
+}
+
+// PeekStale is like Peek, but also returns expired messages. Expired messages are reported as StateStale, but unlike
+// GetWithState, no prefetching is triggered.
+func (c *Cache) PeekStale(key uint64, q dns.Question) (*dns.Msg, State) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.entries[key]
+	if !ok {
+		return nil, StateMiss
 	}
 	value := v.Value.(Value)
+	if !value.matches(q) {
+		return nil, StateMiss
+	}
 	if c.isExpired(&value) {
-		if !c.prefetch() {
-			c.queue.add(func() { c.evictWithLock(key) })
-			return nil, false
+		return value.msg, StateStale
+	}
+	if value.Source == SourceBackend {
+		return value.msg, StateBackendHit
+	}
+	return value.msg, StateHit
+}
+
+func (c *Cache) getValue(key uint64) (*Value, bool) {
+	v, _ := c.lookup(key, nil)
+	return v, v != nil
+}
+
+// lookup returns the value associated with key, and the outcome of the lookup. If q is non-nil, a value cached for
+// another question is treated as a miss.
+func (c *Cache) lookup(key uint64, q *dns.Question) (*Value, State) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.entries[key]
+	if !ok {
+		return nil, StateMiss
+	}
+	value := v.Value.(Value)
+	if q != nil && !value.matches(*q) {
+		return nil, StateMiss // Key collision
+	}
+	if c.isExpired(&value) {
+		if !c.prefetch() || !c.prefetchable(value.Qtype()) {
+			c.queue.add(taskName("evict", value.msg), func() { c.evictWithLock(key) })
+			return nil, StateExpired
 		}
-		c.queue.add(func() { c.refresh(key, value.msg) })
+		c.countPrefetch(func(p *Prefetches) { p.Attempts++ })
+		c.queue.add(taskName("refresh", value.msg), func() { c.refresh(key, value.msg) })
+		return &value, StateStale
+	}
+	if value.Source == SourceBackend {
+		return &value, StateBackendHit
+	}
+	if value.Source == SourcePrefetch {
+		c.countPrefetch(func(p *Prefetches) { p.Hits++ })
 	}
-	return &value, true
+	return &value, StateHit
+}
+
+func (c *Cache) countPrefetch(f func(*Prefetches)) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	f(&c.prefetches)
 }
 
 // List returns the n most recent values in cache c.
@@ -238,39 +602,56 @@ func (c *Cache) List(n int) []Value {
 // If prefetching is enabled, the message will never be evicted, but it will be refreshed when its TTL passes.
 //
 // Setting a new key in a cache that has reached its capacity will evict values in a FIFO order.
-func (c *Cache) Set(key uint32, msg *dns.Msg) {
+func (c *Cache) Set(key uint64, msg *dns.Msg) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.set(key, msg)
+	c.set(key, msg, SourceUpstream)
 }
 
 // Stats returns cache statistics.
 func (c *Cache) Stats() Stats {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	c.statsMu.Lock()
+	prefetches := c.prefetches
+	c.statsMu.Unlock()
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	var avgTaskDuration time.Duration
+	if c.queue.processed > 0 {
+		avgTaskDuration = c.queue.duration / time.Duration(c.queue.processed)
+	}
 	return Stats{
-		Capacity:     c.capacity,
-		Size:         len(c.entries),
-		PendingTasks: len(c.queue.tasks),
+		Capacity:        c.capacity,
+		Size:            len(c.entries),
+		PendingTasks:    len(c.queue.tasks),
+		Workers:         c.queue.workers,
+		ProcessedTasks:  c.queue.processed,
+		AvgTaskDuration: avgTaskDuration,
+		Evictions:       c.evictions,
+		Prefetches:      prefetches,
 	}
 }
 
-func (c *Cache) set(key uint32, msg *dns.Msg) bool {
-	return c.setValue(Value{Key: key, CreatedAt: c.now(), msg: msg})
+func (c *Cache) set(key uint64, msg *dns.Msg, source Source) bool {
+	return c.setValue(Value{Key: key, CreatedAt: c.now(), Source: source, msg: msg, keyHash: c.options.KeyHash})
 }
 
 func (c *Cache) setValue(value Value) bool {
-	if c.capacity == 0 || !canCache(value.msg) {
+	if c.capacity == 0 {
 		return false
 	}
-	if len(c.entries) == c.capacity {
+	ttl := c.ttl(value.msg)
+	if !c.canCache(value.msg, ttl) {
+		return false
+	}
+	value.ExpiresAt = value.CreatedAt.Add(ttl)
+	if current, ok := c.entries[value.Key]; ok {
+		c.values.Remove(current) // Replaced, so the number of entries does not grow
+	} else if len(c.entries) == c.capacity {
 		first := c.values.Front()
 		key := first.Value.(Value).Key
-		c.evict(key, first)
-	}
-	current, ok := c.entries[value.Key]
-	if ok {
-		c.values.Remove(current)
+		c.evict(key, first, &c.evictions.Capacity)
 	}
 	c.entries[value.Key] = c.values.PushBack(value)
 	if c.hasBackend() {
@@ -283,42 +664,95 @@ func (c *Cache) setValue(value Value) bool {
 func (c *Cache) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.entries = make(map[uint32]*list.Element, c.capacity)
+	c.evictions.Flushed += int64(len(c.entries))
+	c.entries = make(map[uint64]*list.Element, c.capacity)
 	c.values = c.values.Init()
 	if c.hasBackend() {
 		c.backend.Reset()
 	}
 }
 
+// ResetStats resets the task, eviction and prefetch counters of the cache.
+func (c *Cache) ResetStats() {
+	c.mu.Lock()
+	c.evictions = Evictions{}
+	c.mu.Unlock()
+	c.statsMu.Lock()
+	c.prefetches = Prefetches{}
+	c.statsMu.Unlock()
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	c.queue.processed = 0
+	c.queue.duration = 0
+}
+
 func (c *Cache) prefetch() bool { return c.client != nil }
 
-func (c *Cache) hasBackend() bool { return c.backend != nil }
+func (c *Cache) prefetchable(qtype uint16) bool {
+	if len(c.options.PrefetchTypes) == 0 {
+		return true
+	}
+	for _, t := range c.options.PrefetchTypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBackend returns whether values should be forwarded to the backend of the cache. The caller must hold c.mu.
+func (c *Cache) hasBackend() bool { return c.backend != nil && !c.closed }
 
-func (c *Cache) refresh(key uint32, old *dns.Msg) {
+// taskName returns the name of the task performing action on msg.
+func taskName(action string, msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return action
+	}
+	q := msg.Question[0]
+	return fmt.Sprintf("%s %s %s", action, q.Name, dnsutil.TypeToString[q.Qtype])
+}
+
+func (c *Cache) refresh(key uint64, old *dns.Msg) {
 	q := old.Question[0]
 	msg := dns.Msg{}
 	msg.SetQuestion(q.Name, q.Qtype)
+	if subnet := dnsutil.ClientSubnet(old); subnet != nil {
+		// Answer is specific to a client subnet, so refresh it for the same subnet
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        subnet.Family,
+			SourceNetmask: subnet.SourceNetmask,
+			Address:       subnet.Address,
+		})
+	}
+	c.countPrefetch(func(p *Prefetches) { p.Queries++ })
 	r, err := c.client.Exchange(&msg)
 	if err != nil {
 		return // Retry on next request
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if !c.set(key, r) {
-		c.evict(key, c.entries[key])
+	if !c.set(key, r, SourcePrefetch) {
+		c.evict(key, c.entries[key], &c.evictions.Refresh)
+		return
 	}
+	c.countPrefetch(func(p *Prefetches) { p.Successes++ })
 }
 
-func (c *Cache) evictWithLock(key uint32) {
+func (c *Cache) evictWithLock(key uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.evict(key, c.entries[key])
+	c.evict(key, c.entries[key], &c.evictions.Expired)
 }
 
-func (c *Cache) evict(key uint32, element *list.Element) {
+// evict removes element with key from the cache and increments counter. The caller must hold c.mu.
+func (c *Cache) evict(key uint64, element *list.Element, counter *int64) {
 	if element == nil {
 		return
 	}
+	*counter++
 	delete(c.entries, key)
 	c.values.Remove(element)
 	if c.hasBackend() {
@@ -326,26 +760,105 @@ func (c *Cache) evict(key uint32, element *list.Element) {
 	}
 }
 
-func (c *Cache) isExpired(v *Value) bool {
-	expiresAt := v.CreatedAt.Add(dnsutil.MinTTL(v.msg))
-	return c.now().After(expiresAt)
-}
+func (c *Cache) isExpired(v *Value) bool { return c.now().After(v.ExpiresAt) }
 
-func (q *queue) add(task func()) {
+// add adds a task running fn to the queue. The task is identified by name when it is abandoned.
+func (q *queue) add(name string, fn func()) {
 	q.wg.Add(1)
-	q.tasks <- task
+	q.mu.Lock()
+	q.nextID++
+	t := task{id: q.nextID, name: name, fn: fn}
+	q.pending[t.id] = name
+	q.mu.Unlock()
+	q.tasks <- t
+}
+
+// start starts a worker consuming tasks from the queue.
+func (q *queue) start() {
+	q.mu.Lock()
+	q.workers++
+	q.mu.Unlock()
+	go q.consume()
+}
+
+// outstanding returns the names of queued and running tasks, in the order they were added.
+func (q *queue) outstanding() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make([]int64, 0, len(q.pending))
+	for id := range q.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, q.pending[id])
+	}
+	return names
 }
 
 func (q *queue) consume() {
-	for task := range q.tasks {
-		task()
+	for t := range q.tasks {
+		start := time.Now()
+		t.fn()
+		q.mu.Lock()
+		delete(q.pending, t.id)
+		q.processed++
+		q.duration += time.Since(start)
+		q.mu.Unlock()
 		q.wg.Done()
 	}
+	q.mu.Lock()
+	q.workers--
+	q.mu.Unlock()
 }
 
-func canCache(msg *dns.Msg) bool {
-	if dnsutil.MinTTL(msg) == 0 {
+func isFailure(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused
+}
+
+func (c *Cache) ttl(msg *dns.Msg) time.Duration {
+	ttl := dnsutil.MinTTL(msg)
+	if c.options.TTLFactor > 0 {
+		ttl = time.Duration(float64(ttl) * c.options.TTLFactor)
+	}
+	if c.options.MaxTTL > 0 && c.options.MaxTTL < ttl {
+		ttl = c.options.MaxTTL
+	}
+	if isFailure(msg) && c.options.FailureTTL < ttl {
+		ttl = c.options.FailureTTL
+	}
+	if len(msg.Question) > 0 {
+		if zoneTTL, ok := c.zoneTTL(msg.Question[0].Name); ok && zoneTTL < ttl {
+			ttl = zoneTTL
+		}
+	}
+	return ttl
+}
+
+// zoneTTL returns the TTL of the longest zone containing name, if any.
+func (c *Cache) zoneTTL(name string) (time.Duration, bool) {
+	if len(c.options.ZoneTTLs) == 0 {
+		return 0, false
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if ttl, ok := c.options.ZoneTTLs[name[off:]]; ok {
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Cache) canCache(msg *dns.Msg, ttl time.Duration) bool {
+	if ttl == 0 {
 		return false
 	}
-	return msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError
+	switch msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return true
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return c.options.FailureTTL > 0
+	}
+	return false
 }
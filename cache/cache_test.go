@@ -2,8 +2,12 @@ package cache
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -46,11 +50,11 @@ type testBackend struct {
 	values []Value
 }
 
-func (b *testBackend) Set(key uint32, value Value) {
+func (b *testBackend) Set(key uint64, value Value) {
 	b.values = append(b.values, value)
 }
 
-func (b *testBackend) Evict(key uint32) {
+func (b *testBackend) Evict(key uint64) {
 	var values []Value
 	for _, v := range b.values {
 		if v.Key == key {
@@ -92,7 +96,7 @@ func TestNewKey(t *testing.T) {
 	var tests = []struct {
 		name          string
 		qtype, qclass uint16
-		out           uint32
+		out           uint64
 	}{
 		{"foo.", dns.TypeA, dns.ClassINET, 2839090419},
 		{"foo.", dns.TypeAAAA, dns.ClassINET, 3344654668},
@@ -107,6 +111,52 @@ func TestNewKey(t *testing.T) {
 	}
 }
 
+func TestKeyCollisions(t *testing.T) {
+	collisions := func(keyHash int) int {
+		n := 0
+		keys := make(map[uint64]bool)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 300000; i++ {
+			name := strconv.FormatUint(r.Uint64(), 36) + ".example.com."
+			key := newKey(keyHash, name, dns.TypeA, dns.ClassINET, nil)
+			if keys[key] {
+				n++
+			}
+			keys[key] = true
+		}
+		return n
+	}
+	// The birthday bound predicts about 10 collisions among 300000 keys of 32 bits
+	if got := collisions(KeyFNV32); got == 0 {
+		t.Errorf("got no collisions with KeyFNV32, want some")
+	}
+	if got := collisions(KeyFNV64); got != 0 {
+		t.Errorf("got %d collisions with KeyFNV64, want none", got)
+	}
+	c := NewWithOptions(10, nil, nil, Options{KeyHash: KeyFNV64})
+	if got, want := c.Key("foo.", dns.TypeA, dns.ClassINET), uint64(0xb266163007235e73); got != want {
+		t.Errorf("Key = %#x, want %#x", got, want)
+	}
+}
+
+func TestNewKeySubnet(t *testing.T) {
+	_, subnet1, _ := net.ParseCIDR("192.0.2.0/24")
+	_, subnet2, _ := net.ParseCIDR("198.51.100.0/24")
+	_, subnet3, _ := net.ParseCIDR("192.0.2.0/25")
+	key := NewKey("foo.", dns.TypeA, dns.ClassINET)
+	keys := map[uint64]bool{key: true}
+	for _, subnet := range []*net.IPNet{subnet1, subnet2, subnet3} {
+		k := NewKeySubnet("foo.", dns.TypeA, dns.ClassINET, subnet)
+		if keys[k] {
+			t.Errorf("NewKeySubnet(%s) = %d, want unique key", subnet, k)
+		}
+		keys[k] = true
+		if k2 := NewKeySubnet("foo.", dns.TypeA, dns.ClassINET, subnet); k2 != k {
+			t.Errorf("NewKeySubnet(%s) = %d, want %d", subnet, k2, k)
+		}
+	}
+}
+
 func TestCache(t *testing.T) {
 	msg := newA("1.example.com.", 60, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"))
 	msgWithZeroTTL := newA("2.example.com.", 0, net.ParseIP("192.0.2.2"))
@@ -118,6 +168,7 @@ func TestCache(t *testing.T) {
 	msgNameError.Rcode = dns.RcodeNameError
 
 	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxTTL := time.Duration((1<<31)-1) * time.Second
 	c := New(100, nil)
 	var tests = []struct {
 		msg       *dns.Msg
@@ -125,13 +176,13 @@ func TestCache(t *testing.T) {
 		ok        bool
 		value     *Value
 	}{
-		{msg, now, true, &Value{Key: 3517338631, CreatedAt: now, msg: msg}},                       // Not expired when query time == create time
-		{msg, now.Add(30 * time.Second), true, &Value{Key: 3517338631, CreatedAt: now, msg: msg}}, // Not expired when below TTL
-		{msg, now.Add(60 * time.Second), true, &Value{Key: 3517338631, CreatedAt: now, msg: msg}}, // Not expired until TTL exceeds
-		{msgNameError, now, true, &Value{Key: 3980405151, CreatedAt: now, msg: msgNameError}},     // NXDOMAIN is cached
-		{msg, now.Add(61 * time.Second), false, nil},                                              // Expired due to TTL exceeded
-		{msgWithZeroTTL, now, false, nil},                                                         // 0 TTL is not cached
-		{msgFailure, now, false, nil},                                                             // Non-cacheable rcode
+		{msg, now, true, &Value{Key: 3517338631, CreatedAt: now, ExpiresAt: now.Add(time.Minute), msg: msg}},                       // Not expired when query time == create time
+		{msg, now.Add(30 * time.Second), true, &Value{Key: 3517338631, CreatedAt: now, ExpiresAt: now.Add(time.Minute), msg: msg}}, // Not expired when below TTL
+		{msg, now.Add(60 * time.Second), true, &Value{Key: 3517338631, CreatedAt: now, ExpiresAt: now.Add(time.Minute), msg: msg}}, // Not expired until TTL exceeds
+		{msgNameError, now, true, &Value{Key: 3980405151, CreatedAt: now, ExpiresAt: now.Add(maxTTL), msg: msgNameError}},          // NXDOMAIN is cached
+		{msg, now.Add(61 * time.Second), false, nil}, // Expired due to TTL exceeded
+		{msgWithZeroTTL, now, false, nil},            // 0 TTL is not cached
+		{msgFailure, now, false, nil},                // Non-cacheable rcode
 	}
 	for i, tt := range tests {
 		c.now = func() time.Time { return now }
@@ -241,7 +292,7 @@ func TestCacheList(t *testing.T) {
 
 func TestReset(t *testing.T) {
 	c := New(10, nil)
-	c.Set(uint32(1), &dns.Msg{})
+	c.Set(uint64(1), &dns.Msg{})
 	c.Reset()
 	if got, want := len(c.entries), 0; got != want {
 		t.Errorf("len(values) = %d, want %d", got, want)
@@ -251,10 +302,57 @@ func TestReset(t *testing.T) {
 	}
 }
 
+type stuckClient struct {
+	unblock chan struct{}
+	answer  *dns.Msg
+}
+
+func (c *stuckClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	<-c.unblock
+	if c.answer == nil {
+		return nil, fmt.Errorf("no answer")
+	}
+	return c.answer, nil
+}
+
+func TestCacheCloseTimeout(t *testing.T) {
+	client := &stuckClient{unblock: make(chan struct{}), answer: testMsg}
+	backend := &testBackend{}
+	now := time.Now()
+	c := newCache(10, client, backend, Options{CloseTimeout: 10 * time.Millisecond}, func() time.Time { return now })
+	c.Set(1, testMsg)
+
+	// Trigger a refresh that never completes
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	if _, state := c.GetWithState(1, testMsg.Question[0]); state != StateStale {
+		t.Fatalf("GetWithState(1) = (_, %s), want (_, %s)", state, StateStale)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return within timeout")
+	}
+	if got, want := c.queue.outstanding(), []string{"refresh example.com. A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("outstanding() = %q, want %q", got, want)
+	}
+
+	// Abandoned task does not write to backend when it completes
+	close(client.unblock)
+	c.queue.wg.Wait()
+	if got, want := len(backend.values), 1; got != want {
+		t.Errorf("len(values) = %d, want %d", got, want)
+	}
+}
+
 func TestCachePrefetch(t *testing.T) {
 	client := newTestClient()
 	now := time.Now()
-	c := newCache(10, client, nil, func() time.Time { return now })
+	c := newCache(10, client, nil, Options{}, func() time.Time { return now })
 	var tests = []struct {
 		initialAnswer string
 		refreshAnswer string
@@ -283,7 +381,7 @@ func TestCachePrefetch(t *testing.T) {
 
 		// Add new value now
 		c.now = func() time.Time { return now }
-		var key uint32 = 1
+		var key uint64 = 1
 		c.Set(key, testMsg)
 
 		// Read value at some point in the future
@@ -309,9 +407,9 @@ func TestCachePrefetch(t *testing.T) {
 func TestCacheEvictAndUpdate(t *testing.T) {
 	client := newTestClient()
 	now := time.Now()
-	c := newCache(10, client, nil, func() time.Time { return now })
+	c := newCache(10, client, nil, Options{}, func() time.Time { return now })
 
-	var key uint32 = 1
+	var key uint64 = 1
 	c.Set(key, testMsg)
 
 	// Initial prefetched answer can no longer be cached
@@ -342,16 +440,101 @@ func TestCacheEvictAndUpdate(t *testing.T) {
 	}
 }
 
+func TestCachePrefetchTypes(t *testing.T) {
+	client := newTestClient()
+	now := time.Now()
+	c := newCache(10, client, nil, Options{PrefetchTypes: []uint16{dns.TypeA}}, func() time.Time { return now })
+
+	msgA := testMsg.Copy()
+	msgTXT := &dns.Msg{}
+	msgTXT.SetQuestion("example.com.", dns.TypeTXT)
+	msgTXT.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"foo"},
+	}}
+	var keyA, keyTXT uint64 = 1, 2
+	c.Set(keyA, msgA)
+	c.Set(keyTXT, msgTXT)
+
+	refreshed := testMsg.Copy()
+	refreshed.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.42")
+	client.setAnswer(refreshed)
+
+	// Expire both entries and trigger prefetch
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.Get(keyA)
+	c.Get(keyTXT)
+	c.Close()
+
+	c.now = func() time.Time { return now.Add(62 * time.Second) }
+	v, ok := c.getValue(keyA)
+	if !ok {
+		t.Fatalf("getValue(%d) = (_, %t), want (_, %t)", keyA, ok, true)
+	}
+	if got, want := v.Answers()[0], "192.0.2.42"; got != want {
+		t.Errorf("getValue(%d) = (%q, _), want (%q, _)", keyA, got, want)
+	}
+	if _, ok := c.getValue(keyTXT); ok {
+		t.Errorf("getValue(%d) = (_, %t), want (_, %t)", keyTXT, ok, false)
+	}
+}
+
+func TestCacheFailureTTL(t *testing.T) {
+	now := time.Now()
+	c := newCache(10, nil, nil, Options{FailureTTL: 5 * time.Second}, func() time.Time { return now })
+	msgServFail := &dns.Msg{}
+	msgServFail.SetQuestion("example.com.", dns.TypeA)
+	msgServFail.Rcode = dns.RcodeServerFailure
+	msgRefused := msgServFail.Copy()
+	msgRefused.Rcode = dns.RcodeRefused
+	msgNotImplemented := msgServFail.Copy()
+	msgNotImplemented.Rcode = dns.RcodeNotImplemented
+
+	var tests = []struct {
+		msg       *dns.Msg
+		queriedAt time.Time
+		ok        bool
+	}{
+		{msgServFail, now, true},
+		{msgServFail, now.Add(5 * time.Second), true},
+		{msgServFail, now.Add(6 * time.Second), false},
+		{msgRefused, now.Add(5 * time.Second), true},
+		{msgRefused, now.Add(6 * time.Second), false},
+		{msgNotImplemented, now, false},
+	}
+	for i, tt := range tests {
+		var key uint64 = 1
+		c.now = func() time.Time { return now }
+		c.Set(key, tt.msg)
+		c.now = func() time.Time { return tt.queriedAt }
+		if _, ok := c.Get(key); ok != tt.ok {
+			t.Errorf("#%d: Get(%d) = (_, %t), want (_, %t)", i, key, ok, tt.ok)
+		}
+		c.Close()
+	}
+
+	// Not cached by default
+	c = New(10, nil)
+	c.Set(1, msgServFail)
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", 1, ok, false)
+	}
+}
+
 func TestPackValue(t *testing.T) {
 	v := Value{
-		Key:       42,
+		Key:       math.MaxUint64,
 		CreatedAt: time.Now().Truncate(time.Second),
 		msg:       testMsg,
+		keyHash:   KeyFNV64,
 	}
 	packed, err := v.Pack()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if want := "v2 1 18446744073709551615 "; !strings.HasPrefix(packed, want) {
+		t.Errorf("Pack() = %q, want prefix %q", packed, want)
+	}
 	unpacked, err := Unpack(packed)
 	if err != nil {
 		t.Fatal(err)
@@ -359,6 +542,9 @@ func TestPackValue(t *testing.T) {
 	if got, want := unpacked.Key, v.Key; got != want {
 		t.Errorf("Key = %d, want %d", got, want)
 	}
+	if got, want := unpacked.keyHash, v.keyHash; got != want {
+		t.Errorf("keyHash = %d, want %d", got, want)
+	}
 	if got, want := unpacked.CreatedAt, v.CreatedAt; !got.Equal(want) {
 		t.Errorf("CreatedAt = %s, want %s", got, want)
 	}
@@ -367,6 +553,47 @@ func TestPackValue(t *testing.T) {
 	}
 }
 
+func TestUnpackVersions(t *testing.T) {
+	const data = "00000100000100000000000003777777076578616d706c6503636f6d0000010001"
+	var tests = []struct {
+		in      string
+		key     uint64
+		keyHash int
+		err     bool
+	}{
+		{"1 1578680472 " + data, 1, KeyFNV32, false},    // Legacy
+		{"v1 2 1578680472 " + data, 2, KeyFNV32, false}, // Version 1
+		{"v2 1 3 1578680472 " + data, 3, KeyFNV64, false},
+		{"v3 4 1578680472 " + data, 0, 0, true}, // Unsupported version
+		{"vfoo 5 1578680472 " + data, 0, 0, true},
+		{"v1 1578680472 " + data, 0, 0, true},
+		{"v2 foo 6 1578680472 " + data, 0, 0, true},
+		{"v2 7 1578680472 " + data, 0, 0, true},
+	}
+	for i, tt := range tests {
+		v, err := Unpack(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("#%d: Unpack(%q) = (_, %v), want error = %t", i, tt.in, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := v.Key; got != tt.key {
+			t.Errorf("#%d: Key = %d, want %d", i, got, tt.key)
+		}
+		if got := v.keyHash; got != tt.keyHash {
+			t.Errorf("#%d: keyHash = %d, want %d", i, got, tt.keyHash)
+		}
+		if got, want := v.CreatedAt, time.Unix(1578680472, 0); !got.Equal(want) {
+			t.Errorf("#%d: CreatedAt = %s, want %s", i, got, want)
+		}
+		if got, want := v.Question(), "www.example.com."; got != want {
+			t.Errorf("#%d: Question() = %q, want %q", i, got, want)
+		}
+	}
+}
+
 func TestCacheWithBackend(t *testing.T) {
 	var tests = []struct {
 		capacity    int
@@ -386,7 +613,7 @@ func TestCacheWithBackend(t *testing.T) {
 		backend := &testBackend{}
 		for j := 0; j < tt.backendSize; j++ {
 			v := Value{
-				Key:       uint32(j),
+				Key:       uint64(j),
 				CreatedAt: time.Now(),
 				msg:       testMsg,
 			}
@@ -396,6 +623,12 @@ func TestCacheWithBackend(t *testing.T) {
 		if got, want := len(c.entries), tt.cacheSize; got != want {
 			t.Errorf("#%d: len(values) = %d, want %d", i, got, want)
 		}
+		for _, v := range c.List(tt.cacheSize) {
+			// Expiry is computed for values loaded from backend
+			if got, want := v.ExpiresAt, v.CreatedAt.Add(time.Minute); !got.Equal(want) {
+				t.Errorf("#%d: ExpiresAt = %s, want %s", i, got, want)
+			}
+		}
 		if tt.backendSize > tt.capacity {
 			if got, want := len(backend.Read()), tt.capacity; got != want {
 				t.Errorf("#%d: len(backend.Read()) = %d, want %d", i, got, want)
@@ -411,17 +644,389 @@ func TestCacheWithBackend(t *testing.T) {
 	}
 }
 
+func TestCacheKeyHashBackend(t *testing.T) {
+	backend := &testBackend{}
+	c := NewWithOptions(10, nil, backend, Options{KeyHash: KeyFNV64})
+	key := c.Key("example.com.", dns.TypeA, dns.ClassINET)
+	c.Set(key, testMsg)
+	c.Close()
+
+	// Values round-trip through the packed format of the backend
+	for i, v := range backend.values {
+		packed, err := v.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.values[i], err = Unpack(packed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c = NewWithOptions(10, nil, backend, Options{KeyHash: KeyFNV64})
+	if _, ok := c.Get(key); !ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", key, ok, true)
+	}
+
+	// Values with keys computed by a different hash function are discarded
+	c = NewWithOptions(10, nil, backend, Options{KeyHash: KeyFNV32})
+	if got, want := len(c.List(10)), 0; got != want {
+		t.Errorf("len(List(10)) = %d, want %d", got, want)
+	}
+	c.Close()
+	if got, want := len(backend.Read()), 0; got != want {
+		t.Errorf("len(backend.Read()) = %d, want %d", got, want)
+	}
+}
+
+func TestCacheSource(t *testing.T) {
+	now := time.Now()
+	backend := &testBackend{}
+	backend.Set(1, Value{Key: 1, CreatedAt: now, msg: testMsg})
+	client := newTestClient()
+	client.setAnswer(testMsg.Copy())
+	c := newCache(10, client, backend, Options{}, func() time.Time { return now })
+	c.Set(2, testMsg)
+	c.Set(3, testMsg)
+
+	// Refresh value 3 after it expires
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.getValue(3)
+	c.Close()
+	c.now = func() time.Time { return now }
+
+	var tests = []struct {
+		key    uint64
+		source Source
+		name   string
+	}{
+		{1, SourceBackend, "backend"},
+		{2, SourceUpstream, "upstream"},
+		{3, SourcePrefetch, "prefetch"},
+	}
+	for i, tt := range tests {
+		v, ok := c.getValue(tt.key)
+		if !ok {
+			t.Fatalf("#%d: getValue(%d) = (_, %t), want (_, %t)", i, tt.key, ok, true)
+		}
+		if v.Source != tt.source {
+			t.Errorf("#%d: Source = %s, want %s", i, v.Source, tt.source)
+		}
+		if got := v.Source.String(); got != tt.name {
+			t.Errorf("#%d: Source.String() = %q, want %q", i, got, tt.name)
+		}
+	}
+}
+
+func TestCacheGetWithState(t *testing.T) {
+	now := time.Now()
+	backend := &testBackend{}
+	backend.Set(1, Value{Key: 1, CreatedAt: now, msg: testMsg})
+	client := newTestClient()
+	client.setAnswer(testMsg.Copy())
+	c := newCache(10, client, backend, Options{PrefetchTypes: []uint16{dns.TypeA}}, func() time.Time { return now })
+	c.Set(2, testMsg)
+	c.Set(3, testMsg)
+	txtMsg := testMsg.Copy()
+	txtMsg.Question[0].Qtype = dns.TypeTXT
+	c.Set(4, txtMsg)
+
+	q := testMsg.Question[0]
+	var tests = []struct {
+		key    uint64
+		q      dns.Question
+		now    time.Time
+		state  State
+		name   string
+		cached bool
+	}{
+		{1, q, now, StateBackendHit, "backend hit", true},
+		{2, q, now, StateHit, "hit", true},
+		{3, q, now.Add(61 * time.Second), StateStale, "stale", true},
+		{4, txtMsg.Question[0], now.Add(61 * time.Second), StateExpired, "expired", false},
+		{5, q, now, StateMiss, "miss", false},
+	}
+	for i, tt := range tests {
+		c.now = func() time.Time { return tt.now }
+		msg, state := c.GetWithState(tt.key, tt.q)
+		c.Close()
+		if state != tt.state {
+			t.Errorf("#%d: GetWithState(%d) = (_, %s), want (_, %s)", i, tt.key, state, tt.state)
+		}
+		if got := state.String(); got != tt.name {
+			t.Errorf("#%d: String() = %q, want %q", i, got, tt.name)
+		}
+		if got := msg != nil; got != tt.cached {
+			t.Errorf("#%d: GetWithState(%d) returned message = %t, want %t", i, tt.key, got, tt.cached)
+		}
+	}
+	// Stale value is refreshed by prefetching, and expired value is evicted
+	c.now = func() time.Time { return now }
+	if _, state := c.GetWithState(3, q); state != StateHit {
+		t.Errorf("GetWithState(3) = (_, %s), want (_, %s)", state, StateHit)
+	}
+	if _, state := c.GetWithState(4, txtMsg.Question[0]); state != StateMiss {
+		t.Errorf("GetWithState(4) = (_, %s), want (_, %s)", state, StateMiss)
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	now := time.Now()
+	client := newTestClient()
+	client.setAnswer(testMsg.Copy())
+	c := newCache(10, client, nil, Options{}, func() time.Time { return now })
+	defer c.Close()
+	c.Set(1, testMsg)
+	c.Set(2, testMsg)
+
+	q := testMsg.Question[0]
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	if msg, state := c.Peek(1, q); msg != nil || state != StateExpired {
+		t.Errorf("Peek(1) = (%v, %s), want (nil, %s)", msg, state, StateExpired)
+	}
+	if _, state := c.Peek(3, q); state != StateMiss {
+		t.Errorf("Peek(3) = (_, %s), want (_, %s)", state, StateMiss)
+	}
+	// Expired value is neither prefetched nor evicted
+	c.now = func() time.Time { return now }
+	if msg, state := c.Peek(2, q); msg == nil || state != StateHit {
+		t.Errorf("Peek(2) = (%v, %s), want (_, %s)", msg, state, StateHit)
+	}
+	if got, want := len(c.List(10)), 2; got != want {
+		t.Errorf("len(List()) = %d, want %d", got, want)
+	}
+	// Expired value is returned by PeekStale, without prefetching
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	if msg, state := c.PeekStale(1, q); msg == nil || state != StateStale {
+		t.Errorf("PeekStale(1) = (%v, %s), want (_, %s)", msg, state, StateStale)
+	}
+	c.Close()
+	if got, want := len(client.answers), 1; got != want {
+		t.Errorf("len(answers) = %d, want %d", got, want)
+	}
+}
+
+func TestCacheKeyCollision(t *testing.T) {
+	c := New(10, nil)
+	defer c.Close()
+	// Force a collision by caching a message under a key shared by all questions
+	var key uint64 = 1
+	c.Set(key, newA("example.com.", 60, net.ParseIP("192.0.2.1")))
+
+	var tests = []struct {
+		q     dns.Question
+		state State
+	}{
+		{dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, StateHit},
+		{dns.Question{Name: "EXAMPLE.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, StateHit},
+		{dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, StateMiss},
+		{dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, StateMiss},
+		{dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}, StateMiss},
+	}
+	for i, tt := range tests {
+		msg, state := c.GetWithState(key, tt.q)
+		if state != tt.state {
+			t.Errorf("#%d: GetWithState(%d, %s) = (_, %s), want (_, %s)", i, key, tt.q.String(), state, tt.state)
+		}
+		if got, want := msg != nil, tt.state == StateHit; got != want {
+			t.Errorf("#%d: GetWithState(%d, %s) returned message = %t, want %t", i, key, tt.q.String(), got, want)
+		}
+		if _, state := c.Peek(key, tt.q); state != tt.state {
+			t.Errorf("#%d: Peek(%d, %s) = (_, %s), want (_, %s)", i, key, tt.q.String(), state, tt.state)
+		}
+	}
+	// Colliding lookups do not evict the cached message
+	if got, want := len(c.List(10)), 1; got != want {
+		t.Errorf("len(List(10)) = %d, want %d", got, want)
+	}
+}
+
+func TestCacheZoneTTLs(t *testing.T) {
+	now := time.Now()
+	zoneTTLs := map[string]time.Duration{
+		"example.com":      30 * time.Second,
+		"Dev.Example.com.": 10 * time.Second,
+	}
+	c := newCache(10, nil, nil, Options{ZoneTTLs: zoneTTLs}, func() time.Time { return now })
+	var tests = []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"example.org.", 60 * time.Second},
+		{"example.com.", 30 * time.Second},
+		{"www.example.com.", 30 * time.Second},
+		{"dev.example.com.", 10 * time.Second},
+		{"host.dev.example.com.", 10 * time.Second},
+		{"HOST.DEV.EXAMPLE.COM.", 10 * time.Second},
+		{"notdev.example.com.", 30 * time.Second},
+	}
+	for i, tt := range tests {
+		key := NewKey(tt.name, dns.TypeA, dns.ClassINET)
+		c.now = func() time.Time { return now }
+		c.Set(key, newA(tt.name, 60, net.ParseIP("192.0.2.1")))
+		c.now = func() time.Time { return now.Add(tt.ttl) }
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("#%d: Get(%q) = (_, %t), want (_, %t)", i, tt.name, ok, true)
+		}
+		c.now = func() time.Time { return now.Add(tt.ttl + time.Second) }
+		if _, ok := c.Get(key); ok {
+			t.Errorf("#%d: Get(%q) = (_, %t), want (_, %t) after %s", i, tt.name, ok, false, tt.ttl)
+		}
+		c.Close()
+	}
+}
+
+func TestCacheTTLFactor(t *testing.T) {
+	now := time.Now()
+	var tests = []struct {
+		factor float64
+		maxTTL time.Duration
+		zone   time.Duration
+		ttl    time.Duration
+	}{
+		{0, 0, 0, 60 * time.Second},
+		{1, 0, 0, 60 * time.Second},
+		{1.5, 0, 0, 90 * time.Second},
+		{2, 0, 0, 120 * time.Second},
+		{1.5, 75 * time.Second, 0, 75 * time.Second},
+		{1.5, 30 * time.Second, 0, 30 * time.Second},
+		{0, 30 * time.Second, 0, 30 * time.Second},
+		{2, 0, 100 * time.Second, 100 * time.Second},
+	}
+	for i, tt := range tests {
+		options := Options{TTLFactor: tt.factor, MaxTTL: tt.maxTTL}
+		if tt.zone > 0 {
+			options.ZoneTTLs = map[string]time.Duration{"example.com.": tt.zone}
+		}
+		c := newCache(10, nil, nil, options, func() time.Time { return now })
+		c.Set(1, newA("example.com.", 60, net.ParseIP("192.0.2.1")))
+		c.now = func() time.Time { return now.Add(tt.ttl) }
+		if _, ok := c.Get(1); !ok {
+			t.Errorf("#%d: Get(1) = (_, %t), want (_, %t) after %s", i, ok, true, tt.ttl)
+		}
+		c.now = func() time.Time { return now.Add(tt.ttl + time.Second) }
+		if _, ok := c.Get(1); ok {
+			t.Errorf("#%d: Get(1) = (_, %t), want (_, %t) after %s", i, ok, false, tt.ttl+time.Second)
+		}
+		c.Close()
+	}
+}
+
 func TestCacheStats(t *testing.T) {
 	c := New(10, nil)
 	c.Set(1, testMsg)
 	c.Set(2, testMsg)
-	want := Stats{Capacity: 10, Size: 2}
+	want := Stats{Capacity: 10, Size: 2, Workers: 1}
 	got := c.Stats()
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("Stats() = %+v, want %+v", got, want)
 	}
 }
 
+func TestCacheWorkerStats(t *testing.T) {
+	now := time.Now()
+	c := newCache(10, nil, nil, Options{}, func() time.Time { return now })
+	c.Set(1, testMsg)
+	c.Set(2, testMsg)
+
+	// Expire entries and trigger eviction tasks
+	now = now.Add(time.Hour)
+	c.Get(1)
+	c.Get(2)
+	c.Close()
+	stats := c.Stats()
+	if got, want := stats.ProcessedTasks, int64(2); got != want {
+		t.Errorf("ProcessedTasks = %d, want %d", got, want)
+	}
+	if stats.AvgTaskDuration <= 0 {
+		t.Errorf("AvgTaskDuration = %s, want > 0", stats.AvgTaskDuration)
+	}
+}
+
+func TestCacheEvictionStats(t *testing.T) {
+	now := time.Now()
+	client := newTestClient()
+	uncacheable := testMsg.Copy()
+	uncacheable.Answer[0].(*dns.A).Hdr.Ttl = 0
+	client.setAnswer(uncacheable)
+	prefetching := newCache(10, client, nil, Options{}, func() time.Time { return now })
+	c := newCache(2, nil, nil, Options{}, func() time.Time { return now })
+
+	// Capacity
+	c.Set(1, testMsg)
+	c.Set(2, testMsg)
+	c.Set(3, testMsg)
+
+	// Flush
+	c.Reset()
+	c.Set(4, testMsg)
+
+	// Expiry and failed refresh
+	prefetching.Set(1, testMsg)
+	now = now.Add(time.Hour)
+	c.Get(4)
+	prefetching.Get(1)
+	c.Close()
+	prefetching.Close()
+
+	want := Evictions{Capacity: 1, Flushed: 2, Expired: 1}
+	if got := c.Stats().Evictions; got != want {
+		t.Errorf("Evictions = %+v, want %+v", got, want)
+	}
+	want = Evictions{Refresh: 1}
+	if got := prefetching.Stats().Evictions; got != want {
+		t.Errorf("Evictions = %+v, want %+v", got, want)
+	}
+	c.ResetStats()
+	if got := c.Stats().Evictions; got != (Evictions{}) {
+		t.Errorf("Evictions = %+v, want %+v", got, Evictions{})
+	}
+}
+
+func TestCacheReplaceAtCapacity(t *testing.T) {
+	c := New(2, nil)
+	c.Set(1, testMsg)
+	c.Set(2, testMsg)
+	c.Set(2, testMsg) // Replaces existing key
+	c.Set(1, testMsg)
+	if got := c.Stats().Evictions.Capacity; got != 0 {
+		t.Errorf("Evictions.Capacity = %d, want 0", got)
+	}
+	for _, key := range []uint64{1, 2} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Get(%d) = false, want true", key)
+		}
+	}
+	if got, want := c.Stats().Size, 2; got != want {
+		t.Errorf("Size = %d, want %d", got, want)
+	}
+}
+
+func TestCachePrefetchStats(t *testing.T) {
+	now := time.Now()
+	client := newTestClient()
+	client.setAnswer(testMsg) // Only the first refresh is answered
+	c := newCache(10, client, nil, Options{}, func() time.Time { return now })
+	c.Set(1, testMsg)
+	c.Set(2, testMsg)
+
+	// Expired values are refreshed
+	now = now.Add(61 * time.Second)
+	c.Get(1)
+	c.Get(2)
+	c.Close()
+
+	// Refreshed value is served fresh
+	c.Get(1)
+
+	want := Prefetches{Attempts: 2, Queries: 2, Successes: 1, Hits: 1}
+	if got := c.Stats().Prefetches; got != want {
+		t.Errorf("Prefetches = %+v, want %+v", got, want)
+	}
+	c.ResetStats()
+	if got := c.Stats().Prefetches; got != (Prefetches{}) {
+		t.Errorf("Prefetches = %+v, want %+v", got, Prefetches{})
+	}
+}
+
 func BenchmarkNewKey(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		NewKey("key", 1, 1)
@@ -432,16 +1037,29 @@ func BenchmarkSet(b *testing.B) {
 	c := New(4096, nil)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		c.Set(uint32(n), &dns.Msg{})
+		c.Set(uint64(n), &dns.Msg{})
 	}
 }
 
 func BenchmarkGet(b *testing.B) {
 	c := New(4096, nil)
-	c.Set(uint32(1), &dns.Msg{})
+	c.Set(uint64(1), &dns.Msg{})
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		c.Get(uint64(1))
+	}
+}
+
+func BenchmarkGetLargeResponse(b *testing.B) {
+	c := New(4096, nil)
+	ipAddrs := make([]net.IP, 0, 100)
+	for i := 0; i < cap(ipAddrs); i++ {
+		ipAddrs = append(ipAddrs, net.IPv4(192, 0, 2, byte(i)))
+	}
+	c.Set(uint64(1), newA("example.com.", 60, ipAddrs...))
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		c.Get(uint32(1))
+		c.Get(uint64(1))
 	}
 }
 
@@ -449,7 +1067,7 @@ func BenchmarkEviction(b *testing.B) {
 	c := New(1, nil)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		c.Set(uint32(n), &dns.Msg{})
-		c.Get(uint32(n))
+		c.Set(uint64(n), &dns.Msg{})
+		c.Get(uint64(n))
 	}
 }
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"flag"
 
+	mdns "github.com/miekg/dns"
 	"github.com/mpolden/zdns"
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns"
 	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/http"
+	"github.com/mpolden/zdns/logfile"
 	"github.com/mpolden/zdns/signal"
 	"github.com/mpolden/zdns/sql"
 )
@@ -65,97 +71,311 @@ func (c *cli) runServer(server server) {
 	}()
 }
 
-func newCli(out io.Writer, args []string, configFile string, sig chan os.Signal) *cli {
-	cl := flag.CommandLine
-	cl.SetOutput(out)
-	log.SetOutput(out)
-	confFile := cl.String("f", configFile, "config file `path`")
-	cl.Parse(args)
-
-	// Config
-	config, err := readConfig(*confFile)
-	fatal(err)
-
-	// Signal handler
-	sigHandler := signal.NewHandler(sig)
+type pipeline struct {
+	sqlClient  *sql.Client
+	sqlLogger  *sql.Logger
+	sqlCache   *sql.Cache
+	fileLogger *logfile.Logger
+	dnsClient  dnsutil.Client
+	cache      *cache.Cache
+	proxy      *dns.Proxy
+	server     *zdns.Server
+}
 
-	// SQL backends
+func newPipeline(config zdns.Config) (*pipeline, error) {
 	var (
-		sqlClient *sql.Client
-		sqlLogger *sql.Logger
-		sqlCache  *sql.Cache
+		p   pipeline
+		err error
 	)
-	if config.DNS.Database != "" {
-		sqlClient, err = sql.New(config.DNS.Database)
-		fatal(err)
 
+	// SQL backends
+	if config.DNS.Database != "" {
+		p.sqlClient, err = sql.New(config.DNS.Database)
+		if err != nil {
+			if !config.DNS.DatabaseOptional {
+				return nil, err
+			}
+			log.Printf("failed to open database %s: %s: continuing without persistence", config.DNS.Database, err)
+		}
+	}
+	if p.sqlClient != nil {
 		// Logger
-		sqlLogger = sql.NewLogger(sqlClient, config.DNS.LogMode, config.DNS.LogTTL)
+		p.sqlLogger = sql.NewLogger(p.sqlClient, config.DNS.LogMode, config.DNS.LogTTL)
+		p.sqlLogger.DiscardAnswers = !config.DNS.LogAnswers
 
 		// Cache
-		sqlCache = sql.NewCache(sqlClient)
+		p.sqlCache = sql.NewCache(p.sqlClient)
+	}
+
+	// File logger
+	if config.DNS.LogFile != "" {
+		w, err := logfile.NewWriter(config.DNS.LogFile, logfile.Options{
+			MaxSize:  int64(config.DNS.LogFileMaxSize) << 20,
+			MaxAge:   config.DNS.LogFileMaxAge,
+			MaxFiles: config.DNS.LogFileMaxFiles,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.fileLogger = logfile.NewLogger(w)
+		p.fileLogger.DiscardAnswers = !config.DNS.LogAnswers
 	}
 
 	// DNS client
 	dnsConfig := dnsutil.Config{
-		Network: config.Resolver.Protocol,
-		Timeout: config.Resolver.Timeout,
+		Network:         config.Resolver.Protocol,
+		Timeout:         config.Resolver.Timeout,
+		Family:          config.Resolver.Family,
+		PoolSize:        config.Resolver.PoolSize,
+		PoolIdleTimeout: config.Resolver.PoolIdleTimeout,
+	}
+	muxOptions := dnsutil.MuxOptions{
+		Concurrency: config.Resolver.Concurrency,
+		AnswerWait:  config.Resolver.AnswerWait,
+		Strategy:    config.Resolver.Strategy,
+		Deadline:    config.Resolver.Deadline,
 	}
-	dnsClients := make([]dnsutil.Client, 0, len(config.DNS.Resolvers))
-	for _, addr := range config.DNS.Resolvers {
-		dnsClients = append(dnsClients, dnsutil.NewClient(addr, dnsConfig))
+	if config.Resolver.Audit {
+		muxOptions.AuditLogger = log.Default()
+	}
+	newClient := func(resolvers []string) dnsutil.Client {
+		dnsClients := make([]dnsutil.Client, 0, len(resolvers))
+		for _, addr := range resolvers {
+			dnsConfig.RateLimit = config.Resolver.RateLimits[addr]
+			dnsClients = append(dnsClients, dnsutil.NewClient(addr, dnsConfig))
+		}
+		return dnsutil.NewMuxWithOptions(muxOptions, dnsClients...)
+	}
+	var dnsClient dnsutil.Client
+	if len(config.DNS.Resolvers) > 0 {
+		dnsClient = newClient(config.DNS.Resolvers)
+	}
+	p.dnsClient = dnsClient
+	routes := make([]dns.Route, 0, len(config.Routes))
+	for _, route := range config.Routes {
+		routes = append(routes, dns.Route{
+			Networks: route.Networks,
+			Zones:    route.Zones,
+			Types:    route.Types,
+			Client:   newClient(route.Resolvers),
+		})
+	}
+
+	// DNS server
+	proxyOptions := dns.Options{
+		RateLimit:              config.DNS.RateLimit,
+		RateLimitResponse:      config.DNS.RateLimitResponse,
+		MaxInFlight:            config.DNS.MaxInFlight,
+		OverloadResponse:       config.DNS.OverloadResponse,
+		Deduplicate:            config.DNS.Deduplicate,
+		DisableCache:           config.DNS.CacheDisabled,
+		QueryTimeout:           config.DNS.QueryTimeout,
+		UDPReaders:             config.DNS.UDPReaders,
+		MaxAnswers:             config.DNS.MaxAnswers,
+		RemoveDuplicateAnswers: config.DNS.RemoveDuplicateAnswers,
+		EDNSOptions:            config.DNS.EDNSOptions,
+		ECSCache:               config.DNS.ECSCache,
+		ECSPrefixIPv4:          config.DNS.ECSPrefixIPv4,
+		ECSPrefixIPv6:          config.DNS.ECSPrefixIPv6,
+		StripDNSSEC:            config.DNS.StripDNSSEC,
+		MinimalResponses:       config.DNS.MinimalResponses,
+		StripOutOfBailiwick:    config.DNS.StripOutOfBailiwick,
+		PreserveQueryCase:      config.DNS.PreserveQueryCase,
+		ShuffleAnswers:         config.DNS.ShuffleAnswers,
+		ShuffleSeed:            config.DNS.ShuffleSeed,
+		RootQueries:            config.DNS.RootQueries,
+		NonRecursive:           config.DNS.NonRecursive,
+		SpecialNames:           config.DNS.SpecialNames,
+		Offline:                config.DNS.OfflineMode,
+		OfflineAddress:         config.DNS.OfflineAddress,
+		Fallback:               config.DNS.Fallback,
+		Routes:                 routes,
+		SearchDomain:           config.DNS.SearchDomain,
+		LocalZones:             config.DNS.LocalZones,
+		Rewrites:               config.DNS.Rewrites,
+		RewriteFallback:        config.DNS.RewriteFallback,
+		WarmUp:                 config.DNS.CacheWarmUp,
+		WarmUpMode:             config.DNS.CacheWarmUpMode,
+		FileLogger:             p.fileLogger,
+	}
+	if config.DNS.Trace {
+		proxyOptions.TraceLogger = log.Default()
 	}
-	dnsClient := dnsutil.NewMux(dnsClients...)
 
 	// Cache
-	var dnsCache *cache.Cache
 	var cacheDNS dnsutil.Client
-	if config.DNS.CachePrefetch {
-		cacheDNS = dnsClient
+	if config.DNS.CachePrefetch && dnsClient != nil {
+		// Prefetched replies are filtered like the replies cached by the proxy
+		cacheDNS = dns.NewFilterClient(dnsClient, proxyOptions)
+	}
+	var cacheBackend cache.Backend
+	if p.sqlCache != nil && config.DNS.CachePersist && !config.DNS.CacheDisabled {
+		cacheBackend = p.sqlCache
+	}
+	cacheOptions := cache.Options{
+		PrefetchTypes: config.DNS.CachePrefetchTypes,
+		FailureTTL:    config.DNS.CacheFailureTTL,
+		ZoneTTLs:      config.DNS.CacheZoneTTLs,
+		TTLFactor:     config.DNS.CacheTTLFactor,
+		MaxTTL:        config.DNS.CacheMaxTTL,
+		KeyHash:       config.DNS.CacheKeyHash,
+		CloseTimeout:  config.DNS.CacheCloseTimeout,
 	}
-	if sqlCache != nil && config.DNS.CachePersist {
-		dnsCache = cache.NewWithBackend(config.DNS.CacheSize, cacheDNS, sqlCache)
+	cacheSize := config.DNS.CacheSize
+	if config.DNS.CacheDisabled {
+		cacheSize = 0
+	}
+	p.cache = cache.NewWithOptions(cacheSize, cacheDNS, cacheBackend, cacheOptions)
 
-	} else {
-		dnsCache = cache.New(config.DNS.CacheSize, cacheDNS)
+	p.proxy, err = dns.NewProxyWithOptions(p.cache, dnsClient, p.sqlLogger, proxyOptions)
+	if err != nil {
+		return nil, err
 	}
+	p.server, err = zdns.NewServer(p.proxy, config)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
 
-	// DNS server
-	proxy, err := dns.NewProxy(dnsCache, dnsClient, sqlLogger)
+// closers returns the components of pipeline p in the order they should be closed.
+func (p *pipeline) closers() []io.Closer {
+	// Close proxy first, then file logger and cache
+	closers := []io.Closer{p.proxy}
+	if p.fileLogger != nil {
+		closers = append(closers, p.fileLogger)
+	}
+	closers = append(closers, p.cache)
+	// ... then database components
+	if p.sqlClient != nil {
+		closers = append(closers, p.sqlLogger, p.sqlCache, p.sqlClient)
+	}
+	// ... and finally the server itself
+	return append(closers, p.server)
+}
+
+func (p *pipeline) Close() error {
+	var err error
+	for _, c := range p.closers() {
+		if err1 := c.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// query resolves the name and optional query type in args through pipeline p, and writes the answer to out.
+func query(out io.Writer, p *pipeline, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: query name [type]")
+	}
+	qtype := dns.TypeA
+	if len(args) == 2 {
+		t, ok := dnsutil.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			return fmt.Errorf("invalid query type: %s", args[1])
+		}
+		qtype = t
+	}
+	if err := p.server.WaitReload().Err(); err != nil {
+		log.Printf("failed to load all sources: %s", err)
+	}
+	msg := &mdns.Msg{}
+	msg.SetQuestion(mdns.Fqdn(args[0]), qtype)
+	start := time.Now()
+	res, err := p.proxy.Resolve(msg, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return err
+	}
+	duration := time.Since(start)
+	for _, rr := range res.Msg.Answer {
+		fmt.Fprintln(out, rr.String())
+	}
+	fmt.Fprintf(out, ";; status: %s, hijacked: %t, cached: %t, time: %s\n",
+		dnsutil.RcodeToString[res.Msg.Rcode], res.Hijacked, res.Cached, duration)
+	return nil
+}
+
+func newCli(stdout, stderr io.Writer, args []string, configFile string, sig chan os.Signal) *cli {
+	cl := flag.NewFlagSet(name, flag.ExitOnError)
+	cl.SetOutput(stderr)
+	log.SetOutput(stderr)
+	confFile := cl.String("f", configFile, "config file `path`")
+	cl.Usage = func() {
+		fmt.Fprintf(cl.Output(), "usage: %s [-f path] [query name [type] | replay file]\n", name)
+		cl.PrintDefaults()
+	}
+	cl.Parse(args)
+
+	// Config
+	config, err := readConfig(*confFile)
 	fatal(err)
 
-	dnsSrv, err := zdns.NewServer(proxy, config)
+	// Signal handler
+	sigHandler := signal.NewHandlerWithDebounce(sig, config.DNS.ReloadDebounce)
+
+	p, err := newPipeline(config)
 	fatal(err)
-	sigHandler.OnReload(dnsSrv)
-	servers := []server{dnsSrv}
+
+	// Resolve a single query without starting any servers
+	if cl.Arg(0) == "query" {
+		err := query(stdout, p, cl.Args()[1:])
+		if err1 := p.Close(); err == nil {
+			err = err1
+		}
+		fatal(err)
+		return &cli{sh: sigHandler}
+	}
+
+	// Replay queries from a file without starting any servers
+	if cl.Arg(0) == "replay" {
+		err := replay(stdout, p, cl.Args()[1:])
+		if err1 := p.Close(); err == nil {
+			err = err1
+		}
+		fatal(err)
+		return &cli{sh: sigHandler}
+	}
+
+	if len(config.DNS.CacheWarm) > 0 {
+		go func() {
+			n := p.proxy.WarmCache(config.DNS.CacheWarm...)
+			log.Printf("warmed cache with %d of %d names", n, len(config.DNS.CacheWarm))
+		}()
+	}
+	sigHandler.OnReload(p.server)
+	sigHandler.OnMaintenance(p.proxy)
+	servers := []server{p.server}
 
 	// HTTP server
 	var httpSrv *http.Server
 	if config.DNS.ListenHTTP != "" {
-		httpSrv = http.NewServer(dnsCache, sqlLogger, sqlCache, config.DNS.ListenHTTP)
+		httpSrv = http.NewServer(p.cache, p.sqlLogger, p.sqlCache, config.DNS.ListenHTTP)
+		httpSrv.Filter = p.server
+		httpSrv.Reloader = p.server
+		httpSrv.Pprof = config.DNS.HTTPPprof
+		httpSrv.Proxy = p.proxy
+		httpSrv.Maintainer = p.proxy
+		if upstream, ok := p.dnsClient.(http.Upstream); ok {
+			httpSrv.Upstream = upstream
+		}
+		httpSrv.AdminToken = config.DNS.HTTPAdminToken
 		servers = append(servers, httpSrv)
 	}
 
+	closers := p.closers()
 	// Close proxy first
-	sigHandler.OnClose(proxy)
+	sigHandler.OnClose(closers[0])
 
 	// ... then HTTP server
 	if httpSrv != nil {
 		sigHandler.OnClose(httpSrv)
 	}
 
-	// ... then cache
-	sigHandler.OnClose(dnsCache)
-
-	// ... then database components
-	if config.DNS.Database != "" {
-		sigHandler.OnClose(sqlLogger)
-		sigHandler.OnClose(sqlCache)
-		sigHandler.OnClose(sqlClient)
+	// ... then the remaining components
+	for _, c := range closers[1:] {
+		sigHandler.OnClose(c)
 	}
-
-	// ... and finally the server itself
-	sigHandler.OnClose(dnsSrv)
 	return &cli{servers: servers, sh: sigHandler}
 }
 
@@ -169,6 +389,6 @@ func (c *cli) run() {
 
 func main() {
 	sig := make(chan os.Signal, 1)
-	c := newCli(os.Stderr, os.Args[1:], configPath(), sig)
+	c := newCli(os.Stdout, os.Stderr, os.Args[1:], configPath(), sig)
 	c.run()
 }
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mpolden/zdns"
+	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/sql"
 )
 
 func tempFile(t *testing.T, s string) (string, error) {
@@ -39,7 +52,309 @@ hijack_mode = "zero"
 	defer os.Remove(f)
 
 	sig := make(chan os.Signal, 1)
-	cli := newCli(ioutil.Discard, []string{"-f", f}, f, sig)
+	cli := newCli(ioutil.Discard, ioutil.Discard, []string{"-f", f}, f, sig)
 	sig <- syscall.SIGTERM
 	cli.sh.Close()
 }
+
+func TestCloseOrder(t *testing.T) {
+	conf := `
+[dns]
+listen = "127.0.0.1:0"
+listen_http = "127.0.0.1:0"
+database = "` + filepath.Join(t.TempDir(), "zdns.db") + `"
+
+[resolver]
+protocol = "udp"
+timeout = "1s"
+`
+	f, err := tempFile(t, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f)
+
+	sig := make(chan os.Signal, 1)
+	cli := newCli(ioutil.Discard, ioutil.Discard, []string{"-f", f}, f, sig)
+	defer cli.sh.Close()
+	var got []string
+	for _, c := range cli.sh.Closers() {
+		got = append(got, fmt.Sprintf("%T", c))
+	}
+	// Components are closed before the components they depend on, e.g. the cache is flushed before its backend is
+	// closed
+	want := []string{"*dns.Proxy", "*http.Server", "*cache.Cache", "*sql.Logger", "*sql.Cache", "*sql.Client",
+		"*zdns.Server"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("close order = %q, want %q", got, want)
+	}
+	sig <- syscall.SIGTERM
+}
+
+func testUpstream(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestQuery(t *testing.T) {
+	addr, shutdown := testUpstream(t)
+	defer shutdown()
+	conf := `
+[dns]
+listen = "127.0.0.1:0"
+resolvers = ["` + addr + `"]
+
+[resolver]
+protocol = "udp"
+timeout = "1s"
+
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack = true
+`
+	f, err := tempFile(t, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f)
+
+	var tests = []struct {
+		args []string
+		out  string
+	}{
+		{[]string{"query", "example.com"}, "example.com.\t60\tIN\tA\t192.0.2.1\n;; status: NOERROR, hijacked: false, cached: false, time: "},
+		{[]string{"query", "example.com", "aaaa"}, ";; status: NOERROR, hijacked: false, cached: false, time: "},
+		{[]string{"query", "badhost1", "A"}, "badhost1.\t3600\tIN\tA\t0.0.0.0\n;; status: NOERROR, hijacked: true, cached: false, time: "},
+	}
+	timing := regexp.MustCompile(`time: \S+\n$`)
+	for i, tt := range tests {
+		var out bytes.Buffer
+		sig := make(chan os.Signal, 1)
+		cli := newCli(&out, ioutil.Discard, append([]string{"-f", f}, tt.args...), f, sig)
+		cli.run()
+		got := out.String()
+		if !strings.HasPrefix(got, tt.out) || !timing.MatchString(got) {
+			t.Errorf("#%d: %v printed %q, want %q", i, tt.args, got, tt.out+"<duration>")
+		}
+	}
+}
+
+func TestDatabaseOptional(t *testing.T) {
+	conf := `
+[dns]
+listen = "127.0.0.1:0"
+database = "/non-existent/zdns.db"
+log_mode = "all"
+cache_persist = true
+
+[resolver]
+protocol = "udp"
+timeout = "1s"
+
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack = true
+`
+	config, err := zdns.ReadConfig(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPipeline(config); err == nil {
+		t.Fatal("expected error when database cannot be opened")
+	}
+
+	config.DNS.DatabaseOptional = true
+	p, err := newPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.sqlClient != nil || p.sqlLogger != nil || p.sqlCache != nil {
+		t.Errorf("pipeline has database components: %+v", p)
+	}
+	var out bytes.Buffer
+	if err := query(&out, p, []string{"badhost1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "badhost1.\t3600\tIN\tA\t0.0.0.0\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("query printed %q, want prefix %q", got, want)
+	}
+}
+
+func TestPersistedCacheWithoutResolvers(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "zdns.db")
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := cache.NewKey("example.com.", dns.TypeA, dns.ClassINET)
+	createdAt := time.Now().Add(-time.Hour).Unix()
+	value, err := cache.Unpack(fmt.Sprintf("%d %d %x", key, createdAt, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sql.New(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := sql.NewCache(client)
+	backend.Set(key, value)
+	backend.Close()
+	client.Close()
+
+	conf := `
+[dns]
+listen = "127.0.0.1:0"
+database = "` + database + `"
+resolvers = []
+cache_persist = true
+cache_prefetch = true
+
+[resolver]
+protocol = "udp"
+`
+	config, err := zdns.ReadConfig(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without resolvers there is nothing to prefetch from, so the expired entry is evicted instead of refreshed
+	if _, ok := p.cache.Get(key); ok {
+		t.Errorf("got expired value for key %d", key)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryOffline(t *testing.T) {
+	var tests = []struct {
+		mode string
+		out  string
+	}{
+		{`offline_mode = "refused"`, ";; status: REFUSED, hijacked: false, cached: false, time: "},
+		{`offline_mode = "nxdomain"`, ";; status: NXDOMAIN, hijacked: false, cached: false, time: "},
+		{"offline_mode = \"address\"\noffline_address = \"192.0.2.10\"", "example.com.\t3600\tIN\tA\t192.0.2.10\n;; status: NOERROR, hijacked: false, cached: false, time: "},
+	}
+	for i, tt := range tests {
+		conf := `
+[dns]
+listen = "127.0.0.1:0"
+resolvers = []
+` + tt.mode + `
+
+[resolver]
+protocol = "udp"
+`
+		config, err := zdns.ReadConfig(strings.NewReader(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := newPipeline(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := query(&out, p, []string{"example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		p.Close()
+		if got := out.String(); !strings.HasPrefix(got, tt.out) {
+			t.Errorf("#%d: query printed %q, want prefix %q", i, got, tt.out)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	addr, shutdown := testUpstream(t)
+	defer shutdown()
+	conf := `
+[dns]
+listen = "127.0.0.1:0"
+resolvers = ["` + addr + `"]
+
+[resolver]
+protocol = "udp"
+timeout = "1s"
+
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack = true
+`
+	config, err := zdns.ReadConfig(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.server.WaitReload().Err(); err != nil {
+		t.Fatal(err)
+	}
+	queries := `
+# comment
+example.com
+example.com A
+example.com aaaa
+badhost1
+`
+	stats, err := replayQueries(strings.NewReader(queries), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Queries, 4; got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	if got, want := stats.Errors, 0; got != want {
+		t.Errorf("Errors = %d, want %d", got, want)
+	}
+	if got, want := stats.Cached, 1; got != want {
+		t.Errorf("Cached = %d, want %d", got, want)
+	}
+	if got, want := stats.Hijacked, 1; got != want {
+		t.Errorf("Hijacked = %d, want %d", got, want)
+	}
+	if got, want := stats.HitRatio(), 0.25; got != want {
+		t.Errorf("HitRatio() = %f, want %f", got, want)
+	}
+	if got, want := stats.Rcodes, map[string]int{"NOERROR": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Rcodes = %v, want %v", got, want)
+	}
+	if got, want := len(stats.latencies), 4; got != want {
+		t.Errorf("len(latencies) = %d, want %d", got, want)
+	}
+	if max := stats.Latency(100); stats.Latency(50) > max || stats.AvgLatency() > max {
+		t.Errorf("latencies %v are not bounded by max %s", stats.latencies, max)
+	}
+
+	if _, err := replayQueries(strings.NewReader("example.com foo"), p); err == nil {
+		t.Error("want error for invalid query type")
+	}
+}
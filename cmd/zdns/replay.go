@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
+)
+
+// replayStats contains aggregate statistics of replayed queries.
+type replayStats struct {
+	Queries   int
+	Errors    int
+	Cached    int
+	Hijacked  int
+	Rcodes    map[string]int
+	latencies []time.Duration
+}
+
+// HitRatio returns the fraction of queries answered from cache.
+func (s replayStats) HitRatio() float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Cached) / float64(s.Queries)
+}
+
+// Latency returns the latency at percentile pct, using the nearest-rank method.
+func (s replayStats) Latency(pct int) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	rank := (pct*len(s.latencies) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return s.latencies[rank-1]
+}
+
+// AvgLatency returns the average latency of all queries.
+func (s replayStats) AvgLatency() time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range s.latencies {
+		sum += d
+	}
+	return sum / time.Duration(len(s.latencies))
+}
+
+// replayQueries resolves each query read from r through pipeline p. Each line of r contains a name and an optional
+// query type. Empty lines and lines starting with # are ignored.
+func replayQueries(r io.Reader, p *pipeline) (replayStats, error) {
+	stats := replayStats{Rcodes: make(map[string]int)}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return replayStats{}, fmt.Errorf("line %d: invalid query: %s", n, line)
+		}
+		qtype := mdns.TypeA
+		if len(fields) == 2 {
+			t, ok := dnsutil.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return replayStats{}, fmt.Errorf("line %d: invalid query type: %s", n, fields[1])
+			}
+			qtype = t
+		}
+		msg := &mdns.Msg{}
+		msg.SetQuestion(mdns.Fqdn(fields[0]), qtype)
+		stats.Queries++
+		start := time.Now()
+		res, err := p.proxy.Resolve(msg, net.IPv4(127, 0, 0, 1))
+		stats.latencies = append(stats.latencies, time.Since(start))
+		if err != nil {
+			stats.Errors++
+			continue
+		}
+		stats.Rcodes[dnsutil.RcodeToString[res.Msg.Rcode]]++
+		if res.Cached {
+			stats.Cached++
+		}
+		if res.Hijacked {
+			stats.Hijacked++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return replayStats{}, err
+	}
+	sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+	return stats, nil
+}
+
+// replay resolves the queries in the file named by args through pipeline p, and writes aggregate statistics to out.
+func replay(out io.Writer, p *pipeline, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: replay file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := p.server.WaitReload().Err(); err != nil {
+		log.Printf("failed to load all sources: %s", err)
+	}
+	stats, err := replayQueries(f, p)
+	if err != nil {
+		return err
+	}
+	rcodes := make([]string, 0, len(stats.Rcodes))
+	for rcode, n := range stats.Rcodes {
+		rcodes = append(rcodes, fmt.Sprintf("%s: %d", rcode, n))
+	}
+	sort.Strings(rcodes)
+	fmt.Fprintf(out, ";; queries: %d, errors: %d, cached: %d, hijacked: %d, hit ratio: %.1f%%\n",
+		stats.Queries, stats.Errors, stats.Cached, stats.Hijacked, stats.HitRatio()*100)
+	fmt.Fprintf(out, ";; rcodes: %s\n", strings.Join(rcodes, ", "))
+	fmt.Fprintf(out, ";; latency: avg %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		stats.AvgLatency(), stats.Latency(50), stats.Latency(90), stats.Latency(99), stats.Latency(100))
+	return nil
+}
@@ -5,10 +5,15 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/hosts"
 	"github.com/mpolden/zdns/sql"
 )
@@ -18,43 +23,180 @@ type Config struct {
 	DNS      DNSOptions
 	Resolver ResolverOptions
 	Hosts    []Hosts
+	Records  []Records
+	Routes   []Route
 }
 
 // DNSOptions controlers the behaviour of the DNS server.
 type DNSOptions struct {
-	Listen          string
-	Protocol        string `toml:"protocol"`
-	CacheSize       int    `toml:"cache_size"`
-	CachePrefetch   bool   `toml:"cache_prefetch"`
-	CachePersist    bool   `toml:"cache_persist"`
-	HijackMode      string `toml:"hijack_mode"`
-	hijackMode      int
-	RefreshInterval string `toml:"hosts_refresh_interval"`
-	refreshInterval time.Duration
-	Resolvers       []string
-	Database        string `toml:"database"`
-	LogModeString   string `toml:"log_mode"`
-	LogMode         int
-	LogTTLString    string `toml:"log_ttl"`
-	LogTTL          time.Duration
-	ListenHTTP      string `toml:"listen_http"`
+	Listen                   string
+	Protocol                 string `toml:"protocol"`
+	CacheString              string `toml:"cache"`
+	CacheDisabled            bool
+	CacheSize                int      `toml:"cache_size"`
+	CachePrefetch            bool     `toml:"cache_prefetch"`
+	CachePrefetchTypeStrings []string `toml:"cache_prefetch_types"`
+	CachePrefetchTypes       []uint16
+	CachePersist             bool   `toml:"cache_persist"`
+	CacheFailureTTLString    string `toml:"cache_failure_ttl"`
+	CacheFailureTTL          time.Duration
+	CacheTTLFactor           float64 `toml:"cache_ttl_factor"`
+	CacheMaxTTLString        string  `toml:"cache_max_ttl"`
+	CacheMaxTTL              time.Duration
+	CacheZoneTTLStrings      map[string]string `toml:"cache_zone_ttl"`
+	CacheZoneTTLs            map[string]time.Duration
+	CacheWarmStrings         []string `toml:"cache_warm"`
+	CacheWarm                []dns.Request
+	CacheWarmUpString        string `toml:"cache_warm_up"`
+	CacheWarmUp              time.Duration
+	CacheWarmUpModeString    string `toml:"cache_warm_up_mode"`
+	CacheWarmUpMode          int
+	CacheKeyHashString       string `toml:"cache_key_hash"`
+	CacheKeyHash             int
+	CacheCloseTimeoutString  string `toml:"cache_close_timeout"`
+	CacheCloseTimeout        time.Duration
+	HijackMode               string `toml:"hijack_mode"`
+	hijackMode               int
+	HijackAddress            string   `toml:"hijack_address"`
+	HijackAddresses          []string `toml:"hijack_addresses"`
+	hijackAddresses          []net.IP
+	HijackTTLString          string `toml:"hijack_ttl"`
+	hijackTTL                time.Duration
+	HijackNetworkStrings     []string `toml:"hijack_networks"`
+	hijackNetworks           []*net.IPNet
+	BlockPatternStrings      []string `toml:"block_patterns"`
+	blockPatterns            []*regexp.Regexp
+	BlockPatternMode         string `toml:"block_pattern_mode"`
+	blockPatternMode         int
+	RefreshInterval          string `toml:"hosts_refresh_interval"`
+	refreshInterval          time.Duration
+	ReloadDebounceString     string `toml:"reload_debounce"`
+	ReloadDebounce           time.Duration
+	QueryTimeoutString       string `toml:"query_timeout"`
+	QueryTimeout             time.Duration
+	HostsBloomFilter         bool   `toml:"hosts_bloom_filter"`
+	HostsConcurrency         int    `toml:"hosts_concurrency"`
+	HostsMaxSize             int    `toml:"hosts_max_size"`
+	HostsOverrideFile        string `toml:"hosts_override_file"`
+	Resolvers                []string
+	ResolvConf               string `toml:"resolv_conf"`
+	Database                 string `toml:"database"`
+	DatabaseOptional         bool   `toml:"database_optional"`
+	LogModeString            string `toml:"log_mode"`
+	LogMode                  int
+	LogTTLString             string `toml:"log_ttl"`
+	LogTTL                   time.Duration
+	LogAnswers               bool   `toml:"log_answers"`
+	LogFile                  string `toml:"log_file"`
+	LogFileMaxSize           int    `toml:"log_file_max_size"`
+	LogFileMaxAgeString      string `toml:"log_file_max_age"`
+	LogFileMaxAge            time.Duration
+	LogFileMaxFiles          int    `toml:"log_file_max_files"`
+	ListenHTTP               string `toml:"listen_http"`
+	HTTPPprof                bool   `toml:"http_pprof"`
+	HTTPAdminToken           string `toml:"http_admin_token"`
+	RateLimit                int    `toml:"rate_limit"`
+	RateLimitResponseString  string `toml:"rate_limit_response"`
+	RateLimitResponse        int
+	MaxInFlight              int    `toml:"max_in_flight"`
+	OverloadResponseString   string `toml:"overload_response"`
+	OverloadResponse         int
+	RootQueriesString        string `toml:"root_queries"`
+	RootQueries              int
+	NonRecursiveString       string `toml:"non_recursive"`
+	NonRecursive             int
+	SpecialNamesString       string `toml:"special_names"`
+	SpecialNames             int
+	Deduplicate              bool     `toml:"deduplicate"`
+	EDNSOptions              []uint16 `toml:"edns_options"`
+	ECSCache                 bool     `toml:"ecs_cache"`
+	ECSPrefixIPv4            int      `toml:"ecs_prefix_ipv4"`
+	ECSPrefixIPv6            int      `toml:"ecs_prefix_ipv6"`
+	StripDNSSEC              bool     `toml:"strip_dnssec"`
+	MinimalResponses         bool     `toml:"minimal_responses"`
+	StripOutOfBailiwick      bool     `toml:"strip_out_of_bailiwick"`
+	PreserveQueryCase        bool     `toml:"preserve_query_case"`
+	ShuffleAnswers           bool     `toml:"shuffle_answers"`
+	ShuffleSeed              int64    `toml:"shuffle_seed"`
+	UDPReaders               int      `toml:"udp_readers"`
+	MaxAnswers               int      `toml:"max_answers"`
+	RemoveDuplicateAnswers   bool     `toml:"remove_duplicate_answers"`
+	Trace                    bool     `toml:"trace"`
+	OfflineModeString        string   `toml:"offline_mode"`
+	OfflineMode              int
+	OfflineAddressString     string `toml:"offline_address"`
+	OfflineAddress           net.IP
+	FallbackFile             string `toml:"fallback_file"`
+	Fallback                 dns.Records
+	SearchDomain             string            `toml:"search_domain"`
+	LocalZones               []string          `toml:"local_zones"`
+	Rewrites                 map[string]string `toml:"rewrite"`
+	RewriteFallback          bool              `toml:"rewrite_fallback"`
 }
 
 // ResolverOptions controls the behaviour of resolvers.
 type ResolverOptions struct {
-	Protocol      string `toml:"protocol"`
-	TimeoutString string `toml:"timeout"`
-	Timeout       time.Duration
+	Protocol              string `toml:"protocol"`
+	TimeoutString         string `toml:"timeout"`
+	Timeout               time.Duration
+	Concurrency           int    `toml:"concurrency"`
+	AnswerWaitString      string `toml:"answer_wait"`
+	AnswerWait            time.Duration
+	StrategyString        string `toml:"strategy"`
+	Strategy              int
+	DeadlineString        string `toml:"deadline"`
+	Deadline              time.Duration
+	FamilyString          string `toml:"family"`
+	Family                int
+	PoolSize              int    `toml:"pool_size"`
+	PoolIdleTimeoutString string `toml:"pool_idle_timeout"`
+	PoolIdleTimeout       time.Duration
+	Audit                 bool           `toml:"audit"`
+	RateLimits            map[string]int `toml:"rate_limit"`
 }
 
 // Hosts controls how a hosts file should be retrieved.
 type Hosts struct {
-	URL     string
-	Hosts   []string `toml:"entries"`
-	hosts   hosts.Hosts
-	Hijack  bool
-	Timeout string
-	timeout time.Duration
+	URL        string
+	Hosts      []string `toml:"entries"`
+	hosts      hosts.Hosts
+	Hijack     bool
+	HijackMode string `toml:"hijack_mode"`
+	hijackMode int
+	OnFailure  string `toml:"on_failure"`
+	onFailure  int
+	Priority   int
+	Timeout    string
+	timeout    time.Duration
+}
+
+// Records controls how static records should be retrieved.
+type Records struct {
+	URL       string
+	Format    string
+	Records   []string `toml:"entries"`
+	records   dns.Records
+	TTLString string `toml:"ttl"`
+	ttl       time.Duration
+}
+
+// Route controls which resolvers are used for queries from particular client networks, for particular zones or of
+// particular types.
+type Route struct {
+	NetworkStrings []string `toml:"networks"`
+	Networks       []*net.IPNet
+	Zones          []string
+	TypeStrings    []string `toml:"types"`
+	Types          []uint16
+	Resolvers      []string
+}
+
+func (r *Records) parse(rd io.Reader) (dns.Records, error) {
+	ttl := uint32(r.ttl.Seconds())
+	if r.Format == "hosts" {
+		return dns.ParseHostsRecordsWithTTL(rd, ttl)
+	}
+	return dns.ParseRecordsWithTTL(rd, ttl)
 }
 
 func newConfig() Config {
@@ -65,17 +207,75 @@ func newConfig() Config {
 	c.DNS.Protocol = "udp"
 	c.DNS.CacheSize = 4096
 	c.DNS.CachePrefetch = true
+	c.DNS.ECSPrefixIPv4 = 24
+	c.DNS.ECSPrefixIPv6 = 56
 	c.DNS.RefreshInterval = "48h"
+	c.DNS.HostsConcurrency = 4
+	c.DNS.HostsMaxSize = 100
 	c.DNS.Resolvers = []string{
 		"1.1.1.1:853",
 		"1.0.0.1:853",
 	}
 	c.DNS.LogTTLString = "168h"
+	c.DNS.LogAnswers = true
+	c.DNS.LogFileMaxSize = 10
+	c.DNS.LogFileMaxFiles = 5
 	c.Resolver.TimeoutString = "2s"
 	c.Resolver.Protocol = "tcp-tls"
 	return c
 }
 
+// containsOption returns whether EDNS option code is in options.
+func containsOption(options []uint16, code uint16) bool {
+	for _, o := range options {
+		if o == code {
+			return true
+		}
+	}
+	return false
+}
+
+// limitResponse returns the response to queries exceeding a limit, corresponding to the string s.
+func limitResponse(s string) (int, bool) {
+	switch s {
+	case "", "refused":
+		return dns.RateLimitRefuse, true
+	case "truncate":
+		return dns.RateLimitTruncate, true
+	case "drop":
+		return dns.RateLimitDrop, true
+	}
+	return 0, false
+}
+
+// failurePolicy returns the failure policy corresponding to the string s.
+func failurePolicy(s string) (int, bool) {
+	switch s {
+	case "", "skip":
+		return FailureSkip, true
+	case "allow":
+		return FailureAllow, true
+	case "block":
+		return FailureBlock, true
+	}
+	return 0, false
+}
+
+// hijackMode returns the hijack mode corresponding to the string s.
+func hijackMode(s string) (int, bool) {
+	switch s {
+	case "", "zero":
+		return HijackZero, true
+	case "empty":
+		return HijackEmpty, true
+	case "hosts":
+		return HijackHosts, true
+	case "nxdomain":
+		return HijackNXDomain, true
+	}
+	return 0, false
+}
+
 func (c *Config) load() error {
 	var err error
 	if c.DNS.Listen == "" {
@@ -87,22 +287,166 @@ func (c *Config) load() error {
 	if c.DNS.Protocol != "udp" {
 		return fmt.Errorf("unsupported protocol: %s", c.DNS.Protocol)
 	}
+	switch c.DNS.CacheString {
+	case "", "on":
+		c.DNS.CacheDisabled = false
+	case "off":
+		c.DNS.CacheDisabled = true
+	default:
+		return fmt.Errorf("invalid cache: %s", c.DNS.CacheString)
+	}
 	if c.DNS.CacheSize < 0 {
 		return fmt.Errorf("cache size must be >= 0")
 	}
+	for _, s := range c.DNS.CachePrefetchTypeStrings {
+		qtype, ok := dnsutil.StringToType[s]
+		if !ok {
+			return fmt.Errorf("invalid prefetch type: %s", s)
+		}
+		c.DNS.CachePrefetchTypes = append(c.DNS.CachePrefetchTypes, qtype)
+	}
+	switch c.DNS.CacheKeyHashString {
+	case "", "fnv32":
+		c.DNS.CacheKeyHash = cache.KeyFNV32
+	case "fnv64":
+		c.DNS.CacheKeyHash = cache.KeyFNV64
+	default:
+		return fmt.Errorf("invalid cache key hash: %s", c.DNS.CacheKeyHashString)
+	}
+	if c.DNS.CacheCloseTimeoutString == "" {
+		c.DNS.CacheCloseTimeoutString = "5s"
+	}
+	c.DNS.CacheCloseTimeout, err = time.ParseDuration(c.DNS.CacheCloseTimeoutString)
+	if err != nil {
+		return fmt.Errorf("invalid cache close timeout: %s", c.DNS.CacheCloseTimeoutString)
+	}
+	if c.DNS.CacheCloseTimeout < 0 {
+		return fmt.Errorf("cache close timeout must be >= 0")
+	}
+	for _, s := range c.DNS.CacheWarmStrings {
+		fields := strings.Fields(s)
+		if len(fields) == 0 || len(fields) > 2 {
+			return fmt.Errorf("invalid cache warm entry: %s", s)
+		}
+		r := dns.Request{Name: fields[0], Type: dns.TypeA}
+		if len(fields) == 2 {
+			qtype, ok := dnsutil.StringToType[fields[1]]
+			if !ok {
+				return fmt.Errorf("invalid cache warm entry: %s", s)
+			}
+			r.Type = qtype
+		}
+		c.DNS.CacheWarm = append(c.DNS.CacheWarm, r)
+	}
+	if c.DNS.CacheWarmUpString == "" {
+		c.DNS.CacheWarmUpString = "0"
+	}
+	c.DNS.CacheWarmUp, err = time.ParseDuration(c.DNS.CacheWarmUpString)
+	if err != nil {
+		return fmt.Errorf("invalid cache warm-up: %s", c.DNS.CacheWarmUpString)
+	}
+	if c.DNS.CacheWarmUp < 0 {
+		return fmt.Errorf("cache warm-up must be >= 0")
+	}
+	switch c.DNS.CacheWarmUpModeString {
+	case "", "forward":
+		c.DNS.CacheWarmUpMode = dns.WarmUpForward
+	case "servfail":
+		c.DNS.CacheWarmUpMode = dns.WarmUpServFail
+	case "stale":
+		c.DNS.CacheWarmUpMode = dns.WarmUpStale
+	default:
+		return fmt.Errorf("invalid cache warm-up mode: %s", c.DNS.CacheWarmUpModeString)
+	}
+	if c.DNS.CacheFailureTTLString == "" {
+		c.DNS.CacheFailureTTLString = "0"
+	}
+	c.DNS.CacheFailureTTL, err = time.ParseDuration(c.DNS.CacheFailureTTLString)
+	if err != nil {
+		return fmt.Errorf("invalid cache failure TTL: %s", c.DNS.CacheFailureTTLString)
+	}
+	if c.DNS.CacheFailureTTL < 0 {
+		return fmt.Errorf("cache failure TTL must be >= 0")
+	}
+	if c.DNS.CacheTTLFactor == 0 {
+		c.DNS.CacheTTLFactor = 1
+	}
+	if c.DNS.CacheTTLFactor < 1 {
+		return fmt.Errorf("cache TTL factor must be >= 1")
+	}
+	if c.DNS.CacheMaxTTLString == "" {
+		c.DNS.CacheMaxTTLString = "0"
+	}
+	c.DNS.CacheMaxTTL, err = time.ParseDuration(c.DNS.CacheMaxTTLString)
+	if err != nil {
+		return fmt.Errorf("invalid cache max TTL: %s", c.DNS.CacheMaxTTLString)
+	}
+	if c.DNS.CacheMaxTTL < 0 {
+		return fmt.Errorf("cache max TTL must be >= 0")
+	}
+	for zone, s := range c.DNS.CacheZoneTTLStrings {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid cache TTL for zone %s: %s", zone, s)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("cache TTL for zone %s must be >= 0", zone)
+		}
+		if c.DNS.CacheZoneTTLs == nil {
+			c.DNS.CacheZoneTTLs = make(map[string]time.Duration)
+		}
+		c.DNS.CacheZoneTTLs[zone] = ttl
+	}
 	if c.DNS.CachePersist && c.DNS.Database == "" {
 		return fmt.Errorf("cache_persist = %t requires 'database' to be set", c.DNS.CachePersist)
 	}
-	switch c.DNS.HijackMode {
-	case "", "zero":
-		c.DNS.hijackMode = HijackZero
-	case "empty":
-		c.DNS.hijackMode = HijackEmpty
-	case "hosts":
-		c.DNS.hijackMode = HijackHosts
-	default:
+	var ok bool
+	c.DNS.hijackMode, ok = hijackMode(c.DNS.HijackMode)
+	if !ok {
 		return fmt.Errorf("invalid hijack mode: %s", c.DNS.HijackMode)
 	}
+	hijackAddresses := c.DNS.HijackAddresses
+	if c.DNS.HijackAddress != "" {
+		hijackAddresses = append([]string{c.DNS.HijackAddress}, hijackAddresses...)
+	}
+	for _, s := range hijackAddresses {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid hijack address: %s", s)
+		}
+		c.DNS.hijackAddresses = append(c.DNS.hijackAddresses, ip)
+	}
+	for _, s := range c.DNS.HijackNetworkStrings {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid hijack network: %s", s)
+		}
+		c.DNS.hijackNetworks = append(c.DNS.hijackNetworks, ipNet)
+	}
+	for _, s := range c.DNS.BlockPatternStrings {
+		pattern, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid block pattern: %s", s)
+		}
+		c.DNS.blockPatterns = append(c.DNS.blockPatterns, pattern)
+	}
+	c.DNS.blockPatternMode = c.DNS.hijackMode
+	if c.DNS.BlockPatternMode != "" {
+		c.DNS.blockPatternMode, ok = hijackMode(c.DNS.BlockPatternMode)
+		if !ok {
+			return fmt.Errorf("invalid block pattern mode: %s", c.DNS.BlockPatternMode)
+		}
+	}
+	if c.DNS.HijackTTLString == "" {
+		c.DNS.HijackTTLString = "1h"
+	}
+	c.DNS.hijackTTL, err = time.ParseDuration(c.DNS.HijackTTLString)
+	if err != nil {
+		return fmt.Errorf("invalid hijack TTL: %s", c.DNS.HijackTTLString)
+	}
+	if c.DNS.hijackTTL < 0 {
+		return fmt.Errorf("hijack TTL must be >= 0")
+	}
 	if c.DNS.RefreshInterval == "" {
 		c.DNS.RefreshInterval = "0"
 	}
@@ -113,10 +457,46 @@ func (c *Config) load() error {
 	if c.DNS.refreshInterval < 0 {
 		return fmt.Errorf("refresh interval must be >= 0")
 	}
+	if c.DNS.ReloadDebounceString == "" {
+		c.DNS.ReloadDebounceString = "0"
+	}
+	c.DNS.ReloadDebounce, err = time.ParseDuration(c.DNS.ReloadDebounceString)
+	if err != nil {
+		return fmt.Errorf("invalid reload debounce: %s", c.DNS.ReloadDebounceString)
+	}
+	if c.DNS.ReloadDebounce < 0 {
+		return fmt.Errorf("reload debounce must be >= 0")
+	}
+	if c.DNS.QueryTimeoutString == "" {
+		c.DNS.QueryTimeoutString = "0"
+	}
+	c.DNS.QueryTimeout, err = time.ParseDuration(c.DNS.QueryTimeoutString)
+	if err != nil {
+		return fmt.Errorf("invalid query timeout: %s", c.DNS.QueryTimeoutString)
+	}
+	if c.DNS.QueryTimeout < 0 {
+		return fmt.Errorf("query timeout must be >= 0")
+	}
+	if c.DNS.HostsConcurrency < 0 {
+		return fmt.Errorf("hosts concurrency must be >= 0")
+	}
+	if c.DNS.HostsMaxSize < 0 {
+		return fmt.Errorf("hosts max size must be >= 0")
+	}
 	for i, hs := range c.Hosts {
 		if (hs.URL == "") == (hs.Hosts == nil) {
 			return fmt.Errorf("exactly one of url or hosts must be set")
 		}
+		c.Hosts[i].hijackMode = c.DNS.hijackMode
+		if hs.HijackMode != "" {
+			if !hs.Hijack {
+				return fmt.Errorf("hijack_mode = %q requires 'hijack' to be set", hs.HijackMode)
+			}
+			c.Hosts[i].hijackMode, ok = hijackMode(hs.HijackMode)
+			if !ok {
+				return fmt.Errorf("invalid hijack mode: %s", hs.HijackMode)
+			}
+		}
 		if hs.URL != "" {
 			url, err := url.Parse(hs.URL)
 			if err != nil {
@@ -137,11 +517,18 @@ func (c *Config) load() error {
 			if err != nil {
 				return fmt.Errorf("%s: invalid timeout: %s", hs.URL, hs.Timeout)
 			}
+			c.Hosts[i].onFailure, ok = failurePolicy(hs.OnFailure)
+			if !ok {
+				return fmt.Errorf("%s: invalid failure policy: %s", hs.URL, hs.OnFailure)
+			}
 		}
 		if hs.Hosts != nil {
 			if hs.Timeout != "" {
 				return fmt.Errorf("%s: timeout cannot be set for inline hosts", hs.Hosts)
 			}
+			if hs.OnFailure != "" {
+				return fmt.Errorf("%s: on_failure cannot be set for inline hosts", hs.Hosts)
+			}
 			var err error
 			r := strings.NewReader(strings.Join(hs.Hosts, "\n"))
 			c.Hosts[i].hosts, err = hosts.Parse(r)
@@ -150,18 +537,82 @@ func (c *Config) load() error {
 			}
 		}
 	}
+	if len(c.DNS.Resolvers) == 0 && c.DNS.ResolvConf != "" {
+		if err := c.readResolvConf(); err != nil {
+			return err
+		}
+	}
+	for i, rs := range c.Records {
+		if (rs.URL == "") == (rs.Records == nil) {
+			return fmt.Errorf("exactly one of url or entries must be set for records")
+		}
+		switch rs.Format {
+		case "", "zone", "hosts":
+		default:
+			return fmt.Errorf("invalid records format: %s", rs.Format)
+		}
+		if rs.TTLString == "" {
+			rs.TTLString = "1h"
+		}
+		ttl, err := time.ParseDuration(rs.TTLString)
+		if err != nil {
+			return fmt.Errorf("invalid records TTL: %s", rs.TTLString)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("records TTL must be >= 0")
+		}
+		rs.ttl = ttl
+		c.Records[i].TTLString, c.Records[i].ttl = rs.TTLString, ttl
+		if rs.URL != "" {
+			url, err := url.Parse(rs.URL)
+			if err != nil {
+				return fmt.Errorf("%s: invalid url: %w", rs.URL, err)
+			}
+			switch url.Scheme {
+			case "file", "http", "https":
+			default:
+				return fmt.Errorf("%s: unsupported scheme: %s", rs.URL, url.Scheme)
+			}
+		}
+		if rs.Records != nil {
+			var err error
+			r := strings.NewReader(strings.Join(rs.Records, "\n"))
+			c.Records[i].records, err = rs.parse(r)
+			if err != nil {
+				return fmt.Errorf("invalid records: %w", err)
+			}
+		}
+	}
 	for _, r := range c.DNS.Resolvers {
-		if c.Resolver.Protocol == "https" {
-			u, err := url.Parse(r)
+		if err := validateResolver(r, c.Resolver.Protocol); err != nil {
+			return err
+		}
+	}
+	for i, route := range c.Routes {
+		if len(route.NetworkStrings) == 0 && len(route.Zones) == 0 && len(route.TypeStrings) == 0 {
+			return fmt.Errorf("networks, zones or types must be set for route")
+		}
+		if len(route.Resolvers) == 0 {
+			return fmt.Errorf("resolvers must be set for route")
+		}
+		c.Routes[i].Networks = make([]*net.IPNet, 0, len(route.NetworkStrings))
+		for _, s := range route.NetworkStrings {
+			_, ipNet, err := net.ParseCIDR(s)
 			if err != nil {
-				return fmt.Errorf("invalid resolver %s: %w", r, err)
+				return fmt.Errorf("invalid route network: %s", s)
 			}
-			if u.Scheme != "https" {
-				return fmt.Errorf("protocol %s requires https scheme for resolver %s", c.Resolver.Protocol, r)
+			c.Routes[i].Networks = append(c.Routes[i].Networks, ipNet)
+		}
+		for _, s := range route.TypeStrings {
+			qtype, ok := dnsutil.StringToType[s]
+			if !ok {
+				return fmt.Errorf("invalid route type: %s", s)
 			}
-		} else {
-			if _, _, err := net.SplitHostPort(r); err != nil {
-				return fmt.Errorf("invalid resolver: %w", err)
+			c.Routes[i].Types = append(c.Routes[i].Types, qtype)
+		}
+		for _, r := range route.Resolvers {
+			if err := validateResolver(r, c.Resolver.Protocol); err != nil {
+				return err
 			}
 		}
 	}
@@ -183,6 +634,77 @@ func (c *Config) load() error {
 	if c.Resolver.Timeout == 0 {
 		c.Resolver.Timeout = 5 * time.Second
 	}
+	if c.Resolver.Concurrency < 0 {
+		return fmt.Errorf("resolver concurrency must be >= 0")
+	}
+	if c.Resolver.AnswerWaitString == "" {
+		c.Resolver.AnswerWaitString = "0"
+	}
+	c.Resolver.AnswerWait, err = time.ParseDuration(c.Resolver.AnswerWaitString)
+	if err != nil {
+		return fmt.Errorf("invalid resolver answer wait: %s", c.Resolver.AnswerWaitString)
+	}
+	if c.Resolver.AnswerWait < 0 {
+		return fmt.Errorf("resolver answer wait must be >= 0")
+	}
+	switch c.Resolver.StrategyString {
+	case "", "parallel":
+		c.Resolver.Strategy = dnsutil.StrategyParallel
+	case "sequential":
+		c.Resolver.Strategy = dnsutil.StrategySequential
+	default:
+		return fmt.Errorf("invalid resolver strategy: %s", c.Resolver.StrategyString)
+	}
+	switch c.Resolver.FamilyString {
+	case "", "auto":
+		c.Resolver.Family = dnsutil.FamilyAuto
+	case "ipv4":
+		c.Resolver.Family = dnsutil.FamilyIPv4
+	case "ipv6":
+		c.Resolver.Family = dnsutil.FamilyIPv6
+	default:
+		return fmt.Errorf("invalid resolver family: %s", c.Resolver.FamilyString)
+	}
+	if c.Resolver.DeadlineString == "" {
+		c.Resolver.DeadlineString = "0"
+	}
+	c.Resolver.Deadline, err = time.ParseDuration(c.Resolver.DeadlineString)
+	if err != nil {
+		return fmt.Errorf("invalid resolver deadline: %s", c.Resolver.DeadlineString)
+	}
+	if c.Resolver.Deadline < 0 {
+		return fmt.Errorf("resolver deadline must be >= 0")
+	}
+	if c.Resolver.PoolSize < 0 {
+		return fmt.Errorf("pool size must be >= 0")
+	}
+	if c.Resolver.PoolIdleTimeoutString == "" {
+		c.Resolver.PoolIdleTimeoutString = "10s"
+	}
+	c.Resolver.PoolIdleTimeout, err = time.ParseDuration(c.Resolver.PoolIdleTimeoutString)
+	if err != nil {
+		return fmt.Errorf("invalid pool idle timeout: %s", c.Resolver.PoolIdleTimeoutString)
+	}
+	if c.Resolver.PoolIdleTimeout < 0 {
+		return fmt.Errorf("pool idle timeout must be >= 0")
+	}
+	resolvers := make(map[string]bool)
+	for _, r := range c.DNS.Resolvers {
+		resolvers[r] = true
+	}
+	for _, route := range c.Routes {
+		for _, r := range route.Resolvers {
+			resolvers[r] = true
+		}
+	}
+	for addr, limit := range c.Resolver.RateLimits {
+		if !resolvers[addr] {
+			return fmt.Errorf("rate_limit resolver is not configured: %s", addr)
+		}
+		if limit < 0 {
+			return fmt.Errorf("rate limit of resolver %s must be >= 0", addr)
+		}
+	}
 	switch c.DNS.LogModeString {
 	case "":
 		c.DNS.LogMode = sql.LogDiscard
@@ -196,6 +718,92 @@ func (c *Config) load() error {
 	if c.DNS.LogModeString != "" && c.DNS.Database == "" {
 		return fmt.Errorf("log_mode = %q requires 'database' to be set", c.DNS.LogModeString)
 	}
+	if c.DNS.ECSCache && !containsOption(c.DNS.EDNSOptions, 8) {
+		return fmt.Errorf("ecs_cache = %t requires 'edns_options' to include 8", c.DNS.ECSCache)
+	}
+	if c.DNS.ECSPrefixIPv4 < 0 || c.DNS.ECSPrefixIPv4 > 32 {
+		return fmt.Errorf("ecs ipv4 prefix must be between 0 and 32")
+	}
+	if c.DNS.ECSPrefixIPv6 < 0 || c.DNS.ECSPrefixIPv6 > 128 {
+		return fmt.Errorf("ecs ipv6 prefix must be between 0 and 128")
+	}
+	if c.DNS.MaxAnswers < 0 {
+		return fmt.Errorf("max answers must be >= 0")
+	}
+	switch c.DNS.OfflineModeString {
+	case "", "servfail":
+		c.DNS.OfflineMode = dns.OfflineServFail
+	case "refused":
+		c.DNS.OfflineMode = dns.OfflineRefuse
+	case "nxdomain":
+		c.DNS.OfflineMode = dns.OfflineNXDomain
+	case "address":
+		c.DNS.OfflineMode = dns.OfflineAddress
+	default:
+		return fmt.Errorf("invalid offline mode: %s", c.DNS.OfflineModeString)
+	}
+	if c.DNS.OfflineAddressString != "" {
+		c.DNS.OfflineAddress = net.ParseIP(c.DNS.OfflineAddressString)
+		if c.DNS.OfflineAddress == nil {
+			return fmt.Errorf("invalid offline address: %s", c.DNS.OfflineAddressString)
+		}
+	}
+	if c.DNS.OfflineMode == dns.OfflineAddress && c.DNS.OfflineAddress == nil {
+		return fmt.Errorf("offline_mode = %q requires 'offline_address' to be set", c.DNS.OfflineModeString)
+	}
+	if c.DNS.FallbackFile != "" {
+		if err := c.readFallback(); err != nil {
+			return err
+		}
+	}
+	if c.DNS.RewriteFallback && c.DNS.SearchDomain == "" && len(c.DNS.Rewrites) == 0 {
+		return fmt.Errorf("rewrite_fallback = %t requires 'search_domain' or 'rewrite' to be set", c.DNS.RewriteFallback)
+	}
+	if c.DNS.UDPReaders < 0 {
+		return fmt.Errorf("udp readers must be >= 0")
+	}
+	if c.DNS.RateLimit < 0 {
+		return fmt.Errorf("rate limit must be >= 0")
+	}
+	c.DNS.RateLimitResponse, ok = limitResponse(c.DNS.RateLimitResponseString)
+	if !ok {
+		return fmt.Errorf("invalid rate limit response: %s", c.DNS.RateLimitResponseString)
+	}
+	if c.DNS.MaxInFlight < 0 {
+		return fmt.Errorf("max in-flight queries must be >= 0")
+	}
+	c.DNS.OverloadResponse, ok = limitResponse(c.DNS.OverloadResponseString)
+	if !ok {
+		return fmt.Errorf("invalid overload response: %s", c.DNS.OverloadResponseString)
+	}
+	switch c.DNS.RootQueriesString {
+	case "", "forward":
+		c.DNS.RootQueries = dns.RootForward
+	case "refused":
+		c.DNS.RootQueries = dns.RootRefuse
+	case "hints":
+		c.DNS.RootQueries = dns.RootHints
+	default:
+		return fmt.Errorf("invalid root queries mode: %s", c.DNS.RootQueriesString)
+	}
+	switch c.DNS.NonRecursiveString {
+	case "", "forward":
+		c.DNS.NonRecursive = dns.NonRecursiveForward
+	case "refused":
+		c.DNS.NonRecursive = dns.NonRecursiveRefuse
+	case "cache":
+		c.DNS.NonRecursive = dns.NonRecursiveCache
+	default:
+		return fmt.Errorf("invalid non-recursive mode: %s", c.DNS.NonRecursiveString)
+	}
+	switch c.DNS.SpecialNamesString {
+	case "", "local":
+		c.DNS.SpecialNames = dns.SpecialLocal
+	case "forward":
+		c.DNS.SpecialNames = dns.SpecialForward
+	default:
+		return fmt.Errorf("invalid special names mode: %s", c.DNS.SpecialNamesString)
+	}
 	if c.DNS.LogTTLString == "" {
 		c.DNS.LogTTLString = "0"
 	}
@@ -203,15 +811,121 @@ func (c *Config) load() error {
 	if err != nil {
 		return fmt.Errorf("invalid log TTL: %s", c.DNS.LogTTLString)
 	}
+	if c.DNS.LogFileMaxSize < 0 {
+		return fmt.Errorf("log file max size must be >= 0")
+	}
+	if c.DNS.LogFileMaxAgeString == "" {
+		c.DNS.LogFileMaxAgeString = "0"
+	}
+	c.DNS.LogFileMaxAge, err = time.ParseDuration(c.DNS.LogFileMaxAgeString)
+	if err != nil {
+		return fmt.Errorf("invalid log file max age: %s", c.DNS.LogFileMaxAgeString)
+	}
+	if c.DNS.LogFileMaxAge < 0 {
+		return fmt.Errorf("log file max age must be >= 0")
+	}
+	if c.DNS.LogFile != "" && c.DNS.LogFileMaxFiles < 1 {
+		return fmt.Errorf("log file max files must be >= 1")
+	}
 	return nil
 }
 
+// validateResolver returns an error if resolver r is not a valid address for protocol.
+func validateResolver(r, protocol string) error {
+	network, addr := dnsutil.SplitResolver(r, protocol)
+	if network == "https" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid resolver %s: %w", r, err)
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("protocol %s requires https scheme for resolver %s", network, r)
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid resolver: %w", err)
+		}
+	}
+	return nil
+}
+
+// readResolvConf sets resolvers to the nameservers of the configured resolv.conf. Nameservers pointing back at our own
+// listening address are skipped to avoid forwarding queries to ourselves.
+func (c *Config) readResolvConf() error {
+	if c.Resolver.Protocol == "tcp-tls" || c.Resolver.Protocol == "https" {
+		return fmt.Errorf("resolv_conf cannot be used with resolver protocol %s", c.Resolver.Protocol)
+	}
+	resolvers, err := dnsutil.ReadResolvConf(c.DNS.ResolvConf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.DNS.ResolvConf, err)
+	}
+	for _, r := range resolvers {
+		if isSelf(r, c.DNS.Listen) {
+			continue
+		}
+		c.DNS.Resolvers = append(c.DNS.Resolvers, r)
+	}
+	if len(c.DNS.Resolvers) == 0 {
+		return fmt.Errorf("%s: no usable resolvers found", c.DNS.ResolvConf)
+	}
+	return nil
+}
+
+func (c *Config) readFallback() error {
+	f, err := os.Open(c.DNS.FallbackFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.DNS.Fallback, err = dns.ParseRecords(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.DNS.FallbackFile, err)
+	}
+	return nil
+}
+
+// isSelf returns whether resolver addr refers to the listening address listen.
+func isSelf(addr, listen string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil || port != listenPort {
+		return false
+	}
+	ip, listenIP := net.ParseIP(host), net.ParseIP(listenHost)
+	if ip == nil {
+		return false
+	}
+	if listenHost == "" || (listenIP != nil && listenIP.IsUnspecified()) {
+		return ip.IsLoopback() || ip.IsUnspecified() || isLocalIP(ip)
+	}
+	return ip.Equal(listenIP)
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadConfig reads a zdns configuration from reader r.
 func ReadConfig(r io.Reader) (Config, error) {
 	conf := newConfig()
-	_, err := toml.NewDecoder(r).Decode(&conf)
+	md, err := toml.NewDecoder(r).Decode(&conf)
 	if err != nil {
 		return Config{}, err
 	}
+	if conf.DNS.ResolvConf != "" && !md.IsDefined("dns", "resolvers") {
+		conf.DNS.Resolvers = nil // Use resolvers from resolv.conf instead of the defaults
+	}
 	return conf, conf.load()
 }
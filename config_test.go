@@ -2,9 +2,16 @@ package zdns
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
 )
 
 func TestConfig(t *testing.T) {
@@ -12,20 +19,91 @@ func TestConfig(t *testing.T) {
 [dns]
 listen = "0.0.0.0:53"
 protocol = "udp"
+cache = "off"
 cache_size = 2048
+cache_prefetch_types = ["A", "AAAA"]
+cache_failure_ttl = "5s"
+cache_ttl_factor = 2
+cache_max_ttl = "1h"
 resolvers = [
   "192.0.2.1:53",
   "192.0.2.2:53=example.com",
+  "https://dns.example.com/dns-query",
 ]
 hijack_mode = "zero" # or: empty, hosts
+hijack_address = "192.0.2.100"
+hijack_addresses = ["192.0.2.101", "2001:db8::100"]
+hijack_ttl = "5m"
+hijack_networks = ["198.51.100.0/24", "2001:db8:1::/48"]
+block_patterns = ['\.(zip|mov)$']
+block_pattern_mode = "nxdomain"
+http_pprof = true
+root_queries = "hints"
+non_recursive = "cache"
+special_names = "forward"
 hosts_refresh_interval = "48h"
+hosts_concurrency = 8
+hosts_max_size = 50
+reload_debounce = "2s"
+query_timeout = "5s"
 database = "/tmp/log.db"
+database_optional = true
 log_mode = "all"
 log_ttl = "72h"
+log_answers = false
+log_file = "/tmp/zdns.log"
+log_file_max_size = 100
+log_file_max_age = "24h"
+log_file_max_files = 3
+rate_limit = 100
+rate_limit_response = "truncate"
+max_in_flight = 1000
+overload_response = "drop"
+deduplicate = true
+edns_options = [8, 10]
+ecs_cache = true
+ecs_prefix_ipv4 = 20
+strip_dnssec = true
+minimal_responses = true
+strip_out_of_bailiwick = true
+preserve_query_case = true
+shuffle_answers = true
+cache_warm = ["example.com", "example.com AAAA"]
+cache_warm_up = "30s"
+cache_warm_up_mode = "stale"
+cache_key_hash = "fnv64"
+cache_close_timeout = "1s"
+shuffle_seed = 42
+udp_readers = 4
+trace = true
+max_answers = 8
+remove_duplicate_answers = true
+offline_mode = "address"
+offline_address = "192.0.2.10"
+search_domain = "home.lan"
+local_zones = ["local", "internal"]
+rewrite_fallback = true
+
+[dns.cache_zone_ttl]
+"dev.example.com" = "10s"
+
+[dns.rewrite]
+"corp" = "corp.example.com"
 
 [resolver]
 protocol = "tcp-tls" # or: "", "udp", "tcp"
 timeout = "1s"
+concurrency = 2
+answer_wait = "50ms"
+strategy = "sequential"
+deadline = "3s"
+family = "ipv6"
+pool_size = 4
+pool_idle_timeout = "30s"
+audit = true
+
+[resolver.rate_limit]
+"192.0.2.2:53=example.com" = 10
 
 [[hosts]]
 url = "file:///home/foo/hosts-good"
@@ -35,6 +113,8 @@ hijack = false
 url = "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"
 timeout = "10s"
 hijack = true
+hijack_mode = "nxdomain"
+on_failure = "block"
 
 [[hosts]]
 entries = [
@@ -42,6 +122,22 @@ entries = [
   "0.0.0.0 goodhost2",
 ]
 hijack = false
+
+[[routes]]
+networks = ["192.168.2.0/24", "fd00:2::/64"]
+resolvers = ["192.0.2.3:53"]
+
+[[routes]]
+zones = ["10.in-addr.arpa"]
+types = ["PTR"]
+resolvers = ["192.0.2.4:53"]
+
+[[records]]
+entries = [
+  "host1.example.com. 60 IN A 192.0.2.1",
+  "host1.example.com. IN TXT \"foo\"",
+]
+ttl = "5m"
 `
 	r := strings.NewReader(text)
 	conf, err := ReadConfig(r)
@@ -55,11 +151,67 @@ hijack = false
 		want  int
 	}{
 		{"DNS.CacheSize", conf.DNS.CacheSize, 2048},
-		{"len(DNS.Resolvers)", len(conf.DNS.Resolvers), 2},
+		{"len(DNS.Resolvers)", len(conf.DNS.Resolvers), 3},
 		{"Resolver.Timeout", int(conf.Resolver.Timeout), int(time.Second)},
 		{"DNS.RefreshInterval", int(conf.DNS.refreshInterval), int(48 * time.Hour)},
+		{"DNS.ReloadDebounce", int(conf.DNS.ReloadDebounce), int(2 * time.Second)},
+		{"DNS.QueryTimeout", int(conf.DNS.QueryTimeout), int(5 * time.Second)},
 		{"len(Hosts)", len(conf.Hosts), 3},
+		{"Hosts[0].hijackMode", conf.Hosts[0].hijackMode, HijackZero},
+		{"Hosts[1].hijackMode", conf.Hosts[1].hijackMode, HijackNXDomain},
+		{"DNS.blockPatternMode", conf.DNS.blockPatternMode, HijackNXDomain},
+		{"DNS.HostsConcurrency", conf.DNS.HostsConcurrency, 8},
+		{"DNS.HostsMaxSize", conf.DNS.HostsMaxSize, 50},
+		{"Hosts[0].onFailure", conf.Hosts[0].onFailure, FailureSkip},
+		{"Hosts[1].onFailure", conf.Hosts[1].onFailure, FailureBlock},
+		{"len(Records)", len(conf.Records), 1},
+		{"len(Routes)", len(conf.Routes), 2},
+		{"len(Routes[0].Networks)", len(conf.Routes[0].Networks), 2},
+		{"len(Routes[1].Networks)", len(conf.Routes[1].Networks), 0},
+		{"Routes[1].Types[0]", int(conf.Routes[1].Types[0]), 12},
+		{"Records[0].records.Len()", conf.Records[0].records.Len(), 2},
+		{"Records[0].ttl", int(conf.Records[0].ttl.Seconds()), 300},
 		{"DNS.LogTTL", int(conf.DNS.LogTTL), int(72 * time.Hour)},
+		{"DNS.LogFileMaxSize", conf.DNS.LogFileMaxSize, 100},
+		{"DNS.LogFileMaxAge", int(conf.DNS.LogFileMaxAge), int(24 * time.Hour)},
+		{"DNS.LogFileMaxFiles", conf.DNS.LogFileMaxFiles, 3},
+		{"len(DNS.CachePrefetchTypes)", len(conf.DNS.CachePrefetchTypes), 2},
+		{"DNS.CachePrefetchTypes[1]", int(conf.DNS.CachePrefetchTypes[1]), 28},
+		{"DNS.CacheFailureTTL", int(conf.DNS.CacheFailureTTL), int(5 * time.Second)},
+		{"DNS.CacheTTLFactor", int(conf.DNS.CacheTTLFactor * 10), 20},
+		{"DNS.CacheMaxTTL", int(conf.DNS.CacheMaxTTL), int(time.Hour)},
+		{"DNS.RateLimit", conf.DNS.RateLimit, 100},
+		{"Resolver.RateLimits[192.0.2.2:53=example.com]", conf.Resolver.RateLimits["192.0.2.2:53=example.com"], 10},
+		{"DNS.CacheZoneTTLs[dev.example.com]", int(conf.DNS.CacheZoneTTLs["dev.example.com"]), int(10 * time.Second)},
+		{"len(DNS.EDNSOptions)", len(conf.DNS.EDNSOptions), 2},
+		{"DNS.EDNSOptions[1]", int(conf.DNS.EDNSOptions[1]), 10},
+		{"DNS.hijackTTL", int(conf.DNS.hijackTTL), int(5 * time.Minute)},
+		{"Resolver.Concurrency", conf.Resolver.Concurrency, 2},
+		{"Resolver.AnswerWait", int(conf.Resolver.AnswerWait), int(50 * time.Millisecond)},
+		{"Resolver.Strategy", conf.Resolver.Strategy, dnsutil.StrategySequential},
+		{"Resolver.Family", conf.Resolver.Family, dnsutil.FamilyIPv6},
+		{"Resolver.Deadline", int(conf.Resolver.Deadline), int(3 * time.Second)},
+		{"Resolver.PoolSize", conf.Resolver.PoolSize, 4},
+		{"Resolver.PoolIdleTimeout", int(conf.Resolver.PoolIdleTimeout), int(30 * time.Second)},
+		{"DNS.RateLimitResponse", conf.DNS.RateLimitResponse, dns.RateLimitTruncate},
+		{"DNS.MaxInFlight", conf.DNS.MaxInFlight, 1000},
+		{"DNS.OverloadResponse", conf.DNS.OverloadResponse, dns.RateLimitDrop},
+		{"DNS.RootQueries", conf.DNS.RootQueries, dns.RootHints},
+		{"DNS.NonRecursive", conf.DNS.NonRecursive, dns.NonRecursiveCache},
+		{"DNS.ECSPrefixIPv4", conf.DNS.ECSPrefixIPv4, 20},
+		{"DNS.ECSPrefixIPv6", conf.DNS.ECSPrefixIPv6, 56},
+		{"DNS.SpecialNames", conf.DNS.SpecialNames, dns.SpecialForward},
+		{"DNS.ShuffleSeed", int(conf.DNS.ShuffleSeed), 42},
+		{"DNS.UDPReaders", conf.DNS.UDPReaders, 4},
+		{"DNS.MaxAnswers", conf.DNS.MaxAnswers, 8},
+		{"DNS.OfflineMode", conf.DNS.OfflineMode, dns.OfflineAddress},
+		{"len(DNS.CacheWarm)", len(conf.DNS.CacheWarm), 2},
+		{"DNS.CacheWarm[0].Type", int(conf.DNS.CacheWarm[0].Type), 1},
+		{"DNS.CacheWarm[1].Type", int(conf.DNS.CacheWarm[1].Type), 28},
+		{"DNS.CacheWarmUp", int(conf.DNS.CacheWarmUp), int(30 * time.Second)},
+		{"DNS.CacheCloseTimeout", int(conf.DNS.CacheCloseTimeout), int(time.Second)},
+		{"DNS.CacheWarmUpMode", conf.DNS.CacheWarmUpMode, dns.WarmUpStale},
+		{"DNS.CacheKeyHash", conf.DNS.CacheKeyHash, cache.KeyFNV64},
 	}
 	for i, tt := range intTests {
 		if tt.got != tt.want {
@@ -77,10 +229,21 @@ hijack = false
 		{"DNS.Resolvers[0]", conf.DNS.Resolvers[0], "192.0.2.1:53"},
 		{"DNS.Resolvers[1]", conf.DNS.Resolvers[1], "192.0.2.2:53=example.com"},
 		{"DNS.HijackMode", conf.DNS.HijackMode, "zero"},
+		{"DNS.hijackAddresses", fmt.Sprint(conf.DNS.hijackAddresses), "[192.0.2.100 192.0.2.101 2001:db8::100]"},
+		{"DNS.hijackNetworks", fmt.Sprint(conf.DNS.hijackNetworks), "[198.51.100.0/24 2001:db8:1::/48]"},
+		{"DNS.blockPatterns", fmt.Sprint(conf.DNS.blockPatterns), `[\.(zip|mov)$]`},
 		{"DNS.Database", conf.DNS.Database, "/tmp/log.db"},
 		{"DNS.LogMode", conf.DNS.LogModeString, "all"},
 		{"DNS.LogTTL", conf.DNS.LogTTLString, "72h"},
+		{"DNS.LogFile", conf.DNS.LogFile, "/tmp/zdns.log"},
 		{"Resolver.Protocol", conf.Resolver.Protocol, "tcp-tls"},
+		{"DNS.OfflineAddress", conf.DNS.OfflineAddress.String(), "192.0.2.10"},
+		{"DNS.SearchDomain", conf.DNS.SearchDomain, "home.lan"},
+		{"DNS.LocalZones", fmt.Sprint(conf.DNS.LocalZones), "[local internal]"},
+		{"DNS.Rewrites[corp]", conf.DNS.Rewrites["corp"], "corp.example.com"},
+		{"Routes[0].Networks[1]", conf.Routes[0].Networks[1].String(), "fd00:2::/64"},
+		{"Routes[0].Resolvers[0]", conf.Routes[0].Resolvers[0], "192.0.2.3:53"},
+		{"Routes[1].Zones[0]", conf.Routes[1].Zones[0], "10.in-addr.arpa"},
 		{"Hosts[0].Source", conf.Hosts[0].URL, "file:///home/foo/hosts-good"},
 		{"Hosts[1].Source", conf.Hosts[1].URL, "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"},
 		{"Hosts[1].Timeout", conf.Hosts[1].Timeout, "10s"},
@@ -99,6 +262,21 @@ hijack = false
 	}{
 		{"Hosts[0].Hijack", conf.Hosts[0].Hijack, false},
 		{"Hosts[1].Hijack", conf.Hosts[1].Hijack, true},
+		{"DNS.Deduplicate", conf.DNS.Deduplicate, true},
+		{"DNS.CacheDisabled", conf.DNS.CacheDisabled, true},
+		{"DNS.DatabaseOptional", conf.DNS.DatabaseOptional, true},
+		{"DNS.Trace", conf.DNS.Trace, true},
+		{"DNS.RemoveDuplicateAnswers", conf.DNS.RemoveDuplicateAnswers, true},
+		{"DNS.StripDNSSEC", conf.DNS.StripDNSSEC, true},
+		{"DNS.MinimalResponses", conf.DNS.MinimalResponses, true},
+		{"DNS.LogAnswers", conf.DNS.LogAnswers, false},
+		{"DNS.StripOutOfBailiwick", conf.DNS.StripOutOfBailiwick, true},
+		{"DNS.PreserveQueryCase", conf.DNS.PreserveQueryCase, true},
+		{"DNS.ShuffleAnswers", conf.DNS.ShuffleAnswers, true},
+		{"DNS.HTTPPprof", conf.DNS.HTTPPprof, true},
+		{"DNS.RewriteFallback", conf.DNS.RewriteFallback, true},
+		{"DNS.ECSCache", conf.DNS.ECSCache, true},
+		{"Resolver.Audit", conf.Resolver.Audit, true},
 	}
 	for i, tt := range boolTests {
 		if tt.got != tt.want {
@@ -107,6 +285,46 @@ hijack = false
 	}
 }
 
+func TestConfigResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	resolvConf := `
+nameserver 127.0.0.1
+nameserver 203.0.113.1
+nameserver 203.0.113.2
+`
+	if err := os.WriteFile(path, []byte(resolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		conf string
+		out  []string
+		err  string
+	}{
+		{"[dns]\nlisten = \"127.0.0.1:53\"\nresolv_conf = \"" + path + "\"\n[resolver]\nprotocol = \"udp\"",
+			[]string{"203.0.113.1:53", "203.0.113.2:53"}, ""},
+		{"[dns]\nlisten = \":53\"\nresolv_conf = \"" + path + "\"\n[resolver]\nprotocol = \"tcp\"",
+			[]string{"203.0.113.1:53", "203.0.113.2:53"}, ""},
+		{"[dns]\nlisten = \"127.0.0.1:53000\"\nresolv_conf = \"" + path + "\"\n[resolver]\nprotocol = \"udp\"",
+			[]string{"127.0.0.1:53", "203.0.113.1:53", "203.0.113.2:53"}, ""},
+		{"[dns]\nresolvers = [\"203.0.113.3:53\"]\nresolv_conf = \"" + path + "\"\n[resolver]\nprotocol = \"udp\"",
+			[]string{"203.0.113.3:53"}, ""},
+		{"[dns]\nresolv_conf = \"" + path + "\"", nil, "resolv_conf cannot be used with resolver protocol tcp-tls"},
+	}
+	for i, tt := range tests {
+		var errString string
+		conf, err := ReadConfig(strings.NewReader(tt.conf))
+		if err != nil {
+			errString = err.Error()
+		}
+		if errString != tt.err {
+			t.Errorf("#%d: err = %q, want %q", i, errString, tt.err)
+		}
+		if err == nil && !reflect.DeepEqual(conf.DNS.Resolvers, tt.out) {
+			t.Errorf("#%d: Resolvers = %q, want %q", i, conf.DNS.Resolvers, tt.out)
+		}
+	}
+}
+
 func TestConfigErrors(t *testing.T) {
 	baseConf := "[dns]\nlisten = \"0.0.0.0:53\"\n"
 	conf0 := baseConf + "cache_size = -1"
@@ -171,6 +389,283 @@ protocol = "https"
 `
 	conf15 := baseConf + `
 cache_persist = true
+`
+	conf16 := baseConf + `
+cache_prefetch_types = ["foo"]
+`
+	conf17 := baseConf + `
+rate_limit = -1
+`
+	conf18 := baseConf + `
+rate_limit_response = "foo"
+`
+	conf19 := baseConf + `
+cache_failure_ttl = "foo"
+`
+	conf20 := baseConf + `
+cache_failure_ttl = "-1s"
+`
+	conf21 := baseConf + `
+[resolver]
+concurrency = -1
+`
+	conf22 := baseConf + `
+hijack_address = "foo"
+`
+	conf23 := baseConf + `
+[resolver]
+answer_wait = "foo"
+`
+	conf24 := baseConf + `
+[resolver]
+answer_wait = "-1s"
+`
+	conf25 := baseConf + `
+hijack_ttl = "foo"
+`
+	conf26 := baseConf + `
+hijack_ttl = "-1s"
+`
+	conf27 := baseConf + `
+[dns.cache_zone_ttl]
+"example.com" = "foo"
+`
+	conf28 := baseConf + `
+[dns.cache_zone_ttl]
+"example.com" = "-1s"
+`
+	conf29 := baseConf + `
+[[records]]
+url = "file:///tmp/foo"
+entries = ["host1.example.com. IN A 192.0.2.1"]
+`
+	conf30 := baseConf + `
+[[records]]
+url = "foo://bar"
+`
+	conf31 := baseConf + `
+[[records]]
+entries = ["host1.example.com. IN A foo"]
+`
+	conf32 := baseConf + `
+[[records]]
+entries = ["192.0.2.1 host1"]
+format = "foo"
+`
+	conf34 := baseConf + `
+[[routes]]
+networks = ["192.168.2.0/24"]
+`
+	conf35 := baseConf + `
+[[routes]]
+networks = ["foo"]
+resolvers = ["192.0.2.3:53"]
+`
+	conf36 := baseConf + `
+[[routes]]
+networks = ["192.168.2.0/24"]
+resolvers = ["foo"]
+`
+	conf37 := baseConf + `
+root_queries = "foo"
+`
+	conf38 := baseConf + `
+cache_warm = ["example.com FOO"]
+`
+	conf39 := baseConf + `
+udp_readers = -1
+`
+	conf40 := baseConf + `
+max_answers = -1
+`
+	conf41 := baseConf + `
+[resolver]
+strategy = "foo"
+`
+	conf42 := baseConf + `
+[resolver]
+deadline = "foo"
+`
+	conf43 := baseConf + `
+[resolver]
+deadline = "-1s"
+`
+	conf44 := baseConf + `
+max_in_flight = -1
+`
+	conf45 := baseConf + `
+overload_response = "foo"
+`
+	conf46 := baseConf + `
+cache = "foo"
+`
+	conf47 := baseConf + `
+offline_mode = "foo"
+`
+	conf48 := baseConf + `
+offline_mode = "address"
+offline_address = "foo"
+`
+	conf49 := baseConf + `
+offline_mode = "address"
+`
+	conf50 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack_mode = "nxdomain"
+`
+	conf51 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack = true
+hijack_mode = "foo"
+`
+	conf52 := baseConf + `
+non_recursive = "foo"
+`
+	conf53 := baseConf + `
+[resolver]
+family = "foo"
+`
+	conf54 := baseConf + `
+reload_debounce = "foo"
+`
+	conf55 := baseConf + `
+reload_debounce = "-1s"
+`
+	conf56 := baseConf + `
+rewrite_fallback = true
+`
+	conf57 := baseConf + `
+[resolver.rate_limit]
+"192.0.2.1:53" = 10
+`
+	conf58 := baseConf + `
+resolvers = ["192.0.2.2:53"]
+
+[resolver.rate_limit]
+"192.0.2.2:53" = -1
+`
+	conf59 := baseConf + `
+hijack_addresses = ["192.0.2.1", "foo"]
+`
+	conf60 := baseConf + `
+special_names = "foo"
+`
+	conf61 := baseConf + `
+[resolver]
+pool_size = -1
+`
+	conf62 := baseConf + `
+[resolver]
+pool_idle_timeout = "foo"
+`
+	conf63 := baseConf + `
+[resolver]
+pool_idle_timeout = "-1s"
+`
+	conf64 := baseConf + `
+ecs_prefix_ipv4 = 33
+`
+	conf65 := baseConf + `
+ecs_prefix_ipv6 = -1
+`
+	conf66 := baseConf + `
+ecs_cache = true
+edns_options = [10]
+`
+	conf67 := baseConf + `
+hijack_networks = ["198.51.100.1"]
+`
+	conf68 := baseConf + `
+query_timeout = "foo"
+`
+	conf69 := baseConf + `
+query_timeout = "-1s"
+`
+	conf70 := baseConf + `
+[[hosts]]
+url = "file:///tmp/foo"
+on_failure = "foo"
+`
+	conf71 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 host1"]
+on_failure = "block"
+`
+	conf72 := baseConf + `
+log_file_max_size = -1
+`
+	conf73 := baseConf + `
+log_file_max_age = "foo"
+`
+	conf74 := baseConf + `
+log_file_max_age = "-1s"
+`
+	conf75 := baseConf + `
+log_file = "/var/log/zdns.log"
+log_file_max_files = 0
+`
+	conf76 := baseConf + `
+cache_key_hash = "foo"
+`
+	conf77 := baseConf + `
+[[routes]]
+resolvers = ["192.0.2.3:53"]
+`
+	conf78 := baseConf + `
+[[routes]]
+types = ["foo"]
+resolvers = ["192.0.2.3:53"]
+`
+	conf79 := baseConf + `
+cache_warm_up = "foo"
+`
+	conf80 := baseConf + `
+cache_warm_up = "-1s"
+`
+	conf81 := baseConf + `
+cache_warm_up_mode = "foo"
+`
+	conf82 := baseConf + `
+cache_close_timeout = "foo"
+`
+	conf83 := baseConf + `
+cache_close_timeout = "-1s"
+`
+	conf84 := baseConf + `
+cache_ttl_factor = 0.5
+`
+	conf85 := baseConf + `
+cache_max_ttl = "foo"
+`
+	conf86 := baseConf + `
+cache_max_ttl = "-1s"
+`
+	conf87 := baseConf + `
+block_patterns = ["(zip"]
+`
+	conf88 := baseConf + `
+block_pattern_mode = "foo"
+`
+	conf89 := baseConf + `
+hosts_concurrency = -1
+`
+	conf90 := baseConf + `
+hosts_max_size = -1
+`
+	conf91 := baseConf + `
+[[records]]
+entries = ["host1.example.com. IN A 192.0.2.1"]
+ttl = "foo"
+`
+	conf92 := baseConf + `
+[[records]]
+entries = ["host1.example.com. IN A 192.0.2.1"]
+ttl = "-1s"
+`
+	conf93 := baseConf + `
+fallback_file = "/nonexistent/zdns/fallback.zone"
 `
 	var tests = []struct {
 		in  string
@@ -193,6 +688,83 @@ cache_persist = true
 		{conf13, `log_mode = "hijacked" requires 'database' to be set`},
 		{conf14, "protocol https requires https scheme for resolver http://example.com"},
 		{conf15, "cache_persist = true requires 'database' to be set"},
+		{conf16, "invalid prefetch type: foo"},
+		{conf17, "rate limit must be >= 0"},
+		{conf18, "invalid rate limit response: foo"},
+		{conf19, "invalid cache failure TTL: foo"},
+		{conf20, "cache failure TTL must be >= 0"},
+		{conf21, "resolver concurrency must be >= 0"},
+		{conf22, "invalid hijack address: foo"},
+		{conf23, "invalid resolver answer wait: foo"},
+		{conf24, "resolver answer wait must be >= 0"},
+		{conf25, "invalid hijack TTL: foo"},
+		{conf26, "hijack TTL must be >= 0"},
+		{conf27, "invalid cache TTL for zone example.com: foo"},
+		{conf28, "cache TTL for zone example.com must be >= 0"},
+		{conf29, "exactly one of url or entries must be set for records"},
+		{conf30, "foo://bar: unsupported scheme: foo"},
+		{conf31, "invalid records: dns: bad A A: \"foo\" at line: 1:27"},
+		{conf32, "invalid records format: foo"},
+		{conf34, "resolvers must be set for route"},
+		{conf35, "invalid route network: foo"},
+		{conf36, "invalid resolver: address foo: missing port in address"},
+		{conf37, "invalid root queries mode: foo"},
+		{conf38, "invalid cache warm entry: example.com FOO"},
+		{conf39, "udp readers must be >= 0"},
+		{conf40, "max answers must be >= 0"},
+		{conf41, "invalid resolver strategy: foo"},
+		{conf42, "invalid resolver deadline: foo"},
+		{conf43, "resolver deadline must be >= 0"},
+		{conf44, "max in-flight queries must be >= 0"},
+		{conf45, "invalid overload response: foo"},
+		{conf46, "invalid cache: foo"},
+		{conf47, "invalid offline mode: foo"},
+		{conf48, "invalid offline address: foo"},
+		{conf49, "offline_mode = \"address\" requires 'offline_address' to be set"},
+		{conf50, "hijack_mode = \"nxdomain\" requires 'hijack' to be set"},
+		{conf51, "invalid hijack mode: foo"},
+		{conf52, "invalid non-recursive mode: foo"},
+		{conf53, "invalid resolver family: foo"},
+		{conf54, "invalid reload debounce: foo"},
+		{conf55, "reload debounce must be >= 0"},
+		{conf56, "rewrite_fallback = true requires 'search_domain' or 'rewrite' to be set"},
+		{conf57, "rate_limit resolver is not configured: 192.0.2.1:53"},
+		{conf58, "rate limit of resolver 192.0.2.2:53 must be >= 0"},
+		{conf59, "invalid hijack address: foo"},
+		{conf60, "invalid special names mode: foo"},
+		{conf61, "pool size must be >= 0"},
+		{conf62, "invalid pool idle timeout: foo"},
+		{conf63, "pool idle timeout must be >= 0"},
+		{conf64, "ecs ipv4 prefix must be between 0 and 32"},
+		{conf65, "ecs ipv6 prefix must be between 0 and 128"},
+		{conf66, "ecs_cache = true requires 'edns_options' to include 8"},
+		{conf67, "invalid hijack network: 198.51.100.1"},
+		{conf68, "invalid query timeout: foo"},
+		{conf69, "query timeout must be >= 0"},
+		{conf70, "file:///tmp/foo: invalid failure policy: foo"},
+		{conf71, "[0.0.0.0 host1]: on_failure cannot be set for inline hosts"},
+		{conf72, "log file max size must be >= 0"},
+		{conf73, "invalid log file max age: foo"},
+		{conf74, "log file max age must be >= 0"},
+		{conf75, "log file max files must be >= 1"},
+		{conf76, "invalid cache key hash: foo"},
+		{conf77, "networks, zones or types must be set for route"},
+		{conf78, "invalid route type: foo"},
+		{conf79, "invalid cache warm-up: foo"},
+		{conf80, "cache warm-up must be >= 0"},
+		{conf81, "invalid cache warm-up mode: foo"},
+		{conf82, "invalid cache close timeout: foo"},
+		{conf83, "cache close timeout must be >= 0"},
+		{conf84, "cache TTL factor must be >= 1"},
+		{conf85, "invalid cache max TTL: foo"},
+		{conf86, "cache max TTL must be >= 0"},
+		{conf87, "invalid block pattern: (zip"},
+		{conf88, "invalid block pattern mode: foo"},
+		{conf89, "hosts concurrency must be >= 0"},
+		{conf90, "hosts max size must be >= 0"},
+		{conf91, "invalid records TTL: foo"},
+		{conf92, "records TTL must be >= 0"},
+		{conf93, "open /nonexistent/zdns/fallback.zone: no such file or directory"},
 	}
 	for i, tt := range tests {
 		var got string
@@ -2,7 +2,11 @@ package dnsutil
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +19,9 @@ var (
 	// TypeToString contains a mapping of DNS request type to string.
 	TypeToString = dns.TypeToString
 
+	// StringToType contains a mapping of string to DNS request type.
+	StringToType = dns.StringToType
+
 	// RcodeToString contains a mapping of Mapping DNS response code to string.
 	RcodeToString = dns.RcodeToString
 )
@@ -28,8 +35,35 @@ type Client interface {
 type Config struct {
 	Network string
 	Timeout time.Duration
+	// Family restricts the address family used to reach resolvers.
+	Family int
+	// PoolSize is the maximum number of connections to the resolver. Connections are reused across exchanges. This
+	// only applies to the tcp and tcp-tls networks. Zero means that a new connection is opened for every exchange.
+	PoolSize int
+	// PoolIdleTimeout is the duration after which idle pooled connections are closed. Zero means no timeout.
+	PoolIdleTimeout time.Duration
+	// RateLimit is the maximum number of queries per second sent to the resolver. Queries exceeding the limit fail
+	// immediately, so that a multiplexed client uses its other clients instead. Zero means no limit.
+	RateLimit int
+}
+
+// ReadResolvConf reads the nameservers listed in the resolv.conf file at path. Each nameserver is returned on the form
+// addr:port.
+func ReadResolvConf(path string) ([]string, error) {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		resolvers = append(resolvers, net.JoinHostPort(server, config.Port))
+	}
+	return resolvers, nil
 }
 
+// ErrRateLimited is the error returned by clients when the rate limit of their resolver is exceeded.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
 type resolver interface {
 	Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error)
 }
@@ -37,49 +71,420 @@ type resolver interface {
 type client struct {
 	resolver resolver
 	address  string
+	verify   bool
+	limiter  *bucket
+
+	statsMu  sync.Mutex
+	stats    ResolverStats
+	rejected int64
+}
+
+// Stats contains statistics of upstream exchanges.
+type Stats struct {
+	// RejectedResponses is the number of responses rejected because they were not a response or did not match their
+	// query.
+	RejectedResponses int64
+	// Resolvers contains statistics of exchanges with each resolver, by address.
+	Resolvers map[string]ResolverStats
+}
+
+// ResolverStats contains statistics of exchanges with a single resolver.
+type ResolverStats struct {
+	// Queries is the number of queries sent to the resolver.
+	Queries int64
+	// Successes is the number of queries answered by the resolver.
+	Successes int64
+	// Errors is the number of queries that failed, including timeouts and rejected responses.
+	Errors int64
+	// Timeouts is the number of queries that timed out.
+	Timeouts int64
+	// AvgLatency is the average duration of successful exchanges.
+	AvgLatency time.Duration
+
+	totalLatency time.Duration
+}
+
+// add adds the counters of other to rs.
+func (rs *ResolverStats) add(other ResolverStats) {
+	rs.Queries += other.Queries
+	rs.Successes += other.Successes
+	rs.Errors += other.Errors
+	rs.Timeouts += other.Timeouts
+	rs.totalLatency += other.totalLatency
+	if rs.Successes > 0 {
+		rs.AvgLatency = rs.totalLatency / time.Duration(rs.Successes)
+	}
+}
+
+// statsReader is implemented by clients that record statistics of their exchanges.
+type statsReader interface {
+	Stats() Stats
+	ResetStats()
+}
+
+// Stats returns statistics of exchanges made by client c.
+func (c *client) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	rs := c.stats
+	if rs.Successes > 0 {
+		rs.AvgLatency = rs.totalLatency / time.Duration(rs.Successes)
+	}
+	return Stats{RejectedResponses: c.rejected, Resolvers: map[string]ResolverStats{c.address: rs}}
+}
+
+// ResetStats resets statistics of exchanges made by client c.
+func (c *client) ResetStats() {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats = ResolverStats{}
+	c.rejected = 0
+}
+
+// recordExchange records the outcome of an exchange, which took duration d, and whether its response was rejected.
+func (c *client) recordExchange(d time.Duration, rejected bool, err error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if rejected {
+		c.rejected++
+	}
+	c.stats.Queries++
+	if err == nil {
+		c.stats.Successes++
+		c.stats.totalLatency += d
+	} else {
+		c.stats.Errors++
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.stats.Timeouts++
+		}
+	}
+}
+
+const (
+	// StrategyParallel queries clients in parallel and uses the first successful response.
+	StrategyParallel = iota
+	// StrategySequential queries clients one at a time, in order, until one responds successfully.
+	StrategySequential
+)
+
+const (
+	// FamilyAuto reaches resolvers over any address family.
+	FamilyAuto = iota
+	// FamilyIPv4 reaches resolvers over IPv4 only.
+	FamilyIPv4
+	// FamilyIPv6 reaches resolvers over IPv6 only.
+	FamilyIPv6
+)
+
+type mux struct {
+	clients []Client
+	options MuxOptions
 }
 
-type mux struct{ clients []Client }
+// MuxOptions configures optional behaviour of a multiplexed client.
+type MuxOptions struct {
+	// Concurrency is the maximum number of clients to query in parallel. Zero means no limit.
+	Concurrency int
+	// AnswerWait is the duration to wait for additional responses after the first successful response. If non-zero,
+	// the response with the most answers received within this duration is returned.
+	AnswerWait time.Duration
+	// Strategy determines how clients are queried. Concurrency and AnswerWait only apply to StrategyParallel.
+	Strategy int
+	// Deadline is the maximum duration of an exchange with StrategySequential, including all clients tried. Zero means
+	// no deadline. Exchanges with each client are still bound by the timeout of that client.
+	Deadline time.Duration
+	// AuditLogger logs every exchange attempted for each query, with its outcome and whether its response was used.
+	// With StrategyParallel, attempts are logged once all clients queried have responded, including those whose
+	// response was not used. Nil disables audit logging.
+	AuditLogger *log.Logger
+}
+
+// audit collects the exchanges attempted for a query.
+type audit struct {
+	logger   *log.Logger
+	msg      *dns.Msg
+	mu       sync.Mutex
+	attempts []attempt
+	used     chan *dns.Msg
+}
+
+// attempt is the outcome of an exchange with a single client.
+type attempt struct {
+	resolver string
+	msg      *dns.Msg
+	err      error
+	duration time.Duration
+}
+
+func newAudit(logger *log.Logger, msg *dns.Msg) *audit {
+	if logger == nil {
+		return nil
+	}
+	return &audit{logger: logger, msg: msg, used: make(chan *dns.Msg, 1)}
+}
+
+// exchange exchanges msg with client and records the outcome as an attempt with resolver.
+func (a *audit) exchange(resolver string, client Client, msg *dns.Msg) (*dns.Msg, error) {
+	if a == nil {
+		return client.Exchange(msg)
+	}
+	start := time.Now()
+	r, err := client.Exchange(msg)
+	a.add(attempt{resolver: resolver, msg: r, err: err, duration: time.Since(start)})
+	return r, err
+}
+
+func (a *audit) add(at attempt) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attempts = append(a.attempts, at)
+}
+
+// use sets the response that was used, to be logged by logUsed.
+func (a *audit) use(msg *dns.Msg) {
+	if a != nil {
+		a.used <- msg
+	}
+}
+
+// logUsed logs all attempts, once the response that was used is known.
+func (a *audit) logUsed() {
+	if a != nil {
+		a.log(<-a.used)
+	}
+}
+
+// log logs all attempts, marking the attempt whose response is used.
+func (a *audit) log(used *dns.Msg) {
+	if a == nil {
+		return
+	}
+	query := "query " + strconv.Itoa(int(a.msg.Id))
+	if len(a.msg.Question) > 0 {
+		q := a.msg.Question[0]
+		query += " for " + TypeToString[q.Qtype] + " " + q.Name
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, at := range a.attempts {
+		if at.err != nil {
+			a.logger.Printf("%s: %s failed in %s: %s", query, at.resolver, at.duration, at.err)
+			continue
+		}
+		suffix := ""
+		if at.msg == used {
+			suffix = " (used)"
+		}
+		a.logger.Printf("%s: %s answered %s in %s%s", query, at.resolver, RcodeToString[at.msg.Rcode], at.duration, suffix)
+	}
+}
 
 // NewMux creates a new multiplexed client which queries all clients in parallel and returns the first successful
 // response.
-func NewMux(client ...Client) Client { return &mux{clients: client} }
+func NewMux(client ...Client) Client { return NewMuxWithOptions(MuxOptions{}, client...) }
+
+// NewMuxWithOptions creates a new multiplexed client which behaves according to options.
+func NewMuxWithOptions(options MuxOptions, client ...Client) Client {
+	return &mux{clients: client, options: options}
+}
+
+// resolver returns the address of the resolver of the client at index i, or the index if it has no known address.
+func (m *mux) resolver(i int) string {
+	if c, ok := m.clients[i].(*client); ok {
+		return c.address
+	}
+	return "#" + strconv.Itoa(i)
+}
+
+// Stats returns statistics of exchanges made by the clients of mux m, by resolver address.
+func (m *mux) Stats() Stats {
+	stats := Stats{Resolvers: make(map[string]ResolverStats)}
+	for _, c := range m.clients {
+		sr, ok := c.(statsReader)
+		if !ok {
+			continue
+		}
+		cs := sr.Stats()
+		stats.RejectedResponses += cs.RejectedResponses
+		for addr, rs := range cs.Resolvers {
+			total := stats.Resolvers[addr]
+			total.add(rs)
+			stats.Resolvers[addr] = total
+		}
+	}
+	return stats
+}
+
+// ResetStats resets statistics of exchanges made by the clients of mux m.
+func (m *mux) ResetStats() {
+	for _, c := range m.clients {
+		if sr, ok := c.(statsReader); ok {
+			sr.ResetStats()
+		}
+	}
+}
 
 func (m *mux) Exchange(msg *dns.Msg) (*dns.Msg, error) {
 	if len(m.clients) == 0 {
 		return nil, fmt.Errorf("no clients to query")
 	}
+	a := newAudit(m.options.AuditLogger, msg)
+	if m.options.Strategy == StrategySequential {
+		r, err := m.exchangeSequential(msg, a)
+		a.log(r)
+		return r, err
+	}
+	r, err := m.exchangeParallel(msg, a)
+	a.use(r)
+	return r, err
+}
+
+// exchangeParallel queries clients in parallel, and returns the first successful response, or the one with most
+// answers received within the answer wait duration.
+func (m *mux) exchangeParallel(msg *dns.Msg, a *audit) (*dns.Msg, error) {
 	responses := make(chan *dns.Msg, len(m.clients))
 	errs := make(chan error, len(m.clients))
-	var wg sync.WaitGroup
-	for _, c := range m.clients {
-		wg.Add(1)
-		go func(client Client) {
-			defer wg.Done()
-			r, err := client.Exchange(msg)
-			if err != nil {
-				errs <- err
-				return
-			}
-			responses <- r
-		}(c)
+	done := make(chan struct{})
+	defer close(done)
+	var sem chan struct{}
+	if m.options.Concurrency > 0 {
+		sem = make(chan struct{}, m.options.Concurrency)
 	}
 	go func() {
+		var wg sync.WaitGroup
+	launch:
+		for i, c := range m.clients {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+				case <-done:
+					break launch // Answered, no need to query remaining clients
+				}
+			}
+			wg.Add(1)
+			go func(i int, client Client) {
+				defer wg.Done()
+				if sem != nil {
+					defer func() { <-sem }()
+				}
+				r, err := a.exchange(m.resolver(i), client, msg)
+				if err != nil {
+					errs <- err
+					return
+				}
+				responses <- r
+			}(i, c)
+		}
 		wg.Wait()
 		close(errs)
 		close(responses)
+		a.logUsed()
 	}()
-	for rr := range responses {
-		return rr, nil
+	best, ok := <-responses
+	if !ok {
+		return nil, <-errs
+	}
+	if m.options.AnswerWait <= 0 {
+		return best, nil
+	}
+	timer := time.NewTimer(m.options.AnswerWait)
+	defer timer.Stop()
+	for {
+		select {
+		case rr, ok := <-responses:
+			if !ok {
+				return best, nil // All clients responded
+			}
+			if len(rr.Answer) > len(best.Answer) {
+				best = rr
+			}
+		case <-timer.C:
+			return best, nil
+		}
 	}
-	return nil, <-errs
 }
 
-// NewClient creates a new Client for addr using config.
+// exchangeSequential queries clients in order, and returns the first successful response. The next client is queried
+// when the current one fails or times out, until all clients are exhausted or the deadline expires.
+func (m *mux) exchangeSequential(msg *dns.Msg, a *audit) (*dns.Msg, error) {
+	var deadline <-chan time.Time
+	if m.options.Deadline > 0 {
+		timer := time.NewTimer(m.options.Deadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	var err error
+	for i, c := range m.clients {
+		results := make(chan result, 1)
+		start := time.Now()
+		go func(client Client) {
+			r, err := client.Exchange(msg)
+			results <- result{r, err}
+		}(c)
+		select {
+		case res := <-results:
+			a.add(attempt{resolver: m.resolver(i), msg: res.msg, err: res.err, duration: time.Since(start)})
+			if res.err == nil {
+				return res.msg, nil
+			}
+			err = res.err
+		case <-deadline:
+			err := fmt.Errorf("no response within deadline of %s", m.options.Deadline)
+			a.add(attempt{resolver: m.resolver(i), err: err, duration: time.Since(start)})
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// SplitResolver splits the resolver address addr into its network and address. The network is determined by an optional
+// scheme, one of udp://, tcp://, tcp-tls:// or https://, and defaults to network if addr has no such scheme. Addresses
+// with a scheme other than https:// are given the default port of their network if they have none.
+func SplitResolver(addr, network string) (string, string) {
+	if network == "udp" {
+		network = ""
+	}
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		return network, addr
+	}
+	port := "53"
+	switch scheme {
+	case "https":
+		return scheme, addr
+	case "udp":
+		scheme = ""
+	case "tcp":
+	case "tcp-tls":
+		port = "853"
+	default:
+		return network, addr
+	}
+	hostPort, tlsName, hasTLSName := strings.Cut(rest, "=")
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), port)
+	}
+	if hasTLSName {
+		hostPort += "=" + tlsName
+	}
+	return scheme, hostPort
+}
+
+// NewClient creates a new Client for addr using config. The network of config can be overridden per address, see
+// SplitResolver.
 func NewClient(addr string, config Config) Client {
+	config.Network, addr = SplitResolver(addr, config.Network)
 	var r resolver
 	if config.Network == "https" {
-		r = http.NewClient(config.Timeout)
+		r = http.NewClientWithNetwork(config.Timeout, familyNetwork("tcp", config.Family))
 	} else {
 		var tlsConfig *tls.Config
 		parts := strings.SplitN(addr, "=", 2)
@@ -87,17 +492,132 @@ func NewClient(addr string, config Config) Client {
 			addr = parts[0]
 			tlsConfig = &tls.Config{ServerName: parts[1]}
 		}
-		r = &dns.Client{Net: config.Network, Timeout: config.Timeout, TLSConfig: tlsConfig}
+		dnsClient := &dns.Client{Net: familyNetwork(config.Network, config.Family), Timeout: config.Timeout, TLSConfig: tlsConfig}
+		if config.PoolSize > 0 && (config.Network == "tcp" || config.Network == "tcp-tls") {
+			r = newPool(dnsClient, config.PoolSize, config.PoolIdleTimeout)
+		} else {
+			r = dnsClient
+		}
+	}
+	// Each UDP exchange uses a new socket, and thus a random source port. Responses are additionally verified to
+	// match their query, guarding against spoofed responses.
+	verify := config.Network == "" || config.Network == "udp"
+	c := &client{resolver: r, address: addr, verify: verify}
+	if config.RateLimit > 0 {
+		c.limiter = newBucket(config.RateLimit)
+	}
+	return c
+}
+
+// familyNetwork returns network restricted to the address family family. For example, "tcp-tls" becomes "tcp4-tls"
+// for FamilyIPv4.
+func familyNetwork(network string, family int) string {
+	suffix := ""
+	switch family {
+	case FamilyIPv4:
+		suffix = "4"
+	case FamilyIPv6:
+		suffix = "6"
+	default:
+		return network
+	}
+	switch network {
+	case "", "udp":
+		return "udp" + suffix
+	case "tcp":
+		return "tcp" + suffix
+	case "tcp-tls":
+		return "tcp" + suffix + "-tls"
 	}
-	return &client{resolver: r, address: addr}
+	return network
 }
 
+// Exchange sends msg to the resolver of the client. Queries are sent as is, and thus without name compression unless
+// msg.Compress is set. Queries forwarded by the proxy never set it, as a single question has no names to compress.
 func (c *client) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	if c.limiter != nil && !c.limiter.take() {
+		return nil, fmt.Errorf("resolver %s failed: %w", c.address, ErrRateLimited)
+	}
+	r, err := c.exchange(msg)
+	// Retry with a lower EDNS version until the resolver supports it, instead of surfacing BADVERS to clients
+	for err == nil && r.Rcode == dns.RcodeBadVers {
+		if msg = downgradeEDNS(msg); msg == nil {
+			break
+		}
+		r, err = c.exchange(msg)
+	}
+	return r, err
+}
+
+func (c *client) exchange(msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
 	r, _, err := c.resolver.Exchange(msg, c.address)
+	rejected := false
+	if err == nil {
+		err = verifyResponse(msg, r)
+		if err == nil && c.verify {
+			err = verify(msg, r)
+		}
+		rejected = err != nil
+	}
+	c.recordExchange(time.Since(start), rejected, err)
 	if err != nil {
 		return nil, fmt.Errorf("resolver %s failed: %w", c.address, err)
 	}
-	return r, err
+	return r, nil
+}
+
+// downgradeEDNS returns a copy of msg using a lower EDNS version, for retrying a query answered with BADVERS. A query
+// using an EDNS version above 0 is downgraded to version 0, and a query using version 0 is downgraded to not use EDNS
+// at all. Nil is returned if msg does not use EDNS.
+func downgradeEDNS(msg *dns.Msg) *dns.Msg {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	msg = msg.Copy()
+	if opt.Version() > 0 {
+		msg.IsEdns0().SetVersion(0)
+		return msg
+	}
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+	return msg
+}
+
+// verifyResponse returns an error if r is not a response to a query with the opcode of msg, such as when a broken
+// resolver echoes the query back.
+func verifyResponse(msg, r *dns.Msg) error {
+	if !r.Response {
+		return fmt.Errorf("message is not a response")
+	}
+	if r.Opcode != msg.Opcode {
+		return fmt.Errorf("response opcode %s does not match query opcode %s", dns.OpcodeToString[r.Opcode],
+			dns.OpcodeToString[msg.Opcode])
+	}
+	return nil
+}
+
+// verify returns an error if response r does not match the query msg.
+func verify(msg, r *dns.Msg) error {
+	if r.Id != msg.Id {
+		return fmt.Errorf("response id %d does not match query id %d", r.Id, msg.Id)
+	}
+	if len(r.Question) != len(msg.Question) {
+		return fmt.Errorf("response has %d questions, want %d", len(r.Question), len(msg.Question))
+	}
+	for i, q := range msg.Question {
+		rq := r.Question[i]
+		if !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+			return fmt.Errorf("response question %s does not match query question %s", rq.String(), q.String())
+		}
+	}
+	return nil
 }
 
 // Answers returns all values in the answer section of DNS message msg.
@@ -111,14 +631,33 @@ func Answers(msg *dns.Msg) []string {
 	return answers
 }
 
-// MinTTL returns the lowest TTL of of answer, authority and additional sections.
+// ClientSubnet returns the EDNS client subnet option of msg, if any.
+func ClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// MinTTL returns the lowest TTL of of answer, authority and additional sections. The TTL of a negative response is
+// also limited by the MINIMUM field of the SOA record in its authority section.
 func MinTTL(msg *dns.Msg) time.Duration {
 	var ttl uint32 = (1 << 31) - 1 // Maximum TTL from RFC 2181
 	for _, answer := range msg.Answer {
 		ttl = min(answer.Header().Ttl, ttl)
 	}
+	negative := IsNegative(msg)
 	for _, ns := range msg.Ns {
 		ttl = min(ns.Header().Ttl, ttl)
+		if soa, ok := ns.(*dns.SOA); ok && negative {
+			ttl = min(soa.Minttl, ttl) // RFC 2308, section 5
+		}
 	}
 	for _, extra := range msg.Extra {
 		// OPT (EDNS) is a pseudo record which uses TTL field for extended RCODE and flags
@@ -130,6 +669,25 @@ func MinTTL(msg *dns.Msg) time.Duration {
 	return time.Duration(ttl) * time.Second
 }
 
+// IsNegative returns whether msg is a negative response, i.e. NXDOMAIN, or NODATA where the answer section contains no
+// records of the queried type. The answer section of a NODATA response may still contain the CNAME chain leading to
+// the name without data.
+func IsNegative(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 {
+		return false
+	}
+	q := msg.Question[0]
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			return false
+		}
+	}
+	return true
+}
+
 func min(x, y uint32) uint32 {
 	if x < y {
 		return x
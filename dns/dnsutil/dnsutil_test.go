@@ -1,14 +1,22 @@
 package dnsutil
 
 import (
+	"bytes"
 	"errors"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/mpolden/zdns/dns/http"
 )
 
 type response struct {
@@ -105,6 +113,33 @@ func TestMinTTL(t *testing.T) {
 			t.Errorf("#%d: MinTTL(\n%s) = %s, want %s", i, msg.String(), got, tt.ttl)
 		}
 	}
+
+	// Negative responses are limited by SOA minimum
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeSOA, Ttl: 3600}, Minttl: 60}
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Ttl: 300}, Target: "www.example.net."}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "www.example.net.", Rrtype: dns.TypeA, Ttl: 300}, A: net.ParseIP("192.0.2.1")}
+	var negativeTests = []struct {
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+		ttl    time.Duration
+	}{
+		{dns.TypeAAAA, dns.RcodeSuccess, []dns.RR{cname}, time.Minute},       // NODATA after CNAME
+		{dns.TypeAAAA, dns.RcodeSuccess, nil, time.Minute},                   // NODATA
+		{dns.TypeA, dns.RcodeNameError, nil, time.Minute},                    // NXDOMAIN
+		{dns.TypeA, dns.RcodeSuccess, []dns.RR{cname, a}, 300 * time.Second}, // Positive
+		{dns.TypeA, dns.RcodeServerFailure, nil, time.Hour},                  // Not negative
+	}
+	for i, tt := range negativeTests {
+		msg := dns.Msg{}
+		msg.SetQuestion("www.example.com.", tt.qtype)
+		msg.Rcode = tt.rcode
+		msg.Answer = tt.answer
+		msg.Ns = []dns.RR{soa}
+		if got := MinTTL(&msg); got != tt.ttl {
+			t.Errorf("#%d: MinTTL(\n%s) = %s, want %s", i, msg.String(), got, tt.ttl)
+		}
+	}
 }
 
 func TestAnswers(t *testing.T) {
@@ -157,3 +192,703 @@ func TestExchange(t *testing.T) {
 		t.Errorf("got %s, want error", err)
 	}
 }
+
+type delayedClient struct {
+	delay  time.Duration
+	answer *dns.Msg
+	err    error
+}
+
+func (c *delayedClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.answer, nil
+}
+
+func TestExchangeAnswerWait(t *testing.T) {
+	one := newA("example.com.", 60, "192.0.2.1")
+	three := newA("example.com.", 60, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	two := newA("example.com.", 60, "192.0.2.1", "192.0.2.2")
+	clients := []Client{
+		&delayedClient{answer: one},
+		&delayedClient{delay: 20 * time.Millisecond, answer: three},
+		&delayedClient{delay: 10 * time.Millisecond, answer: two},
+		&delayedClient{delay: time.Second, answer: newA("example.com.", 60, "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4")},
+	}
+	var tests = []struct {
+		wait    time.Duration
+		answers int
+	}{
+		{0, 1},
+		{200 * time.Millisecond, 3},
+	}
+	for i, tt := range tests {
+		mux := NewMuxWithOptions(MuxOptions{AnswerWait: tt.wait}, clients...)
+		ts := time.Now()
+		r, err := mux.Exchange(&dns.Msg{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(r.Answer); got != tt.answers {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, tt.answers)
+		}
+		if d := time.Since(ts); d > tt.wait+100*time.Millisecond {
+			t.Errorf("#%d: Exchange took %s, want <= %s", i, d, tt.wait)
+		}
+	}
+}
+
+func TestExchangeSequential(t *testing.T) {
+	one := newA("example.com.", 60, "192.0.2.1")
+	two := newA("example.com.", 60, "192.0.2.1", "192.0.2.2")
+	timeout := &delayedClient{delay: 50 * time.Millisecond, err: errors.New("i/o timeout")}
+	var tests = []struct {
+		clients  []Client
+		deadline time.Duration
+		answers  int
+		err      string
+		min      time.Duration
+	}{
+		{[]Client{timeout, &delayedClient{answer: two}, &delayedClient{answer: one}}, 0, 2, "", 50 * time.Millisecond},
+		{[]Client{timeout, timeout, &delayedClient{answer: one}}, time.Second, 1, "", 100 * time.Millisecond},
+		{[]Client{timeout, &delayedClient{answer: one}}, 20 * time.Millisecond, 0, "no response within deadline of 20ms", 20 * time.Millisecond},
+		{[]Client{timeout, timeout}, 0, 0, "i/o timeout", 100 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		mux := NewMuxWithOptions(MuxOptions{Strategy: StrategySequential, Deadline: tt.deadline}, tt.clients...)
+		ts := time.Now()
+		r, err := mux.Exchange(&dns.Msg{})
+		d := time.Since(ts)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("#%d: err = %v, want %q", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: got error %s", i, err)
+		} else if got := len(r.Answer); got != tt.answers {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, tt.answers)
+		}
+		if d < tt.min {
+			t.Errorf("#%d: Exchange took %s, want >= %s", i, d, tt.min)
+		}
+		if tt.deadline > 0 && d > tt.deadline+100*time.Millisecond {
+			t.Errorf("#%d: Exchange took %s, want <= %s", i, d, tt.deadline)
+		}
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the lines written to b, in sorted order and with durations removed.
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := regexp.MustCompile(` in [0-9.]+[a-zµ]+`).ReplaceAllString(b.buf.String(), "")
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestExchangeAudit(t *testing.T) {
+	newClient := func(addr string, r resolver) *client {
+		c := NewClient(addr, Config{}).(*client)
+		c.resolver = r
+		return c
+	}
+	answered := newClient("192.0.2.1:53", &recordingResolver{})
+	failing := newClient("192.0.2.2:53", &failingResolver{err: errors.New("connection refused")})
+	slow := &delayedClient{delay: 50 * time.Millisecond, answer: newA("example.com.", 60, "192.0.2.1")}
+	var tests = []struct {
+		strategy int
+		clients  []Client
+		lines    []string
+	}{
+		{StrategyParallel, []Client{slow, answered, failing}, []string{
+			"query 42 for A example.com.: #0 answered NOERROR",
+			"query 42 for A example.com.: 192.0.2.1:53 answered NOERROR (used)",
+			"query 42 for A example.com.: 192.0.2.2:53 failed: resolver 192.0.2.2:53 failed: connection refused",
+		}},
+		{StrategySequential, []Client{failing, answered, slow}, []string{
+			"query 42 for A example.com.: 192.0.2.1:53 answered NOERROR (used)",
+			"query 42 for A example.com.: 192.0.2.2:53 failed: resolver 192.0.2.2:53 failed: connection refused",
+		}},
+	}
+	for i, tt := range tests {
+		var buf syncBuffer
+		mux := NewMuxWithOptions(MuxOptions{Strategy: tt.strategy, AuditLogger: log.New(&buf, "", 0)}, tt.clients...)
+		msg := &dns.Msg{}
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Id = 42
+		if _, err := mux.Exchange(msg); err != nil {
+			t.Fatal(err)
+		}
+		// Parallel attempts are logged once all clients have responded
+		for deadline := time.Now().Add(2 * time.Second); len(buf.lines()) < len(tt.lines) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := buf.lines(); !reflect.DeepEqual(got, tt.lines) {
+			t.Errorf("#%d: got lines %q, want %q", i, got, tt.lines)
+		}
+	}
+}
+
+type countingClient struct {
+	mu      sync.Mutex
+	current int
+	max     int
+	calls   int
+}
+
+func (c *countingClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	c.mu.Lock()
+	c.calls++
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.current--
+	c.mu.Unlock()
+	return nil, errors.New("error")
+}
+
+func TestExchangeConcurrency(t *testing.T) {
+	client := &countingClient{}
+	clients := make([]Client, 10)
+	for i := range clients {
+		clients[i] = client
+	}
+	mux := NewMuxWithOptions(MuxOptions{Concurrency: 2}, clients...)
+	if _, err := mux.Exchange(&dns.Msg{}); err == nil {
+		t.Fatal("want error")
+	}
+	if got, want := client.calls, len(clients); got != want {
+		t.Errorf("calls = %d, want %d", got, want)
+	}
+	if got, want := client.max, 2; got != want {
+		t.Errorf("max concurrent exchanges = %d, want %d", got, want)
+	}
+}
+
+func TestReadResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := `# Generated by NetworkManager
+search example.com
+nameserver 192.0.2.1
+nameserver 2001:db8::1
+options ndots:2
+`
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1:53", "[2001:db8::1]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadResolvConf(%q) = %q, want %q", path, got, want)
+	}
+	if _, err := ReadResolvConf(filepath.Join(t.TempDir(), "nonexistent")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestSplitResolver(t *testing.T) {
+	var tests = []struct {
+		addr, network       string
+		outNetwork, outAddr string
+	}{
+		{"192.0.2.1:53", "", "", "192.0.2.1:53"},
+		{"192.0.2.1:853=example.com", "tcp-tls", "tcp-tls", "192.0.2.1:853=example.com"},
+		{"192.0.2.1:53", "udp", "", "192.0.2.1:53"},
+		{"udp://192.0.2.1", "tcp-tls", "", "192.0.2.1:53"},
+		{"udp://192.0.2.1:5353", "tcp-tls", "", "192.0.2.1:5353"},
+		{"udp://[2001:db8::1]", "", "", "[2001:db8::1]:53"},
+		{"tcp://192.0.2.1", "", "tcp", "192.0.2.1:53"},
+		{"tcp-tls://192.0.2.1=example.com", "", "tcp-tls", "192.0.2.1:853=example.com"},
+		{"https://dns.example.com/dns-query", "", "https", "https://dns.example.com/dns-query"},
+		{"http://dns.example.com/dns-query", "https", "https", "http://dns.example.com/dns-query"},
+	}
+	for i, tt := range tests {
+		network, addr := SplitResolver(tt.addr, tt.network)
+		if network != tt.outNetwork || addr != tt.outAddr {
+			t.Errorf("#%d: SplitResolver(%q, %q) = (%q, %q), want (%q, %q)", i, tt.addr, tt.network, network, addr, tt.outNetwork, tt.outAddr)
+		}
+	}
+}
+
+func TestNewClientMixedProtocols(t *testing.T) {
+	config := Config{Network: "tcp-tls", Timeout: time.Second}
+	addrs := []string{"udp://192.0.2.1", "https://dns.example.com/dns-query", "192.0.2.2:853"}
+	var clients []*client
+	for _, addr := range addrs {
+		clients = append(clients, NewClient(addr, config).(*client))
+	}
+	if got, ok := clients[0].resolver.(*dns.Client); !ok || got.Net != "" || clients[0].address != "192.0.2.1:53" {
+		t.Errorf("got resolver %+v for %s, want udp client", clients[0].resolver, clients[0].address)
+	}
+	if _, ok := clients[1].resolver.(*http.Client); !ok {
+		t.Errorf("got resolver %T for %s, want https client", clients[1].resolver, clients[1].address)
+	}
+	if got, ok := clients[2].resolver.(*dns.Client); !ok || got.Net != "tcp-tls" {
+		t.Errorf("got resolver %+v for %s, want tcp-tls client", clients[2].resolver, clients[2].address)
+	}
+}
+
+func TestNewClientFamily(t *testing.T) {
+	var tests = []struct {
+		addr    string
+		network string
+		family  int
+		want    string
+	}{
+		{"192.0.2.1:53", "", FamilyAuto, ""},
+		{"192.0.2.1:53", "", FamilyIPv4, "udp4"},
+		{"192.0.2.1:53", "", FamilyIPv6, "udp6"},
+		{"tcp://192.0.2.1", "", FamilyIPv4, "tcp4"},
+		{"192.0.2.1:853", "tcp-tls", FamilyIPv6, "tcp6-tls"},
+		{"https://dns.example.com/dns-query", "", FamilyAuto, "tcp"},
+		{"https://dns.example.com/dns-query", "", FamilyIPv4, "tcp4"},
+		{"https://dns.example.com/dns-query", "", FamilyIPv6, "tcp6"},
+	}
+	for i, tt := range tests {
+		c := NewClient(tt.addr, Config{Network: tt.network, Family: tt.family}).(*client)
+		var got string
+		switch r := c.resolver.(type) {
+		case *dns.Client:
+			got = r.Net
+		case *http.Client:
+			got = r.Network()
+		}
+		if got != tt.want {
+			t.Errorf("#%d: network = %q, want %q", i, got, tt.want)
+		}
+	}
+}
+
+type spoofingResolver struct{ id uint16 }
+
+func (r *spoofingResolver) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	reply.Id += r.id
+	return reply, 0, nil
+}
+
+func TestClientVerify(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	var tests = []struct {
+		id       uint16
+		verify   bool
+		rejected int64
+	}{
+		{0, true, 0},
+		{1, true, 1},
+		{1, false, 0},
+	}
+	for i, tt := range tests {
+		c := &client{resolver: &spoofingResolver{id: tt.id}, address: "192.0.2.1:53", verify: tt.verify}
+		_, err := c.Exchange(msg)
+		if rejected := c.Stats().RejectedResponses; rejected != tt.rejected {
+			t.Errorf("#%d: rejected = %d, want %d", i, rejected, tt.rejected)
+		}
+		if (err != nil) != (tt.rejected > 0) {
+			t.Errorf("#%d: err = %v, want error = %t", i, err, tt.rejected > 0)
+		}
+	}
+	if !NewClient("192.0.2.1:53", Config{}).(*client).verify {
+		t.Error("expected udp client to verify responses")
+	}
+}
+
+// echoingResolver answers queries with a copy of the query, modified by f if set.
+type echoingResolver struct{ f func(*dns.Msg) }
+
+func (r *echoingResolver) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	reply := msg.Copy()
+	if r.f != nil {
+		r.f(reply)
+	}
+	return reply, 0, nil
+}
+
+func TestClientNonResponse(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	var tests = []struct {
+		resolver resolver
+		err      string
+	}{
+		{&echoingResolver{}, "resolver 192.0.2.1:53 failed: message is not a response"},
+		{&echoingResolver{f: func(r *dns.Msg) { r.Response = true; r.Opcode = dns.OpcodeStatus }},
+			"resolver 192.0.2.1:53 failed: response opcode STATUS does not match query opcode QUERY"},
+		{&spoofingResolver{}, ""},
+	}
+	for i, tt := range tests {
+		// Applies regardless of whether responses are verified
+		c := &client{resolver: tt.resolver, address: "192.0.2.1:53"}
+		_, err := c.Exchange(msg)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: err = %q, want %q", i, got, tt.err)
+		}
+		var want int64
+		if tt.err != "" {
+			want = 1
+		}
+		if rejected := c.Stats().RejectedResponses; rejected != want {
+			t.Errorf("#%d: rejected = %d, want %d", i, rejected, want)
+		}
+	}
+
+	// Fails over to the next resolver
+	c1 := &client{resolver: &echoingResolver{}, address: "192.0.2.1:53"}
+	c2 := &client{resolver: &spoofingResolver{}, address: "192.0.2.2:53"}
+	mux := NewMuxWithOptions(MuxOptions{Strategy: StrategySequential}, c1, c2)
+	r, err := mux.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Response {
+		t.Errorf("got non-response %s, want response", r)
+	}
+}
+
+type recordingResolver struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (r *recordingResolver) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = append(r.addrs, addr)
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	return reply, 0, nil
+}
+
+func TestClientRateLimit(t *testing.T) {
+	resolver := &recordingResolver{}
+	c1 := NewClient("192.0.2.1:53", Config{RateLimit: 2}).(*client)
+	c1.resolver = resolver
+	c2 := NewClient("192.0.2.2:53", Config{}).(*client)
+	c2.resolver = resolver
+	now := time.Now()
+	c1.limiter.now = func() time.Time { return now }
+	mux := NewMuxWithOptions(MuxOptions{Strategy: StrategySequential}, c1, c2)
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	exchange := func() {
+		if _, err := mux.Exchange(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		exchange()
+	}
+	// Tokens are refilled as time passes
+	now = now.Add(500 * time.Millisecond)
+	exchange()
+	exchange()
+	want := []string{"192.0.2.1:53", "192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53", "192.0.2.2:53"}
+	if !reflect.DeepEqual(resolver.addrs, want) {
+		t.Errorf("got %q, want %q", resolver.addrs, want)
+	}
+	if _, err := c1.Exchange(msg); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v, want %v", err, ErrRateLimited)
+	}
+}
+
+// badVersResolver answers queries using an EDNS version above version with BADVERS. A negative version answers all
+// queries using EDNS with BADVERS.
+type badVersResolver struct {
+	version  int
+	versions []int
+}
+
+func (r *badVersResolver) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	version := -1
+	if opt := msg.IsEdns0(); opt != nil {
+		version = int(opt.Version())
+	}
+	r.versions = append(r.versions, version)
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	if version > r.version {
+		reply.Rcode = dns.RcodeBadVers
+	}
+	return reply, 0, nil
+}
+
+func TestClientBadVers(t *testing.T) {
+	var tests = []struct {
+		query    int
+		resolver int
+		rcode    int
+		versions []int
+	}{
+		{0, 0, dns.RcodeSuccess, []int{0}},
+		{1, 0, dns.RcodeSuccess, []int{1, 0}},
+		{0, -1, dns.RcodeSuccess, []int{0, -1}},
+		{1, -1, dns.RcodeSuccess, []int{1, 0, -1}},
+		{-1, -2, dns.RcodeBadVers, []int{-1}},
+	}
+	for i, tt := range tests {
+		resolver := &badVersResolver{version: tt.resolver}
+		c := NewClient("192.0.2.1:53", Config{}).(*client)
+		c.resolver = resolver
+		msg := &dns.Msg{}
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if tt.query >= 0 {
+			msg.SetEdns0(4096, false)
+			msg.IsEdns0().SetVersion(uint8(tt.query))
+		}
+		r, err := c.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if !reflect.DeepEqual(resolver.versions, tt.versions) {
+			t.Errorf("#%d: exchanged EDNS versions %v, want %v", i, resolver.versions, tt.versions)
+		}
+		if opt := msg.IsEdns0(); tt.query >= 0 && (opt == nil || int(opt.Version()) != tt.query) {
+			t.Errorf("#%d: query was modified", i)
+		}
+	}
+}
+
+type failingResolver struct{ err error }
+
+func (r *failingResolver) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return nil, 0, r.err
+}
+
+func TestClientStats(t *testing.T) {
+	newClient := func(addr string, r resolver) *client {
+		c := NewClient(addr, Config{}).(*client)
+		c.resolver = r
+		return c
+	}
+	ok := newClient("192.0.2.1:53", &recordingResolver{})
+	failing := newClient("192.0.2.2:53", &failingResolver{err: errors.New("connection refused")})
+	timeout := newClient("192.0.2.3:53", &failingResolver{err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}})
+	spoofed := newClient("192.0.2.4:53", &spoofingResolver{id: 1})
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 2
+	for _, c := range []*client{ok, ok, failing, timeout, timeout, spoofed} {
+		c.Exchange(msg)
+	}
+
+	m := NewMux(ok, failing, timeout, spoofed).(*mux)
+	stats := m.Stats()
+	if got, want := stats.RejectedResponses, int64(1); got != want {
+		t.Errorf("RejectedResponses = %d, want %d", got, want)
+	}
+	got := stats.Resolvers
+	for addr, rs := range got { // Latency varies
+		rs.AvgLatency = 0
+		rs.totalLatency = 0
+		got[addr] = rs
+	}
+	want := map[string]ResolverStats{
+		"192.0.2.1:53": {Queries: 2, Successes: 2},
+		"192.0.2.2:53": {Queries: 1, Errors: 1},
+		"192.0.2.3:53": {Queries: 2, Errors: 2, Timeouts: 2},
+		"192.0.2.4:53": {Queries: 1, Errors: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolvers = %+v, want %+v", got, want)
+	}
+
+	// Clients of another mux are counted separately, even when they share an address
+	other := NewMux(newClient("192.0.2.1:53", &recordingResolver{})).(*mux)
+	other.Exchange(msg)
+	if got, want := m.Stats().Resolvers["192.0.2.1:53"].Queries, int64(2); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	if got, want := other.Stats().Resolvers["192.0.2.1:53"].Queries, int64(1); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+
+	m.ResetStats()
+	if got, want := m.Stats(), (Stats{Resolvers: map[string]ResolverStats{
+		"192.0.2.1:53": {}, "192.0.2.2:53": {}, "192.0.2.3:53": {}, "192.0.2.4:53": {},
+	}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if got, want := other.Stats().Resolvers["192.0.2.1:53"].Queries, int64(1); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	mu      sync.Mutex
+	accepts int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.accepts++
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *countingListener) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accepts
+}
+
+func TestClientPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: ln}
+	started := make(chan bool)
+	server := &dns.Server{
+		Listener:          listener,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name == "slow.example.com." {
+				return // Never reply
+			}
+			m := &dns.Msg{}
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	c := NewClient("tcp://"+ln.Addr().String(), Config{PoolSize: 2, PoolIdleTimeout: time.Minute, Timeout: 500 * time.Millisecond})
+	p, ok := c.(*client).resolver.(*pool)
+	if !ok {
+		t.Fatalf("got resolver %T, want %T", c.(*client).resolver, p)
+	}
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	exchange := func() {
+		msg := &dns.Msg{}
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := c.Exchange(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		exchange()
+	}
+	if got, want := listener.count(), 1; got != want {
+		t.Errorf("got %d connections, want %d", got, want)
+	}
+
+	// Idle connection expires
+	now = now.Add(2 * time.Minute)
+	exchange()
+	if got, want := listener.count(), 2; got != want {
+		t.Errorf("got %d connections, want %d", got, want)
+	}
+
+	// Closed idle connection is retried over a new connection
+	p.idle[0].conn.Close()
+	exchange()
+	if got, want := listener.count(), 3; got != want {
+		t.Errorf("got %d connections, want %d", got, want)
+	}
+
+	// Other failures are not retried
+	msg := &dns.Msg{}
+	msg.SetQuestion("slow.example.com.", dns.TypeA)
+	if _, err := c.Exchange(msg); err == nil {
+		t.Error("want error")
+	}
+	if got, want := p.dials, int64(3); got != want {
+		t.Errorf("got %d dials, want %d", got, want)
+	}
+
+	// Waiting for an exhausted pool times out
+	p.slots <- struct{}{}
+	p.slots <- struct{}{}
+	_, err = c.Exchange(msg)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got error %v, want timeout", err)
+	}
+	<-p.slots
+	<-p.slots
+
+	// Expired idle connections are closed when a connection is returned
+	conn1, err := p.dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put(conn1)
+	now = now.Add(2 * time.Minute)
+	conn2, err := p.dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put(conn2)
+	if got, want := len(p.idle), 1; got != want {
+		t.Errorf("got %d idle connections, want %d", got, want)
+	}
+
+	// Pooling only applies to connection-oriented networks
+	if _, ok := NewClient("192.0.2.1:53", Config{PoolSize: 2}).(*client).resolver.(*pool); ok {
+		t.Error("want no pool for udp client")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	reply := func(f func(*dns.Msg)) *dns.Msg {
+		r := &dns.Msg{}
+		r.SetReply(msg)
+		f(r)
+		return r
+	}
+	var tests = []struct {
+		reply *dns.Msg
+		ok    bool
+	}{
+		{reply(func(r *dns.Msg) {}), true},
+		{reply(func(r *dns.Msg) { r.Question[0].Name = "EXAMPLE.com." }), true},
+		{reply(func(r *dns.Msg) { r.Id++ }), false},
+		{reply(func(r *dns.Msg) { r.Question[0].Name = "example.org." }), false},
+		{reply(func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAAAA }), false},
+		{reply(func(r *dns.Msg) { r.Question = nil }), false},
+	}
+	for i, tt := range tests {
+		if err := verify(msg, tt.reply); (err == nil) != tt.ok {
+			t.Errorf("#%d: verify() = %v, want ok = %t", i, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package dnsutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pooledConn is an idle connection in a pool.
+type pooledConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// pool is a resolver reusing connections to a single address across exchanges. It is used for connection-oriented
+// networks, where opening a new connection per exchange is costly.
+type pool struct {
+	client      *dns.Client
+	idleTimeout time.Duration
+	slots       chan struct{}
+	mu          sync.Mutex
+	idle        []pooledConn
+	dials       int64
+	now         func() time.Time
+}
+
+// newPool creates a new pool of at most size connections made by client. Connections idle for longer than
+// idleTimeout are closed instead of reused. Zero means no idle timeout.
+func newPool(client *dns.Client, size int, idleTimeout time.Duration) *pool {
+	return &pool{
+		client:      client,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, size),
+		now:         time.Now,
+	}
+}
+
+func (p *pool) expired(c pooledConn, now time.Time) bool {
+	return p.idleTimeout > 0 && now.Sub(c.since) > p.idleTimeout
+}
+
+// get returns an idle connection, if any. Expired idle connections are closed.
+func (p *pool) get() (*dns.Conn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for len(p.idle) > 0 {
+		last := len(p.idle) - 1
+		c := p.idle[last]
+		p.idle = p.idle[:last]
+		if p.expired(c, now) {
+			c.conn.Close()
+			continue
+		}
+		return c.conn, true
+	}
+	return nil, false
+}
+
+// put returns conn to the idle connections of the pool. Expired idle connections are closed, so that they are not
+// kept open until the pool is exhausted.
+func (p *pool) put(conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if p.expired(c, now) {
+			c.conn.Close()
+			continue
+		}
+		idle = append(idle, c)
+	}
+	p.idle = append(idle, pooledConn{conn: conn, since: now})
+}
+
+func (p *pool) dial(addr string) (*dns.Conn, error) {
+	p.mu.Lock()
+	p.dials++
+	p.mu.Unlock()
+	return p.client.Dial(addr)
+}
+
+// waitTimeout returns the maximum duration to wait for a connection to become available.
+func (p *pool) waitTimeout() time.Duration {
+	if p.client.Timeout > 0 {
+		return p.client.Timeout
+	}
+	return 2 * time.Second // Default timeout of dns.Client
+}
+
+// Exchange sends msg over a pooled connection to addr. The exchange waits for a connection to become available if
+// the pool is exhausted, for at most the timeout of the client. An idle connection that was closed, e.g. by the
+// server, is retried once over a new connection.
+func (p *pool) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	timer := time.NewTimer(p.waitTimeout())
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, 0, fmt.Errorf("no pooled connection available: %w", os.ErrDeadlineExceeded)
+	}
+	defer func() { <-p.slots }()
+	conn, reused := p.get()
+	if !reused {
+		var err error
+		conn, err = p.dial(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	r, rtt, err := p.client.ExchangeWithConn(msg, conn)
+	if err != nil && reused && isClosed(err) {
+		conn.Close()
+		conn, err = p.dial(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, rtt, err = p.client.ExchangeWithConn(msg, conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	p.put(conn)
+	return r, rtt, nil
+}
+
+// isClosed returns whether err is caused by using a connection that has been closed by either end.
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,40 @@
+package dnsutil
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket limiting the rate of queries sent to a single resolver.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newBucket creates a new bucket allowing rate queries per second. The bucket starts full, allowing bursts of up to
+// rate queries.
+func newBucket(rate int) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), now: time.Now}
+}
+
+// take takes a token from the bucket, and returns whether one was available.
+func (b *bucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flight represents an upstream exchange in progress.
+type flight struct {
+	wg   sync.WaitGroup
+	msg  *dns.Msg
+	err  error
+	dups int
+}
+
+// flightGroup collapses concurrent exchanges for the same key into a single exchange.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[uint64]*flight
+}
+
+func newFlightGroup() *flightGroup { return &flightGroup{flights: make(map[uint64]*flight)} }
+
+// do calls fn and returns its result, unless a call for key is already in progress, in which case the result of that
+// call is awaited and returned instead. The shared return value reports whether the result was given to multiple
+// callers.
+func (g *flightGroup) do(key uint64, fn func() (*dns.Msg, error)) (msg *dns.Msg, shared bool, err error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.dups++
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.msg, true, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.msg, f.err = fn()
+	g.mu.Lock()
+	delete(g.flights, key)
+	shared = f.dups > 0
+	g.mu.Unlock()
+	f.wg.Done()
+	return f.msg, shared, f.err
+}
+
+func (g *flightGroup) waiting(key uint64) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f.dups
+	}
+	return 0
+}
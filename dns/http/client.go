@@ -2,10 +2,14 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,14 +24,57 @@ const mimeType = "application/dns-udpwireformat"
 
 // Client is a DNS-over-HTTPS client.
 type Client struct {
+	mu         sync.Mutex
 	httpClient *http.Client
+	timeout    time.Duration
+	network    string
 }
 
 // NewClient creates a new DNS-over-HTTPS client.
-func NewClient(timeout time.Duration) *Client {
-	return &Client{httpClient: &http.Client{Timeout: timeout}}
+func NewClient(timeout time.Duration) *Client { return NewClientWithNetwork(timeout, "tcp") }
+
+// NewClientWithNetwork creates a new DNS-over-HTTPS client that only connects over network, which is one of "tcp",
+// "tcp4" or "tcp6".
+func NewClientWithNetwork(timeout time.Duration, network string) *Client {
+	c := &Client{timeout: timeout, network: network}
+	c.httpClient = c.newHTTPClient()
+	return c
+}
+
+// newHTTPClient returns a HTTP client with a transport of its own, such that its connections can be discarded
+// without affecting other clients.
+func (c *Client) newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.network != "tcp" {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, c.network, addr)
+		}
+	}
+	return &http.Client{Timeout: c.timeout, Transport: transport}
 }
 
+func (c *Client) client() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.httpClient
+}
+
+// reconnect replaces the failed HTTP client, unless it has been replaced already. Connections of the failed client
+// are closed, such that subsequent exchanges establish fresh connections.
+func (c *Client) reconnect(failed *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.httpClient != failed {
+		return
+	}
+	failed.CloseIdleConnections()
+	c.httpClient = c.newHTTPClient()
+}
+
+// Network returns the network used by client c.
+func (c *Client) Network() string { return c.network }
+
 // Exchange sends the DNS message msg to the DNS-over-HTTPS endpoint addr and returns the response.
 func (c *Client) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
 	u, err := url.Parse(addr)
@@ -40,17 +87,21 @@ func (c *Client) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, e
 		return nil, 0, err
 	}
 
-	r, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(p))
-	if err != nil {
-		return nil, 0, err
-	}
-	r.Header.Set("Content-Type", mimeType)
-	r.Header.Set("Accept", mimeType)
-
 	t := time.Now()
-	resp, err := c.httpClient.Do(r)
+	httpClient := c.client()
+	resp, err := do(httpClient, u, p)
 	if err != nil {
-		return nil, 0, err
+		// Connections may have gone stale, e.g. after a network change. Reconnect and retry once, unless the
+		// exchange timed out
+		c.reconnect(httpClient)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, 0, err
+		}
+		resp, err = do(c.client(), u, p)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 	defer resp.Body.Close()
 
@@ -72,3 +123,14 @@ func (c *Client) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, e
 	}
 	return &reply, rtt, nil
 }
+
+// do sends the packed DNS message p to u using httpClient.
+func do(httpClient *http.Client, u *url.URL, p []byte) (*http.Response, error) {
+	r, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", mimeType)
+	r.Header.Set("Accept", mimeType)
+	return httpClient.Do(r)
+}
@@ -3,9 +3,11 @@ package http
 import (
 	"encoding/hex"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -82,3 +84,56 @@ www.example.com.	128	IN	A	192.0.2.1
 		t.Errorf("got %s, want %s", got, want)
 	}
 }
+
+func TestExchangeReconnect(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		conns    int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		fail := requests == 2
+		mu.Unlock()
+		if fail {
+			// Simulate a stale connection by closing it without responding
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		handler(w, r)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	msg := dns.Msg{}
+	if err := msg.Unpack(hexDecode(request)); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		if _, _, err := client.Exchange(&msg, srv.URL); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := requests, 4; got != want {
+		t.Errorf("requests = %d, want %d", got, want)
+	}
+	if got, want := conns, 2; got != want {
+		t.Errorf("connections = %d, want %d", got, want)
+	}
+}
@@ -3,13 +3,17 @@ package dns
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns/dnsutil"
+	"github.com/mpolden/zdns/logfile"
 	"github.com/mpolden/zdns/sql"
 )
 
@@ -20,6 +24,78 @@ const (
 	TypeAAAA = dns.TypeAAAA
 )
 
+const (
+	// RateLimitRefuse responds with REFUSED to rate limited queries.
+	RateLimitRefuse = iota
+	// RateLimitTruncate responds with an empty truncated answer to rate limited queries.
+	RateLimitTruncate
+	// RateLimitDrop drops rate limited queries without responding.
+	RateLimitDrop
+)
+
+const (
+	// RootForward forwards queries for the root zone and top-level domains upstream.
+	RootForward = iota
+	// RootRefuse responds with REFUSED to queries for the root zone and top-level domains.
+	RootRefuse
+	// RootHints answers NS queries for the root zone with the root server hints, and responds with REFUSED to other
+	// queries for the root zone and top-level domains.
+	RootHints
+)
+
+const (
+	// OfflineServFail responds with SERVFAIL to queries that cannot be forwarded because there are no upstream
+	// resolvers.
+	OfflineServFail = iota
+	// OfflineRefuse responds with REFUSED to queries that cannot be forwarded.
+	OfflineRefuse
+	// OfflineNXDomain responds with NXDOMAIN to queries that cannot be forwarded.
+	OfflineNXDomain
+	// OfflineAddress answers A or AAAA queries that cannot be forwarded with a fallback address. Queries of other
+	// types, or of a type not matching the address family, receive an empty answer.
+	OfflineAddress
+)
+
+const (
+	// NonRecursiveForward forwards queries with the RD bit cleared as if recursion was desired.
+	NonRecursiveForward = iota
+	// NonRecursiveRefuse responds with REFUSED to queries with the RD bit cleared, unless they are answered locally.
+	NonRecursiveRefuse
+	// NonRecursiveCache answers queries with the RD bit cleared from local records and the cache only. Queries that
+	// are not cached receive REFUSED.
+	NonRecursiveCache
+)
+
+const (
+	// SpecialLocal answers queries for special-use names locally, as described in RFC 6761. Names in the localhost
+	// zone resolve to the loopback addresses, the loopback addresses resolve to localhost, and names in the invalid
+	// zone do not exist.
+	SpecialLocal = iota
+	// SpecialForward forwards queries for special-use names upstream, like any other query.
+	SpecialForward
+)
+
+const (
+	// WarmUpForward forwards queries missing the cache upstream during warm-up, like after warm-up.
+	WarmUpForward = iota
+	// WarmUpServFail responds with SERVFAIL to queries missing the cache during warm-up.
+	WarmUpServFail
+	// WarmUpStale answers queries from expired cache entries during warm-up, without refreshing them. Queries
+	// missing the cache are forwarded upstream.
+	WarmUpStale
+)
+
+// loopbackIPv6PTR is the reverse name of the IPv6 loopback address.
+var loopbackIPv6PTR, _ = dns.ReverseAddr("::1")
+
+// rootServers contains the names of the root servers, as published in the root hints file by IANA.
+var rootServers = []string{
+	"a.root-servers.net.", "b.root-servers.net.", "c.root-servers.net.", "d.root-servers.net.",
+	"e.root-servers.net.", "f.root-servers.net.", "g.root-servers.net.", "h.root-servers.net.",
+	"i.root-servers.net.", "j.root-servers.net.", "k.root-servers.net.", "l.root-servers.net.",
+	"m.root-servers.net.",
+}
+
 // Request represents a simplified DNS request.
 type Request struct {
 	Type uint16
@@ -27,28 +103,285 @@ type Request struct {
 }
 
 // Reply represents a simplifed DNS reply.
-type Reply struct{ rr []dns.RR }
+type Reply struct {
+	rr    []dns.RR
+	rcode int
+}
 
 // Handler represents the handler for a DNS request.
 type Handler func(*Request) *Reply
 
+// AnswerHandler represents the handler for the addresses answered by upstream to a DNS request. It returns the reply
+// replacing the upstream answer, or nil to keep the upstream answer.
+type AnswerHandler func(*Request, []net.IP) *Reply
+
 // Proxy represents a DNS proxy.
 type Proxy struct {
-	Handler Handler
-	cache   *cache.Cache
-	logger  *sql.Logger
-	server  *dns.Server
-	client  dnsutil.Client
-	mu      sync.RWMutex
+	Handler       Handler
+	AnswerHandler AnswerHandler
+	cache         *cache.Cache
+	logger        *sql.Logger
+	servers       []*dns.Server
+	client        dnsutil.Client
+	limiter       *limiter
+	slots         chan struct{}
+	flights       *flightGroup
+	stats         *stats
+	options       Options
+	mu            sync.RWMutex
+	randMu        sync.Mutex
+	rand          *rand.Rand
+
+	maintenance bool
+	warmUntil   time.Time
+}
+
+// Options configures optional behaviour of a Proxy.
+type Options struct {
+	// RateLimit is the maximum number of queries per second accepted from a single client. Zero means no limit.
+	RateLimit int
+	// RateLimitResponse determines how queries exceeding RateLimit are answered.
+	RateLimitResponse int
+	// MaxInFlight is the maximum number of queries handled concurrently. Zero means no limit.
+	MaxInFlight int
+	// OverloadResponse determines how queries exceeding MaxInFlight are answered. It accepts the same values as
+	// RateLimitResponse.
+	OverloadResponse int
+	// EDNSOptions is the list of EDNS option codes forwarded upstream. All other EDNS options are stripped from
+	// queries before forwarding them.
+	EDNSOptions []uint16
+	// StripDNSSEC removes DNSSEC records from replies before they are sent to clients.
+	StripDNSSEC bool
+	// MinimalResponses removes records from the authority and additional sections of replies before they are sent
+	// to clients. The SOA record of negative replies, and the OPT record, are kept.
+	MinimalResponses bool
+	// PreserveQueryCase spells the question name, and owner names equal to the query name except for case, of
+	// replies in the case of the query. Some upstreams reply with a differently cased name, which confuses clients
+	// that compare names case-sensitively.
+	PreserveQueryCase bool
+	// StripOutOfBailiwick removes records in the authority and additional sections of upstream replies that are
+	// outside the bailiwick of the query, before caching and replying.
+	StripOutOfBailiwick bool
+	// ShuffleAnswers randomizes the order of records within each record set in the answer section of replies.
+	ShuffleAnswers bool
+	// ShuffleSeed is the seed used when shuffling answers. Zero means a time-based seed.
+	ShuffleSeed int64
+	// QueryTimeout is the maximum duration of resolving a query, after which the query is answered with SERVFAIL.
+	// Resolution continues in the background, such that a late upstream answer is still cached. Zero means no
+	// timeout.
+	QueryTimeout time.Duration
+	// DisableCache forwards all queries without answering from or adding to the cache. The cache is never accessed.
+	DisableCache bool
+	// Deduplicate collapses concurrent identical queries that miss the cache into a single upstream exchange.
+	Deduplicate bool
+	// MaxAnswers is the maximum number of records in the answer section of replies. Replies with more answers are
+	// trimmed to the first MaxAnswers records, both before caching and before replying. Zero means no limit.
+	MaxAnswers int
+	// RemoveDuplicateAnswers removes identical records from the answer section of replies, both before caching and
+	// before replying. The first occurrence of each record is kept.
+	RemoveDuplicateAnswers bool
+	// UDPReaders is the number of goroutines reading packets in parallel from each UDP socket. Values less than 2
+	// mean a single reader.
+	UDPReaders int
+	// RootQueries determines how queries for the root zone and top-level domains are answered.
+	RootQueries int
+	// NonRecursive determines how queries with the RD bit cleared are answered. Queries answered by Handler or as
+	// root queries are not affected.
+	NonRecursive int
+	// SpecialNames determines how queries for the special-use names localhost and invalid, and for the reverse names
+	// of the loopback addresses, are answered. Queries answered by Handler are not affected.
+	SpecialNames int
+	// TraceLogger logs each step taken to resolve a query, prefixed with an ID unique to the query. Nil disables
+	// tracing.
+	TraceLogger *log.Logger
+	// FileLogger logs each answered query to a file, in addition to the logger given to the proxy. Nil disables
+	// logging to file.
+	FileLogger *logfile.Logger
+	// Offline determines how queries are answered when there is no upstream client, i.e. the client given to the
+	// proxy is nil. Queries answered by Handler or by a route are not affected. Offline also determines how queries
+	// missing the cache are answered in maintenance mode.
+	Offline int
+	// OfflineAddress is the fallback address used when Offline is OfflineAddress.
+	OfflineAddress net.IP
+	// Fallback answers queries as a last resort when all upstream resolvers failed, when QueryTimeout is exceeded, or
+	// when a query would otherwise be answered according to Offline. Fallback answers are not cached. Nil disables fallback.
+	Fallback Records
+	// Routes forwards queries from particular client networks, for particular zones or of particular types to other
+	// upstream clients. The first route matching the query is used. Queries not matching any route are forwarded to
+	// the default client.
+	Routes []Route
+	// SearchDomain is appended to single-label query names before they are resolved, e.g. a query for nas is
+	// resolved as nas.home.lan. Empty means no search domain.
+	SearchDomain string
+	// Rewrites maps name suffixes to the suffixes they are rewritten to before a query is resolved. The longest
+	// matching suffix applies. Names matching a rewrite are not expanded with SearchDomain.
+	Rewrites map[string]string
+	// LocalZones lists zones, such as local. or internal., that are never forwarded upstream. Queries for names in a
+	// local zone that are not answered by Handler or forwarded by a matching route receive NXDOMAIN, instead of leaking
+	// to upstream resolvers.
+	LocalZones []string
+	// ECSCache caches answers to queries carrying an EDNS client subnet option separately for each client subnet,
+	// unless the upstream answer applies to all subnets. The subnet forwarded upstream is truncated to at most
+	// ECSPrefixIPv4 or ECSPrefixIPv6 bits, which also bounds the number of cache entries per name. Client subnet options
+	// are only forwarded if allowed by EDNSOptions.
+	ECSCache bool
+	// ECSPrefixIPv4 is the maximum prefix length of IPv4 client subnets used when ECSCache is set.
+	ECSPrefixIPv4 int
+	// ECSPrefixIPv6 is the maximum prefix length of IPv6 client subnets used when ECSCache is set.
+	ECSPrefixIPv6 int
+	// RewriteFallback resolves the original name of a rewritten query if resolving the rewritten name fails or
+	// results in NXDOMAIN.
+	RewriteFallback bool
+	// WarmUp is the duration after the proxy is created during which queries are answered according to WarmUpMode,
+	// to avoid flooding upstream resolvers while the cache is cold. Zero disables warm-up. Warm-up has no effect if
+	// the cache is disabled.
+	WarmUp time.Duration
+	// WarmUpMode determines how queries are answered during warm-up.
+	WarmUpMode int
+}
+
+// Route forwards queries matching all of its non-empty criteria to Client. A query matches if it is sent from a
+// client in any of the networks Networks, its name is in any of the zones Zones and its type is any of Types. For
+// example, reverse lookups of private addresses can be routed to an internal resolver by setting Zones to
+// 10.in-addr.arpa. and Types to PTR.
+type Route struct {
+	Networks []*net.IPNet
+	Zones    []string
+	Types    []uint16
+	Client   dnsutil.Client
+}
+
+// matches returns whether a query for q from ip matches route r.
+func (r *Route) matches(ip net.IP, q dns.Question) bool {
+	if len(r.Networks) > 0 {
+		match := false
+		for _, ipNet := range r.Networks {
+			if ipNet.Contains(ip) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(r.Zones) > 0 {
+		name := dns.CanonicalName(q.Name)
+		match := false
+		for _, zone := range r.Zones {
+			if dns.IsSubDomain(zone, name) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(r.Types) > 0 {
+		for _, qtype := range r.Types {
+			if qtype == q.Qtype {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
 
 // NewProxy creates a new DNS proxy.
 func NewProxy(cache *cache.Cache, client dnsutil.Client, logger *sql.Logger) (*Proxy, error) {
-	return &Proxy{
-		logger: logger,
-		cache:  cache,
-		client: client,
-	}, nil
+	return NewProxyWithOptions(cache, client, logger, Options{})
+}
+
+// NewProxyWithOptions creates a new DNS proxy that behaves according to options.
+func NewProxyWithOptions(cache *cache.Cache, client dnsutil.Client, logger *sql.Logger, options Options) (*Proxy, error) {
+	if options.RateLimit < 0 {
+		return nil, fmt.Errorf("rate limit must be >= 0")
+	}
+	if options.MaxAnswers < 0 {
+		return nil, fmt.Errorf("max answers must be >= 0")
+	}
+	if options.MaxInFlight < 0 {
+		return nil, fmt.Errorf("max in-flight queries must be >= 0")
+	}
+	if options.ECSPrefixIPv4 < 0 || options.ECSPrefixIPv4 > 32 {
+		return nil, fmt.Errorf("ecs ipv4 prefix must be between 0 and 32")
+	}
+	if options.ECSPrefixIPv6 < 0 || options.ECSPrefixIPv6 > 128 {
+		return nil, fmt.Errorf("ecs ipv6 prefix must be between 0 and 128")
+	}
+	if options.SearchDomain != "" {
+		options.SearchDomain = dns.CanonicalName(options.SearchDomain)
+		if !validSuffix(options.SearchDomain) {
+			return nil, fmt.Errorf("invalid search domain: %s", options.SearchDomain)
+		}
+	}
+	if options.Rewrites != nil {
+		rewrites := make(map[string]string, len(options.Rewrites))
+		for from, to := range options.Rewrites {
+			from, to = dns.CanonicalName(from), dns.CanonicalName(to)
+			if !validSuffix(from) || !validSuffix(to) {
+				return nil, fmt.Errorf("invalid rewrite: %s -> %s", from, to)
+			}
+			rewrites[from] = to
+		}
+		options.Rewrites = rewrites
+	}
+	if options.LocalZones != nil {
+		zones := make([]string, 0, len(options.LocalZones))
+		for _, zone := range options.LocalZones {
+			zone = dns.CanonicalName(zone)
+			if !validSuffix(zone) {
+				return nil, fmt.Errorf("invalid local zone: %s", zone)
+			}
+			zones = append(zones, zone)
+		}
+		options.LocalZones = zones
+	}
+	if options.Routes != nil {
+		routes := make([]Route, 0, len(options.Routes))
+		for _, route := range options.Routes {
+			zones := make([]string, 0, len(route.Zones))
+			for _, zone := range route.Zones {
+				zone = dns.CanonicalName(zone)
+				if !validSuffix(zone) {
+					return nil, fmt.Errorf("invalid route zone: %s", zone)
+				}
+				zones = append(zones, zone)
+			}
+			route.Zones = zones
+			routes = append(routes, route)
+		}
+		options.Routes = routes
+	}
+	p := &Proxy{
+		logger:  logger,
+		cache:   cache,
+		client:  client,
+		stats:   newStats(),
+		options: options,
+	}
+	if options.RateLimit > 0 {
+		p.limiter = newLimiter(options.RateLimit)
+	}
+	if options.MaxInFlight > 0 {
+		p.slots = make(chan struct{}, options.MaxInFlight)
+	}
+	if options.Deduplicate {
+		p.flights = newFlightGroup()
+	}
+	if options.WarmUp > 0 {
+		p.warmUntil = time.Now().Add(options.WarmUp)
+	}
+	if options.ShuffleAnswers {
+		seed := options.ShuffleSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		p.rand = rand.New(rand.NewSource(seed))
+	}
+	return p, nil
 }
 
 // ReplyA creates a resource record of type A.
@@ -60,7 +393,7 @@ func ReplyA(name string, ipAddr ...net.IP) *Reply {
 			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
 		})
 	}
-	return &Reply{rr}
+	return &Reply{rr: rr}
 }
 
 // ReplyAAAA creates a resource record of type AAAA.
@@ -72,7 +405,18 @@ func ReplyAAAA(name string, ipAddr ...net.IP) *Reply {
 			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600},
 		})
 	}
-	return &Reply{rr}
+	return &Reply{rr: rr}
+}
+
+// ReplyNXDomain creates a reply indicating that the requested name does not exist.
+func ReplyNXDomain() *Reply { return &Reply{rcode: dns.RcodeNameError} }
+
+// SetTTL sets the TTL of all resource records in reply r.
+func (r *Reply) SetTTL(ttl uint32) *Reply {
+	for _, rr := range r.rr {
+		rr.Header().Ttl = ttl
+	}
+	return r
 }
 
 func (r *Reply) String() string {
@@ -97,66 +441,1152 @@ func (p *Proxy) reply(r *dns.Msg) *dns.Msg {
 	if reply == nil {
 		return nil
 	}
+	return replyMsg(r, reply)
+}
+
+// answerReply returns the reply replacing the upstream answer msg to r, if any.
+func (p *Proxy) answerReply(r, msg *dns.Msg) *dns.Msg {
+	if p.AnswerHandler == nil || len(r.Question) != 1 {
+		return nil
+	}
+	var ipAddrs []net.IP
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			ipAddrs = append(ipAddrs, v.A)
+		case *dns.AAAA:
+			ipAddrs = append(ipAddrs, v.AAAA)
+		}
+	}
+	if len(ipAddrs) == 0 {
+		return nil
+	}
+	reply := p.AnswerHandler(&Request{
+		Name: r.Question[0].Name,
+		Type: r.Question[0].Qtype,
+	}, ipAddrs)
+	if reply == nil {
+		return nil
+	}
+	return replyMsg(r, reply)
+}
+
+// replyMsg returns the DNS message answering r with reply.
+func replyMsg(r *dns.Msg, reply *Reply) *dns.Msg {
 	m := dns.Msg{Answer: reply.rr}
-	// Pretend this is an recursive answer
-	m.RecursionAvailable = true
-	m.SetReply(r)
+	m.SetRcode(r, reply.rcode)
+	setFlags(&m, true)
 	return &m
 }
 
+// setFlags sets the header flags of msg according to its source. Answers from local records are authoritative, while
+// forwarded answers are not. Recursion is available in both cases.
+func setFlags(msg *dns.Msg, local bool) {
+	msg.Authoritative = local
+	msg.RecursionAvailable = true
+}
+
+// Stats returns the number of queries received by query type, and responses sent by response code.
+func (p *Proxy) Stats() Stats { return p.stats.read() }
+
+// ResetStats resets the statistics of proxy p.
+func (p *Proxy) ResetStats() { p.stats.reset() }
+
+// SetMaintenance enables or disables maintenance mode. In maintenance mode, queries are answered from local records
+// and the cache only. Nothing is forwarded upstream, and queries that cannot be answered locally are answered as
+// determined by the Offline option.
+func (p *Proxy) SetMaintenance(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maintenance = enabled
+}
+
+// Maintenance reports whether maintenance mode is enabled.
+func (p *Proxy) Maintenance() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.maintenance
+}
+
+// ToggleMaintenance toggles maintenance mode and reports whether it is now enabled.
+func (p *Proxy) ToggleMaintenance() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maintenance = !p.maintenance
+	return p.maintenance
+}
+
+// WarmingUp reports whether the proxy is warming up, i.e. whether queries missing the cache are answered according to
+// the WarmUpMode option.
+func (p *Proxy) WarmingUp() bool {
+	return p.options.WarmUpMode != WarmUpForward && time.Now().Before(p.warmUntil)
+}
+
 // Close closes the proxy.
 func (p *Proxy) Close() error {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	if p.server != nil {
-		return p.server.Shutdown()
+	var err error
+	for _, server := range p.servers {
+		if err1 := server.Shutdown(); err == nil {
+			err = err1
+		}
 	}
-	return nil
+	return err
 }
 
-func (p *Proxy) writeMsg(w dns.ResponseWriter, msg *dns.Msg, hijacked bool) {
-	var ip net.IP
+func remoteIP(w dns.ResponseWriter) net.IP {
 	switch v := w.RemoteAddr().(type) {
 	case *net.UDPAddr:
-		ip = v.IP
+		return v.IP
 	case *net.TCPAddr:
-		ip = v.IP
+		return v.IP
+	case *net.UnixAddr:
+		return net.IPv4(127, 0, 0, 1) // Unix socket clients are always local
 	default:
 		panic(fmt.Sprintf("unexpected remote address type %T", v))
 	}
+}
+
+func (p *Proxy) rateLimited(w dns.ResponseWriter, r *dns.Msg) bool {
+	if p.limiter == nil || p.limiter.allow(remoteIP(w)) {
+		return false
+	}
+	writeLimited(w, r, p.options.RateLimitResponse)
+	return true
+}
+
+// acquire reserves a slot for handling a query. It returns false if all slots are taken.
+func (p *Proxy) acquire() bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot reserved by acquire.
+func (p *Proxy) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// writeLimited answers query r, which was not handled due to a limit, according to response.
+func writeLimited(w dns.ResponseWriter, r *dns.Msg, response int) {
+	m := dns.Msg{}
+	switch response {
+	case RateLimitRefuse:
+		m.SetRcode(r, dns.RcodeRefused)
+	case RateLimitTruncate:
+		m.SetReply(r)
+		m.Truncated = true
+	case RateLimitDrop:
+		return
+	}
+	setFlags(&m, false)
+	w.WriteMsg(&m)
+}
+
+const (
+	// maxLabels is the maximum number of labels in a domain name, excluding the root label.
+	maxLabels = 127
+	// maxNameOctets is the maximum length of a domain name in wire format.
+	maxNameOctets = 255
+)
+
+// malformed returns whether the name of any question in query r exceeds 255 octets or 127 labels, or is otherwise
+// not a valid domain name.
+func malformed(r *dns.Msg) bool {
+	var buf [maxNameOctets + 1]byte
+	for _, q := range r.Question {
+		if labels, ok := dns.IsDomainName(q.Name); !ok || labels > maxLabels {
+			return true
+		}
+		if n, err := dns.PackDomainName(q.Name, buf[:], 0, nil, false); err != nil || n > maxNameOctets {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFormErr answers query r with FORMERR. The question section is left out, as it cannot be packed.
+func writeFormErr(w dns.ResponseWriter, r *dns.Msg) {
+	m := dns.Msg{}
+	m.SetRcode(r, dns.RcodeFormatError)
+	m.Question = nil
+	setFlags(&m, false)
+	w.WriteMsg(&m)
+}
+
+func (p *Proxy) writeMsg(w dns.ResponseWriter, msg *dns.Msg, hijacked bool) {
+	w.WriteMsg(msg) // Reply before logging, such that logging never delays the reply
 	if p.logger != nil {
-		p.logger.Record(ip, hijacked, msg.Question[0].Qtype, msg.Question[0].Name, dnsutil.Answers(msg)...)
+		p.logger.Record(remoteIP(w), hijacked, msg.Question[0].Qtype, msg.Question[0].Name, dnsutil.Answers(msg)...)
+	}
+	if p.options.FileLogger != nil {
+		p.options.FileLogger.Record(remoteIP(w), hijacked, msg.Question[0].Qtype, msg.Question[0].Name, dnsutil.Answers(msg)...)
+	}
+}
+
+// shuffleAnswers returns a copy of msg where the order of records is randomized within each record set of the answer
+// section. The order of record sets is preserved, such that a CNAME is still followed by its target.
+func (p *Proxy) shuffleAnswers(msg *dns.Msg) *dns.Msg {
+	if len(msg.Answer) < 2 {
+		return msg
+	}
+	m := *msg
+	m.Answer = make([]dns.RR, len(msg.Answer))
+	copy(m.Answer, msg.Answer)
+	p.randMu.Lock()
+	defer p.randMu.Unlock()
+	for start := 0; start < len(m.Answer); {
+		end := start + 1
+		for end < len(m.Answer) && sameRRset(m.Answer[start], m.Answer[end]) {
+			end++
+		}
+		rrset := m.Answer[start:end]
+		p.rand.Shuffle(len(rrset), func(i, j int) { rrset[i], rrset[j] = rrset[j], rrset[i] })
+		start = end
+	}
+	return &m
+}
+
+// filterClient is a client that filters upstream replies like the proxy does before caching them.
+type filterClient struct {
+	client  dnsutil.Client
+	options Options
+}
+
+// NewFilterClient returns a client that filters replies from client in the same way as a proxy configured with options
+// filters upstream replies before caching them. This should wrap clients that fill the cache outside of the proxy, such
+// as the client used to prefetch cache values.
+func NewFilterClient(client dnsutil.Client, options Options) dnsutil.Client {
+	return &filterClient{client: client, options: options}
+}
+
+func (c *filterClient) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	rr, err := c.client.Exchange(r)
+	if err != nil {
+		return nil, err
+	}
+	return filterReply(r, rr, &c.options), nil
+}
+
+// filterReply returns upstream reply msg to query r, filtered according to options.
+func filterReply(r *dns.Msg, msg *dns.Msg, options *Options) *dns.Msg {
+	if options.StripOutOfBailiwick {
+		msg = stripOutOfBailiwick(r, msg)
+	}
+	return trimAnswers(msg, options)
+}
+
+// trimAnswers returns msg with duplicate answers removed and the number of answers capped, according to options.
+func trimAnswers(msg *dns.Msg, options *Options) *dns.Msg {
+	if options.RemoveDuplicateAnswers {
+		msg = removeDuplicateAnswers(msg)
+	}
+	return capAnswers(msg, options.MaxAnswers)
+}
+
+// removeDuplicateAnswers returns a copy of msg without duplicate records in the answer section. Records are duplicates
+// if they are equal in everything but TTL. Message msg is returned unchanged if it has no duplicate answers.
+func removeDuplicateAnswers(msg *dns.Msg) *dns.Msg {
+	var answers []dns.RR
+	for i, rr := range msg.Answer {
+		duplicate := false
+		for _, kept := range msg.Answer[:i] {
+			if dns.IsDuplicate(rr, kept) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			if answers == nil {
+				answers = append(make([]dns.RR, 0, len(msg.Answer)-1), msg.Answer[:i]...)
+			}
+			continue
+		}
+		if answers != nil {
+			answers = append(answers, rr)
+		}
+	}
+	if answers == nil {
+		return msg
+	}
+	m := *msg
+	m.Answer = answers
+	return &m
+}
+
+// capAnswers returns a copy of msg where the answer section is trimmed to the first n records. Message msg is returned
+// unchanged if n is zero or it has no more than n answers.
+func capAnswers(msg *dns.Msg, n int) *dns.Msg {
+	if n == 0 || len(msg.Answer) <= n {
+		return msg
+	}
+	m := *msg
+	m.Answer = msg.Answer[:n:n]
+	return &m
+}
+
+// stripOutOfBailiwick returns a copy of msg without authority and additional records that are outside the bailiwick of
+// query r. Authority records must be owned by the query name, a CNAME target in the answer, or a parent of either.
+// Additional records must be owned by one of these names, an authority record, or a name below them. Message msg is
+// returned unchanged if all records are in bailiwick.
+func stripOutOfBailiwick(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 {
+		return msg
+	}
+	names := []string{r.Question[0].Name}
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			names = append(names, cname.Target)
+		}
+	}
+	var ns []dns.RR
+	for _, rr := range msg.Ns {
+		for _, name := range names {
+			if dns.IsSubDomain(rr.Header().Name, name) {
+				ns = append(ns, rr)
+				break
+			}
+		}
+	}
+	zones := names
+	for _, rr := range ns {
+		zones = append(zones, rr.Header().Name)
+	}
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+			continue
+		}
+		for _, zone := range zones {
+			if dns.IsSubDomain(zone, rr.Header().Name) {
+				extra = append(extra, rr)
+				break
+			}
+		}
+	}
+	if len(ns) == len(msg.Ns) && len(extra) == len(msg.Extra) {
+		return msg
+	}
+	m := *msg
+	m.Ns = ns
+	m.Extra = extra
+	return &m
+}
+
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
+
+func isDNSSEC(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY:
+		return true
+	}
+	return false
+}
+
+// stripDNSSEC returns a copy of msg without DNSSEC records. Message msg is returned unchanged if it has no such records.
+func stripDNSSEC(msg *dns.Msg) *dns.Msg {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if !isDNSSEC(rr) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if isDNSSEC(rr) {
+				m := *msg
+				m.Answer = strip(msg.Answer)
+				m.Ns = strip(msg.Ns)
+				m.Extra = strip(msg.Extra)
+				return &m
+			}
+		}
+	}
+	return msg
+}
+
+// minimize returns a copy of msg without records in the authority and additional sections. The SOA record of a
+// negative reply is kept, such that clients can cache the negative reply, as is the OPT record. Message msg is returned
+// unchanged if it has no such records to remove.
+func minimize(msg *dns.Msg) *dns.Msg {
+	keep := func(rrs []dns.RR, rrtype uint16) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == rrtype {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	var ns []dns.RR
+	if dnsutil.IsNegative(msg) {
+		ns = keep(msg.Ns, dns.TypeSOA)
+	}
+	extra := keep(msg.Extra, dns.TypeOPT)
+	if len(ns) == len(msg.Ns) && len(extra) == len(msg.Extra) {
+		return msg
 	}
-	w.WriteMsg(msg)
+	m := *msg
+	m.Ns = ns
+	m.Extra = extra
+	return &m
+}
+
+// matchCase returns a copy of msg where the question name, and owner names equal to the name of query r except for
+// case, are spelled as in r. Message msg is returned unchanged if it has no such names.
+func matchCase(r, msg *dns.Msg) *dns.Msg {
+	if len(r.Question) != 1 {
+		return msg
+	}
+	name := r.Question[0].Name
+	mismatch := func(s string) bool { return s != name && strings.EqualFold(s, name) }
+	changed := false
+	for _, q := range msg.Question {
+		changed = changed || mismatch(q.Name)
+	}
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			changed = changed || mismatch(rr.Header().Name)
+		}
+	}
+	if !changed {
+		return msg
+	}
+	fix := func(rrs []dns.RR) []dns.RR {
+		if rrs == nil {
+			return nil
+		}
+		fixed := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			if mismatch(rr.Header().Name) {
+				rr = dns.Copy(rr) // Records may be shared with the cache
+				rr.Header().Name = name
+			}
+			fixed[i] = rr
+		}
+		return fixed
+	}
+	m := *msg
+	m.Question = make([]dns.Question, len(msg.Question))
+	for i, q := range msg.Question {
+		if mismatch(q.Name) {
+			q.Name = name
+		}
+		m.Question[i] = q
+	}
+	m.Answer = fix(msg.Answer)
+	m.Ns = fix(msg.Ns)
+	m.Extra = fix(msg.Extra)
+	return &m
 }
 
 // ServeDNS implements the dns.Handler interface.
 func (p *Proxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if reply := p.reply(r); reply != nil {
-		p.writeMsg(w, reply, true)
+	if len(r.Question) > 0 {
+		p.stats.countQuery(r.Question[0].Qtype)
+	}
+	w = &countingWriter{ResponseWriter: w, stats: p.stats}
+	if malformed(r) {
+		p.stats.countMalformed()
+		writeFormErr(w, r)
 		return
 	}
-	q := r.Question[0]
-	key := cache.NewKey(q.Name, q.Qtype, q.Qclass)
-	if msg, ok := p.cache.Get(key); ok {
-		msg.SetReply(r)
-		p.writeMsg(w, msg, false)
+	if !p.acquire() {
+		writeLimited(w, r, p.options.OverloadResponse)
 		return
 	}
-	rr, err := p.client.Exchange(r)
-	if err == nil {
-		p.writeMsg(w, rr, false)
-		p.cache.Set(key, rr)
-	} else {
+	if p.rateLimited(w, r) {
+		p.release()
+		return
+	}
+	t := newTrace(p.options.TraceLogger)
+	// The slot is held until resolution finishes, even if it outlives the query timeout
+	res, err := p.resolveTimeout(r, remoteIP(w), t, p.release)
+	if err != nil {
 		log.Print(err)
+		t.printf("replied with SERVFAIL")
 		dns.HandleFailed(w, r)
+		return
+	}
+	t.printf("replied with %s and %d answers", dnsutil.RcodeToString[res.Msg.Rcode], len(res.Msg.Answer))
+	p.writeMsg(w, res.Msg, res.Hijacked)
+}
+
+// Resolution is the outcome of resolving a query.
+type Resolution struct {
+	// Msg is the reply to the query.
+	Msg *dns.Msg
+	// Hijacked is true if the query was answered by Handler, or if the upstream answer was replaced by AnswerHandler.
+	Hijacked bool
+	// Cached is true if the query was answered from cache.
+	Cached bool
+}
+
+// Resolve resolves query r from a client with address ip, in the same way as a query received by the proxy. Rate
+// limiting is not applied.
+func (p *Proxy) Resolve(r *dns.Msg, ip net.IP) (Resolution, error) {
+	return p.resolveTimeout(r, ip, newTrace(p.options.TraceLogger), func() {})
+}
+
+// resolveTimeout resolves query r, and fails if resolution exceeds the query timeout, unless r can be answered from
+// the fallback records. Function done is called when resolution finishes, which may be after resolveTimeout returns.
+func (p *Proxy) resolveTimeout(r *dns.Msg, ip net.IP, t *trace, done func()) (Resolution, error) {
+	if p.options.QueryTimeout == 0 {
+		defer done()
+		return p.resolveTrace(r, ip, t)
+	}
+	type result struct {
+		res Resolution
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		defer done()
+		res, err := p.resolveTrace(r, ip, t)
+		results <- result{res, err}
+	}()
+	timer := time.NewTimer(p.options.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result.res, result.err
+	case <-timer.C:
+		t.printf("no answer within query timeout of %s", p.options.QueryTimeout)
+		if reply := p.fallbackReply(r); reply != nil {
+			t.printf("answering from fallback records")
+			return Resolution{Msg: reply}, nil
+		}
+		return Resolution{}, fmt.Errorf("no answer within query timeout of %s", p.options.QueryTimeout)
+	}
+}
+
+func (p *Proxy) resolveTrace(r *dns.Msg, ip net.IP, t *trace) (Resolution, error) {
+	if len(r.Question) > 0 {
+		q := r.Question[0]
+		t.printf("received query %s %s from %s", dnsutil.TypeToString[q.Qtype], q.Name, ip)
+	}
+	res, err := p.resolveRewrite(r, ip, t)
+	if err != nil {
+		return Resolution{}, err
+	}
+	if p.options.StripDNSSEC {
+		res.Msg = stripDNSSEC(res.Msg)
+	}
+	if p.options.MinimalResponses {
+		res.Msg = minimize(res.Msg)
+	}
+	if p.options.PreserveQueryCase {
+		res.Msg = matchCase(r, res.Msg)
+	}
+	res.Msg = trimAnswers(res.Msg, &p.options)
+	if p.rand != nil {
+		res.Msg = p.shuffleAnswers(res.Msg)
+	}
+	return res, nil
+}
+
+// validSuffix returns whether name can be used as the suffix of a rewritten name.
+func validSuffix(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok && name != "."
+}
+
+// rewriteName returns the name that name should be rewritten to, and whether name should be rewritten at all.
+func (p *Proxy) rewriteName(name string) (string, bool) {
+	if len(p.options.Rewrites) > 0 {
+		canonical := dns.CanonicalName(name)
+		for off, end := 0, false; !end; off, end = dns.NextLabel(canonical, off) {
+			if to, ok := p.options.Rewrites[canonical[off:]]; ok {
+				return dns.Fqdn(name)[:off] + to, true
+			}
+		}
+	}
+	if p.options.SearchDomain != "" && dns.CountLabel(name) == 1 {
+		return dns.Fqdn(name) + p.options.SearchDomain, true
+	}
+	return "", false
+}
+
+// resolveRewrite resolves query r, after rewriting its name according to the configured search domain and rewrites.
+// The reply is rewritten back to the name of the original query.
+func (p *Proxy) resolveRewrite(r *dns.Msg, ip net.IP, t *trace) (Resolution, error) {
+	if len(r.Question) != 1 {
+		return p.resolve(r, ip, t)
+	}
+	name, ok := p.rewriteName(r.Question[0].Name)
+	if !ok {
+		return p.resolve(r, ip, t)
+	}
+	t.printf("rewrote %s to %s", r.Question[0].Name, name)
+	rewritten := r.Copy()
+	rewritten.Question[0].Name = name
+	res, err := p.resolve(rewritten, ip, t)
+	if p.options.RewriteFallback && (err != nil || res.Msg.Rcode == dns.RcodeNameError) {
+		t.printf("resolving %s failed: falling back to %s", name, r.Question[0].Name)
+		return p.resolve(r, ip, t)
+	}
+	if err != nil {
+		return Resolution{}, err
+	}
+	res.Msg = restoreName(res.Msg, r, name)
+	return res, nil
+}
+
+// restoreName returns a copy of reply msg to the rewritten query for name, where the question is replaced by the
+// question of the original query r, and answers for name are renamed to the original name.
+func restoreName(msg *dns.Msg, r *dns.Msg, name string) *dns.Msg {
+	msg = msg.Copy()
+	msg.Question = append([]dns.Question(nil), r.Question...)
+	for _, rr := range msg.Answer {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = r.Question[0].Name
+		}
+	}
+	return msg
+}
+
+func (p *Proxy) resolve(r *dns.Msg, ip net.IP, t *trace) (Resolution, error) {
+	if reply := p.reply(r); reply != nil {
+		t.printf("answered by handler")
+		return Resolution{Msg: reply, Hijacked: true}, nil
+	}
+	if reply := p.specialReply(r); reply != nil {
+		t.printf("answered special-use name locally")
+		return Resolution{Msg: reply}, nil
+	}
+	if reply := p.rootReply(r); reply != nil {
+		t.printf("answered root zone query locally")
+		return Resolution{Msg: reply}, nil
+	}
+	// Routes take precedence over local zones, such that a local zone can be served by the resolver of a route
+	routeClient := p.route(ip, r)
+	if zone, ok := p.localZone(r); ok && routeClient == nil {
+		t.printf("answered query in local zone %s with NXDOMAIN", zone)
+		m := dns.Msg{}
+		m.SetRcode(r, dns.RcodeNameError)
+		setFlags(&m, true)
+		return Resolution{Msg: &m}, nil
+	}
+	nonRecursive := NonRecursiveForward
+	if !r.RecursionDesired {
+		nonRecursive = p.options.NonRecursive
+		if nonRecursive == NonRecursiveForward {
+			r = r.Copy()
+			r.RecursionDesired = true
+		}
+	}
+	if nonRecursive == NonRecursiveRefuse || (nonRecursive == NonRecursiveCache && p.options.DisableCache) {
+		t.printf("refusing non-recursive query")
+		return Resolution{Msg: refused(r)}, nil
+	}
+	var (
+		rr  *dns.Msg
+		err error
+	)
+	maintenance := p.Maintenance()
+	warmingUp := p.WarmingUp()
+	if client := routeClient; client != nil {
+		if nonRecursive == NonRecursiveCache {
+			t.printf("refusing non-recursive query for uncached route")
+			return Resolution{Msg: refused(r)}, nil
+		}
+		if maintenance {
+			t.printf("maintenance mode: answering offline")
+			return p.offlineReply(r)
+		}
+		// The cache is shared by all clients, so answers from other upstreams are neither cached nor answered from
+		// cache
+		t.printf("forwarding to upstream of matching route")
+		q := p.stripEDNS(r)
+		rr, err = client.Exchange(q)
+		if err == nil {
+			rr = filterReply(q, rr, &p.options)
+		}
+	} else if p.client == nil {
+		t.printf("no upstream: answering offline")
+		return p.offlineReply(r)
+	} else {
+		q := r.Question[0]
+		key := p.cache.Key(q.Name, q.Qtype, q.Qclass)
+		globalKey := key
+		if subnet, query := p.ecsQuery(r); subnet != nil {
+			t.printf("using client subnet %s", subnet)
+			r = query
+			key = p.cache.KeySubnet(q.Name, q.Qtype, q.Qclass, subnet)
+		}
+		if p.options.DisableCache {
+			if maintenance {
+				t.printf("maintenance mode: answering offline")
+				return p.offlineReply(r)
+			}
+			t.printf("cache disabled: forwarding upstream")
+		} else if msg, state := p.cacheGet(key, globalKey, q, maintenance, warmingUp); msg != nil {
+			if state == cache.StateStale && warmingUp && p.options.WarmUpMode == WarmUpStale {
+				t.printf("cache stale: serving expired answer during warm-up")
+			} else if state == cache.StateStale {
+				t.printf("cache stale: serving expired answer while prefetching")
+			} else {
+				t.printf("cache %s", state)
+			}
+			if reply := p.answerReply(r, msg); reply != nil {
+				t.printf("cached answer hijacked by answer handler")
+				return Resolution{Msg: reply, Hijacked: true, Cached: true}, nil
+			}
+			msg.SetReply(r)
+			setFlags(msg, false)
+			return Resolution{Msg: msg, Cached: true}, nil
+		} else if nonRecursive == NonRecursiveCache {
+			t.printf("cache %s: refusing non-recursive query", state)
+			return Resolution{Msg: refused(r)}, nil
+		} else if maintenance {
+			t.printf("cache %s: answering offline in maintenance mode", state)
+			return p.offlineReply(r)
+		} else if warmingUp && p.options.WarmUpMode == WarmUpServFail {
+			t.printf("cache %s: answering with SERVFAIL during warm-up", state)
+			m := dns.Msg{}
+			m.SetRcode(r, dns.RcodeServerFailure)
+			setFlags(&m, false)
+			return Resolution{Msg: &m}, nil
+		} else {
+			t.printf("cache %s: forwarding upstream", state)
+		}
+		rr, err = p.exchange(key, r, t)
+	}
+	if err != nil {
+		t.printf("upstream failed: %s", err)
+		if reply := p.fallbackReply(r); reply != nil {
+			t.printf("answering from fallback records")
+			return Resolution{Msg: reply}, nil
+		}
+		return Resolution{}, err
+	}
+	t.printf("upstream answered with %s", dnsutil.RcodeToString[rr.Rcode])
+	if reply := p.answerReply(r, rr); reply != nil {
+		t.printf("upstream answer hijacked by answer handler")
+		return Resolution{Msg: reply, Hijacked: true}, nil
+	}
+	setFlags(rr, false)
+	return Resolution{Msg: rr}, nil
+}
+
+// refused returns a reply to r with response code REFUSED.
+func refused(r *dns.Msg) *dns.Msg {
+	m := dns.Msg{}
+	m.SetRcode(r, dns.RcodeRefused)
+	setFlags(&m, false)
+	return &m
+}
+
+// rootReply returns a local reply to r if it is a query for the root zone or a top-level domain that should not be
+// forwarded, and nil otherwise.
+func (p *Proxy) rootReply(r *dns.Msg) *dns.Msg {
+	if p.options.RootQueries == RootForward || len(r.Question) != 1 {
+		return nil
+	}
+	q := r.Question[0]
+	if dns.CountLabel(q.Name) > 1 {
+		return nil
+	}
+	m := dns.Msg{}
+	if p.options.RootQueries == RootHints && q.Name == "." && q.Qtype == dns.TypeNS {
+		m.SetReply(r)
+		for _, ns := range rootServers {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 518400},
+				Ns:  ns,
+			})
+		}
+		setFlags(&m, true)
+	} else {
+		m.SetRcode(r, dns.RcodeRefused)
+		setFlags(&m, false)
+	}
+	return &m
+}
+
+// localZone returns the local zone containing the name of query r, if any.
+func (p *Proxy) localZone(r *dns.Msg) (string, bool) {
+	if len(p.options.LocalZones) == 0 || len(r.Question) != 1 {
+		return "", false
+	}
+	name := dns.CanonicalName(r.Question[0].Name)
+	for _, zone := range p.options.LocalZones {
+		if dns.IsSubDomain(zone, name) {
+			return zone, true
+		}
 	}
+	return "", false
+}
+
+// specialReply returns the reply to r if it is a query for a special-use name that should be answered locally.
+func (p *Proxy) specialReply(r *dns.Msg) *dns.Msg {
+	if p.options.SpecialNames != SpecialLocal || len(r.Question) != 1 {
+		return nil
+	}
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	m := dns.Msg{}
+	switch {
+	case dns.IsSubDomain("localhost.", name):
+		m.SetReply(r)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 3600}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+		}
+	case dns.IsSubDomain("invalid.", name):
+		m.SetRcode(r, dns.RcodeNameError)
+	case name == "1.0.0.127.in-addr.arpa." || name == loopbackIPv6PTR:
+		m.SetReply(r)
+		if q.Qtype == dns.TypePTR {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 3600}
+			m.Answer = []dns.RR{&dns.PTR{Hdr: hdr, Ptr: "localhost."}}
+		}
+	default:
+		return nil
+	}
+	setFlags(&m, true)
+	return &m
+}
+
+// fallbackReply returns the reply to r from the fallback records, or nil if there are no matching records.
+func (p *Proxy) fallbackReply(r *dns.Msg) *dns.Msg {
+	if p.options.Fallback == nil || len(r.Question) != 1 {
+		return nil
+	}
+	reply := p.options.Fallback.Reply(&Request{Name: r.Question[0].Name, Type: r.Question[0].Qtype})
+	if reply == nil {
+		return nil
+	}
+	return replyMsg(r, reply)
+}
+
+// offlineReply returns the reply to r when there is no upstream client to forward it to. Fallback records take
+// precedence over the Offline option.
+func (p *Proxy) offlineReply(r *dns.Msg) (Resolution, error) {
+	if reply := p.fallbackReply(r); reply != nil {
+		return Resolution{Msg: reply}, nil
+	}
+	m := dns.Msg{}
+	switch p.options.Offline {
+	case OfflineRefuse:
+		m.SetRcode(r, dns.RcodeRefused)
+	case OfflineNXDomain:
+		m.SetRcode(r, dns.RcodeNameError)
+	case OfflineAddress:
+		m.SetReply(r)
+		q := r.Question[0]
+		ip := p.options.OfflineAddress
+		var reply *Reply
+		if q.Qtype == dns.TypeA && ip.To4() != nil {
+			reply = ReplyA(q.Name, ip)
+		} else if q.Qtype == dns.TypeAAAA && ip.To4() == nil {
+			reply = ReplyAAAA(q.Name, ip)
+		}
+		if reply != nil {
+			m.Answer = reply.rr
+		}
+	default:
+		return Resolution{}, fmt.Errorf("no upstream resolvers to query")
+	}
+	setFlags(&m, false)
+	return Resolution{Msg: &m}, nil
+}
+
+// route returns the client of the first route matching query r from ip, or nil if there is no such route.
+func (p *Proxy) route(ip net.IP, r *dns.Msg) dnsutil.Client {
+	var q dns.Question
+	if len(r.Question) > 0 {
+		q = r.Question[0]
+	}
+	for i := range p.options.Routes {
+		if p.options.Routes[i].matches(ip, q) {
+			return p.options.Routes[i].Client
+		}
+	}
+	return nil
+}
+
+// exchange forwards r to the upstream resolver and caches the answer. If deduplication is enabled, concurrent calls
+// for the same key share a single upstream exchange. The answer returned is always a copy owned by the caller, so
+// that modifying it changes neither the cached answer nor the answer of another caller.
+func (p *Proxy) exchange(key uint64, r *dns.Msg, t *trace) (*dns.Msg, error) {
+	r = p.stripEDNS(r)
+	fn := func() (*dns.Msg, error) {
+		rr, err := p.client.Exchange(r)
+		if err == nil {
+			rr = filterReply(r, rr, &p.options)
+			if !p.options.DisableCache {
+				t.printf("caching answer")
+				p.cache.Set(p.cacheKey(key, r, rr), rr.Copy())
+			}
+		}
+		return rr, err
+	}
+	if p.flights == nil {
+		return fn()
+	}
+	rr, shared, err := p.flights.do(key, fn)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		t.printf("sharing upstream answer with concurrent queries")
+	}
+	// The answer of the flight is shared by all callers, including callers that join after fn returns
+	rr = rr.Copy()
+	rr.Id = r.Id
+	return rr, nil
+}
+
+// ecsQuery returns the client subnet of query r, and a copy of r where the subnet is truncated to the configured
+// maximum prefix length. The subnet is nil if ECSCache is disabled, or if r has no client subnet option to forward.
+func (p *Proxy) ecsQuery(r *dns.Msg) (*net.IPNet, *dns.Msg) {
+	if !p.options.ECSCache {
+		return nil, nil
+	}
+	r = p.stripEDNS(r)
+	option := dnsutil.ClientSubnet(r)
+	if option == nil {
+		return nil, nil
+	}
+	bits, maxPrefix := 32, p.options.ECSPrefixIPv4
+	if option.Family == 2 {
+		bits, maxPrefix = 128, p.options.ECSPrefixIPv6
+	}
+	prefix := int(option.SourceNetmask)
+	if prefix > maxPrefix {
+		prefix = maxPrefix
+	}
+	mask := net.CIDRMask(prefix, bits)
+	ip := option.Address
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	if ip == nil || mask == nil {
+		return nil, nil
+	}
+	subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	r = r.Copy()
+	opt := r.IsEdns0()
+	for i, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); ok {
+			opt.Option[i] = &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        option.Family,
+				SourceNetmask: uint8(prefix),
+				Address:       subnet.IP,
+			}
+		}
+	}
+	return subnet, r
+}
+
+// cacheGet returns the cached answer to question q for key. If key is specific to a client subnet and has no cached
+// answer, the answer cached for all subnets under globalKey is returned instead. If peek is true, the lookup does not
+// trigger prefetching of expired answers. If warmingUp is true and WarmUpMode is WarmUpStale, expired answers are
+// returned without being refreshed.
+func (p *Proxy) cacheGet(key, globalKey uint64, q dns.Question, peek, warmingUp bool) (*dns.Msg, cache.State) {
+	get := p.cache.GetWithState
+	if peek {
+		get = p.cache.Peek
+	} else if warmingUp && p.options.WarmUpMode == WarmUpStale {
+		get = p.cache.PeekStale
+	}
+	msg, state := get(key, q)
+	if msg == nil && key != globalKey {
+		return get(globalKey, q)
+	}
+	return msg, state
+}
+
+// cacheKey returns the key to cache reply rr to query r under. Replies to queries for a client subnet are cached for
+// all subnets if the upstream indicates that the answer does not depend on the subnet, i.e. its scope is zero.
+func (p *Proxy) cacheKey(key uint64, r, rr *dns.Msg) uint64 {
+	if !p.options.ECSCache || dnsutil.ClientSubnet(r) == nil {
+		return key
+	}
+	if option := dnsutil.ClientSubnet(rr); option != nil && option.SourceScope > 0 {
+		return key
+	}
+	q := r.Question[0]
+	return p.cache.Key(q.Name, q.Qtype, q.Qclass)
+}
+
+// stripEDNS returns a copy of r without EDNS options that are not explicitly allowed. Message r is returned unchanged
+// if it has no such options.
+func (p *Proxy) stripEDNS(r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return r
+	}
+	allowed := func(option dns.EDNS0) bool {
+		for _, code := range p.options.EDNSOptions {
+			if option.Option() == code {
+				return true
+			}
+		}
+		return false
+	}
+	strip := false
+	for _, option := range opt.Option {
+		if !allowed(option) {
+			strip = true
+			break
+		}
+	}
+	if !strip {
+		return r
+	}
+	r = r.Copy()
+	opt = r.IsEdns0()
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if allowed(option) {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	return r
+}
+
+// WarmCache resolves requests and caches their answers. Requests answered by Handler are skipped. It returns the
+// number of requests that were resolved, which is always zero if the cache is disabled or there is no upstream client.
+func (p *Proxy) WarmCache(requests ...Request) int {
+	if p.options.DisableCache || p.client == nil {
+		return 0
+	}
+	n := 0
+	for _, r := range requests {
+		msg := dns.Msg{}
+		msg.SetQuestion(dns.Fqdn(r.Name), r.Type)
+		if p.reply(&msg) != nil {
+			continue
+		}
+		q := msg.Question[0]
+		key := p.cache.Key(q.Name, q.Qtype, q.Qclass)
+		if _, err := p.exchange(key, &msg, nil); err != nil {
+			log.Printf("failed to warm cache for %s %s: %s", dnsutil.TypeToString[q.Qtype], q.Name, err)
+			continue
+		}
+		n++
+	}
+	return n
 }
 
 // ListenAndServe listens on the network address addr and uses the server to process requests.
+//
+// If addr has the form unix:path, the proxy listens on a Unix domain socket at path, using TCP message framing. The
+// network argument is ignored in this case.
 func (p *Proxy) ListenAndServe(addr string, network string) error {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return p.listenAndServeUnix(path)
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		return p.listenAndServeAny(port, network)
+	}
+	server := p.newServer(network)
+	server.Addr = addr
+	p.mu.Lock()
+	p.servers = []*dns.Server{server}
+	p.mu.Unlock()
+	return server.ListenAndServe()
+}
+
+func (p *Proxy) listenAndServeUnix(path string) error {
+	// Remove any stale socket left behind by a previous process
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	server := &dns.Server{Listener: l, Net: "tcp", Handler: p}
 	p.mu.Lock()
-	p.server = &dns.Server{Addr: addr, Net: network, Handler: p}
+	p.servers = []*dns.Server{server}
 	p.mu.Unlock()
-	return p.server.ListenAndServe()
+	return server.ActivateAndServe()
+}
+
+// newServer returns a server for network which passes requests to proxy p.
+func (p *Proxy) newServer(network string) *dns.Server {
+	server := &dns.Server{Net: network, Handler: p}
+	if n := p.options.UDPReaders; n > 1 {
+		server.DecorateReader = func(r dns.Reader) dns.Reader { return newUDPReader(r, n) }
+	}
+	return server
+}
+
+// listenAndServeAny listens on port of both the IPv4 and IPv6 wildcard address. This avoids relying on dual-stack
+// behaviour, which varies between operating systems.
+func (p *Proxy) listenAndServeAny(port string, network string) error {
+	if network == "" {
+		network = "udp"
+	}
+	var servers []*dns.Server
+	closeAll := func() {
+		for _, server := range servers {
+			if server.PacketConn != nil {
+				server.PacketConn.Close()
+			}
+			if server.Listener != nil {
+				server.Listener.Close()
+			}
+		}
+	}
+	for _, family := range []struct{ suffix, host string }{{"4", "0.0.0.0"}, {"6", "::"}} {
+		addr := net.JoinHostPort(family.host, port)
+		server := p.newServer(network)
+		switch network {
+		case "udp":
+			pc, err := net.ListenPacket(network+family.suffix, addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			server.PacketConn = pc
+		case "tcp":
+			l, err := net.Listen(network+family.suffix, addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			server.Listener = l
+		default:
+			closeAll()
+			return fmt.Errorf("invalid network for wildcard address: %s", network)
+		}
+		servers = append(servers, server)
+	}
+	p.mu.Lock()
+	p.servers = servers
+	p.mu.Unlock()
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) { errs <- server.ActivateAndServe() }(server)
+	}
+	err := <-errs
+	p.Close() // Stop the remaining server
+	return err
 }
@@ -1,27 +1,44 @@
 package dns
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns/dnsutil"
+	"github.com/mpolden/zdns/logfile"
 )
 
 func init() {
 	log.SetOutput(ioutil.Discard)
 }
 
-type dnsWriter struct{ lastReply *dns.Msg }
+type dnsWriter struct {
+	lastReply *dns.Msg
+	remoteIP  net.IP
+}
 
 func (w *dnsWriter) LocalAddr() net.Addr { return nil }
 func (w *dnsWriter) RemoteAddr() net.Addr {
-	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 50000}
+	ip := w.remoteIP
+	if ip == nil {
+		ip = net.IPv4(192, 0, 2, 100)
+	}
+	return &net.UDPAddr{IP: ip, Port: 50000}
 }
 func (w *dnsWriter) Write(b []byte) (int, error) { return 0, nil }
 func (w *dnsWriter) Close() error                { return nil }
@@ -195,6 +212,2329 @@ func TestProxyWithCache(t *testing.T) {
 	}
 }
 
+func TestProxyCacheKeyCollision(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	// Cache an answer for host1 under the key of host2, as if their keys collide
+	m1 := dns.Msg{}
+	m1.SetQuestion("host1.", dns.TypeA)
+	m1.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	p.cache.Set(p.cache.Key("host2.", dns.TypeA, dns.ClassINET), &m1)
+
+	m2 := dns.Msg{}
+	m2.Id = dns.Id()
+	m2.SetQuestion("host2.", dns.TypeA)
+	m2.Answer = ReplyA("host2.", net.ParseIP("192.0.2.2")).rr
+	r.setResponse(&response{answer: &m2})
+	assertRR(t, p, &m2, "192.0.2.2")
+}
+
+func TestProxyCacheNoDataAfterCNAME(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	// Target of CNAME has an A record, but no AAAA record
+	answer := dns.Msg{}
+	answer.SetQuestion("www.example.com.", dns.TypeAAAA)
+	answer.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: "www.example.net.",
+	}}
+	answer.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.net.",
+		Mbox:   "hostmaster.example.net.",
+		Minttl: 60,
+	}}
+	r.setResponse(&response{answer: &answer})
+
+	for i := 0; i < 2; i++ {
+		m := dns.Msg{}
+		m.SetQuestion("www.example.com.", dns.TypeAAAA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		reply := w.lastReply
+		if got, want := reply.Rcode, dns.RcodeSuccess; got != want {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[want])
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Errorf("#%d: Answer = %v, want CNAME only", i, reply.Answer)
+		}
+		if len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("#%d: Ns = %v, want SOA", i, reply.Ns)
+		}
+		r.setResponse(&response{fail: true}) // Second reply must be answered from cache
+	}
+
+	// Negative answer is cached for the SOA minimum
+	k := p.cache.Key("www.example.com.", dns.TypeAAAA, dns.ClassINET)
+	values := p.cache.List(1)
+	if len(values) != 1 || values[0].Key != k {
+		t.Fatalf("List(1) = %v, want value with key %d", values, k)
+	}
+	if got, want := values[0].ExpiresAt.Sub(values[0].CreatedAt), time.Minute; got != want {
+		t.Errorf("cached for %s, want %s", got, want)
+	}
+}
+
+func TestProxyFlags(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "local." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	answer := dns.Msg{}
+	answer.SetQuestion("remote.", dns.TypeA)
+	answer.Answer = ReplyA("remote.", net.ParseIP("192.0.2.1")).rr
+	answer.Authoritative = true // Upstream claims authority, which must not be forwarded
+	r.setResponse(&response{answer: &answer})
+
+	var tests = []struct {
+		name          string
+		authoritative bool
+	}{
+		{"local.", true},
+		{"remote.", false},
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := w.lastReply.Authoritative; got != tt.authoritative {
+			t.Errorf("#%d: Authoritative = %t, want %t", i, got, tt.authoritative)
+		}
+		if got := w.lastReply.RecursionAvailable; !got {
+			t.Errorf("#%d: RecursionAvailable = %t, want %t", i, got, true)
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	var tests = []struct {
+		response  int
+		rcode     int
+		truncated bool
+		dropped   bool
+	}{
+		{RateLimitRefuse, dns.RcodeRefused, false, false},
+		{RateLimitTruncate, dns.RcodeSuccess, true, false},
+		{RateLimitDrop, 0, false, true},
+	}
+	for i, tt := range tests {
+		p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{RateLimit: 1, RateLimitResponse: tt.response})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+		now := time.Now()
+		p.limiter.now = func() time.Time { return now }
+
+		m := dns.Msg{}
+		m.SetQuestion("host1.", dns.TypeA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Fatalf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+
+		// Second query in the same window exceeds limit
+		w = &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if tt.dropped {
+			if w.lastReply != nil {
+				t.Errorf("#%d: got reply %s, want none", i, w.lastReply)
+			}
+		} else {
+			if got := w.lastReply.Rcode; got != tt.rcode {
+				t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+			}
+			if got := w.lastReply.Truncated; got != tt.truncated {
+				t.Errorf("#%d: Truncated = %t, want %t", i, got, tt.truncated)
+			}
+			if got, want := len(w.lastReply.Answer), 0; got != want {
+				t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+			}
+		}
+
+		// Next window allows query again
+		p.limiter.now = func() time.Time { return now.Add(time.Second) }
+		w = &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestProxyMaxInFlight(t *testing.T) {
+	var tests = []struct {
+		response int
+		rcode    int
+		dropped  bool
+	}{
+		{RateLimitRefuse, dns.RcodeRefused, false},
+		{RateLimitDrop, 0, true},
+	}
+	for i, tt := range tests {
+		p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{MaxInFlight: 2, OverloadResponse: tt.response})
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan bool)
+		unblock := make(chan bool)
+		p.Handler = func(r *Request) *Reply {
+			if r.Name == "slow." {
+				started <- true
+				<-unblock
+			}
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		serve := func(name string) *dnsWriter {
+			m := dns.Msg{}
+			m.SetQuestion(name, dns.TypeA)
+			w := &dnsWriter{}
+			p.ServeDNS(w, &m)
+			return w
+		}
+
+		// Fill all slots with queries that block
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve("slow.")
+			}()
+			<-started
+		}
+
+		// Query exceeding the limit is rejected
+		w := serve("host1.")
+		if tt.dropped {
+			if w.lastReply != nil {
+				t.Errorf("#%d: got reply %s, want none", i, w.lastReply)
+			}
+		} else if got := w.lastReply.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+
+		// Query is accepted again when slots are freed
+		close(unblock)
+		wg.Wait()
+		w = serve("host1.")
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+	}
+	if _, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{MaxInFlight: -1}); err == nil {
+		t.Error("expected error for negative max in-flight queries")
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	p := testProxy(t)
+	p.client = &testResolver{}
+	defer p.Close()
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "host1." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	var tests = []struct {
+		name  string
+		qtype uint16
+	}{
+		{"host1.", dns.TypeA},
+		{"host1.", dns.TypeA},
+		{"host2.", dns.TypeAAAA},
+		{"host2.", dns.TypeNULL},
+	}
+	for _, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, tt.qtype)
+		p.ServeDNS(&dnsWriter{}, &m)
+	}
+	want := Stats{
+		Queries:   map[string]int64{"A": 2, "AAAA": 1, "OTHER": 1},
+		Responses: map[string]int64{"NOERROR": 2, "SERVFAIL": 2},
+	}
+	if got := p.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	p.ResetStats()
+	want = Stats{Queries: map[string]int64{}, Responses: map[string]int64{}}
+	if got := p.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+	path := filepath.Join(t.TempDir(), "zdns.sock")
+	go p.ListenAndServe("unix:"+path, "udp")
+	defer p.Close()
+
+	var conn net.Conn
+	var err error
+	ts := time.Now()
+	for {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatalf("timed out waiting for unix socket: %s", err)
+		}
+	}
+	defer conn.Close()
+
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TCP framing: Two byte length prefix
+	if _, err := conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	reply := dns.Msg{}
+	if err := reply.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Id, m.Id; got != want {
+		t.Errorf("Id = %d, want %d", got, want)
+	}
+	if got, want := len(reply.Answer), 1; got != want {
+		t.Fatalf("len(Answer) = %d, want %d", got, want)
+	}
+	if got, want := reply.Answer[0].(*dns.A).A.String(), "0.0.0.0"; got != want {
+		t.Errorf("A = %s, want %s", got, want)
+	}
+}
+
+type blockingResolver struct {
+	mu      sync.Mutex
+	answer  *dns.Msg
+	release chan bool
+	calls   int
+}
+
+func (r *blockingResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	<-r.release
+	answer := r.answer.Copy()
+	answer.Id = msg.Id
+	return answer, nil
+}
+
+func TestProxyQueryTimeout(t *testing.T) {
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.IPv4(192, 0, 2, 1)).rr
+	client := &blockingResolver{answer: answer, release: make(chan bool)}
+	records, err := ParseRecords(strings.NewReader("host2. 60 IN A 192.0.2.100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := Options{QueryTimeout: 50 * time.Millisecond, MaxInFlight: 2, Fallback: records}
+	p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ts := time.Now()
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeServerFailure; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if d := time.Since(ts); d > time.Second {
+		t.Errorf("query answered after %s, want prompt answer", d)
+	}
+
+	// Query timing out is answered from fallback records
+	m2 := dns.Msg{}
+	m2.SetQuestion("host2.", dns.TypeA)
+	w = &dnsWriter{}
+	p.ServeDNS(w, &m2)
+	if got, want := (&Reply{rr: w.lastReply.Answer}).String(), "host2.\t60\tIN\tA\t192.0.2.100"; got != want {
+		t.Errorf("Answer = %q, want %q", got, want)
+	}
+
+	// Slots are held until the upstream exchanges finish
+	w = &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeRefused; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+
+	// Late upstream answer is cached
+	close(client.release)
+	key := cache.NewKey("host1.", dns.TypeA, dns.ClassINET)
+	for {
+		if _, ok := p.cache.Get(key); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatal("timed out waiting for answer to be cached")
+		}
+	}
+}
+
+func TestProxyDeduplicate(t *testing.T) {
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = []dns.RR{&dns.A{
+		A:   net.ParseIP("192.0.2.1"),
+		Hdr: dns.RR_Header{Name: "host1.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+	}}
+	client := &blockingResolver{answer: answer, release: make(chan bool)}
+	p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, Options{Deduplicate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10
+	key := cache.NewKey("host1.", dns.TypeA, dns.ClassINET)
+	writers := make([]*dnsWriter, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		writers[i] = &dnsWriter{}
+		r := m.Copy()
+		r.Id = uint16(i)
+		wg.Add(1)
+		go func(w *dnsWriter, r *dns.Msg) {
+			defer wg.Done()
+			p.ServeDNS(w, r)
+		}(writers[i], r)
+	}
+	ts := time.Now()
+	for p.flights.waiting(key) < n-1 {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatal("timed out waiting for queries to be deduplicated")
+		}
+	}
+	close(client.release)
+	wg.Wait()
+
+	if got, want := client.calls, 1; got != want {
+		t.Errorf("calls = %d, want %d", got, want)
+	}
+	for i, w := range writers {
+		if got, want := w.lastReply.Id, uint16(i); got != want {
+			t.Errorf("#%d: Id = %d, want %d", i, got, want)
+		}
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+	}
+
+	// Replies are modified without modifying the cached answer
+	cached, ok := p.cache.Get(key)
+	if !ok {
+		t.Fatal("expected cached answer")
+	}
+	if cached.RecursionAvailable {
+		t.Error("cached answer was modified by reply")
+	}
+	want := answer.Copy()
+	want.Id = cached.Id // Set by the resolver
+	if got, want := cached.String(), want.String(); got != want {
+		t.Errorf("cached answer = %s, want %s", got, want)
+	}
+}
+
+func TestProxyCachedAnswerUnmodified(t *testing.T) {
+	resolver := &testResolver{}
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = []dns.RR{&dns.A{
+		A:   net.ParseIP("192.0.2.1"),
+		Hdr: dns.RR_Header{Name: "host1.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+	}}
+	resolver.setResponse(&response{answer: answer})
+	res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Msg.RecursionAvailable {
+		t.Error("expected reply to set recursion available")
+	}
+	cached, ok := p.cache.Get(cache.NewKey("host1.", dns.TypeA, dns.ClassINET))
+	if !ok {
+		t.Fatal("expected cached answer")
+	}
+	if cached.RecursionAvailable {
+		t.Error("cached answer was modified by reply")
+	}
+}
+
+type recordingResolver struct {
+	mu   sync.Mutex
+	msgs []*dns.Msg
+}
+
+func (r *recordingResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	return reply, nil
+}
+
+func TestProxyWarmUp(t *testing.T) {
+	var tests = []struct {
+		mode    int
+		name    string
+		rcode   int
+		answer  bool
+		queries int
+	}{
+		{WarmUpForward, "cached.", dns.RcodeSuccess, true, 0},
+		{WarmUpForward, "expired.", dns.RcodeSuccess, false, 1},
+		{WarmUpForward, "uncached.", dns.RcodeSuccess, false, 1},
+		{WarmUpServFail, "cached.", dns.RcodeSuccess, true, 0},
+		{WarmUpServFail, "expired.", dns.RcodeServerFailure, false, 0},
+		{WarmUpServFail, "uncached.", dns.RcodeServerFailure, false, 0},
+		{WarmUpStale, "cached.", dns.RcodeSuccess, true, 0},
+		{WarmUpStale, "expired.", dns.RcodeSuccess, true, 0},
+		{WarmUpStale, "uncached.", dns.RcodeSuccess, false, 1},
+	}
+	for i, tt := range tests {
+		resolver := &recordingResolver{}
+		c := cache.NewWithOptions(10, nil, nil, cache.Options{ZoneTTLs: map[string]time.Duration{"expired.": time.Nanosecond}})
+		p, err := NewProxyWithOptions(c, resolver, nil, Options{WarmUp: time.Hour, WarmUpMode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"cached.", "expired."} {
+			m := dns.Msg{}
+			m.SetQuestion(name, dns.TypeA)
+			m.Answer = ReplyA(name, net.IPv4(192, 0, 2, 1)).rr
+			c.Set(c.Key(name, dns.TypeA, dns.ClassINET), &m)
+		}
+		time.Sleep(time.Nanosecond)
+		if got, want := p.WarmingUp(), tt.mode != WarmUpForward; got != want {
+			t.Errorf("#%d: WarmingUp() = %t, want %t", i, got, want)
+		}
+
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := len(res.Msg.Answer) > 0; got != tt.answer {
+			t.Errorf("#%d: answered = %t, want %t", i, got, tt.answer)
+		}
+		if got := len(resolver.msgs); got != tt.queries {
+			t.Errorf("#%d: len(msgs) = %d, want %d", i, got, tt.queries)
+		}
+
+		// Forwarding resumes after warm-up
+		p.warmUntil = time.Time{}
+		if p.WarmingUp() {
+			t.Errorf("#%d: want warm-up to end", i)
+		}
+		m = dns.Msg{}
+		m.SetQuestion("uncached.", dns.TypeAAAA)
+		if _, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(resolver.msgs), tt.queries+1; got != want {
+			t.Errorf("#%d: len(msgs) = %d, want %d after warm-up", i, got, want)
+		}
+		p.Close()
+	}
+}
+
+func TestProxyNonRecursive(t *testing.T) {
+	var tests = []struct {
+		mode      int
+		name      string
+		rcode     int
+		forwarded bool
+	}{
+		{NonRecursiveForward, "local.", dns.RcodeSuccess, false},
+		{NonRecursiveForward, "cached.", dns.RcodeSuccess, false},
+		{NonRecursiveForward, "uncached.", dns.RcodeSuccess, true},
+		{NonRecursiveRefuse, "local.", dns.RcodeSuccess, false},
+		{NonRecursiveRefuse, "cached.", dns.RcodeRefused, false},
+		{NonRecursiveRefuse, "uncached.", dns.RcodeRefused, false},
+		{NonRecursiveCache, "local.", dns.RcodeSuccess, false},
+		{NonRecursiveCache, "cached.", dns.RcodeSuccess, false},
+		{NonRecursiveCache, "uncached.", dns.RcodeRefused, false},
+	}
+	for i, tt := range tests {
+		resolver := &recordingResolver{}
+		p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{NonRecursive: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Handler = func(r *Request) *Reply {
+			if r.Name == "local." {
+				return ReplyA(r.Name, net.IPv4zero)
+			}
+			return nil
+		}
+		cached := dns.Msg{}
+		cached.SetQuestion("cached.", dns.TypeA)
+		cached.Answer = ReplyA("cached.", net.IPv4(192, 0, 2, 1)).rr
+		p.cache.Set(cache.NewKey("cached.", dns.TypeA, dns.ClassINET), &cached)
+
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		m.RecursionDesired = false
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := len(resolver.msgs) > 0; got != tt.forwarded {
+			t.Errorf("#%d: forwarded = %t, want %t", i, got, tt.forwarded)
+		} else if tt.forwarded && !resolver.msgs[0].RecursionDesired {
+			t.Errorf("#%d: want RD bit set in forwarded query", i)
+		}
+		if m.RecursionDesired {
+			t.Errorf("#%d: query was modified", i)
+		}
+		p.Close()
+	}
+}
+
+func TestProxyMaintenance(t *testing.T) {
+	resolver := &recordingResolver{}
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{Offline: OfflineRefuse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "local." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	cached := dns.Msg{}
+	cached.SetQuestion("cached.", dns.TypeA)
+	cached.Answer = ReplyA("cached.", net.IPv4(192, 0, 2, 1)).rr
+	p.cache.Set(cache.NewKey("cached.", dns.TypeA, dns.ClassINET), &cached)
+
+	if got := p.ToggleMaintenance(); !got {
+		t.Fatal("want maintenance mode enabled")
+	}
+	var tests = []struct {
+		name   string
+		rcode  int
+		answer bool
+	}{
+		{"local.", dns.RcodeSuccess, true},
+		{"cached.", dns.RcodeSuccess, true},
+		{"uncached.", dns.RcodeRefused, false},
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := len(res.Msg.Answer) > 0; got != tt.answer {
+			t.Errorf("#%d: answered = %t, want %t", i, got, tt.answer)
+		}
+	}
+	if got, want := len(resolver.msgs), 0; got != want {
+		t.Errorf("len(msgs) = %d, want %d in maintenance mode", got, want)
+	}
+
+	// Forwarding resumes when maintenance mode is disabled
+	p.SetMaintenance(false)
+	if p.Maintenance() {
+		t.Fatal("want maintenance mode disabled")
+	}
+	m := dns.Msg{}
+	m.SetQuestion("uncached.", dns.TypeA)
+	if _, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(resolver.msgs), 1; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyAnswerHandler(t *testing.T) {
+	p, err := NewProxy(cache.New(10, nil), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	r := &testResolver{}
+	p.client = r
+	_, blocked, _ := net.ParseCIDR("192.0.2.0/24")
+	p.AnswerHandler = func(r *Request, ipAddrs []net.IP) *Reply {
+		for _, ip := range ipAddrs {
+			if blocked.Contains(ip) {
+				return ReplyNXDomain()
+			}
+		}
+		return nil
+	}
+	var tests = []struct {
+		name     string
+		ip       net.IP
+		rcode    int
+		hijacked bool
+		cached   bool
+	}{
+		{"host1.", net.IPv4(192, 0, 2, 1), dns.RcodeNameError, true, false},
+		{"host1.", net.IPv4(192, 0, 2, 1), dns.RcodeNameError, true, true},
+		{"host2.", net.IPv4(198, 51, 100, 1), dns.RcodeSuccess, false, false},
+		{"host2.", net.IPv4(198, 51, 100, 1), dns.RcodeSuccess, false, true},
+	}
+	for i, tt := range tests {
+		answer := dns.Msg{}
+		answer.SetQuestion(tt.name, dns.TypeA)
+		answer.Answer = ReplyA(tt.name, tt.ip).rr
+		r.setResponse(&response{answer: &answer})
+
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if res.Hijacked != tt.hijacked {
+			t.Errorf("#%d: Hijacked = %t, want %t", i, res.Hijacked, tt.hijacked)
+		}
+		if res.Cached != tt.cached {
+			t.Errorf("#%d: Cached = %t, want %t", i, res.Cached, tt.cached)
+		}
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	options := Options{
+		SearchDomain: "home.lan",
+		Rewrites:     map[string]string{"corp.": "corp.example.com", "a.corp.": "a.example.net."},
+	}
+	var tests = []struct {
+		name     string
+		fallback bool
+		answer   string
+		resolved string
+	}{
+		{"nas.", false, "nas.\t3600\tIN\tA\t192.0.2.1", "nas.home.lan."},
+		{"NAS.", false, "NAS.\t3600\tIN\tA\t192.0.2.1", "NAS.home.lan."},
+		{"Host.Corp.", false, "Host.Corp.\t3600\tIN\tA\t192.0.2.2", "Host.corp.example.com."},
+		{"host.corp.", false, "host.corp.\t3600\tIN\tA\t192.0.2.2", "host.corp.example.com."},
+		{"host.a.corp.", false, "host.a.corp.\t3600\tIN\tA\t192.0.2.3", "host.a.example.net."},
+		{"nas.example.com.", false, "", "nas.example.com."},
+		{"missing.", false, "", "missing.home.lan."},
+		{"missing.", true, "missing.\t3600\tIN\tA\t192.0.2.4", "missing."},
+	}
+	for i, tt := range tests {
+		options.RewriteFallback = tt.fallback
+		p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resolved string
+		p.Handler = func(r *Request) *Reply {
+			resolved = r.Name
+			switch strings.ToLower(r.Name) {
+			case "nas.home.lan.":
+				return ReplyA(r.Name, net.IPv4(192, 0, 2, 1))
+			case "host.corp.example.com.":
+				return ReplyA(r.Name, net.IPv4(192, 0, 2, 2))
+			case "host.a.example.net.":
+				return ReplyA(r.Name, net.IPv4(192, 0, 2, 3))
+			case "missing.":
+				return ReplyA(r.Name, net.IPv4(192, 0, 2, 4))
+			}
+			return ReplyNXDomain()
+		}
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != tt.resolved {
+			t.Errorf("#%d: resolved %s, want %s", i, resolved, tt.resolved)
+		}
+		if got := res.Msg.Question[0].Name; got != tt.name {
+			t.Errorf("#%d: Question = %s, want %s", i, got, tt.name)
+		}
+		answer := ""
+		if len(res.Msg.Answer) > 0 {
+			answer = res.Msg.Answer[0].String()
+		}
+		if answer != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, answer, tt.answer)
+		}
+		if m.Question[0].Name != tt.name {
+			t.Errorf("#%d: query was modified", i)
+		}
+		p.Close()
+	}
+}
+
+func TestProxyHostsRecords(t *testing.T) {
+	records, err := ParseHostsRecords(strings.NewReader(`
+192.0.2.1   host1 Host1.example.com
+2001:db8::1 host1
+192.0.2.2   *.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records.Len(), 3; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	client := &recordingResolver{}
+	p, err := NewProxy(cache.New(0, nil), client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Handler = records.Reply
+	defer p.Close()
+
+	var tests = []struct {
+		rtype  uint16
+		rname  string
+		answer string
+	}{
+		{TypeA, "host1.", "host1.\t3600\tIN\tA\t192.0.2.1"},
+		{TypeAAAA, "host1.", "host1.\t3600\tIN\tAAAA\t2001:db8::1"},
+		{TypeA, "host1.example.com.", "host1.example.com.\t3600\tIN\tA\t192.0.2.1"},
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(tt.rname, tt.rtype)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Fatalf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+		if got := w.lastReply.Answer[0].String(); got != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, tt.answer)
+		}
+	}
+	if got, want := len(client.msgs), 0; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+
+	// Names not in hosts are resolved upstream, including wildcard names
+	m := dns.Msg{}
+	m.SetQuestion("foo.example.com.", TypeA)
+	p.ServeDNS(&dnsWriter{}, &m)
+	if got, want := len(client.msgs), 1; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyTrace(t *testing.T) {
+	var buf strings.Builder
+	resolver := &testResolver{}
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{TraceLogger: log.New(&buf, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	reply := m.Copy()
+	reply.Answer = []dns.RR{ReplyA("host1.", net.IPv4(192, 0, 2, 1)).rr[0]}
+	resolver.setResponse(&response{answer: reply})
+
+	var tests = []struct {
+		name  string
+		steps []string
+	}{
+		{"host1.", []string{
+			"received query A host1. from 192.0.2.100",
+			"cache miss: forwarding upstream",
+			"caching answer",
+			"upstream answered with NOERROR",
+			"replied with NOERROR and 1 answers",
+		}},
+		{"host1.", []string{
+			"received query A host1. from 192.0.2.100",
+			"cache hit",
+			"replied with NOERROR and 1 answers",
+		}},
+		{"badhost1.", []string{
+			"received query A badhost1. from 192.0.2.100",
+			"answered by handler",
+			"replied with NOERROR and 1 answers",
+		}},
+	}
+	line := regexp.MustCompile(`^trace ([0-9a-f]{8}): (.+)$`)
+	ids := make(map[string]bool)
+	for i, tt := range tests {
+		buf.Reset()
+		m.SetQuestion(tt.name, dns.TypeA)
+		p.ServeDNS(&dnsWriter{}, &m)
+		var (
+			id    string
+			steps []string
+		)
+		for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			match := line.FindStringSubmatch(l)
+			if match == nil {
+				t.Fatalf("#%d: unexpected log line %q", i, l)
+			}
+			if id == "" {
+				id = match[1]
+			} else if match[1] != id {
+				t.Errorf("#%d: trace ID of %q = %s, want %s", i, l, match[1], id)
+			}
+			steps = append(steps, match[2])
+		}
+		if !reflect.DeepEqual(steps, tt.steps) {
+			t.Errorf("#%d: steps = %q, want %q", i, steps, tt.steps)
+		}
+		if ids[id] {
+			t.Errorf("#%d: trace ID %s reused", i, id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestProxyMaxAnswers(t *testing.T) {
+	resolver := &testResolver{}
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{MaxAnswers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ips := make([]net.IP, 10)
+	for i := range ips {
+		ips[i] = net.IPv4(192, 0, 2, byte(i+1))
+	}
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyA(r.Name, ips...)
+		}
+		return nil
+	}
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	reply := m.Copy()
+	reply.Answer = ReplyA("host1.", ips...).rr
+	resolver.setResponse(&response{answer: reply})
+
+	for i, name := range []string{"host1.", "host1.", "badhost1."} {
+		m.SetQuestion(name, dns.TypeA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 3; got != want {
+			t.Fatalf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+		for j, rr := range w.lastReply.Answer {
+			if got, want := rr.(*dns.A).A, ips[j]; !got.Equal(want) {
+				t.Errorf("#%d: Answer[%d] = %s, want %s", i, j, got, want)
+			}
+		}
+	}
+	q := m.Question[0]
+	cached, ok := p.cache.Get(cache.NewKey("host1.", q.Qtype, q.Qclass))
+	if !ok {
+		t.Fatal("expected answer to be cached")
+	}
+	if got, want := len(cached.Answer), 3; got != want {
+		t.Errorf("len(Answer) = %d, want %d for cached answer", got, want)
+	}
+	if got, want := len(reply.Answer), 10; got != want {
+		t.Errorf("len(Answer) = %d, want %d for upstream answer", got, want)
+	}
+
+	if _, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{MaxAnswers: -1}); err == nil {
+		t.Error("expected error for negative max answers")
+	}
+}
+
+func TestProxyRemoveDuplicateAnswers(t *testing.T) {
+	resolver := &testResolver{}
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{RemoveDuplicateAnswers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	reply := m.Copy()
+	reply.Answer = ReplyA("host1.", net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 1)).rr
+	reply.Answer = append(reply.Answer, ReplyA("host1.", net.IPv4(192, 0, 2, 2)).SetTTL(60).rr...)
+	resolver.setResponse(&response{answer: reply})
+
+	want := []string{"192.0.2.1", "192.0.2.2"}
+	for i := 0; i < 2; i++ { // Second reply is answered from cache
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		var got []string
+		for _, rr := range w.lastReply.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, want)
+		}
+	}
+	q := m.Question[0]
+	cached, ok := p.cache.Get(cache.NewKey(q.Name, q.Qtype, q.Qclass))
+	if !ok {
+		t.Fatal("expected answer to be cached")
+	}
+	if got, want := len(cached.Answer), 2; got != want {
+		t.Errorf("len(Answer) = %d, want %d for cached answer", got, want)
+	}
+	if got, want := len(reply.Answer), 4; got != want {
+		t.Errorf("len(Answer) = %d, want %d for upstream answer", got, want)
+	}
+}
+
+func TestProxyStripOutOfBailiwick(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	names := func(rrs []dns.RR) []string {
+		var names []string
+		for _, rr := range rrs {
+			names = append(names, rr.Header().Name)
+		}
+		return names
+	}
+	var tests = []struct {
+		stripped bool
+		ns       []string
+		extra    []string
+	}{
+		{false, []string{"example.com.", "evil.example."}, []string{"ns1.example.com.", "cdn.example.net.", "ns1.evil.example.", "."}},
+		{true, []string{"example.com."}, []string{"ns1.example.com.", "cdn.example.net.", "."}},
+	}
+	for i, tt := range tests {
+		resolver := &testResolver{}
+		p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{StripOutOfBailiwick: tt.stripped})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := dns.Msg{}
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		reply := m.Copy()
+		reply.Answer = []dns.RR{
+			rr("www.example.com. 60 IN CNAME cdn.example.net."),
+			rr("cdn.example.net. 60 IN A 192.0.2.1"),
+		}
+		reply.Ns = []dns.RR{
+			rr("example.com. 60 IN NS ns1.example.com."),
+			rr("evil.example. 60 IN NS ns1.evil.example."),
+		}
+		reply.Extra = []dns.RR{
+			rr("ns1.example.com. 60 IN A 192.0.2.2"),
+			rr("cdn.example.net. 60 IN A 192.0.2.3"),
+			rr("ns1.evil.example. 60 IN A 192.0.2.4"),
+		}
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		resolver.setResponse(&response{answer: reply})
+		for j := 0; j < 2; j++ { // Second reply is answered from cache
+			res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(res.Msg.Ns); !reflect.DeepEqual(got, tt.ns) {
+				t.Errorf("#%d.%d: Ns = %q, want %q", i, j, got, tt.ns)
+			}
+			if got := names(res.Msg.Extra); !reflect.DeepEqual(got, tt.extra) {
+				t.Errorf("#%d.%d: Extra = %q, want %q", i, j, got, tt.extra)
+			}
+		}
+		if got, want := len(reply.Ns), 2; got != want {
+			t.Errorf("#%d: len(Ns) = %d, want %d for upstream answer", i, got, want)
+		}
+		p.Close()
+	}
+}
+
+func TestProxyRoutesStripOutOfBailiwick(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	routeClient := &testResolver{}
+	options := Options{
+		StripOutOfBailiwick: true,
+		Routes:              []Route{{Zones: []string{"example.com"}, Client: routeClient}},
+	}
+	p, err := NewProxyWithOptions(cache.New(10, nil), &testResolver{}, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m := dns.Msg{}
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	reply := m.Copy()
+	reply.Answer = []dns.RR{rr("www.example.com. 60 IN A 192.0.2.1")}
+	reply.Ns = []dns.RR{
+		rr("example.com. 60 IN NS ns1.example.com."),
+		rr("evil.example. 60 IN NS ns1.evil.example."),
+	}
+	reply.Extra = []dns.RR{
+		rr("ns1.example.com. 60 IN A 192.0.2.2"),
+		rr("ns1.evil.example. 60 IN A 192.0.2.3"),
+	}
+	routeClient.setResponse(&response{answer: reply})
+	res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ns, extra []string
+	for _, rr := range res.Msg.Ns {
+		ns = append(ns, rr.Header().Name)
+	}
+	for _, rr := range res.Msg.Extra {
+		extra = append(extra, rr.Header().Name)
+	}
+	if want := []string{"example.com."}; !reflect.DeepEqual(ns, want) {
+		t.Errorf("Ns = %q, want %q", ns, want)
+	}
+	if want := []string{"ns1.example.com."}; !reflect.DeepEqual(extra, want) {
+		t.Errorf("Extra = %q, want %q", extra, want)
+	}
+}
+
+type staleBackend struct{ values []cache.Value }
+
+func (b *staleBackend) Set(key uint64, value cache.Value) {}
+func (b *staleBackend) Evict(key uint64)                  {}
+func (b *staleBackend) Read() []cache.Value               { return b.values }
+func (b *staleBackend) Reset()                            {}
+
+func TestProxyPrefetchStripOutOfBailiwick(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	m := dns.Msg{}
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	stale := m.Copy()
+	stale.Answer = []dns.RR{rr("www.example.com. 60 IN A 192.0.2.1")}
+	data, err := stale.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := cache.Unpack(fmt.Sprintf("v1 1 %d %s", time.Now().Add(-time.Hour).Unix(), hex.EncodeToString(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &testResolver{}
+	reply := m.Copy()
+	reply.Answer = []dns.RR{rr("www.example.com. 60 IN A 192.0.2.2")}
+	reply.Ns = []dns.RR{
+		rr("example.com. 60 IN NS ns1.example.com."),
+		rr("evil.example. 60 IN NS ns1.evil.example."),
+	}
+	reply.Extra = []dns.RR{
+		rr("ns1.example.com. 60 IN A 192.0.2.3"),
+		rr("ns1.evil.example. 60 IN A 192.0.2.4"),
+	}
+	resolver.setResponse(&response{answer: reply})
+	client := NewFilterClient(resolver, Options{StripOutOfBailiwick: true})
+	c := cache.NewWithOptions(10, client, &staleBackend{values: []cache.Value{value}}, cache.Options{})
+
+	// Stale value is served and prefetched
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("expected stale value")
+	}
+	c.Close() // Flush queued operations
+	msg, ok := c.Get(1)
+	if !ok {
+		t.Fatal("expected prefetched value")
+	}
+	if got, want := dnsutil.Answers(msg), []string{"192.0.2.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Answers = %q, want %q", got, want)
+	}
+	if got, want := len(msg.Ns), 1; got != want {
+		t.Errorf("len(Ns) = %d, want %d", got, want)
+	}
+	if got, want := len(msg.Extra), 1; got != want {
+		t.Errorf("len(Extra) = %d, want %d", got, want)
+	}
+	if got, want := msg.Extra[0].Header().Name, "ns1.example.com."; got != want {
+		t.Errorf("Extra[0] = %s, want %s", got, want)
+	}
+}
+func TestProxyDisableCache(t *testing.T) {
+	resolver := &recordingResolver{}
+	// Any cache access panics as the cache is nil
+	p, err := NewProxyWithOptions(nil, resolver, nil, Options{DisableCache: true, Deduplicate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Cached {
+			t.Errorf("#%d: Cached = true, want false", i)
+		}
+	}
+	if got, want := len(resolver.msgs), 2; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+	if got, want := p.WarmCache(Request{Name: "host2.", Type: TypeA}), 0; got != want {
+		t.Errorf("WarmCache() = %d, want %d", got, want)
+	}
+	if got, want := len(resolver.msgs), 2; got != want {
+		t.Errorf("len(msgs) = %d, want %d after warming cache", got, want)
+	}
+}
+
+func TestProxyOffline(t *testing.T) {
+	var tests = []struct {
+		offline int
+		address net.IP
+		qtype   uint16
+		rcode   int
+		answer  string
+	}{
+		{OfflineServFail, nil, dns.TypeA, dns.RcodeServerFailure, ""},
+		{OfflineRefuse, nil, dns.TypeA, dns.RcodeRefused, ""},
+		{OfflineNXDomain, nil, dns.TypeAAAA, dns.RcodeNameError, ""},
+		{OfflineAddress, net.IPv4(192, 0, 2, 1), dns.TypeA, dns.RcodeSuccess, "host1.\t3600\tIN\tA\t192.0.2.1"},
+		{OfflineAddress, net.IPv4(192, 0, 2, 1), dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{OfflineAddress, net.ParseIP("2001:db8::1"), dns.TypeAAAA, dns.RcodeSuccess, "host1.\t3600\tIN\tAAAA\t2001:db8::1"},
+		{OfflineAddress, net.ParseIP("2001:db8::1"), dns.TypeMX, dns.RcodeSuccess, ""},
+	}
+	for i, tt := range tests {
+		p, err := NewProxyWithOptions(cache.New(10, nil), nil, nil, Options{Offline: tt.offline, OfflineAddress: tt.address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Handler = func(r *Request) *Reply {
+			if r.Name == "badhost1." {
+				return ReplyA(r.Name, net.IPv4zero)
+			}
+			return nil
+		}
+		// Handler still answers
+		m := dns.Msg{}
+		m.SetQuestion("badhost1.", dns.TypeA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+
+		m.SetQuestion("host1.", tt.qtype)
+		w = &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := w.lastReply.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := (&Reply{rr: w.lastReply.Answer}).String(); got != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, tt.answer)
+		}
+		if got, want := p.WarmCache(Request{Name: "host1.", Type: tt.qtype}), 0; got != want {
+			t.Errorf("#%d: WarmCache() = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestProxyFallback(t *testing.T) {
+	records, err := ParseRecords(strings.NewReader("host1. 60 IN A 192.0.2.100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &testResolver{}
+	resolver.setResponse(&response{fail: true})
+	p, err := NewProxyWithOptions(cache.New(10, nil), resolver, nil, Options{Fallback: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	offline, err := NewProxyWithOptions(cache.New(10, nil), nil, nil, Options{Fallback: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+	upstream := &dns.Msg{}
+	upstream.SetQuestion("host1.", dns.TypeA)
+	upstream.Answer = ReplyA("host1.", net.IPv4(192, 0, 2, 1)).rr
+
+	var tests = []struct {
+		p       *Proxy
+		recover bool
+		qname   string
+		rcode   int
+		answer  string
+	}{
+		{p, false, "host1.", dns.RcodeSuccess, "host1.\t60\tIN\tA\t192.0.2.100"},
+		{p, false, "host2.", dns.RcodeServerFailure, ""},
+		{p, true, "host1.", dns.RcodeSuccess, "host1.\t3600\tIN\tA\t192.0.2.1"}, // Upstream recovered
+		{offline, false, "host1.", dns.RcodeSuccess, "host1.\t60\tIN\tA\t192.0.2.100"},
+		{offline, false, "host2.", dns.RcodeServerFailure, ""},
+	}
+	for i, tt := range tests {
+		if tt.recover {
+			resolver.setResponse(&response{answer: upstream})
+		}
+		m := dns.Msg{}
+		m.SetQuestion(tt.qname, dns.TypeA)
+		w := &dnsWriter{}
+		tt.p.ServeDNS(w, &m)
+		if got := w.lastReply.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := (&Reply{rr: w.lastReply.Answer}).String(); got != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, tt.answer)
+		}
+	}
+}
+
+func TestProxyRoutes(t *testing.T) {
+	defaultClient := &recordingResolver{}
+	guestClient := &recordingResolver{}
+	v6Client := &recordingResolver{}
+	_, guestNet, _ := net.ParseCIDR("192.0.2.0/25")
+	_, v6Net, _ := net.ParseCIDR("2001:db8::/32")
+	options := Options{Routes: []Route{
+		{Networks: []*net.IPNet{guestNet}, Client: guestClient},
+		{Networks: []*net.IPNet{v6Net}, Client: v6Client},
+	}}
+	p, err := NewProxyWithOptions(cache.New(10, nil), defaultClient, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var tests = []struct {
+		remoteIP string
+		client   *recordingResolver
+	}{
+		{"192.0.2.1", guestClient},
+		{"192.0.2.127", guestClient},
+		{"192.0.2.128", defaultClient},
+		{"2001:db8::1", v6Client},
+		{"2001:db9::1", defaultClient},
+	}
+	for i, tt := range tests {
+		clients := []*recordingResolver{defaultClient, guestClient, v6Client}
+		before := make([]int, len(clients))
+		for j, c := range clients {
+			before[j] = len(c.msgs)
+		}
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(fmt.Sprintf("%d.example.com.", i), TypeA) // Avoid answers from cache
+		w := &dnsWriter{remoteIP: net.ParseIP(tt.remoteIP)}
+		p.ServeDNS(w, &m)
+		if w.lastReply == nil || w.lastReply.Id != m.Id {
+			t.Errorf("#%d: expected reply to query %d", i, m.Id)
+		}
+		for j, c := range clients {
+			want := 0
+			if c == tt.client {
+				want = 1
+			}
+			if got := len(c.msgs) - before[j]; got != want {
+				t.Errorf("#%d: client %d received %d queries from %s, want %d", i, j, got, tt.remoteIP, want)
+			}
+		}
+	}
+
+	// Answers from other upstreams do not use the cache
+	for i := 0; i < 2; i++ {
+		m := dns.Msg{}
+		m.SetQuestion("0.example.com.", TypeA)
+		p.ServeDNS(&dnsWriter{remoteIP: net.IPv4(192, 0, 2, 1)}, &m)
+	}
+	if got, want := len(guestClient.msgs), 4; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyRoutesReverse(t *testing.T) {
+	defaultClient := &recordingResolver{}
+	internalClient := &recordingResolver{}
+	options := Options{Routes: []Route{
+		{Zones: []string{"10.in-addr.arpa", "168.192.IN-ADDR.ARPA."}, Types: []uint16{dns.TypePTR}, Client: internalClient},
+	}}
+	p, err := NewProxyWithOptions(cache.New(10, nil), defaultClient, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		client *recordingResolver
+	}{
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, internalClient},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, internalClient},
+		{"2.1.168.192.IN-ADDR.ARPA.", dns.TypePTR, internalClient},
+		{"3.1.168.192.in-addr.arpa.", dns.TypeTXT, defaultClient},
+		{"1.2.0.192.in-addr.arpa.", dns.TypePTR, defaultClient},
+		{"10.in-addr.arpa.example.com.", dns.TypePTR, defaultClient},
+		{"example.com.", dns.TypeA, defaultClient},
+	}
+	for i, tt := range tests {
+		clients := []*recordingResolver{defaultClient, internalClient}
+		before := make([]int, len(clients))
+		for j, c := range clients {
+			before[j] = len(c.msgs)
+		}
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, tt.qtype)
+		p.ServeDNS(&dnsWriter{remoteIP: net.IPv4(192, 168, 1, 2)}, &m)
+		for j, c := range clients {
+			want := 0
+			if c == tt.client {
+				want = 1
+			}
+			if got := len(c.msgs) - before[j]; got != want {
+				t.Errorf("#%d: client %d received %d queries for %s, want %d", i, j, got, tt.name, want)
+			}
+		}
+	}
+
+	if _, err := NewProxyWithOptions(nil, defaultClient, nil, Options{Routes: []Route{{Zones: []string{"foo..bar"}}}}); err == nil {
+		t.Error("expected error for invalid route zone")
+	}
+}
+
+func TestProxyRootQueries(t *testing.T) {
+	var tests = []struct {
+		mode    int
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		queries int
+	}{
+		{RootForward, ".", dns.TypeNS, dns.RcodeSuccess, 0, 1},
+		{RootForward, "com.", dns.TypeA, dns.RcodeSuccess, 0, 1},
+		{RootRefuse, ".", dns.TypeNS, dns.RcodeRefused, 0, 0},
+		{RootRefuse, "com.", dns.TypeA, dns.RcodeRefused, 0, 0},
+		{RootRefuse, "example.com.", dns.TypeA, dns.RcodeSuccess, 0, 1},
+		{RootHints, ".", dns.TypeNS, dns.RcodeSuccess, 13, 0},
+		{RootHints, ".", dns.TypeSOA, dns.RcodeRefused, 0, 0},
+		{RootHints, "com.", dns.TypeNS, dns.RcodeRefused, 0, 0},
+		{RootHints, "example.com.", dns.TypeNS, dns.RcodeSuccess, 0, 1},
+	}
+	for i, tt := range tests {
+		client := &recordingResolver{}
+		p, err := NewProxyWithOptions(cache.New(0, nil), client, nil, Options{RootQueries: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(tt.name, tt.qtype)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := w.lastReply.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := len(w.lastReply.Answer); got != tt.answers {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, tt.answers)
+		}
+		if got := len(client.msgs); got != tt.queries {
+			t.Errorf("#%d: len(msgs) = %d, want %d", i, got, tt.queries)
+		}
+		if got := w.lastReply.Id; got != m.Id {
+			t.Errorf("#%d: Id = %d, want %d", i, got, m.Id)
+		}
+	}
+}
+
+func TestProxySpecialNames(t *testing.T) {
+	var tests = []struct {
+		mode    int
+		name    string
+		qtype   uint16
+		rcode   int
+		answer  string
+		queries int
+	}{
+		{SpecialLocal, "localhost.", dns.TypeA, dns.RcodeSuccess, "localhost.\t3600\tIN\tA\t127.0.0.1", 0},
+		{SpecialLocal, "LocalHost.", dns.TypeAAAA, dns.RcodeSuccess, "LocalHost.\t3600\tIN\tAAAA\t::1", 0},
+		{SpecialLocal, "foo.localhost.", dns.TypeA, dns.RcodeSuccess, "foo.localhost.\t3600\tIN\tA\t127.0.0.1", 0},
+		{SpecialLocal, "localhost.", dns.TypeMX, dns.RcodeSuccess, "", 0},
+		{SpecialLocal, "invalid.", dns.TypeA, dns.RcodeNameError, "", 0},
+		{SpecialLocal, "foo.invalid.", dns.TypeA, dns.RcodeNameError, "", 0},
+		{SpecialLocal, "1.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "1.0.0.127.in-addr.arpa.\t3600\tIN\tPTR\tlocalhost.", 0},
+		{SpecialLocal, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.\t3600\tIN\tPTR\tlocalhost.", 0},
+		{SpecialLocal, "2.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "", 1},
+		{SpecialLocal, "notlocalhost.", dns.TypeA, dns.RcodeSuccess, "", 1},
+		{SpecialLocal, "localhost.example.com.", dns.TypeA, dns.RcodeSuccess, "", 1},
+		{SpecialForward, "localhost.", dns.TypeA, dns.RcodeSuccess, "", 1},
+		{SpecialForward, "invalid.", dns.TypeA, dns.RcodeSuccess, "", 1},
+	}
+	for i, tt := range tests {
+		client := &recordingResolver{}
+		p, err := NewProxyWithOptions(cache.New(0, nil), client, nil, Options{SpecialNames: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, tt.qtype)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		answers := make([]string, 0, len(res.Msg.Answer))
+		for _, rr := range res.Msg.Answer {
+			answers = append(answers, rr.String())
+		}
+		if got := strings.Join(answers, "\n"); got != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, tt.answer)
+		}
+		if got := len(client.msgs); got != tt.queries {
+			t.Errorf("#%d: len(msgs) = %d, want %d", i, got, tt.queries)
+		}
+	}
+}
+
+func TestProxyLocalZones(t *testing.T) {
+	client := &recordingResolver{}
+	routeClient := &recordingResolver{}
+	options := Options{
+		LocalZones: []string{"local", "Internal."},
+		Routes:     []Route{{Zones: []string{"corp.internal"}, Client: routeClient}},
+	}
+	p, err := NewProxyWithOptions(cache.New(0, nil), client, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "nas.local." {
+			return ReplyA(r.Name, net.IPv4(192, 168, 1, 10))
+		}
+		return nil
+	}
+	var tests = []struct {
+		name      string
+		rcode     int
+		forwarded bool
+		routed    bool
+	}{
+		{"nas.local.", dns.RcodeSuccess, false, false}, // Answered locally
+		{"printer.local.", dns.RcodeNameError, false, false},
+		{"local.", dns.RcodeNameError, false, false},
+		{"db.INTERNAL.", dns.RcodeNameError, false, false},
+		{"db.corp.INTERNAL.", dns.RcodeSuccess, false, true}, // Forwarded by route
+		{"notlocal.", dns.RcodeSuccess, true, false},
+		{"local.example.com.", dns.RcodeSuccess, true, false},
+	}
+	for i, tt := range tests {
+		client.msgs = nil
+		routeClient.msgs = nil
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		res, err := p.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got := len(client.msgs) > 0; got != tt.forwarded {
+			t.Errorf("#%d: forwarded = %t, want %t", i, got, tt.forwarded)
+		}
+		if got := len(routeClient.msgs) > 0; got != tt.routed {
+			t.Errorf("#%d: routed = %t, want %t", i, got, tt.routed)
+		}
+	}
+	if _, err := NewProxyWithOptions(cache.New(0, nil), client, nil, Options{LocalZones: []string{"."}}); err == nil {
+		t.Error("want error for root zone")
+	}
+}
+
+func TestProxyShuffleAnswers(t *testing.T) {
+	records, err := ParseRecords(strings.NewReader(`
+www.example.com. IN CNAME example.com.
+example.com.     IN A     192.0.2.1
+example.com.     IN A     192.0.2.2
+example.com.     IN A     192.0.2.3
+example.com.     IN A     192.0.2.4
+example.com.     IN A     192.0.2.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := &dns.Msg{}
+	answer.SetQuestion("www.example.com.", TypeA)
+	answer.Answer = append(records["www.example.com."], records["example.com."]...)
+	order := func(seed int64) []string {
+		client := &testResolver{}
+		client.setResponse(&response{answer: answer})
+		p, err := NewProxyWithOptions(cache.New(0, nil), client, nil, Options{ShuffleAnswers: true, ShuffleSeed: seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var order []string
+		for i := 0; i < 5; i++ {
+			m := dns.Msg{}
+			m.SetQuestion("www.example.com.", TypeA)
+			w := &dnsWriter{}
+			p.ServeDNS(w, &m)
+			if got, want := len(w.lastReply.Answer), len(answer.Answer); got != want {
+				t.Fatalf("len(Answer) = %d, want %d", got, want)
+			}
+			if _, ok := w.lastReply.Answer[0].(*dns.CNAME); !ok {
+				t.Errorf("Answer[0] = %s, want CNAME", w.lastReply.Answer[0])
+			}
+			var ips []string
+			for _, rr := range w.lastReply.Answer[1:] {
+				ips = append(ips, rr.(*dns.A).A.String())
+			}
+			order = append(order, strings.Join(ips, " "))
+		}
+		return order
+	}
+	order1 := order(42)
+	order2 := order(42)
+	if !reflect.DeepEqual(order1, order2) {
+		t.Errorf("got order %q and %q with the same seed, want equal", order1, order2)
+	}
+	shuffled := false
+	for _, o := range order1 {
+		if o != "192.0.2.1 192.0.2.2 192.0.2.3 192.0.2.4 192.0.2.5" {
+			shuffled = true
+		}
+	}
+	if !shuffled {
+		t.Errorf("got order %q, want answers to be shuffled", order1)
+	}
+	// Upstream answer is not modified
+	if got, want := answer.Answer[1].(*dns.A).A.String(), "192.0.2.1"; got != want {
+		t.Errorf("Answer[1] = %s, want %s", got, want)
+	}
+}
+
+func TestProxyWarmCache(t *testing.T) {
+	client := &recordingResolver{}
+	c := cache.New(10, nil)
+	p, err := NewProxy(c, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "blocked.example.com." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	n := p.WarmCache(
+		Request{Name: "example.com", Type: TypeA},
+		Request{Name: "example.com.", Type: TypeAAAA},
+		Request{Name: "blocked.example.com.", Type: TypeA},
+	)
+	if got, want := n, 2; got != want {
+		t.Errorf("WarmCache() = %d, want %d", got, want)
+	}
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		cached bool
+	}{
+		{"example.com.", TypeA, true},
+		{"example.com.", TypeAAAA, true},
+		{"blocked.example.com.", TypeA, false},
+		{"example.org.", TypeA, false},
+	}
+	for i, tt := range tests {
+		if _, ok := c.Get(cache.NewKey(tt.name, tt.qtype, dns.ClassINET)); ok != tt.cached {
+			t.Errorf("#%d: cached(%s %s) = %t, want %t", i, dns.TypeToString[tt.qtype], tt.name, ok, tt.cached)
+		}
+	}
+	if got, want := len(client.msgs), 2; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+
+	// Warm names are answered from cache
+	m := dns.Msg{}
+	m.SetQuestion("example.com.", TypeA)
+	p.ServeDNS(&dnsWriter{}, &m)
+	if got, want := len(client.msgs), 2; got != want {
+		t.Errorf("len(msgs) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyEDNSOptions(t *testing.T) {
+	client := &recordingResolver{}
+	p, err := NewProxyWithOptions(cache.New(0, nil), client, nil, Options{EDNSOptions: []uint16{dns.EDNS0COOKIE}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "24a5ac1223a5ac12"},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}},
+	)
+	p.ServeDNS(&dnsWriter{}, m)
+
+	if got, want := len(client.msgs), 1; got != want {
+		t.Fatalf("len(msgs) = %d, want %d", got, want)
+	}
+	forwarded := client.msgs[0].IsEdns0()
+	if forwarded == nil {
+		t.Fatal("expected OPT record in forwarded query")
+	}
+	var codes []uint16
+	for _, option := range forwarded.Option {
+		codes = append(codes, option.Option())
+	}
+	if want := []uint16{dns.EDNS0COOKIE}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("forwarded options = %v, want %v", codes, want)
+	}
+	if got, want := len(opt.Option), 2; got != want {
+		t.Errorf("len(Option) of original query = %d, want %d", got, want)
+	}
+}
+
+// ecsResolver answers with the address of the client subnet in the query, and the given scope.
+type ecsResolver struct {
+	mu      sync.Mutex
+	scope   uint8
+	subnets []string
+}
+
+func (r *ecsResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	subnet := dnsutil.ClientSubnet(msg)
+	if subnet == nil {
+		r.subnets = append(r.subnets, "")
+		return reply, nil
+	}
+	r.subnets = append(r.subnets, fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask))
+	reply.Answer = ReplyA(msg.Question[0].Name, subnet.Address).SetTTL(60).rr
+	reply.SetEdns0(4096, false)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   r.scope,
+		Address:       subnet.Address,
+	})
+	return reply, nil
+}
+
+func TestProxyECSCache(t *testing.T) {
+	query := func(p *Proxy, addr string, prefix uint8) string {
+		m := &dns.Msg{}
+		m.SetQuestion("host1.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		ip := net.ParseIP(addr)
+		family := uint16(2)
+		if ip.To4() != nil {
+			ip, family = ip.To4(), 1
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: prefix, Address: ip})
+		res, err := p.Resolve(m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Msg.Answer) != 1 {
+			t.Fatalf("len(Answer) = %d, want 1", len(res.Msg.Answer))
+		}
+		return res.Msg.Answer[0].(*dns.A).A.String()
+	}
+	options := Options{EDNSOptions: []uint16{dns.EDNS0SUBNET}, ECSCache: true, ECSPrefixIPv4: 24, ECSPrefixIPv6: 56}
+
+	// Answers vary by subnet
+	client := &ecsResolver{scope: 24}
+	p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		addr   string
+		prefix uint8
+		answer string
+	}{
+		{"198.51.100.10", 32, "198.51.100.0"},
+		{"203.0.113.10", 32, "203.0.113.0"},
+		{"198.51.100.20", 32, "198.51.100.0"}, // Cached for the same /24
+		{"203.0.113.20", 24, "203.0.113.0"},   // Cached for the same /24
+	}
+	for i, tt := range tests {
+		if got := query(p, tt.addr, tt.prefix); got != tt.answer {
+			t.Errorf("#%d: answer = %s, want %s", i, got, tt.answer)
+		}
+	}
+	if want := []string{"198.51.100.0/24", "203.0.113.0/24"}; !reflect.DeepEqual(client.subnets, want) {
+		t.Errorf("forwarded subnets = %q, want %q", client.subnets, want)
+	}
+	p.Close()
+
+	// Answers apply to all subnets
+	client = &ecsResolver{scope: 0}
+	p, err = NewProxyWithOptions(cache.New(10, nil), client, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	query(p, "198.51.100.10", 32)
+	if got, want := query(p, "203.0.113.10", 32), "198.51.100.0"; got != want {
+		t.Errorf("answer = %s, want %s", got, want)
+	}
+	if got, want := len(client.subnets), 1; got != want {
+		t.Errorf("len(subnets) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyStripDNSSEC(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	answer := m.Copy()
+	a, err := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrsig, err := dns.NewRR("example.com. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsec, err := dns.NewRR("example.com. 60 IN NSEC www.example.com. A RRSIG NSEC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.Answer = []dns.RR{a, rrsig}
+	answer.Ns = []dns.RR{nsec}
+
+	for _, strip := range []bool{false, true} {
+		client := &testResolver{}
+		client.setResponse(&response{answer: answer})
+		p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, Options{StripDNSSEC: strip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// First reply is forwarded, second reply is cached
+		for i := 0; i < 2; i++ {
+			w := &dnsWriter{}
+			p.ServeDNS(w, m)
+			answers, ns := 2, 1
+			if strip {
+				answers, ns = 1, 0
+			}
+			if got := len(w.lastReply.Answer); got != answers {
+				t.Errorf("#%d: len(Answer) = %d, want %d (strip = %t)", i, got, answers, strip)
+			}
+			if got := len(w.lastReply.Ns); got != ns {
+				t.Errorf("#%d: len(Ns) = %d, want %d (strip = %t)", i, got, ns, strip)
+			}
+		}
+		if got, want := len(answer.Answer), 2; got != want {
+			t.Errorf("len(Answer) of upstream response = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestProxyMinimalResponses(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	var tests = []struct {
+		name   string
+		answer []dns.RR
+		ns     []dns.RR
+		extra  []dns.RR
+		wantNs int
+	}{
+		{"host1.", []dns.RR{rr("host1. 60 IN A 192.0.2.1")}, []dns.RR{rr("host1. 60 IN NS ns1.host1.")},
+			[]dns.RR{rr("ns1.host1. 60 IN A 192.0.2.53")}, 0},
+		{"host2.", nil, []dns.RR{rr("host2. 60 IN SOA ns1.host2. hostmaster.host2. 1 3600 600 86400 60")},
+			[]dns.RR{rr("ns1.host2. 60 IN A 192.0.2.53")}, 1}, // NODATA keeps SOA
+		{"host3.", []dns.RR{rr("host3. 60 IN CNAME host4.")},
+			[]dns.RR{rr("host4. 60 IN SOA ns1.host4. hostmaster.host4. 1 3600 600 86400 60")},
+			[]dns.RR{rr("ns1.host4. 60 IN A 192.0.2.53")}, 1}, // NODATA after CNAME keeps SOA
+		{"host5.", []dns.RR{rr("host5. 60 IN CNAME host6."), rr("host6. 60 IN A 192.0.2.1")},
+			[]dns.RR{rr("host6. 60 IN NS ns1.host6.")}, []dns.RR{rr("ns1.host6. 60 IN A 192.0.2.53")}, 0},
+	}
+	for i, tt := range tests {
+		m := &dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		m.SetEdns0(4096, false)
+		answer := m.Copy()
+		answer.Answer = tt.answer
+		answer.Ns = tt.ns
+		answer.Extra = append(answer.Extra, tt.extra...)
+		for _, minimal := range []bool{false, true} {
+			client := &testResolver{}
+			client.setResponse(&response{answer: answer})
+			p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, Options{MinimalResponses: minimal})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &dnsWriter{}
+			p.ServeDNS(w, m)
+			ns, extra := len(tt.ns), len(tt.extra)+1
+			if minimal {
+				ns, extra = tt.wantNs, 1
+			}
+			if got := len(w.lastReply.Answer); got != len(tt.answer) {
+				t.Errorf("#%d: len(Answer) = %d, want %d (minimal = %t)", i, got, len(tt.answer), minimal)
+			}
+			if got := len(w.lastReply.Ns); got != ns {
+				t.Errorf("#%d: len(Ns) = %d, want %d (minimal = %t)", i, got, ns, minimal)
+			}
+			if got := len(w.lastReply.Extra); got != extra {
+				t.Errorf("#%d: len(Extra) = %d, want %d (minimal = %t)", i, got, extra, minimal)
+			}
+			if w.lastReply.IsEdns0() == nil {
+				t.Errorf("#%d: want OPT record (minimal = %t)", i, minimal)
+			}
+			p.Close()
+		}
+	}
+}
+
+func TestProxyPreserveQueryCase(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	answer := &dns.Msg{}
+	answer.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	answer.Answer = []dns.RR{rr("EXAMPLE.com. 60 IN CNAME Www.Example.com."), rr("Www.Example.com. 60 IN A 192.0.2.1")}
+
+	var tests = []struct {
+		name     string
+		preserve bool
+		owner    string
+	}{
+		{"ExAmple.COM.", false, "EXAMPLE.com."}, // Forwarded
+		{"example.com.", false, "EXAMPLE.com."}, // Cached
+		{"ExAmple.COM.", true, "ExAmple.COM."},
+		{"example.com.", true, "example.com."},
+	}
+	for i, tt := range tests {
+		if i%2 == 1 {
+			continue // Tested along with the previous query
+		}
+		client := &testResolver{}
+		client.setResponse(&response{answer: answer})
+		p, err := NewProxyWithOptions(cache.New(10, nil), client, nil, Options{PreserveQueryCase: tt.preserve})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, tt := range tests[i : i+2] {
+			m := &dns.Msg{}
+			m.SetQuestion(tt.name, dns.TypeA)
+			w := &dnsWriter{}
+			p.ServeDNS(w, m)
+			if got := w.lastReply.Question[0].Name; got != tt.owner {
+				t.Errorf("#%d: Question[0].Name = %q, want %q", i+j, got, tt.owner)
+			}
+			if got, want := len(w.lastReply.Answer), 2; got != want {
+				t.Fatalf("#%d: len(Answer) = %d, want %d", i+j, got, want)
+			}
+			if got := w.lastReply.Answer[0].Header().Name; got != tt.owner {
+				t.Errorf("#%d: Answer[0] owner = %q, want %q", i+j, got, tt.owner)
+			}
+			if got, want := w.lastReply.Answer[1].Header().Name, "Www.Example.com."; got != want {
+				t.Errorf("#%d: Answer[1] owner = %q, want %q", i+j, got, want)
+			}
+		}
+		p.Close()
+	}
+	if got, want := answer.Answer[0].Header().Name, "EXAMPLE.com."; got != want {
+		t.Errorf("owner of upstream response = %q, want %q", got, want)
+	}
+}
+
+func TestProxyMalformedName(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+	label63 := strings.Repeat("a", 63)
+	var tests = []struct {
+		name  string
+		rcode int
+	}{
+		{strings.Repeat(label63+".", 3) + strings.Repeat("a", 61) + ".", dns.RcodeSuccess},     // 255 octets
+		{strings.Repeat(label63+".", 3) + strings.Repeat("a", 62) + ".", dns.RcodeFormatError}, // 256 octets
+		{strings.Repeat(label63+".", 5), dns.RcodeFormatError},
+		{strings.Repeat("a.", 127), dns.RcodeSuccess},
+		{strings.Repeat("a.", 128), dns.RcodeFormatError},
+		{strings.Repeat("a", 64) + ".", dns.RcodeFormatError},
+	}
+	malformed := int64(0)
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, dns.TypeA)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := w.lastReply.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if tt.rcode == dns.RcodeFormatError {
+			malformed++
+			if _, err := w.lastReply.Pack(); err != nil {
+				t.Errorf("#%d: Pack() = %v, want packable reply", i, err)
+			}
+		}
+	}
+	stats := p.Stats()
+	if got := stats.Malformed; got != malformed {
+		t.Errorf("Malformed = %d, want %d", got, malformed)
+	}
+	if got, want := stats.Responses["FORMERR"], malformed; got != want {
+		t.Errorf("Responses[FORMERR] = %d, want %d", got, want)
+	}
+}
+
+func TestProxyFileLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zdns.log")
+	w, err := logfile.NewWriter(path, logfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logfile.NewLogger(w)
+	p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{FileLogger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+	m := dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	p.ServeDNS(&dnsWriter{}, &m)
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"remote_addr":"192.0.2.100","hijacked":true,"type":"A","question":"example.com.","answers":["0.0.0.0"]}` + "\n"
+	if got := string(b); !strings.HasSuffix(got, want) || strings.Count(got, "\n") != 1 {
+		t.Errorf("got %q, want single entry ending in %q", got, want)
+	}
+}
+
+func TestProxyListenAny(t *testing.T) {
+	if pc, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skipf("ipv6 is unavailable: %s", err)
+	} else {
+		pc.Close()
+	}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+	go p.ListenAndServe(":"+port, "udp")
+	defer p.Close()
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		addr := net.JoinHostPort(host, port)
+		m := dns.Msg{}
+		m.SetQuestion("host1.", dns.TypeA)
+		var reply *dns.Msg
+		ts := time.Now()
+		for {
+			reply, err = dns.Exchange(&m, addr)
+			if err == nil {
+				break
+			}
+			if time.Since(ts) > 2*time.Second {
+				t.Fatalf("timed out waiting for %s: %s", addr, err)
+			}
+		}
+		if got, want := len(reply.Answer), 1; got != want {
+			t.Errorf("len(Answer) = %d, want %d (addr = %s)", got, want, addr)
+		}
+	}
+}
+
+// serveUDP starts serving proxy p on a free UDP port on the loopback address. It returns the address and a channel
+// receiving the result of ListenAndServe.
+func serveUDP(tb testing.TB, p *Proxy) (string, chan error) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- p.ListenAndServe(addr, "udp") }()
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	for ts := time.Now(); ; {
+		if _, err := dns.Exchange(&m, addr); err == nil {
+			break
+		}
+		if time.Since(ts) > 2*time.Second {
+			tb.Fatalf("timed out waiting for %s", addr)
+		}
+	}
+	return addr, errs
+}
+
+func TestProxyUDPReaders(t *testing.T) {
+	p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{UDPReaders: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4(192, 0, 2, 1)) }
+	addr, errs := serveUDP(t, p)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				name := fmt.Sprintf("host%d-%d.", i, j)
+				m := dns.Msg{}
+				m.SetQuestion(name, dns.TypeA)
+				reply, err := dns.Exchange(&m, addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if reply.Id != m.Id || len(reply.Answer) != 1 || reply.Answer[0].Header().Name != name {
+					t.Errorf("got reply %s to query for %s", reply, name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("ListenAndServe() = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for proxy to stop")
+	}
+}
+
+func BenchmarkProxyUDPReaders(b *testing.B) {
+	for _, readers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			p, err := NewProxyWithOptions(cache.New(0, nil), nil, nil, Options{UDPReaders: readers})
+			if err != nil {
+				b.Fatal(err)
+			}
+			p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4(192, 0, 2, 1)) }
+			addr, _ := serveUDP(b, p)
+			defer p.Close()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c := &dns.Client{}
+				m := dns.Msg{}
+				m.SetQuestion("host1.", dns.TypeA)
+				for pb.Next() {
+					if _, _, err := c.Exchange(&m, addr); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRecords(t *testing.T) {
+	records, err := ParseRecords(strings.NewReader(`
+host1.example.com.         IN A    192.0.2.1
+HOST1.example.com.         IN AAAA 2001:db8::1
+host2.example.com          IN TXT  "foo bar"
+host1.example.com.     300 IN A    192.0.2.2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records.Len(), 4; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	var tests = []struct {
+		rtype uint16
+		rname string
+		out   string
+	}{
+		{TypeA, "host1.example.com.", "host1.example.com.\t3600\tIN\tA\t192.0.2.1\nhost1.example.com.\t300\tIN\tA\t192.0.2.2"},
+		{TypeA, "Host1.Example.Com.", "host1.example.com.\t3600\tIN\tA\t192.0.2.1\nhost1.example.com.\t300\tIN\tA\t192.0.2.2"},
+		{TypeAAAA, "host1.example.com.", "HOST1.example.com.\t3600\tIN\tAAAA\t2001:db8::1"},
+		{dns.TypeTXT, "host2.example.com.", "host2.example.com.\t3600\tIN\tTXT\t\"foo bar\""},
+		{dns.TypeMX, "host1.example.com.", ""},
+		{TypeA, "host3.example.com.", ""},
+	}
+	for i, tt := range tests {
+		reply := records.Reply(&Request{Type: tt.rtype, Name: tt.rname})
+		if reply == nil {
+			reply = &Reply{}
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: Reply(%s %s) = %q, want %q", i, dns.TypeToString[tt.rtype], tt.rname, got, tt.out)
+		}
+	}
+	// Replies do not modify records
+	records.Reply(&Request{Type: TypeA, Name: "host1.example.com."}).SetTTL(0)
+	if got, want := records["host1.example.com."][2].Header().Ttl, uint32(300); got != want {
+		t.Errorf("Ttl = %d, want %d", got, want)
+	}
+	if _, err := ParseRecords(strings.NewReader("host1.example.com. IN A foo")); err == nil {
+		t.Error("expected error for invalid record")
+	}
+
+	// Default TTL
+	records, err = ParseRecordsWithTTL(strings.NewReader("host1.example.com. IN A 192.0.2.1"), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records["host1.example.com."][0].Header().Ttl, uint32(60); got != want {
+		t.Errorf("Ttl = %d, want %d", got, want)
+	}
+	records, err = ParseHostsRecordsWithTTL(strings.NewReader("192.0.2.1 host1.example.com"), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records["host1.example.com."][0].Header().Ttl, uint32(60); got != want {
+		t.Errorf("Ttl = %d, want %d", got, want)
+	}
+}
+
+func TestProxyRecordsHTTPS(t *testing.T) {
+	records, err := ParseRecords(strings.NewReader(`
+svc.example.com.            IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech="AEX+DQBBpQAgACB/RsHOPX2+cyD5rWAT1NEP7/MzUXPhaUkzuqEJLPRSHwAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA="
+svc.example.com.            IN A     192.0.2.1
+_8443._foo.svc.example.com. IN SVCB  1 svc.example.com. alpn=h2 port=8443
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testProxy(t)
+	defer p.Close()
+	p.Handler = records.Reply
+
+	var tests = []struct {
+		qtype uint16
+		qname string
+		out   string
+	}{
+		{dns.TypeHTTPS, "svc.example.com.", "svc.example.com.\t3600\tIN\tHTTPS\t1 . alpn=\"h3,h2\" port=\"8443\" ipv4hint=\"192.0.2.1\" ipv6hint=\"2001:db8::1\" ech=\"AEX+DQBBpQAgACB/RsHOPX2+cyD5rWAT1NEP7/MzUXPhaUkzuqEJLPRSHwAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA=\""},
+		{dns.TypeSVCB, "_8443._foo.svc.example.com.", "_8443._foo.svc.example.com.\t3600\tIN\tSVCB\t1 svc.example.com. alpn=\"h2\" port=\"8443\""},
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion(tt.qname, tt.qtype)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 1; got != want {
+			t.Fatalf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+		if got := w.lastReply.Answer[0].String(); got != tt.out {
+			t.Errorf("#%d: Answer[0] = %q, want %q", i, got, tt.out)
+		}
+		if !w.lastReply.Authoritative {
+			t.Errorf("#%d: Authoritative = false, want true", i)
+		}
+	}
+}
+
 func TestReplyString(t *testing.T) {
 	var tests = []struct {
 		fn      func(string, ...net.IP) *Reply
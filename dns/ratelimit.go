@@ -0,0 +1,37 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// limiter limits the number of queries per second from a single client.
+type limiter struct {
+	mu     sync.Mutex
+	limit  int
+	window int64
+	counts map[string]int
+	now    func() time.Time
+}
+
+func newLimiter(limit int) *limiter {
+	return &limiter{limit: limit, counts: make(map[string]int), now: time.Now}
+}
+
+// allow returns whether a query from ip is allowed in the current one second window.
+func (l *limiter) allow(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	window := l.now().Unix()
+	if window != l.window {
+		l.window = window
+		l.counts = make(map[string]int)
+	}
+	k := string(ip)
+	if l.counts[k] >= l.limit {
+		return false
+	}
+	l.counts[k]++
+	return true
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"io"
+
+	"github.com/miekg/dns"
+	"github.com/mpolden/zdns/hosts"
+)
+
+// Records represents a set of static resource records, indexed by their canonical name.
+type Records map[string][]dns.RR
+
+// ParseRecords parses resource records in zone file format from reader r. Relative names are assumed to be relative to
+// the root zone. Records without an explicit TTL inherit the TTL of the previous record, as in a zone file, or 3600 seconds
+// if there is no previous record or $TTL directive.
+func ParseRecords(r io.Reader) (Records, error) { return ParseRecordsWithTTL(r, 3600) }
+
+// ParseRecordsWithTTL parses resource records like ParseRecords, but records without an explicit TTL, previous record or
+// $TTL directive are given ttl seconds.
+func ParseRecordsWithTTL(r io.Reader, ttl uint32) (Records, error) {
+	records := make(Records)
+	zp := dns.NewZoneParser(r, ".", "")
+	zp.SetDefaultTTL(ttl)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ParseHostsRecords parses hosts from reader r, and returns them as A and AAAA records with a TTL of 3600 seconds.
+// Wildcard entries are ignored.
+func ParseHostsRecords(r io.Reader) (Records, error) { return ParseHostsRecordsWithTTL(r, 3600) }
+
+// ParseHostsRecordsWithTTL parses hosts like ParseHostsRecords, but the records are given ttl seconds.
+func ParseHostsRecordsWithTTL(r io.Reader, ttl uint32) (Records, error) {
+	hs, err := hosts.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make(Records)
+	for name, ipAddrs := range hs {
+		if hosts.IsWildcard(name) {
+			continue
+		}
+		name = dns.CanonicalName(name)
+		for _, ipAddr := range ipAddrs {
+			var reply *Reply
+			if ipAddr.IP.To4() != nil {
+				reply = ReplyA(name, ipAddr.IP)
+			} else {
+				reply = ReplyAAAA(name, ipAddr.IP)
+			}
+			records[name] = append(records[name], reply.SetTTL(ttl).rr...)
+		}
+	}
+	return records, nil
+}
+
+// Len returns the number of records in rs.
+func (rs Records) Len() int {
+	n := 0
+	for _, rr := range rs {
+		n += len(rr)
+	}
+	return n
+}
+
+// Reply returns a reply containing the records matching the name and type of request r. If there are no matching
+// records, nil is returned.
+func (rs Records) Reply(r *Request) *Reply {
+	var rr []dns.RR
+	for _, record := range rs[dns.CanonicalName(r.Name)] {
+		if record.Header().Rrtype == r.Type {
+			rr = append(rr, dns.Copy(record))
+		}
+	}
+	if len(rr) == 0 {
+		return nil
+	}
+	return &Reply{rr: rr}
+}
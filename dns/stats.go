@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// otherLabel is the label counting query types and response codes that are not tracked individually.
+const otherLabel = "OTHER"
+
+// statsTypes contains the query types tracked individually. Counting is limited to a fixed set of types so that the
+// number of counters stays bounded, regardless of the queries received.
+var statsTypes = map[uint16]bool{
+	dns.TypeA:      true,
+	dns.TypeAAAA:   true,
+	dns.TypeANY:    true,
+	dns.TypeCAA:    true,
+	dns.TypeCNAME:  true,
+	dns.TypeDNSKEY: true,
+	dns.TypeDS:     true,
+	dns.TypeHTTPS:  true,
+	dns.TypeMX:     true,
+	dns.TypeNAPTR:  true,
+	dns.TypeNS:     true,
+	dns.TypePTR:    true,
+	dns.TypeSOA:    true,
+	dns.TypeSRV:    true,
+	dns.TypeSVCB:   true,
+	dns.TypeTXT:    true,
+}
+
+// Stats contains statistics of queries handled by a proxy.
+type Stats struct {
+	// Queries is the number of queries received, by query type.
+	Queries map[string]int64
+	// Responses is the number of responses sent, by response code.
+	Responses map[string]int64
+	// Malformed is the number of queries rejected with FORMERR because their name exceeds the limits of a domain name.
+	Malformed int64
+}
+
+type stats struct {
+	mu        sync.Mutex
+	queries   map[string]int64
+	responses map[string]int64
+	malformed int64
+}
+
+func newStats() *stats {
+	return &stats{queries: make(map[string]int64), responses: make(map[string]int64)}
+}
+
+func (s *stats) countQuery(qtype uint16) {
+	label := otherLabel
+	if statsTypes[qtype] {
+		label = dns.TypeToString[qtype]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[label]++
+}
+
+func (s *stats) countResponse(rcode int) {
+	label, ok := dns.RcodeToString[rcode]
+	if !ok {
+		label = otherLabel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[label]++
+}
+
+func (s *stats) countMalformed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.malformed++
+}
+
+func (s *stats) read() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{
+		Queries:   make(map[string]int64, len(s.queries)),
+		Responses: make(map[string]int64, len(s.responses)),
+		Malformed: s.malformed,
+	}
+	for k, v := range s.queries {
+		st.Queries[k] = v
+	}
+	for k, v := range s.responses {
+		st.Responses[k] = v
+	}
+	return st
+}
+
+func (s *stats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = make(map[string]int64)
+	s.responses = make(map[string]int64)
+	s.malformed = 0
+}
+
+// countingWriter is a dns.ResponseWriter counting the response codes of written messages.
+type countingWriter struct {
+	dns.ResponseWriter
+	stats *stats
+}
+
+func (w *countingWriter) WriteMsg(m *dns.Msg) error {
+	w.stats.countResponse(m.Rcode)
+	return w.ResponseWriter.WriteMsg(m)
+}
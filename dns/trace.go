@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+// trace logs the steps taken to resolve a single query. All lines logged by a trace are prefixed with its ID. A nil
+// trace logs nothing.
+type trace struct {
+	id     string
+	logger *log.Logger
+}
+
+func newTrace(logger *log.Logger) *trace {
+	if logger == nil {
+		return nil
+	}
+	return &trace{id: fmt.Sprintf("%08x", rand.Uint32()), logger: logger}
+}
+
+func (t *trace) printf(format string, v ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.logger.Printf("trace %s: %s", t.id, fmt.Sprintf(format, v...))
+}
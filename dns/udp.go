@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// udpReader reads packets from a UDP connection using a pool of goroutines, each reading from the connection in
+// parallel. Packets are handed over to the server's serve loop in the order they are read.
+type udpReader struct {
+	dns.Reader
+	readers int
+	packets chan udpPacket
+	start   sync.Once
+	stop    sync.Once
+	done    chan struct{}
+}
+
+type udpPacket struct {
+	msg     []byte
+	session *dns.SessionUDP
+	err     error
+}
+
+func newUDPReader(reader dns.Reader, readers int) *udpReader {
+	return &udpReader{
+		Reader:  reader,
+		readers: readers,
+		packets: make(chan udpPacket, readers),
+		done:    make(chan struct{}),
+	}
+}
+
+// ReadUDP returns the next packet read by any of the reader goroutines. The goroutines are started on the first call.
+func (r *udpReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	r.start.Do(func() {
+		for i := 0; i < r.readers; i++ {
+			go r.read(conn)
+		}
+	})
+	p := <-r.packets
+	if isFatal(p.err) {
+		// The server is shutting down. Stop any reader still waiting to deliver a packet
+		r.stop.Do(func() { close(r.done) })
+	}
+	return p.msg, p.session, p.err
+}
+
+func (r *udpReader) read(conn *net.UDPConn) {
+	for {
+		msg := make([]byte, dns.MinMsgSize)
+		n, session, err := dns.ReadFromSessionUDP(conn, msg)
+		if err != nil {
+			n = 0
+		}
+		select {
+		case r.packets <- udpPacket{msg: msg[:n], session: session, err: err}:
+		case <-r.done:
+			return
+		}
+		if isFatal(err) {
+			return
+		}
+	}
+}
+
+// isFatal returns whether err should stop reading from a connection. Reads from the connection have no deadline, so a
+// timeout can only be caused by the server shutting down.
+func isFatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return !ok || netErr.Timeout() || !netErr.Temporary()
+}
@@ -0,0 +1,105 @@
+package hosts
+
+import (
+	"math"
+	"strings"
+)
+
+// BloomFilter is a probabilistic set of host names. Testing a name that was added to the filter always succeeds, while
+// testing a name that was not added succeeds with a small, configurable probability. A filter speeds up lookups of
+// names that are not in a large Hosts, but does not replace it.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// NewBloomFilter creates a Bloom filter sized for n names with a false positive probability of p.
+func NewBloomFilter(n int, p float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// NewBloomFilterFrom creates a Bloom filter containing all names in hosts.
+func NewBloomFilterFrom(hosts Hosts, p float64) *BloomFilter {
+	f := NewBloomFilter(len(hosts), p)
+	for name := range hosts {
+		f.Add(name)
+	}
+	return f
+}
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// fnv1a continues the 64-bit FNV-1a hash sum with the bytes of s. Computed inline to avoid allocating a hash.Hash64 on
+// every lookup.
+func fnv1a(sum uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		sum ^= uint64(s[i])
+		sum *= prime64
+	}
+	return sum
+}
+
+// hashes returns two hashes of name, derived from its 64-bit FNV-1a hash.
+func hashes(name string) (uint64, uint64) { return split(fnv1a(offset64, name)) }
+
+// split derives two hashes from the 64-bit hash sum.
+func split(sum uint64) (uint64, uint64) { return sum & 0xffffffff, sum>>32 | 1 }
+
+// Add adds name to the filter.
+func (f *BloomFilter) Add(name string) {
+	h1, h2 := hashes(name)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test returns whether name may have been added to the filter. A false return value means that name was definitely
+// not added.
+func (f *BloomFilter) Test(name string) bool { return f.test(fnv1a(offset64, name)) }
+
+// test returns whether the name hashing to sum may have been added to the filter.
+func (f *BloomFilter) test(sum uint64) bool {
+	h1, h2 := split(sum)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the size of the filter in bytes.
+func (f *BloomFilter) Size() int { return len(f.bits) * 8 }
+
+// Match returns whether name, or a wildcard name covering it, may have been added to the filter. See Hosts.Match.
+// Wildcard names are hashed in place, so that Match does not allocate.
+func (f *BloomFilter) Match(name string) bool {
+	if f.Test(name) {
+		return true
+	}
+	wildcard := fnv1a(offset64, "*.")
+	for i := strings.IndexByte(name, '.'); i >= 0 && i < len(name)-1; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if f.test(fnv1a(wildcard, name)) {
+			return true
+		}
+	}
+	return false
+}
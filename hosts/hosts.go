@@ -46,6 +46,31 @@ func (h Hosts) Get(name string) ([]net.IPAddr, bool) {
 	return ipAddrs, ok
 }
 
+// Match returns the name of the hosts entry matching name. An exact match is preferred, otherwise the closest
+// wildcard entry, such as *.example.com, covering a subdomain of name is returned.
+func (h Hosts) Match(name string) (string, bool) {
+	if _, ok := h[name]; ok {
+		return name, true
+	}
+	return matchWildcard(name, func(wildcard string) bool {
+		_, ok := h[wildcard]
+		return ok
+	})
+}
+
+// IsWildcard returns whether name is a wildcard name.
+func IsWildcard(name string) bool { return strings.HasPrefix(name, "*.") }
+
+func matchWildcard(name string, f func(string) bool) (string, bool) {
+	for i := strings.IndexByte(name, '.'); i >= 0 && i < len(name)-1; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if wildcard := "*." + name; f(wildcard) {
+			return wildcard, true
+		}
+	}
+	return "", false
+}
+
 // Del deletes the hosts entry of name.
 func (h Hosts) Del(name string) {
 	delete(h, name)
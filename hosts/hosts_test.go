@@ -1,7 +1,10 @@
 package hosts
 
 import (
+	"fmt"
+	"net"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -98,3 +101,178 @@ ff02::3         ip6-allhosts
 	}
 	testParser(&Parser{}, in, tests2, t)
 }
+
+func TestMatch(t *testing.T) {
+	h, err := Parse(strings.NewReader(`
+192.0.2.1 example.com
+192.0.2.2 *.example.com
+192.0.2.3 *.sub.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewBloomFilterFrom(h, 0.01)
+	var tests = []struct {
+		in    string
+		match string
+		ok    bool
+	}{
+		{"example.com", "example.com", true},
+		{"foo.example.com", "*.example.com", true},
+		{"foo.bar.example.com", "*.example.com", true},
+		{"sub.example.com", "*.example.com", true},
+		{"foo.sub.example.com", "*.sub.example.com", true},
+		{"example.org", "", false},
+		{"com", "", false},
+		{"", "", false},
+	}
+	for i, tt := range tests {
+		match, ok := h.Match(tt.in)
+		if match != tt.match || ok != tt.ok {
+			t.Errorf("#%d: Match(%q) = (%q, %t), want (%q, %t)", i, tt.in, match, ok, tt.match, tt.ok)
+		}
+		if tt.ok && !f.Match(tt.in) {
+			t.Errorf("#%d: BloomFilter.Match(%q) = false, want true", i, tt.in)
+		}
+	}
+}
+
+func testHosts(n int) Hosts {
+	hosts := make(Hosts, n)
+	for i := 0; i < n; i++ {
+		hosts[fmt.Sprintf("host%d.example.com", i)] = []net.IPAddr{{IP: net.IPv4zero}}
+	}
+	return hosts
+}
+
+func TestBloomFilter(t *testing.T) {
+	n := 10000
+	hosts := testHosts(n)
+	f := NewBloomFilterFrom(hosts, 0.01)
+	for name := range hosts {
+		if !f.Test(name) {
+			t.Fatalf("Test(%q) = false, want true", name)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if f.Test(fmt.Sprintf("other%d.example.com", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(n); rate > 0.02 {
+		t.Errorf("false positive rate = %f, want <= %f", rate, 0.02)
+	}
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	h, err := Parse(strings.NewReader(`
+192.0.2.1 *.example.com
+192.0.2.2 *.Sub.Example.ORG
+192.0.2.3 MixedCase.example.net
+192.0.2.4 *.ads.EXAMPLE.net
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewBloomFilterFrom(h, 0.01)
+	names := []string{
+		"foo.example.com",
+		"Foo.Bar.example.com",
+		"foo.Sub.Example.ORG",
+		"A.B.Sub.Example.ORG",
+		"MixedCase.example.net",
+		"Tracker.ads.EXAMPLE.net",
+		"x.Y.z.ads.EXAMPLE.net",
+	}
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("Host%d.Sub.Example.ORG", i), fmt.Sprintf("host%d.ADS.example.net", i))
+	}
+	matches := 0
+	for _, name := range names {
+		if _, ok := h.Match(name); !ok {
+			continue
+		}
+		matches++
+		if !f.Match(name) {
+			t.Errorf("BloomFilter.Match(%q) = false, want true", name)
+		}
+	}
+	if want := 1007; matches != want {
+		t.Errorf("hosts matched %d names, want %d", matches, want)
+	}
+}
+
+func TestBloomFilterMatchAllocs(t *testing.T) {
+	f := NewBloomFilterFrom(testHosts(1000), 0.01)
+	f.Add("*.example.org")
+	for _, name := range []string{"foo.bar.example.net", "foo.bar.example.org"} {
+		if allocs := testing.AllocsPerRun(100, func() { f.Match(name) }); allocs != 0 {
+			t.Errorf("Match(%q) allocated %.0f times, want 0", name, allocs)
+		}
+	}
+	if !f.Match("foo.bar.example.org") {
+		t.Error("Match(\"foo.bar.example.org\") = false, want true")
+	}
+}
+
+func BenchmarkHostsGetMiss(b *testing.B) {
+	hosts := testHosts(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hosts.Get("nonexistent.example.com")
+	}
+}
+
+func BenchmarkBloomFilterTestMiss(b *testing.B) {
+	f := NewBloomFilterFrom(testHosts(100000), 0.01)
+	b.ReportMetric(float64(f.Size()), "filter-bytes")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Test("nonexistent.example.com")
+	}
+}
+
+func BenchmarkHostsMatchMiss(b *testing.B) {
+	hosts := testHosts(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hosts.Match("foo.nonexistent.example.com")
+	}
+}
+
+func BenchmarkBloomFilterMatchMiss(b *testing.B) {
+	f := NewBloomFilterFrom(testHosts(100000), 0.01)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Match("foo.nonexistent.example.com")
+	}
+}
+
+// heapAlloc returns the number of bytes allocated on the heap that are still in use.
+func heapAlloc() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
+
+// BenchmarkRetainedHeap compares the heap retained by hosts alone with the heap retained by hosts and a Bloom filter of
+// them. The filter is kept in addition to hosts, so it always adds memory.
+func BenchmarkRetainedHeap(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		before := heapAlloc()
+		hosts := testHosts(100000)
+		withMap := heapAlloc()
+		f := NewBloomFilterFrom(hosts, 0.01)
+		withFilter := heapAlloc()
+		runtime.KeepAlive(hosts)
+		runtime.KeepAlive(f)
+		b.ReportMetric(float64(withMap-before), "map-bytes")
+		b.ReportMetric(float64(withFilter-before), "map+filter-bytes")
+	}
+}
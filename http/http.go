@@ -2,35 +2,112 @@ package http
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	_ "net/http/pprof" // Registers debug handlers as a side effect.
+	"net/http/pprof"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mpolden/zdns"
 	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns"
 	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/sql"
 )
 
 const (
-	jsonMediaType = "application/json"
+	jsonMediaType  = "application/json"
+	csvMediaType   = "text/csv"
+	jsonlMediaType = "application/x-ndjson"
 )
 
 // A Server defines parameters for running an HTTP server. The HTTP server serves an API for inspecting cache contents
 // and request log.
 type Server struct {
+	// Filter enables endpoints for blocking and allowing hosts, and reloading hosts sources, at runtime, if set.
+	Filter Filter
+	// Reloader enables an endpoint for reloading static records and hosts at runtime, if set.
+	Reloader Reloader
+	// Pprof enables the runtime profiling endpoints of net/http/pprof under /debug/pprof/, if set. These are admin
+	// endpoints.
+	Pprof bool
+	// Proxy enables metrics of queries by type and responses by response code, if set.
+	Proxy Proxy
+	// Upstream enables metrics of exchanges with each upstream resolver, if set.
+	Upstream Upstream
+	// Maintainer enables endpoints for inspecting and toggling maintenance mode at runtime, if set.
+	Maintainer Maintainer
+	// AdminToken is the bearer token required by admin endpoints, such as those blocking and allowing hosts. Admin
+	// endpoints reject all requests if it is empty.
+	AdminToken string
+
 	cache    *cache.Cache
 	logger   *sql.Logger
 	sqlCache *sql.Cache
 	server   *http.Server
+	// metricMu is held exclusively while metrics are reset, so that metrics are never read from a partial reset.
+	metricMu sync.RWMutex
+}
+
+// Filter is the interface for types that can block and allow hosts, and reload hosts sources, at runtime.
+type Filter interface {
+	Block(name string) error
+	Allow(name string) error
+	ReloadHostsWithResult() zdns.ReloadResult
+}
+
+// Reloader is the interface for types that can reload static records and hosts at runtime, and report the status of
+// each source.
+type Reloader interface {
+	ReloadWithResult() zdns.ReloadResult
+	Sources() []zdns.SourceStatus
+}
+
+// Proxy is the interface for types that collect statistics of DNS queries.
+type Proxy interface {
+	Stats() dns.Stats
+	ResetStats()
+}
+
+// Upstream is the interface for types that collect statistics of exchanges with upstream resolvers.
+type Upstream interface {
+	Stats() dnsutil.Stats
+	ResetStats()
+}
+
+// Maintainer is the interface for types that can toggle maintenance mode at runtime.
+type Maintainer interface {
+	SetMaintenance(enabled bool)
+	Maintenance() bool
+}
+
+type maintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+type reloadResult struct {
+	Sources  []reloadSource `json:"sources"`
+	Duration string         `json:"duration"`
+}
+
+type reloadSource struct {
+	Source  string `json:"source"`
+	Type    string `json:"type"`
+	Entries int    `json:"entries"`
+	Error   string `json:"error,omitempty"`
 }
 
 type entry struct {
 	Time       string   `json:"time"`
+	Key        *uint64  `json:"key,omitempty"`
 	TTL        int64    `json:"ttl,omitempty"`
 	RemoteAddr net.IP   `json:"remote_addr,omitempty"`
 	Hijacked   *bool    `json:"hijacked,omitempty"`
@@ -38,6 +115,7 @@ type entry struct {
 	Question   string   `json:"question"`
 	Answers    []string `json:"answers,omitempty"`
 	Rcode      string   `json:"rcode,omitempty"`
+	Source     string   `json:"source,omitempty"`
 }
 
 type stats struct {
@@ -46,8 +124,25 @@ type stats struct {
 }
 
 type summary struct {
-	Log   logStats   `json:"log"`
-	Cache cacheStats `json:"cache"`
+	Log       logStats        `json:"log"`
+	Cache     cacheStats      `json:"cache"`
+	DNS       *dnsStats       `json:"dns,omitempty"`
+	Resolvers []resolverStats `json:"resolvers,omitempty"`
+}
+
+type resolverStats struct {
+	Address    string `json:"address"`
+	Queries    int64  `json:"queries"`
+	Successes  int64  `json:"successes"`
+	Errors     int64  `json:"errors"`
+	Timeouts   int64  `json:"timeouts"`
+	AvgLatency string `json:"avg_latency"`
+}
+
+type dnsStats struct {
+	Queries   map[string]int64 `json:"queries"`
+	Responses map[string]int64 `json:"responses"`
+	Malformed int64            `json:"malformed"`
 }
 
 type request struct {
@@ -63,10 +158,29 @@ type logStats struct {
 }
 
 type cacheStats struct {
-	Size         int           `json:"size"`
-	Capacity     int           `json:"capacity"`
-	PendingTasks int           `json:"pending_tasks"`
-	BackendStats *backendStats `json:"backend,omitempty"`
+	Size            int           `json:"size"`
+	Capacity        int           `json:"capacity"`
+	PendingTasks    int           `json:"pending_tasks"`
+	Workers         int           `json:"workers"`
+	ProcessedTasks  int64         `json:"processed_tasks"`
+	AvgTaskDuration string        `json:"avg_task_duration"`
+	Evictions       evictionStats `json:"evictions"`
+	Prefetches      prefetchStats `json:"prefetches"`
+	BackendStats    *backendStats `json:"backend,omitempty"`
+}
+
+type prefetchStats struct {
+	Attempts  int64 `json:"attempts"`
+	Queries   int64 `json:"queries"`
+	Successes int64 `json:"successes"`
+	Hits      int64 `json:"hits"`
+}
+
+type evictionStats struct {
+	Capacity int64 `json:"capacity"`
+	Expired  int64 `json:"expired"`
+	Flushed  int64 `json:"flushed"`
+	Refresh  int64 `json:"refresh"`
 }
 
 type backendStats struct {
@@ -96,14 +210,12 @@ func newHTTPBadRequest(err error) *httpError {
 // NewServer creates a new HTTP server, serving logs from the given logger and listening on addr.
 func NewServer(cache *cache.Cache, logger *sql.Logger, sqlCache *sql.Cache, addr string) *Server {
 	server := &http.Server{Addr: addr}
-	s := &Server{
+	return &Server{
 		server:   server,
 		cache:    cache,
 		logger:   logger,
 		sqlCache: sqlCache,
 	}
-	s.server.Handler = s.handler()
-	return s
 }
 
 func (s *Server) handler() http.Handler {
@@ -112,11 +224,71 @@ func (s *Server) handler() http.Handler {
 	r.route(http.MethodDelete, "/cache/v1/", s.cacheResetHandler)
 	if s.logger != nil {
 		r.route(http.MethodGet, "/log/v1/", s.logHandler)
+		r.route(http.MethodGet, "/log/v1/export", s.logExportHandler)
 		r.route(http.MethodGet, "/metric/v1/", s.metricHandler)
+		r.route(http.MethodPost, "/metric/v1/reset", s.admin(s.metricResetHandler))
+	}
+	if s.Filter != nil {
+		r.route(http.MethodPost, "/filter/v1/block", s.admin(s.blockHandler))
+		r.route(http.MethodPost, "/filter/v1/allow", s.admin(s.allowHandler))
+		r.route(http.MethodPost, "/filter/v1/reload", s.admin(s.filterReloadHandler))
+	}
+	if s.Reloader != nil {
+		r.route(http.MethodPost, "/reload/v1/", s.admin(s.reloadHandler))
+	}
+	if s.Maintainer != nil {
+		r.route(http.MethodGet, "/maintenance/v1/", s.maintenanceHandler)
+		r.route(http.MethodPost, "/maintenance/v1/", s.admin(s.maintenanceEnableHandler))
+		r.route(http.MethodDelete, "/maintenance/v1/", s.admin(s.maintenanceDisableHandler))
+	}
+	if s.Pprof {
+		mux := http.NewServeMux()
+		mux.Handle("/", r.handler())
+		mux.Handle("/debug/pprof/", s.adminFunc(pprof.Index))
+		mux.Handle("/debug/pprof/cmdline", s.adminFunc(pprof.Cmdline))
+		mux.Handle("/debug/pprof/profile", s.adminFunc(pprof.Profile))
+		mux.Handle("/debug/pprof/symbol", s.adminFunc(pprof.Symbol))
+		mux.Handle("/debug/pprof/trace", s.adminFunc(pprof.Trace))
+		return mux
 	}
 	return r.handler()
 }
 
+// admin returns a handler that calls handler only if the request is authenticated by the admin token.
+func (s *Server) admin(handler appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *httpError {
+		if s.AdminToken == "" {
+			writeJSONHeader(w)
+			return &httpError{Status: http.StatusForbidden, Message: "Admin token is not configured"}
+		}
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			writeJSONHeader(w)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return &httpError{Status: http.StatusUnauthorized, Message: "Invalid or missing admin token"}
+		}
+		return handler(w, r)
+	}
+}
+
+// adminFunc is like admin, but for plain handler functions.
+func (s *Server) adminFunc(handler http.HandlerFunc) appHandler {
+	return s.admin(func(w http.ResponseWriter, r *http.Request) *httpError {
+		handler(w, r)
+		return nil
+	})
+}
+
+// bearerToken returns the bearer token of the Authorization header of r, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
 func countFrom(r *http.Request) (int, error) {
 	param := r.URL.Query().Get("n")
 	if param == "" {
@@ -157,13 +329,16 @@ func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) *httpError
 	cacheValues := s.cache.List(count)
 	entries := make([]entry, 0, len(cacheValues))
 	for _, v := range cacheValues {
+		key := v.Key
 		entries = append(entries, entry{
 			Time:     v.CreatedAt.UTC().Format(time.RFC3339),
+			Key:      &key,
 			TTL:      int64(v.TTL().Truncate(time.Second).Seconds()),
 			Qtype:    dnsutil.TypeToString[v.Qtype()],
 			Question: v.Question(),
 			Answers:  v.Answers(),
 			Rcode:    dnsutil.RcodeToString[v.Rcode()],
+			Source:   v.Source.String(),
 		})
 	}
 	writeJSON(w, entries)
@@ -178,6 +353,95 @@ func (s *Server) cacheResetHandler(w http.ResponseWriter, r *http.Request) *http
 	return nil
 }
 
+func (s *Server) metricResetHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	// Each source of metrics is reset separately, so a query in flight may be counted by some sources and not others.
+	// Resetting all of them while holding metricMu ensures that metric requests see either all or none of the resets.
+	s.metricMu.Lock()
+	defer s.metricMu.Unlock()
+	s.cache.ResetStats()
+	if s.Upstream != nil {
+		s.Upstream.ResetStats()
+	}
+	if s.Proxy != nil {
+		s.Proxy.ResetStats()
+	}
+	writeJSON(w, struct {
+		Message string `json:"message"`
+	}{"Reset metrics."})
+	return nil
+}
+
+func (s *Server) filterHandler(w http.ResponseWriter, r *http.Request, block bool) *httpError {
+	writeJSONHeader(w)
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return newHTTPBadRequest(fmt.Errorf("missing parameter: name"))
+	}
+	var err error
+	var message string
+	if block {
+		err = s.Filter.Block(name)
+		message = "Blocked " + name + "."
+	} else {
+		err = s.Filter.Allow(name)
+		message = "Allowed " + name + "."
+	}
+	if err != nil {
+		return newHTTPError(err)
+	}
+	writeJSON(w, struct {
+		Message string `json:"message"`
+	}{message})
+	return nil
+}
+
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeReloadResult(w, s.Reloader.ReloadWithResult())
+	return nil
+}
+
+func (s *Server) filterReloadHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeReloadResult(w, s.Filter.ReloadHostsWithResult())
+	return nil
+}
+
+func writeReloadResult(w http.ResponseWriter, result zdns.ReloadResult) {
+	sources := make([]reloadSource, 0, len(result.Sources))
+	for _, src := range result.Sources {
+		source := reloadSource{Source: src.Source, Type: src.Type, Entries: src.Entries}
+		if src.Err != nil {
+			source.Error = src.Err.Error()
+		}
+		sources = append(sources, source)
+	}
+	writeJSONHeader(w)
+	writeJSON(w, reloadResult{Sources: sources, Duration: result.Duration.String()})
+}
+
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSONHeader(w)
+	writeJSON(w, maintenanceStatus{Maintenance: s.Maintainer.Maintenance()})
+	return nil
+}
+
+func (s *Server) maintenanceEnableHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	s.Maintainer.SetMaintenance(true)
+	return s.maintenanceHandler(w, r)
+}
+
+func (s *Server) maintenanceDisableHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	s.Maintainer.SetMaintenance(false)
+	return s.maintenanceHandler(w, r)
+}
+
+func (s *Server) blockHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	return s.filterHandler(w, r, true)
+}
+
+func (s *Server) allowHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	return s.filterHandler(w, r, false)
+}
+
 func (s *Server) logHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	count, err := countFrom(r)
 	if err != nil {
@@ -191,20 +455,86 @@ func (s *Server) logHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	}
 	entries := make([]entry, 0, len(logEntries))
 	for _, le := range logEntries {
-		hijacked := le.Hijacked
-		entries = append(entries, entry{
-			Time:       le.Time.UTC().Format(time.RFC3339),
-			RemoteAddr: le.RemoteAddr,
-			Hijacked:   &hijacked,
-			Qtype:      dnsutil.TypeToString[le.Qtype],
-			Question:   le.Question,
-			Answers:    le.Answers,
-		})
+		entries = append(entries, newEntry(le))
 	}
 	writeJSON(w, entries)
 	return nil
 }
 
+func sinceFrom(r *http.Request) (time.Time, error) {
+	param := r.URL.Query().Get("since")
+	if param == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid value for parameter since: %s", param)
+	}
+	return t, nil
+}
+
+func newEntry(le sql.LogEntry) entry {
+	hijacked := le.Hijacked
+	return entry{
+		Time:       le.Time.UTC().Format(time.RFC3339),
+		RemoteAddr: le.RemoteAddr,
+		Hijacked:   &hijacked,
+		Qtype:      dnsutil.TypeToString[le.Qtype],
+		Question:   le.Question,
+		Answers:    le.Answers,
+	}
+}
+
+func (s *Server) logExportHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	since, err := sinceFrom(r)
+	if err != nil {
+		writeJSONHeader(w)
+		return newHTTPBadRequest(err)
+	}
+	var write func(sql.LogEntry) error
+	var flush func() error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", jsonlMediaType)
+		enc := json.NewEncoder(w)
+		write = func(le sql.LogEntry) error { return enc.Encode(newEntry(le)) }
+		flush = func() error { return nil }
+	case "csv":
+		w.Header().Set("Content-Type", csvMediaType)
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"time", "remote_addr", "hijacked", "type", "question", "answers"}); err != nil {
+			return newHTTPError(err)
+		}
+		write = func(le sql.LogEntry) error {
+			e := newEntry(le)
+			return cw.Write([]string{
+				e.Time,
+				e.RemoteAddr.String(),
+				strconv.FormatBool(*e.Hijacked),
+				e.Qtype,
+				e.Question,
+				strings.Join(e.Answers, " "),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		writeJSONHeader(w)
+		return newHTTPBadRequest(fmt.Errorf("invalid value for parameter format: %s", format))
+	}
+	// Rows are streamed as they are read, so the status has been sent by the time an error occurs
+	if err := s.logger.Export(since, write); err != nil {
+		log.Printf("failed to export log: %s", err)
+		return nil
+	}
+	if err := flush(); err != nil {
+		log.Printf("failed to export log: %s", err)
+	}
+	return nil
+}
+
 func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	resolution, err := resolutionFrom(r)
 	if err != nil {
@@ -228,6 +558,11 @@ func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *htt
 	if s.sqlCache != nil {
 		bstats = &backendStats{PendingTasks: s.sqlCache.Stats().PendingTasks}
 	}
+	var dstats *dnsStats
+	if s.Proxy != nil {
+		pstats := s.Proxy.Stats()
+		dstats = &dnsStats{Queries: pstats.Queries, Responses: pstats.Responses, Malformed: pstats.Malformed}
+	}
 	stats := stats{
 		Summary: summary{
 			Log: logStats{
@@ -236,11 +571,28 @@ func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *htt
 				Hijacked: lstats.Hijacked,
 			},
 			Cache: cacheStats{
-				Capacity:     cstats.Capacity,
-				Size:         cstats.Size,
-				PendingTasks: cstats.PendingTasks,
+				Capacity:        cstats.Capacity,
+				Size:            cstats.Size,
+				PendingTasks:    cstats.PendingTasks,
+				Workers:         cstats.Workers,
+				ProcessedTasks:  cstats.ProcessedTasks,
+				AvgTaskDuration: cstats.AvgTaskDuration.String(),
+				Evictions: evictionStats{
+					Capacity: cstats.Evictions.Capacity,
+					Expired:  cstats.Evictions.Expired,
+					Flushed:  cstats.Evictions.Flushed,
+					Refresh:  cstats.Evictions.Refresh,
+				},
+				Prefetches: prefetchStats{
+					Attempts:  cstats.Prefetches.Attempts,
+					Queries:   cstats.Prefetches.Queries,
+					Successes: cstats.Prefetches.Successes,
+					Hits:      cstats.Prefetches.Hits,
+				},
 				BackendStats: bstats,
 			},
+			DNS:       dstats,
+			Resolvers: s.readResolverStats(),
 		},
 		Requests: requests,
 	}
@@ -248,6 +600,27 @@ func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *htt
 	return nil
 }
 
+// readResolverStats returns statistics of each upstream resolver, sorted by address.
+func (s *Server) readResolverStats() []resolverStats {
+	if s.Upstream == nil {
+		return nil
+	}
+	rstats := s.Upstream.Stats().Resolvers
+	resolvers := make([]resolverStats, 0, len(rstats))
+	for addr, rs := range rstats {
+		resolvers = append(resolvers, resolverStats{
+			Address:    addr,
+			Queries:    rs.Queries,
+			Successes:  rs.Successes,
+			Errors:     rs.Errors,
+			Timeouts:   rs.Timeouts,
+			AvgLatency: rs.AvgLatency.String(),
+		})
+	}
+	sort.Slice(resolvers, func(i, j int) bool { return resolvers[i].Address < resolvers[j].Address })
+	return resolvers
+}
+
 func (s *Server) prometheusMetricHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	lstats, err := s.logger.Stats(time.Minute)
 	if err != nil {
@@ -255,11 +628,69 @@ func (s *Server) prometheusMetricHandler(w http.ResponseWriter, r *http.Request)
 	}
 	totalRequestsGauge.Set(float64(lstats.Total))
 	hijackedRequestsGauge.Set(float64(lstats.Hijacked))
+	cstats := s.cache.Stats()
+	cachePendingTasksGauge.Set(float64(cstats.PendingTasks))
+	cacheWorkersGauge.Set(float64(cstats.Workers))
+	cacheProcessedTasksGauge.Set(float64(cstats.ProcessedTasks))
+	cacheAvgTaskDurationGauge.Set(cstats.AvgTaskDuration.Seconds())
+	cacheEvictionsGauge.WithLabelValues("capacity").Set(float64(cstats.Evictions.Capacity))
+	cacheEvictionsGauge.WithLabelValues("expired").Set(float64(cstats.Evictions.Expired))
+	cacheEvictionsGauge.WithLabelValues("flushed").Set(float64(cstats.Evictions.Flushed))
+	cacheEvictionsGauge.WithLabelValues("refresh").Set(float64(cstats.Evictions.Refresh))
+	cachePrefetchAttemptsGauge.Set(float64(cstats.Prefetches.Attempts))
+	cachePrefetchQueriesGauge.Set(float64(cstats.Prefetches.Queries))
+	cachePrefetchSuccessesGauge.Set(float64(cstats.Prefetches.Successes))
+	cachePrefetchHitsGauge.Set(float64(cstats.Prefetches.Hits))
+	if s.Upstream != nil {
+		rstats := s.Upstream.Stats()
+		rejectedResponsesGauge.Set(float64(rstats.RejectedResponses))
+		resolverQueriesGauge.Reset()
+		resolverSuccessesGauge.Reset()
+		resolverErrorsGauge.Reset()
+		resolverTimeoutsGauge.Reset()
+		resolverAvgLatencyGauge.Reset()
+		for addr, rs := range rstats.Resolvers {
+			resolverQueriesGauge.WithLabelValues(addr).Set(float64(rs.Queries))
+			resolverSuccessesGauge.WithLabelValues(addr).Set(float64(rs.Successes))
+			resolverErrorsGauge.WithLabelValues(addr).Set(float64(rs.Errors))
+			resolverTimeoutsGauge.WithLabelValues(addr).Set(float64(rs.Timeouts))
+			resolverAvgLatencyGauge.WithLabelValues(addr).Set(rs.AvgLatency.Seconds())
+		}
+	}
+	if s.Proxy != nil {
+		pstats := s.Proxy.Stats()
+		queriesGauge.Reset()
+		for qtype, n := range pstats.Queries {
+			queriesGauge.WithLabelValues(qtype).Set(float64(n))
+		}
+		responsesGauge.Reset()
+		for rcode, n := range pstats.Responses {
+			responsesGauge.WithLabelValues(rcode).Set(float64(n))
+		}
+		malformedQueriesGauge.Set(float64(pstats.Malformed))
+	}
+	if s.Reloader != nil {
+		filterEntriesGauge.Reset()
+		filterLastReloadGauge.Reset()
+		for _, src := range s.Reloader.Sources() {
+			if src.Type != "hosts" {
+				continue
+			}
+			filterEntriesGauge.WithLabelValues(src.Source).Set(float64(src.Entries))
+			lastReload := 0.0
+			if !src.LoadedAt.IsZero() {
+				lastReload = float64(src.LoadedAt.UnixNano()) / float64(time.Second)
+			}
+			filterLastReloadGauge.WithLabelValues(src.Source).Set(lastReload)
+		}
+	}
 	prometheusHandler.ServeHTTP(w, r)
 	return nil
 }
 
 func (s *Server) metricHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	s.metricMu.RLock()
+	defer s.metricMu.RUnlock()
 	format := ""
 	if formatParams := r.URL.Query()["format"]; len(formatParams) > 0 {
 		format = formatParams[0]
@@ -279,6 +710,7 @@ func (s *Server) Close() error { return s.server.Shutdown(context.TODO()) }
 
 // ListenAndServe starts the HTTP server listening on the configured address.
 func (s *Server) ListenAndServe() error {
+	s.server.Handler = s.handler()
 	log.Printf("http server listening on http://%s", s.server.Addr)
 	err := s.server.ListenAndServe()
 	if err == http.ErrServerClosed {
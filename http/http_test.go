@@ -1,6 +1,8 @@
 package http
 
 import (
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -8,9 +10,13 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/mpolden/zdns"
 	"github.com/mpolden/zdns/cache"
+	zdnsdns "github.com/mpolden/zdns/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/sql"
 )
 
@@ -29,6 +35,29 @@ func newA(name string, ttl uint32, ipAddr ...net.IP) *dns.Msg {
 	return &m
 }
 
+type testFilter struct {
+	blocked map[string]bool
+	reloads int
+}
+
+func (f *testFilter) Block(name string) error {
+	f.blocked[name] = true
+	return nil
+}
+
+func (f *testFilter) Allow(name string) error {
+	f.blocked[name] = false
+	return nil
+}
+
+func (f *testFilter) ReloadHostsWithResult() zdns.ReloadResult {
+	f.reloads++
+	return zdns.ReloadResult{
+		Sources:  []zdns.SourceResult{{Source: "inline hosts", Type: "hosts", Entries: f.reloads}},
+		Duration: time.Millisecond,
+	}
+}
+
 func testServer() (*httptest.Server, *Server) {
 	sqlClient, err := sql.New(":memory:")
 	if err != nil {
@@ -55,10 +84,17 @@ func httpGet(url string) (*http.Response, string, error) {
 }
 
 func httpRequest(method, url, body string) (*http.Response, string, error) {
+	return httpAdminRequest(method, url, body, "")
+}
+
+func httpAdminRequest(method, url, body, token string) (*http.Response, string, error) {
 	r, err := http.NewRequest(method, url, strings.NewReader(body))
 	if err != nil {
 		return nil, "", err
 	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
 	res, err := http.DefaultClient.Do(r)
 	if err != nil {
 		return nil, "", err
@@ -81,24 +117,65 @@ func TestRequests(t *testing.T) {
 	srv.logger.Record(net.IPv4(127, 0, 0, 42), false, 1, "example.com.", "192.0.2.100", "192.0.2.101")
 	srv.logger.Record(net.IPv4(127, 0, 0, 254), true, 28, "example.com.", "2001:db8::1")
 	srv.logger.Close() // Flush
-	srv.cache.Set(1, newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
-	srv.cache.Set(2, newA("2.example.com.", 30, net.IPv4(192, 0, 2, 201)))
+	srv.cache.Set(cache.NewKey("1.example.com.", dns.TypeA, dns.ClassINET), newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
+	srv.cache.Set(cache.NewKey("2.example.com.", dns.TypeA, dns.ClassINET), newA("2.example.com.", 30, net.IPv4(192, 0, 2, 201)))
 
-	cr1 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR"},` +
-		`{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR"}]`
-	cr2 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR"}]`
+	cr1 := `[{"time":"RFC3339","key":2738568364,"ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR","source":"upstream"},` +
+		`{"time":"RFC3339","key":3517338631,"ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR","source":"upstream"}]`
+	cr2 := `[{"time":"RFC3339","key":2738568364,"ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR","source":"upstream"}]`
 	lr1 := `[{"time":"RFC3339","remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]},` +
 		`{"time":"RFC3339","remote_addr":"127.0.0.42","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.101","192.0.2.100"]}]`
 	lr2 := `[{"time":"RFC3339","remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]}]`
-	mr1 := `{"summary":{"log":{"since":"RFC3339","total":2,"hijacked":1,"pending_tasks":0},"cache":{"size":2,"capacity":10,"pending_tasks":0,"backend":{"pending_tasks":0}}},"requests":[{"time":"RFC3339","count":2}]}`
+	er1 := `{"time":"RFC3339","remote_addr":"127.0.0.42","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.100","192.0.2.101"]}` + "\n" +
+		`{"time":"RFC3339","remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]}` + "\n"
+	er2 := "time,remote_addr,hijacked,type,question,answers\n" +
+		"RFC3339,127.0.0.42,false,A,example.com.,192.0.2.100 192.0.2.101\n" +
+		"RFC3339,127.0.0.254,true,AAAA,example.com.,2001:db8::1\n"
+	mr1 := `{"summary":{"log":{"since":"RFC3339","total":2,"hijacked":1,"pending_tasks":0},"cache":{"size":2,"capacity":10,"pending_tasks":0,"workers":1,"processed_tasks":0,"avg_task_duration":"0s","evictions":{"capacity":0,"expired":0,"flushed":0,"refresh":0},"prefetches":{"attempts":0,"queries":0,"successes":0,"hits":0},"backend":{"pending_tasks":0}}},"requests":[{"time":"RFC3339","count":2}]}`
 	mr2 := `
 <ANY>
+# HELP zdns_cache_evictions The number of values removed from the cache, by reason.
+# TYPE zdns_cache_evictions gauge
+zdns_cache_evictions{reason="capacity"} 0
+zdns_cache_evictions{reason="expired"} 0
+zdns_cache_evictions{reason="flushed"} 0
+zdns_cache_evictions{reason="refresh"} 0
+# HELP zdns_cache_pending_tasks The number of tasks waiting in the cache queue.
+# TYPE zdns_cache_pending_tasks gauge
+zdns_cache_pending_tasks 0
+# HELP zdns_cache_prefetch_attempts The number of refreshes scheduled for expired cache values.
+# TYPE zdns_cache_prefetch_attempts gauge
+zdns_cache_prefetch_attempts 0
+# HELP zdns_cache_prefetch_hits The number of cache lookups answered by a fresh value cached by prefetching.
+# TYPE zdns_cache_prefetch_hits gauge
+zdns_cache_prefetch_hits 0
+# HELP zdns_cache_prefetch_queries The number of upstream queries made to refresh cache values.
+# TYPE zdns_cache_prefetch_queries gauge
+zdns_cache_prefetch_queries 0
+# HELP zdns_cache_prefetch_successes The number of refreshed messages that were cached.
+# TYPE zdns_cache_prefetch_successes gauge
+zdns_cache_prefetch_successes 0
+# HELP zdns_cache_task_duration_avg_seconds The average duration of processed cache tasks.
+# TYPE zdns_cache_task_duration_avg_seconds gauge
+zdns_cache_task_duration_avg_seconds 0
+# HELP zdns_cache_tasks_processed The number of cache tasks processed.
+# TYPE zdns_cache_tasks_processed gauge
+zdns_cache_tasks_processed 0
+# HELP zdns_cache_workers The number of workers consuming the cache queue.
+# TYPE zdns_cache_workers gauge
+zdns_cache_workers 1
+# HELP zdns_queries_malformed The number of DNS queries rejected because their name exceeds the limits of a domain name.
+# TYPE zdns_queries_malformed gauge
+zdns_queries_malformed 0
 # HELP zdns_requests_hijacked The number of hijacked DNS requests.
 # TYPE zdns_requests_hijacked gauge
 zdns_requests_hijacked 1
 # HELP zdns_requests_total The total number of DNS requests.
 # TYPE zdns_requests_total gauge
 zdns_requests_total 2
+# HELP zdns_resolver_responses_rejected The number of upstream responses rejected because they did not match their query.
+# TYPE zdns_resolver_responses_rejected gauge
+zdns_resolver_responses_rejected 0
 `
 	var tests = []struct {
 		method      string
@@ -111,6 +188,12 @@ zdns_requests_total 2
 		{http.MethodGet, "/log/v1/", lr1, 200, jsonMediaType},
 		{http.MethodGet, "/log/v1/?n=foo", `{"status":400,"message":"invalid value for parameter n: foo"}`, 400, jsonMediaType},
 		{http.MethodGet, "/log/v1/?n=1", lr2, 200, jsonMediaType},
+		{http.MethodGet, "/log/v1/export", er1, 200, jsonlMediaType},
+		{http.MethodGet, "/log/v1/export?format=jsonl&since=2006-01-02T15:04:05Z", er1, 200, jsonlMediaType},
+		{http.MethodGet, "/log/v1/export?format=csv", er2, 200, csvMediaType},
+		{http.MethodGet, "/log/v1/export?format=csv&since=2100-01-01T00:00:00Z", "time,remote_addr,hijacked,type,question,answers\n", 200, csvMediaType},
+		{http.MethodGet, "/log/v1/export?format=foo", `{"status":400,"message":"invalid value for parameter format: foo"}`, 400, jsonMediaType},
+		{http.MethodGet, "/log/v1/export?since=foo", `{"status":400,"message":"invalid value for parameter since: foo"}`, 400, jsonMediaType},
 		{http.MethodGet, "/cache/v1/", cr1, 200, jsonMediaType},
 		{http.MethodGet, "/cache/v1/?n=foo", `{"status":400,"message":"invalid value for parameter n: foo"}`, 400, jsonMediaType},
 		{http.MethodGet, "/cache/v1/?n=1", cr2, 200, jsonMediaType},
@@ -162,3 +245,472 @@ zdns_requests_total 2
 		}
 	}
 }
+
+func TestFilter(t *testing.T) {
+	_, srv := testServer()
+	filter := &testFilter{blocked: make(map[string]bool)}
+	srv.Filter = filter
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		url      string
+		token    string
+		response string
+		status   int
+		blocked  bool
+	}{
+		{"/filter/v1/block", "secret", `{"status":400,"message":"missing parameter: name"}`, 400, false},
+		{"/filter/v1/block?name=example.com", "", `{"status":401,"message":"Invalid or missing admin token"}`, 401, false},
+		{"/filter/v1/block?name=example.com", "wrong", `{"status":401,"message":"Invalid or missing admin token"}`, 401, false},
+		{"/filter/v1/block?name=example.com", "secret", `{"message":"Blocked example.com."}`, 200, true},
+		{"/filter/v1/allow?name=example.com", "", `{"status":401,"message":"Invalid or missing admin token"}`, 401, true},
+		{"/filter/v1/allow?name=example.com", "secret", `{"message":"Allowed example.com."}`, 200, false},
+	}
+	for i, tt := range tests {
+		res, data, err := httpAdminRequest(http.MethodPost, httpSrv.URL+tt.url, "", tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: POST %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		if data != tt.response {
+			t.Errorf("#%d: POST %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+		if got := filter.blocked["example.com"]; got != tt.blocked {
+			t.Errorf("#%d: blocked = %t, want %t", i, got, tt.blocked)
+		}
+	}
+
+	// Hosts sources are reloaded
+	for i := 1; i <= 2; i++ {
+		res, data, err := httpAdminRequest(http.MethodPost, httpSrv.URL+"/filter/v1/reload", "", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.StatusCode, 200; got != want {
+			t.Errorf("#%d: got status %d, want %d", i, got, want)
+		}
+		want := fmt.Sprintf(`{"sources":[{"source":"inline hosts","type":"hosts","entries":%d}],"duration":"1ms"}`, i)
+		if data != want {
+			t.Errorf("#%d: got response %s, want %s", i, data, want)
+		}
+		if got := filter.reloads; got != i {
+			t.Errorf("#%d: reloads = %d, want %d", i, got, i)
+		}
+	}
+
+	// Reloading requires admin token
+	res, _, err := httpRequest(http.MethodPost, httpSrv.URL+"/filter/v1/reload", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 401; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := filter.reloads, 2; got != want {
+		t.Errorf("reloads = %d, want %d", got, want)
+	}
+
+	// Endpoints are not available without a filter
+	httpSrv2, _ := testServer()
+	defer httpSrv2.Close()
+	res, _, err = httpRequest(http.MethodPost, httpSrv2.URL+"/filter/v1/block?name=example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+
+	// Admin endpoints are disabled without an admin token
+	_, srv3 := testServer()
+	srv3.Filter = filter
+	httpSrv3 := httptest.NewServer(srv3.handler())
+	defer httpSrv3.Close()
+	res, data, err := httpAdminRequest(http.MethodPost, httpSrv3.URL+"/filter/v1/block?name=example.com", "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 403; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if want := `{"status":403,"message":"Admin token is not configured"}`; data != want {
+		t.Errorf("got response %s, want %s", data, want)
+	}
+	if filter.blocked["example.com"] {
+		t.Error("expected example.com to not be blocked")
+	}
+}
+
+func TestPprof(t *testing.T) {
+	var tests = []struct {
+		pprof      bool
+		adminToken string
+		token      string
+		url        string
+		status     int
+	}{
+		{false, "secret", "secret", "/debug/pprof/", 404},
+		{false, "secret", "secret", "/debug/pprof/heap", 404},
+		{true, "secret", "secret", "/debug/pprof/", 200},
+		{true, "secret", "secret", "/debug/pprof/heap", 200},
+		{true, "secret", "", "/debug/pprof/", 401},
+		{true, "secret", "wrong", "/debug/pprof/heap", 401},
+		{true, "", "", "/debug/pprof/", 403},
+		{true, "secret", "", "/cache/v1/", 200},
+		{true, "secret", "", "/not-found", 404},
+	}
+	for i, tt := range tests {
+		_, srv := testServer()
+		srv.Pprof = tt.pprof
+		srv.AdminToken = tt.adminToken
+		httpSrv := httptest.NewServer(srv.handler())
+		res, _, err := httpAdminRequest(http.MethodGet, httpSrv.URL+tt.url, "", tt.token)
+		httpSrv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+	}
+}
+
+type testReloader struct {
+	result  zdns.ReloadResult
+	sources []zdns.SourceStatus
+	calls   int
+}
+
+func (r *testReloader) ReloadWithResult() zdns.ReloadResult {
+	r.calls++
+	return r.result
+}
+
+func (r *testReloader) Sources() []zdns.SourceStatus { return r.sources }
+
+func TestReload(t *testing.T) {
+	_, srv := testServer()
+	reloader := &testReloader{}
+	srv.Reloader = reloader
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		result   zdns.ReloadResult
+		response string
+	}{
+		{zdns.ReloadResult{Sources: []zdns.SourceResult{{Source: "inline hosts", Type: "hosts", Entries: 2}},
+			Duration: time.Millisecond},
+			`{"sources":[{"source":"inline hosts","type":"hosts","entries":2}],"duration":"1ms"}`},
+		{zdns.ReloadResult{Sources: []zdns.SourceResult{{Source: "file:///foo", Type: "records", Err: fmt.Errorf("not found")}},
+			Duration: time.Second},
+			`{"sources":[{"source":"file:///foo","type":"records","entries":0,"error":"not found"}],"duration":"1s"}`},
+	}
+	for i, tt := range tests {
+		reloader.result = tt.result
+		res, data, err := httpAdminRequest(http.MethodPost, httpSrv.URL+"/reload/v1/", "", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.StatusCode, 200; got != want {
+			t.Errorf("#%d: got status %d, want %d", i, got, want)
+		}
+		if data != tt.response {
+			t.Errorf("#%d: got response %s, want %s", i, data, tt.response)
+		}
+	}
+
+	// Reloading requires admin token
+	reloader.calls = 0
+	res, _, err := httpRequest(http.MethodPost, httpSrv.URL+"/reload/v1/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 401; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got := reloader.calls; got != 0 {
+		t.Errorf("reloads = %d, want 0", got)
+	}
+
+	// Endpoint is not available without a reloader
+	httpSrv2, _ := testServer()
+	defer httpSrv2.Close()
+	res, _, err = httpRequest(http.MethodPost, httpSrv2.URL+"/reload/v1/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
+
+type testMaintainer struct{ enabled bool }
+
+func (m *testMaintainer) SetMaintenance(enabled bool) { m.enabled = enabled }
+
+func (m *testMaintainer) Maintenance() bool { return m.enabled }
+
+func TestMaintenance(t *testing.T) {
+	_, srv := testServer()
+	maintainer := &testMaintainer{}
+	srv.Maintainer = maintainer
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		method   string
+		response string
+		enabled  bool
+	}{
+		{http.MethodGet, `{"maintenance":false}`, false},
+		{http.MethodPost, `{"maintenance":true}`, true},
+		{http.MethodGet, `{"maintenance":true}`, true},
+		{http.MethodDelete, `{"maintenance":false}`, false},
+	}
+	for i, tt := range tests {
+		res, data, err := httpAdminRequest(tt.method, httpSrv.URL+"/maintenance/v1/", "", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.StatusCode, 200; got != want {
+			t.Errorf("#%d: got status %d, want %d", i, got, want)
+		}
+		if data != tt.response {
+			t.Errorf("#%d: got response %s, want %s", i, data, tt.response)
+		}
+		if maintainer.enabled != tt.enabled {
+			t.Errorf("#%d: maintenance = %t, want %t", i, maintainer.enabled, tt.enabled)
+		}
+	}
+
+	// Changing mode requires admin token
+	for i, method := range []string{http.MethodPost, http.MethodDelete} {
+		maintainer.enabled = method == http.MethodDelete
+		res, _, err := httpRequest(method, httpSrv.URL+"/maintenance/v1/", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.StatusCode, 401; got != want {
+			t.Errorf("#%d: got status %d, want %d", i, got, want)
+		}
+		if want := method == http.MethodDelete; maintainer.enabled != want {
+			t.Errorf("#%d: maintenance = %t, want %t", i, maintainer.enabled, want)
+		}
+	}
+
+	// Current mode is shown without admin token
+	res, _, err := httpRequest(http.MethodGet, httpSrv.URL+"/maintenance/v1/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
+
+type testBackend struct{ values []cache.Value }
+
+func (b *testBackend) Set(key uint64, value cache.Value) {}
+func (b *testBackend) Evict(key uint64)                  {}
+func (b *testBackend) Read() []cache.Value               { return b.values }
+func (b *testBackend) Reset()                            {}
+
+func TestMetricReset(t *testing.T) {
+	_, srv := testServer()
+	// Load an expired value, which is evicted by a cache task when read
+	data, err := newA("example.com.", 60, net.IPv4(192, 0, 2, 1)).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := cache.Unpack(fmt.Sprintf("v1 1 %d %s", time.Now().Add(-time.Hour).Unix(), hex.EncodeToString(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.cache = cache.NewWithOptions(10, nil, &testBackend{values: []cache.Value{value}}, cache.Options{})
+	srv.cache.Get(1)
+	srv.cache.Close()
+	if got, want := srv.cache.Stats().ProcessedTasks, int64(1); got != want {
+		t.Fatalf("ProcessedTasks = %d, want %d", got, want)
+	}
+
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	// Reset requires admin token
+	res, _, err := httpRequest(http.MethodPost, httpSrv.URL+"/metric/v1/reset", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 401; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := srv.cache.Stats().ProcessedTasks, int64(1); got != want {
+		t.Errorf("ProcessedTasks = %d, want %d", got, want)
+	}
+
+	res, body, err := httpAdminRequest(http.MethodPost, httpSrv.URL+"/metric/v1/reset", "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := body, `{"message":"Reset metrics."}`; got != want {
+		t.Errorf("got response %s, want %s", got, want)
+	}
+	if got, want := srv.cache.Stats().ProcessedTasks, int64(0); got != want {
+		t.Errorf("ProcessedTasks = %d, want %d", got, want)
+	}
+}
+
+type testProxy struct{ stats zdnsdns.Stats }
+
+func (p *testProxy) Stats() zdnsdns.Stats { return p.stats }
+
+func (p *testProxy) ResetStats() { p.stats = zdnsdns.Stats{} }
+
+func TestQueryMetrics(t *testing.T) {
+	_, srv := testServer()
+	proxy := &testProxy{stats: zdnsdns.Stats{
+		Queries:   map[string]int64{"A": 2, "AAAA": 1},
+		Responses: map[string]int64{"NOERROR": 2, "NXDOMAIN": 1},
+		Malformed: 1,
+	}}
+	srv.Proxy = proxy
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		url  string
+		want []string
+	}{
+		{"/metric/v1/", []string{`"dns":{"queries":{"A":2,"AAAA":1},"responses":{"NOERROR":2,"NXDOMAIN":1},"malformed":1}`}},
+		{"/metric/v1/?format=prometheus", []string{
+			`zdns_queries{type="A"} 2`,
+			`zdns_queries{type="AAAA"} 1`,
+			`zdns_responses{rcode="NOERROR"} 2`,
+			`zdns_responses{rcode="NXDOMAIN"} 1`,
+			`zdns_queries_malformed 1`,
+		}},
+	}
+	for i, tt := range tests {
+		_, body, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("#%d: response %q does not contain %q", i, body, want)
+			}
+		}
+	}
+
+	if _, _, err := httpAdminRequest(http.MethodPost, httpSrv.URL+"/metric/v1/reset", "", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxy.stats.Queries; got != nil {
+		t.Errorf("Queries = %v, want nil", got)
+	}
+}
+
+func TestFilterMetrics(t *testing.T) {
+	_, srv := testServer()
+	srv.Reloader = &testReloader{sources: []zdns.SourceStatus{
+		{
+			SourceResult: zdns.SourceResult{Source: "https://example.com/hosts", Type: "hosts", Entries: 42},
+			LoadedAt:     time.Unix(1700000000, 0),
+		},
+		{SourceResult: zdns.SourceResult{Source: "file:///missing", Type: "hosts", Err: fmt.Errorf("not found")}},
+		{SourceResult: zdns.SourceResult{Source: "inline records", Type: "records", Entries: 1}, LoadedAt: time.Now()},
+	}}
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+
+	_, body, err := httpGet(httpSrv.URL + "/metric/v1/?format=prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`zdns_filter_entries{source="https://example.com/hosts"} 42`,
+		`zdns_filter_entries{source="file:///missing"} 0`,
+		`zdns_filter_last_reload_seconds{source="https://example.com/hosts"} 1.7e+09`,
+		`zdns_filter_last_reload_seconds{source="file:///missing"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response %q does not contain %q", body, want)
+		}
+	}
+	if strings.Contains(body, "inline records") {
+		t.Errorf("response %q contains records source", body)
+	}
+}
+
+func TestResolverMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	client := dnsutil.NewMux(dnsutil.NewClient(addr, dnsutil.Config{Timeout: time.Second}))
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Exchange(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, srv := testServer()
+	srv.Upstream = client.(Upstream)
+	srv.AdminToken = "secret"
+	httpSrv := httptest.NewServer(srv.handler())
+	defer httpSrv.Close()
+	_, body, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"resolvers":[{"address":"` + addr + `","queries":2,"successes":2,"errors":0,"timeouts":0,"avg_latency":`
+	if !strings.Contains(body, want) {
+		t.Errorf("response %q does not contain %q", body, want)
+	}
+	_, body, err = httpGet(httpSrv.URL + "/metric/v1/?format=prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`zdns_resolver_queries{resolver="` + addr + `"} 2`,
+		`zdns_resolver_successes{resolver="` + addr + `"} 2`,
+		`zdns_resolver_errors{resolver="` + addr + `"} 0`,
+		`zdns_resolver_timeouts{resolver="` + addr + `"} 0`,
+		`zdns_resolver_latency_avg_seconds{resolver="` + addr + `"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response %q does not contain %q", body, want)
+		}
+	}
+
+	// Resetting metrics resets the statistics of the upstream client
+	if _, _, err := httpAdminRequest(http.MethodPost, httpSrv.URL+"/metric/v1/reset", "", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.(Upstream).Stats().Resolvers[addr].Queries; got != 0 {
+		t.Errorf("Queries = %d, want 0", got)
+	}
+}
@@ -15,5 +15,85 @@ var (
 		Name: "zdns_requests_hijacked",
 		Help: "The number of hijacked DNS requests.",
 	})
+	cachePendingTasksGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_pending_tasks",
+		Help: "The number of tasks waiting in the cache queue.",
+	})
+	cacheWorkersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_workers",
+		Help: "The number of workers consuming the cache queue.",
+	})
+	cacheProcessedTasksGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_tasks_processed",
+		Help: "The number of cache tasks processed.",
+	})
+	cacheEvictionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_cache_evictions",
+		Help: "The number of values removed from the cache, by reason.",
+	}, []string{"reason"})
+	cachePrefetchAttemptsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_prefetch_attempts",
+		Help: "The number of refreshes scheduled for expired cache values.",
+	})
+	cachePrefetchQueriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_prefetch_queries",
+		Help: "The number of upstream queries made to refresh cache values.",
+	})
+	cachePrefetchSuccessesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_prefetch_successes",
+		Help: "The number of refreshed messages that were cached.",
+	})
+	cachePrefetchHitsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_prefetch_hits",
+		Help: "The number of cache lookups answered by a fresh value cached by prefetching.",
+	})
+	cacheAvgTaskDurationGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_cache_task_duration_avg_seconds",
+		Help: "The average duration of processed cache tasks.",
+	})
+	rejectedResponsesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_resolver_responses_rejected",
+		Help: "The number of upstream responses rejected because they did not match their query.",
+	})
+	resolverQueriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_resolver_queries",
+		Help: "The number of queries sent upstream, by resolver.",
+	}, []string{"resolver"})
+	resolverSuccessesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_resolver_successes",
+		Help: "The number of queries answered upstream, by resolver.",
+	}, []string{"resolver"})
+	resolverErrorsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_resolver_errors",
+		Help: "The number of upstream queries that failed, including timeouts, by resolver.",
+	}, []string{"resolver"})
+	resolverTimeoutsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_resolver_timeouts",
+		Help: "The number of upstream queries that timed out, by resolver.",
+	}, []string{"resolver"})
+	resolverAvgLatencyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_resolver_latency_avg_seconds",
+		Help: "The average duration of successful upstream queries, by resolver.",
+	}, []string{"resolver"})
+	queriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_queries",
+		Help: "The number of DNS queries received, by query type.",
+	}, []string{"type"})
+	responsesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_responses",
+		Help: "The number of DNS responses sent, by response code.",
+	}, []string{"rcode"})
+	malformedQueriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_queries_malformed",
+		Help: "The number of DNS queries rejected because their name exceeds the limits of a domain name.",
+	})
+	filterEntriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_filter_entries",
+		Help: "The number of entries loaded from a hosts source.",
+	}, []string{"source"})
+	filterLastReloadGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_filter_last_reload_seconds",
+		Help: "The time a hosts source was last loaded successfully, in seconds since the Unix epoch.",
+	}, []string{"source"})
 	prometheusHandler = promhttp.Handler()
 )
@@ -0,0 +1,211 @@
+package logfile
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mpolden/zdns/dns/dnsutil"
+)
+
+// Options configures rotation of a Writer.
+type Options struct {
+	// MaxSize is the size in bytes at which the file is rotated. Zero disables rotation by size.
+	MaxSize int64
+	// MaxAge is the age at which the file is rotated, counted from when it was opened. Zero disables rotation by age.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files to retain. Older files are removed. Zero means that no rotated files are
+	// retained, i.e. the file is truncated when rotated.
+	MaxFiles int
+}
+
+// Writer is a writer to a file that rotates the file when it reaches a maximum size or age. Rotated files are named
+// by appending a number to the file name, where 1 is the most recently rotated file.
+type Writer struct {
+	path     string
+	options  Options
+	mu       sync.Mutex
+	file     *os.File
+	closed   bool
+	size     int64
+	openedAt time.Time
+	now      func() time.Time
+}
+
+// NewWriter opens the file at path for appending, creating it if it does not exist.
+func NewWriter(path string, options Options) (*Writer, error) {
+	w := &Writer{path: path, options: options, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	w.openedAt = w.now()
+	return nil
+}
+
+// name returns the name of the rotated file numbered n.
+func (w *Writer) name(n int) string { return w.path + "." + strconv.Itoa(n) }
+
+func (w *Writer) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false // Never rotate an empty file
+	}
+	if w.options.MaxSize > 0 && w.size+int64(n) > w.options.MaxSize {
+		return true
+	}
+	return w.options.MaxAge > 0 && w.now().Sub(w.openedAt) >= w.options.MaxAge
+}
+
+// rotate closes the current file, shifts the rotated files and opens a new file. If shifting fails, writing continues
+// to the current file.
+func (w *Writer) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	if err := w.shift(); err != nil {
+		log.Printf("failed to rotate %s: %s", w.path, err)
+	}
+	return w.open()
+}
+
+// shift renames the current file and any rotated files, such that the oldest rotated file exceeding MaxFiles is
+// removed.
+func (w *Writer) shift() error {
+	oldest := w.path
+	if w.options.MaxFiles > 0 {
+		oldest = w.name(w.options.MaxFiles)
+	}
+	if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := w.options.MaxFiles; i > 0; i-- {
+		src := w.path
+		if i > 1 {
+			src = w.name(i - 1)
+		}
+		if err := os.Rename(src, w.name(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes p to the file, rotating the file first if writing p would exceed its maximum size or if it has
+// reached its maximum age.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil { // Previous rotation failed
+			return 0, err
+		}
+	} else if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Logger is a logger that logs DNS requests to a file, with one JSON object per line. Log entries are written
+// asynchronously, such that writing the file does not delay replies.
+type Logger struct {
+	// DiscardAnswers discards the answers of DNS requests, such that only their metadata is logged.
+	DiscardAnswers bool
+
+	w     io.WriteCloser
+	queue chan []byte
+	wg    sync.WaitGroup
+	now   func() time.Time
+}
+
+type entry struct {
+	Time       string   `json:"time"`
+	RemoteAddr net.IP   `json:"remote_addr"`
+	Hijacked   bool     `json:"hijacked"`
+	Qtype      string   `json:"type"`
+	Question   string   `json:"question"`
+	Answers    []string `json:"answers,omitempty"`
+}
+
+// NewLogger creates a new logger writing to w.
+func NewLogger(w io.WriteCloser) *Logger {
+	l := &Logger{w: w, queue: make(chan []byte, 1024), now: time.Now}
+	go l.readQueue()
+	return l
+}
+
+// Record writes the given DNS request to the log file.
+func (l *Logger) Record(remoteAddr net.IP, hijacked bool, qtype uint16, question string, answers ...string) {
+	if l.DiscardAnswers {
+		answers = nil
+	}
+	b, err := json.Marshal(entry{
+		Time:       l.now().UTC().Format(time.RFC3339),
+		RemoteAddr: remoteAddr,
+		Hijacked:   hijacked,
+		Qtype:      dnsutil.TypeToString[qtype],
+		Question:   question,
+		Answers:    answers,
+	})
+	if err != nil {
+		log.Printf("failed to encode log entry: %s", err)
+		return
+	}
+	l.wg.Add(1)
+	l.queue <- append(b, '\n')
+}
+
+func (l *Logger) readQueue() {
+	for b := range l.queue {
+		if _, err := l.w.Write(b); err != nil {
+			log.Printf("failed to write log entry: %s", err)
+		}
+		l.wg.Done()
+	}
+}
+
+// Close consumes any outstanding log entries and closes the underlying writer of the logger.
+func (l *Logger) Close() error {
+	l.wg.Wait()
+	return l.w.Close()
+}
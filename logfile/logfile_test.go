@@ -0,0 +1,126 @@
+package logfile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, name string) string {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriterRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zdns.log")
+	w, err := NewWriter(path, Options{MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, s := range []string{"line1\n", "line2\n", "line3\n", "line4\n", "line5\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		name string
+		data string
+	}{
+		{path, "line5\n"},
+		{path + ".1", "line4\n"},
+		{path + ".2", "line3\n"},
+	}
+	for i, tt := range tests {
+		if got := readFile(t, tt.name); got != tt.data {
+			t.Errorf("#%d: %s = %q, want %q", i, tt.name, got, tt.data)
+		}
+	}
+	// Oldest files are pruned
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("want %s.3 to be removed, got %v", path, err)
+	}
+}
+
+func TestWriterRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zdns.log")
+	w, err := NewWriter(path, Options{MaxAge: time.Hour, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	now := time.Now()
+	w.now = func() time.Time { return now }
+	w.openedAt = now
+	w.Write([]byte("line1\n"))
+	now = now.Add(59 * time.Minute)
+	w.Write([]byte("line2\n"))
+	if got, want := readFile(t, path), "line1\nline2\n"; got != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+	now = now.Add(time.Minute)
+	w.Write([]byte("line3\n"))
+	if got, want := readFile(t, path), "line3\n"; got != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+	if got, want := readFile(t, path+".1"), "line1\nline2\n"; got != want {
+		t.Errorf("%s.1 = %q, want %q", path, got, want)
+	}
+}
+
+func TestWriterNoRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "zdns.log")
+	w, err := NewWriter(path, Options{MaxSize: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("line1\n"))
+	w.Write([]byte("line2\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, path), "line2\n"; got != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files, want 1", len(files))
+	}
+	if _, err := w.Write([]byte("line3\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zdns.log")
+	w, err := NewWriter(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := NewLogger(w)
+	logger.now = func() time.Time { return time.Date(2020, 1, 5, 0, 58, 49, 0, time.UTC) }
+	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", "192.0.2.1", "192.0.2.2")
+	logger.DiscardAnswers = true
+	logger.Record(net.IPv4(192, 0, 2, 100), true, 28, "example.org.", "::")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`{"time":"2020-01-05T00:58:49Z","remote_addr":"192.0.2.100","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.1","192.0.2.2"]}`,
+		`{"time":"2020-01-05T00:58:49Z","remote_addr":"192.0.2.100","hijacked":true,"type":"AAAA","question":"example.org."}`,
+		``,
+	}, "\n")
+	if got := readFile(t, path); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
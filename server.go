@@ -1,6 +1,7 @@
 package zdns
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,16 +24,76 @@ const (
 	HijackZero = iota
 	// HijackEmpty returns an empty answer to matching requests.
 	HijackEmpty
-	// HijackHosts returns the value of the  hoss entry to matching request.
+	// HijackHosts returns the value of the  hoss entry to matching request. Requests matching a wildcard entry are
+	// answered with the configured hijack addresses, if any.
 	HijackHosts
+	// HijackNXDomain answers matching requests with NXDOMAIN.
+	HijackNXDomain
 )
 
+const (
+	// FailureSkip skips a failing hosts source, while the remaining hosts sources apply.
+	FailureSkip = iota
+	// FailureAllow stops hijacking requests while a hosts source is failing. Only runtime overrides apply.
+	FailureAllow
+	// FailureBlock hijacks all requests while a hosts source is failing. Only runtime overrides allowing a name apply.
+	FailureBlock
+)
+
+// ReloadResult describes the outcome of reloading static records and hosts.
+type ReloadResult struct {
+	Sources  []SourceResult
+	Duration time.Duration
+}
+
+// SourceResult describes the outcome of loading a single source of static records or hosts.
+type SourceResult struct {
+	// Source is the URL of the source, or a description of inline entries.
+	Source string
+	// Type is the type of the source, either "records" or "hosts".
+	Type string
+	// Entries is the number of entries loaded from the source. For hosts sources that are not hijacked, this is the
+	// number of entries removed.
+	Entries int
+	// Err is the error encountered when loading the source, if any.
+	Err error
+}
+
+// SourceStatus describes the state of a single source of static records or hosts, as of its most recent load.
+type SourceStatus struct {
+	SourceResult
+	// LoadedAt is the time the source was last loaded successfully. It is zero if the source has never been loaded.
+	LoadedAt time.Time
+}
+
+// Err returns the first error encountered during reload, if any.
+func (r ReloadResult) Err() error {
+	for _, s := range r.Sources {
+		if s.Err != nil {
+			return fmt.Errorf("%s: %w", s.Source, s.Err)
+		}
+	}
+	return nil
+}
+
 // A Server defines parameters for running a DNS server.
 type Server struct {
 	Config     Config
 	hosts      hosts.Hosts
+	hostModes  map[string]int
+	failure    int
+	failMode   int
+	allowed    hosts.Hosts
+	priorities hostPriorities
+	sources    map[string]SourceStatus
+	records    dns.Records
+	bloom      *hosts.BloomFilter
+	overrides  map[string]bool
 	proxy      *dns.Proxy
 	done       chan bool
+	loaded     chan bool
+	initial    ReloadResult
+	closeOnce  sync.Once
 	mu         sync.RWMutex
 	httpClient *http.Client
 }
@@ -39,19 +102,32 @@ type Server struct {
 func NewServer(proxy *dns.Proxy, config Config) (*Server, error) {
 	server := &Server{
 		Config:     config,
-		done:       make(chan bool, 1),
+		done:       make(chan bool),
+		loaded:     make(chan bool),
 		proxy:      proxy,
 		httpClient: &http.Client{Timeout: 10 * time.Second},
 	}
-	proxy.Handler = server.hijack
+	proxy.Handler = server.handle
+	if len(config.DNS.hijackNetworks) > 0 {
+		proxy.AnswerHandler = server.hijackAnswer
+	}
+
+	// Load runtime overrides
+	if err := server.readOverrides(); err != nil {
+		return nil, err
+	}
 
 	// Periodically refresh hosts
 	if interval := config.DNS.refreshInterval; interval > 0 {
 		go server.reloadHosts(interval)
 	}
 
-	// Load initial hosts
-	go server.loadHosts()
+	// Load initial records and hosts
+	go func() {
+		defer close(server.loaded)
+		server.initial = server.ReloadWithResult()
+		logReload(server.initial)
+	}()
 	return server, nil
 }
 
@@ -74,6 +150,40 @@ func (s *Server) httpGet(url string) (io.ReadCloser, error) {
 }
 
 func (s *Server) readHosts(name string) (hosts.Hosts, error) {
+	rc, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = rc
+	var lr *io.LimitedReader
+	if maxSize := s.Config.DNS.HostsMaxSize; maxSize > 0 {
+		lr = &io.LimitedReader{R: rc, N: int64(maxSize)<<20 + 1} // Read one byte past the limit to detect exceeding it
+		r = lr
+	}
+	hosts, err := hosts.Parse(r)
+	if lr != nil && lr.N == 0 {
+		// Checked before the parse error, as the cut off at the limit may leave the source unparseable
+		hosts, err = nil, fmt.Errorf("size exceeds limit of %d MB", s.Config.DNS.HostsMaxSize)
+	}
+	if err1 := rc.Close(); err == nil {
+		err = err1
+	}
+	return hosts, err
+}
+
+func (s *Server) readRecords(r Records) (dns.Records, error) {
+	rc, err := s.open(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	records, err := r.parse(rc)
+	if err1 := rc.Close(); err == nil {
+		err = err1
+	}
+	return records, err
+}
+
+func (s *Server) open(name string) (io.ReadCloser, error) {
 	url, err := url.Parse(name)
 	if err != nil {
 		return nil, err
@@ -94,11 +204,7 @@ func (s *Server) readHosts(name string) (hosts.Hosts, error) {
 	default:
 		return nil, fmt.Errorf("%s: invalid scheme: %s", url, url.Scheme)
 	}
-	hosts, err := hosts.Parse(rc)
-	if err1 := rc.Close(); err == nil {
-		err = err1
-	}
-	return hosts, err
+	return rc, nil
 }
 
 func nonFqdn(s string) string {
@@ -120,64 +226,442 @@ func (s *Server) reloadHosts(interval time.Duration) {
 	}
 }
 
-func (s *Server) loadHosts() {
+// hostPriorities holds the priorities of hosts entries loaded from sources with a non-zero priority.
+type hostPriorities struct {
+	allowed map[string]int
+	blocked map[string]int
+}
+
+func setPriority(priorities map[string]int, name string, priority int) {
+	if priority == 0 {
+		delete(priorities, name)
+	} else {
+		priorities[name] = priority
+	}
+}
+
+// fetchedHosts holds the hosts read from a remote hosts source.
+type fetchedHosts struct {
+	hosts hosts.Hosts
+	err   error
+}
+
+// readRemoteHosts reads the hosts of all remote hosts sources concurrently, limited by the configured hosts
+// concurrency. The result of each source is returned at its index in the configuration.
+func (s *Server) readRemoteHosts() []fetchedHosts {
+	fetched := make([]fetchedHosts, len(s.Config.Hosts))
+	limit := s.Config.DNS.HostsConcurrency
+	if limit == 0 {
+		limit = len(s.Config.Hosts) // No limit
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, h := range s.Config.Hosts {
+		if h.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			hs, err := s.readHosts(url)
+			fetched[i] = fetchedHosts{hosts: hs, err: err}
+		}(i, h.URL)
+	}
+	wg.Wait()
+	return fetched
+}
+
+func (s *Server) loadHosts() []SourceResult {
 	hs := make(hosts.Hosts)
-	for _, h := range s.Config.Hosts {
+	modes := make(map[string]int)
+	allowed := make(hosts.Hosts)
+	priorities := hostPriorities{allowed: make(map[string]int), blocked: make(map[string]int)}
+	results := make([]SourceResult, len(s.Config.Hosts))
+	failure, failMode := FailureSkip, s.Config.DNS.hijackMode
+	// Load sources in order of increasing priority, such that entries of sources with a higher priority replace those
+	// of sources with a lower priority
+	order := make([]int, len(s.Config.Hosts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.Config.Hosts[order[i]].Priority < s.Config.Hosts[order[j]].Priority
+	})
+	fetched := s.readRemoteHosts()
+	for _, i := range order {
+		h := s.Config.Hosts[i]
 		src := "inline hosts"
 		hs1 := h.hosts
 		if h.URL != "" {
 			src = h.URL
-			var err error
-			hs1, err = s.readHosts(h.URL)
-			if err != nil {
+			hs1 = fetched[i].hosts
+			if err := fetched[i].err; err != nil {
 				log.Printf("failed to read hosts from %s: %s", h.URL, err)
+				results[i] = SourceResult{Source: src, Type: "hosts", Err: err}
+				if h.onFailure > failure {
+					failure, failMode = h.onFailure, h.hijackMode // FailureBlock takes precedence
+				}
 				continue
 			}
 		}
 		if h.Hijack {
 			for name, ipAddrs := range hs1 {
 				hs[name] = ipAddrs
+				setPriority(priorities.blocked, name, h.Priority)
+				if h.hijackMode == s.Config.DNS.hijackMode {
+					delete(modes, name)
+				} else {
+					modes[name] = h.hijackMode
+				}
 			}
 			log.Printf("loaded %d hosts from %s", len(hs1), src)
+			results[i] = SourceResult{Source: src, Type: "hosts", Entries: len(hs1)}
 		} else {
 			removed := 0
-			for hostToRemove := range hs1 {
+			for hostToRemove, ipAddrs := range hs1 {
+				allowed[hostToRemove] = ipAddrs
+				setPriority(priorities.allowed, hostToRemove, h.Priority)
 				if _, ok := hs.Get(hostToRemove); ok {
 					removed++
 					hs.Del(hostToRemove)
+					delete(modes, hostToRemove)
+					delete(priorities.blocked, hostToRemove)
 				}
 			}
 			if removed > 0 {
 				log.Printf("removed %d hosts from %s", removed, src)
 			}
+			results[i] = SourceResult{Source: src, Type: "hosts", Entries: removed}
 		}
 	}
+	var bloom *hosts.BloomFilter
+	if s.Config.DNS.HostsBloomFilter {
+		bloom = hosts.NewBloomFilterFrom(hs, 0.01)
+	}
 	s.mu.Lock()
+	s.updateSources(results)
 	s.hosts = hs
+	s.hostModes = modes
+	s.allowed = allowed
+	s.priorities = priorities
+	s.bloom = bloom
+	s.failure = failure
+	s.failMode = failMode
 	s.mu.Unlock()
 	log.Printf("loaded %d hosts in total", len(hs))
+	switch failure {
+	case FailureAllow:
+		log.Printf("hosts source failed: allowing all requests until it loads")
+	case FailureBlock:
+		log.Printf("hosts source failed: hijacking all requests until it loads")
+	}
+	return results
+}
+
+func (s *Server) loadRecords() []SourceResult {
+	records := make(dns.Records)
+	results := make([]SourceResult, 0, len(s.Config.Records))
+	for _, r := range s.Config.Records {
+		src := "inline records"
+		rs := r.records
+		if r.URL != "" {
+			src = r.URL
+			var err error
+			rs, err = s.readRecords(r)
+			if err != nil {
+				log.Printf("failed to read records from %s: %s", r.URL, err)
+				results = append(results, SourceResult{Source: src, Type: "records", Err: err})
+				continue
+			}
+		}
+		for name, rr := range rs {
+			records[name] = append(records[name], rr...)
+		}
+		log.Printf("loaded %d records from %s", rs.Len(), src)
+		results = append(results, SourceResult{Source: src, Type: "records", Entries: rs.Len()})
+	}
+	s.mu.Lock()
+	s.updateSources(results)
+	s.records = records
+	s.mu.Unlock()
+	return results
+}
+
+// updateSources records the outcome of loading sources in results. The caller must hold the write lock.
+func (s *Server) updateSources(results []SourceResult) {
+	if s.sources == nil {
+		s.sources = make(map[string]SourceStatus)
+	}
+	now := time.Now()
+	for _, r := range results {
+		key := r.Type + " " + r.Source
+		status := SourceStatus{SourceResult: r, LoadedAt: s.sources[key].LoadedAt}
+		if r.Err == nil {
+			status.LoadedAt = now
+		}
+		s.sources[key] = status
+	}
+}
+
+// Sources returns the status of all sources of static records and hosts loaded so far, sorted by type and source.
+func (s *Server) Sources() []SourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sources := make([]SourceStatus, 0, len(s.sources))
+	for _, status := range s.sources {
+		sources = append(sources, status)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Type != sources[j].Type {
+			return sources[i].Type < sources[j].Type
+		}
+		return sources[i].Source < sources[j].Source
+	})
+	return sources
+}
+
+func (s *Server) readOverrides() error {
+	s.overrides = make(map[string]bool)
+	file := s.Config.DNS.HostsOverrideFile
+	if file == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || (fields[0] != "block" && fields[0] != "allow") {
+			return fmt.Errorf("%s: line %d: invalid override: %q", file, n, scanner.Text())
+		}
+		s.overrides[fields[1]] = fields[0] == "block"
+	}
+	return scanner.Err()
+}
+
+func (s *Server) writeOverrides() error {
+	file := s.Config.DNS.HostsOverrideFile
+	if file == "" {
+		return nil
+	}
+	names := make([]string, 0, len(s.overrides))
+	for name := range s.overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		action := "allow"
+		if s.overrides[name] {
+			action = "block"
+		}
+		sb.WriteString(action + " " + name + "\n")
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *Server) override(name string, block bool) error {
+	name = nonFqdn(name)
+	if name == "" {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.overrides[name]
+	s.overrides[name] = block
+	if err := s.writeOverrides(); err != nil {
+		// Roll back, so that the override does not apply unless it is persisted
+		if exists {
+			s.overrides[name] = old
+		} else {
+			delete(s.overrides, name)
+		}
+		return err
+	}
+	return nil
 }
 
-// Reload updates hosts entries of Server s.
-func (s *Server) Reload() { s.loadHosts() }
+// Block ensures that name is hijacked, regardless of hosts lists. The override is persisted if an override file is
+// configured.
+func (s *Server) Block(name string) error { return s.override(name, true) }
+
+// Allow ensures that name is never hijacked, regardless of hosts lists. The override is persisted if an override file
+// is configured.
+func (s *Server) Allow(name string) error { return s.override(name, false) }
+
+// Reload updates static records and hosts entries of Server s.
+func (s *Server) Reload() { logReload(s.ReloadWithResult()) }
+
+// WaitReload waits for the initial load of static records and hosts started by NewServer, and returns its outcome.
+func (s *Server) WaitReload() ReloadResult {
+	<-s.loaded
+	return s.initial
+}
+
+func logReload(result ReloadResult) {
+	if err := result.Err(); err != nil {
+		log.Printf("reload completed with errors in %s: %s", result.Duration, err)
+	} else {
+		log.Printf("reload completed in %s", result.Duration)
+	}
+}
+
+// ReloadWithResult updates static records and hosts entries of Server s, and returns the outcome of loading each
+// source. Sources that fail to load are skipped.
+func (s *Server) ReloadWithResult() ReloadResult {
+	start := time.Now()
+	sources := s.loadRecords()
+	sources = append(sources, s.loadHosts()...)
+	return ReloadResult{Sources: sources, Duration: time.Since(start)}
+}
 
-// Close terminates all active operations and shuts down the DNS server.
+// ReloadHostsWithResult updates hosts entries of Server s, without reloading static records, and returns the outcome of
+// loading each hosts source. Sources that fail to load are skipped.
+func (s *Server) ReloadHostsWithResult() ReloadResult {
+	start := time.Now()
+	sources := s.loadHosts()
+	return ReloadResult{Sources: sources, Duration: time.Since(start)}
+}
+
+// Close terminates all active operations and shuts down the DNS server. It is safe to call Close more than once, also
+// concurrently.
 func (s *Server) Close() error {
-	s.done <- true
+	s.closeOnce.Do(func() { close(s.done) })
 	return nil
 }
 
+// handle answers request r from static records, or hijacks it if it matches any hosts entry.
+func (s *Server) handle(r *dns.Request) *dns.Reply {
+	s.mu.RLock()
+	reply := s.records.Reply(r)
+	s.mu.RUnlock()
+	if reply != nil {
+		return reply
+	}
+	return s.hijack(r)
+}
+
 func (s *Server) hijack(r *dns.Request) *dns.Reply {
+	reply := s.hijackPattern(r)
+	if reply == nil {
+		reply = s.hijackReply(r)
+	}
+	if reply == nil {
+		return nil
+	}
+	return reply.SetTTL(uint32(s.Config.DNS.hijackTTL.Seconds()))
+}
+
+// hijackPattern returns the reply to request r if its name matches any block pattern. Block patterns apply to requests
+// of all types, before and independently of hosts sources. Only a runtime override allowing the name takes precedence.
+func (s *Server) hijackPattern(r *dns.Request) *dns.Reply {
+	if len(s.Config.DNS.blockPatterns) == 0 {
+		return nil
+	}
+	name := strings.ToLower(nonFqdn(r.Name))
+	matched := false
+	for _, pattern := range s.Config.DNS.blockPatterns {
+		if pattern.MatchString(name) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+	s.mu.RLock()
+	block, overridden := s.overrides[nonFqdn(r.Name)]
+	s.mu.RUnlock()
+	if overridden && !block {
+		return nil // Allowed by override
+	}
+	reply := hijackModeReply(r, s.Config.DNS.blockPatternMode, s.sinkholeAddrs())
+	if reply == nil {
+		reply = &dns.Reply{} // Type not applicable to mode
+	}
+	return reply
+}
+
+// hijackReply returns the reply to request r if it should be hijacked. Runtime overrides take precedence over hosts
+// sources, which are evaluated in the following order: exact allowlist, wildcard allowlist, exact block and wildcard
+// block. An allowlist entry only applies if its source has at least the priority of the source of the matching block
+// entry. The order of the sources in the configuration does not matter. While a hosts source with a failure policy is
+// failing, the policy applies instead of hosts sources.
+func (s *Server) hijackReply(r *dns.Request) *dns.Reply {
 	if r.Type != dns.TypeA && r.Type != dns.TypeAAAA {
 		return nil // Type not applicable
 	}
+	name := nonFqdn(r.Name)
 	s.mu.RLock()
-	ipAddrs, ok := s.hosts.Get(nonFqdn(r.Name))
+	block, overridden := s.overrides[name]
+	if overridden && !block {
+		s.mu.RUnlock()
+		return nil // Allowed by override
+	}
+	switch s.failure {
+	case FailureAllow:
+		if !overridden {
+			s.mu.RUnlock()
+			return nil // Fail open
+		}
+	case FailureBlock:
+		mode := s.failMode
+		s.mu.RUnlock()
+		return hijackModeReply(r, mode, s.sinkholeAddrs()) // Fail closed
+	}
+	if s.allowedLocked(name) && !overridden {
+		s.mu.RUnlock()
+		return nil // Allowed by exact or wildcard allowlist entry
+	}
+	if !overridden && s.bloom != nil && !s.bloom.Match(name) {
+		s.mu.RUnlock()
+		return nil // Definitely no match
+	}
+	match, ok := s.hosts.Match(name)
+	ipAddrs, _ := s.hosts.Get(match)
+	mode, overriddenMode := s.hostModes[match]
 	s.mu.RUnlock()
-	if !ok {
+	if !ok && !overridden {
 		return nil // No match
 	}
-	switch s.Config.DNS.hijackMode {
+	if ok && hosts.IsWildcard(match) && len(s.Config.DNS.hijackAddresses) > 0 {
+		ipAddrs = s.sinkholeAddrs() // Sinkhole subdomains matched by wildcard
+	}
+	if !ok || !overriddenMode {
+		mode = s.Config.DNS.hijackMode // Matched by override or by a source using the default mode
+	}
+	return hijackModeReply(r, mode, ipAddrs)
+}
+
+// sinkholeAddrs returns the configured hijack addresses.
+func (s *Server) sinkholeAddrs() []net.IPAddr {
+	ipAddrs := make([]net.IPAddr, 0, len(s.Config.DNS.hijackAddresses))
+	for _, ip := range s.Config.DNS.hijackAddresses {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: ip})
+	}
+	return ipAddrs
+}
+
+// hijackModeReply returns the reply to hijacked request r according to mode. Addresses ipAddrs are answered in mode
+// HijackHosts.
+func hijackModeReply(r *dns.Request, mode int, ipAddrs []net.IPAddr) *dns.Reply {
+	switch mode {
 	case HijackZero:
 		switch r.Type {
 		case dns.TypeA:
@@ -187,6 +671,8 @@ func (s *Server) hijack(r *dns.Request) *dns.Reply {
 		}
 	case HijackEmpty:
 		return &dns.Reply{}
+	case HijackNXDomain:
+		return dns.ReplyNXDomain()
 	case HijackHosts:
 		var ipv4Addr []net.IP
 		var ipv6Addr []net.IP
@@ -207,6 +693,54 @@ func (s *Server) hijack(r *dns.Request) *dns.Reply {
 	return nil
 }
 
+// hijackAnswer returns the reply replacing the upstream answer to request r if any of the answered addresses ipAddrs
+// is in a hijacked network. Names allowed by a runtime override or by the allowlist are not hijacked. The reply is
+// determined by the default hijack mode, where sinkhole addresses are answered in mode HijackHosts.
+func (s *Server) hijackAnswer(r *dns.Request, ipAddrs []net.IP) *dns.Reply {
+	if !s.inHijackNetwork(ipAddrs) {
+		return nil
+	}
+	name := nonFqdn(r.Name)
+	s.mu.RLock()
+	block, overridden := s.overrides[name]
+	allowed := s.allowedLocked(name)
+	s.mu.RUnlock()
+	if overridden && !block || allowed && !overridden {
+		return nil
+	}
+	reply := hijackModeReply(r, s.Config.DNS.hijackMode, s.sinkholeAddrs())
+	if reply == nil {
+		reply = &dns.Reply{} // Type not applicable to mode
+	}
+	return reply.SetTTL(uint32(s.Config.DNS.hijackTTL.Seconds()))
+}
+
+// allowedLocked returns whether name matches an allowlist entry that is not outranked by a block entry from a source
+// with a higher priority. The caller must hold s.mu.
+func (s *Server) allowedLocked(name string) bool {
+	match, ok := s.allowed.Match(name)
+	if !ok {
+		return false
+	}
+	if len(s.priorities.allowed) == 0 && len(s.priorities.blocked) == 0 {
+		return true // All sources have the same priority
+	}
+	block, ok := s.hosts.Match(name)
+	return !ok || s.priorities.allowed[match] >= s.priorities.blocked[block]
+}
+
+// inHijackNetwork returns whether any of ipAddrs is in a hijacked network.
+func (s *Server) inHijackNetwork(ipAddrs []net.IP) bool {
+	for _, ip := range ipAddrs {
+		for _, ipNet := range s.Config.DNS.hijackNetworks {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // ListenAndServe starts a server on configured address and protocol.
 func (s *Server) ListenAndServe() error {
 	log.Printf("dns server listening on %s [%s]", s.Config.DNS.Listen, s.Config.DNS.Protocol)
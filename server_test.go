@@ -7,10 +7,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	mdns "github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns"
 	"github.com/mpolden/zdns/hosts"
@@ -157,6 +161,207 @@ func TestReloadHostsOnTick(t *testing.T) {
 	}
 }
 
+func TestLoadHostsConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	slowServer := func(delay time.Duration, response string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(delay)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			w.Write([]byte(response))
+		}))
+	}
+	// The first source finishes last, but is still merged first
+	srvs := []*httptest.Server{
+		slowServer(300*time.Millisecond, "192.0.2.1 badhost1\n192.0.2.1 badhost2"),
+		slowServer(100*time.Millisecond, "192.0.2.2 badhost1"),
+		slowServer(100*time.Millisecond, "0.0.0.0 badhost2"),
+		slowServer(100*time.Millisecond, "192.0.2.3 badhost3"),
+	}
+	config := Config{
+		DNS:      DNSOptions{Listen: "0.0.0.0:53", HostsConcurrency: 3},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+	}
+	for i, srv := range srvs {
+		defer srv.Close()
+		config.Hosts = append(config.Hosts, Hosts{URL: srv.URL, Hijack: i != 2})
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, httpClient: &http.Client{}}
+	start := time.Now()
+	results := s.loadHosts()
+	if took, limit := time.Since(start), 600*time.Millisecond; took >= limit {
+		t.Errorf("loadHosts took %s, want < %s", took, limit)
+	}
+	if maxInFlight != 3 {
+		t.Errorf("maxInFlight = %d, want %d", maxInFlight, 3)
+	}
+	want := hosts.Hosts{
+		"badhost1": []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}},
+		"badhost3": []net.IPAddr{{IP: net.ParseIP("192.0.2.3")}},
+	}
+	if !reflect.DeepEqual(want, s.hosts) {
+		t.Errorf("got %+v, want %+v", s.hosts, want)
+	}
+	entries := []int{2, 1, 1, 1}
+	for i, want := range entries {
+		if got := results[i].Entries; got != want {
+			t.Errorf("#%d: Entries = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestWaitReload(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Write([]byte("192.0.2.1 badhost1\n"))
+	}))
+	defer httpSrv.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: "0.0.0.0:53"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts:    []Hosts{{URL: httpSrv.URL, Hijack: true}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := dns.NewProxy(cache.New(0, nil), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(proxy, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	result := srv.WaitReload()
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.Sources[0].Entries, 1; got != want {
+		t.Errorf("Entries = %d, want %d", got, want)
+	}
+	if _, ok := srv.hosts["badhost1"]; !ok {
+		t.Error("expected hosts to be loaded")
+	}
+	// Waiting again returns the same result, without loading sources again
+	srv.WaitReload()
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+}
+
+func TestLoadHostsMaxSize(t *testing.T) {
+	const (
+		line  = "192.0.2.1 badhost1\n"
+		limit = 1<<20 + 1 // Bytes read by readHosts before giving up
+	)
+	// Comment line making the read stop after the given number of bytes of the last entry
+	padding := func(n int) string {
+		k := (limit - n) % len(line)
+		if k < 2 {
+			k += len(line)
+		}
+		return strings.Repeat("#", k-1) + "\n"
+	}
+	var tests = []struct {
+		prefix string
+		line   string
+	}{
+		{"", line},
+		{padding(len("192.0.2.1 bad")), line}, // Stops in the middle of an entry
+		{padding(len("192.0")), line},         // Stops in the middle of an address
+	}
+	for i, tt := range tests {
+		var written int64
+		done := make(chan bool)
+		// Serves an endless hosts list
+		httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			n, err := w.Write([]byte(tt.prefix))
+			written += int64(n)
+			for err == nil && written < 1<<30 {
+				n, err = w.Write([]byte(tt.line))
+				written += int64(n)
+			}
+		}))
+		config := Config{
+			DNS:      DNSOptions{Listen: "0.0.0.0:53", HostsMaxSize: 1},
+			Resolver: ResolverOptions{TimeoutString: "0"},
+			Hosts: []Hosts{
+				{URL: httpSrv.URL, Hijack: true},
+				{Hosts: []string{"192.0.2.2 badhost2"}, Hijack: true},
+			},
+		}
+		if err := config.load(); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Config: config, httpClient: &http.Client{}}
+		results := s.loadHosts()
+		<-done
+		httpSrv.Close()
+		if written >= 1<<30 {
+			t.Errorf("#%d: read all %d bytes of hosts source, want read to be aborted", i, written)
+		}
+		want := "size exceeds limit of 1 MB"
+		if err := results[0].Err; err == nil || err.Error() != want {
+			t.Errorf("#%d: Err = %v, want %q", i, err, want)
+		}
+		if _, ok := s.hosts.Get("badhost1"); ok {
+			t.Errorf("#%d: got badhost1 from aborted hosts source", i)
+		}
+		if _, ok := s.hosts.Get("badhost2"); !ok {
+			t.Errorf("#%d: want badhost2 from inline hosts", i)
+		}
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	s, cleanup := testServer(t, 10*time.Millisecond)
+	defer cleanup() // Closes once more
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	closed := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Close to return")
+	}
+	select {
+	case <-s.done:
+	default:
+		t.Error("want server to be shut down")
+	}
+}
+
 func TestNonFqdn(t *testing.T) {
 	var tests = []struct {
 		in, out string
@@ -175,12 +380,16 @@ func TestNonFqdn(t *testing.T) {
 
 func TestHijack(t *testing.T) {
 	s := &Server{
-		Config: Config{},
+		Config: Config{DNS: DNSOptions{
+			hijackAddresses: []net.IP{net.ParseIP("192.0.2.100"), net.ParseIP("192.0.2.101"), net.ParseIP("2001:db8::100")},
+			hijackTTL:       time.Hour,
+		}},
 		hosts: hosts.Hosts{
 			"badhost1": []net.IPAddr{
 				{IP: net.ParseIP("192.0.2.1")},
 				{IP: net.ParseIP("2001:db8::1")},
 			},
+			"*.doubleclick.net": []net.IPAddr{{IP: net.IPv4zero}},
 		},
 	}
 
@@ -199,16 +408,630 @@ func TestHijack(t *testing.T) {
 		{dns.TypeAAAA, "badhost1", HijackZero, "badhost1\t3600\tIN\tAAAA\t::"},
 		{dns.TypeAAAA, "badhost1", HijackEmpty, ""},
 		{dns.TypeAAAA, "badhost1", HijackHosts, "badhost1\t3600\tIN\tAAAA\t2001:db8::1"},
+		{dns.TypeA, "doubleclick.net", HijackHosts, ""}, // Wildcard does not match parent
+		{dns.TypeA, "tracker.doubleclick.net", HijackZero, "tracker.doubleclick.net\t3600\tIN\tA\t0.0.0.0"},
+		{dns.TypeA, "tracker.doubleclick.net", HijackHosts, "tracker.doubleclick.net\t3600\tIN\tA\t192.0.2.100\n" +
+			"tracker.doubleclick.net\t3600\tIN\tA\t192.0.2.101"},
+		{dns.TypeA, "a.tracker.doubleclick.net", HijackHosts, "a.tracker.doubleclick.net\t3600\tIN\tA\t192.0.2.100\n" +
+			"a.tracker.doubleclick.net\t3600\tIN\tA\t192.0.2.101"},
+		{dns.TypeAAAA, "tracker.doubleclick.net", HijackHosts, "tracker.doubleclick.net\t3600\tIN\tAAAA\t2001:db8::100"},
+	}
+	for _, bloom := range []*hosts.BloomFilter{nil, hosts.NewBloomFilterFrom(s.hosts, 0.01)} {
+		s.bloom = bloom
+		for i, tt := range tests {
+			s.Config.DNS.hijackMode = tt.mode
+			req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+			reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.rname})
+			if reply == nil && tt.out == "" {
+				reply = &dns.Reply{}
+			}
+			if reply.String() != tt.out {
+				t.Errorf("#%d: hijack(%+v) = %q, want %q (bloom = %t)", i, req, reply.String(), tt.out, bloom != nil)
+			}
+		}
+	}
+}
+
+func TestHijackAnswer(t *testing.T) {
+	_, ipv4Net, _ := net.ParseCIDR("198.51.100.0/24")
+	_, ipv6Net, _ := net.ParseCIDR("2001:db8:1::/48")
+	s := &Server{
+		Config: Config{DNS: DNSOptions{
+			hijackNetworks: []*net.IPNet{ipv4Net, ipv6Net},
+			hijackTTL:      time.Hour,
+		}},
+		allowed: hosts.Hosts{"goodhost1": nil},
+	}
+
+	var tests = []struct {
+		rtype     uint16
+		rname     string
+		ipAddrs   []string
+		mode      int
+		addresses []net.IP
+		out       string
+	}{
+		{dns.TypeA, "host1", []string{"192.0.2.1"}, HijackZero, nil, "<nil>"},
+		{dns.TypeA, "host1", []string{"192.0.2.1", "198.51.100.1"}, HijackZero, nil, "host1\t3600\tIN\tA\t0.0.0.0"},
+		{dns.TypeAAAA, "host1", []string{"2001:db8:1::1"}, HijackZero, nil, "host1\t3600\tIN\tAAAA\t::"},
+		{dns.TypeAAAA, "host1", []string{"2001:db8:2::1"}, HijackZero, nil, "<nil>"},
+		{dns.TypeA, "host1", []string{"198.51.100.1"}, HijackEmpty, nil, ""},
+		{dns.TypeA, "host1", []string{"198.51.100.1"}, HijackHosts, []net.IP{net.ParseIP("192.0.2.100")},
+			"host1\t3600\tIN\tA\t192.0.2.100"},
+		{dns.TypeA, "goodhost1", []string{"198.51.100.1"}, HijackZero, nil, "<nil>"}, // Allowed
 	}
 	for i, tt := range tests {
 		s.Config.DNS.hijackMode = tt.mode
-		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
-		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.rname})
-		if reply == nil && tt.out == "" {
+		s.Config.DNS.hijackAddresses = tt.addresses
+		ipAddrs := make([]net.IP, 0, len(tt.ipAddrs))
+		for _, ip := range tt.ipAddrs {
+			ipAddrs = append(ipAddrs, net.ParseIP(ip))
+		}
+		out := "<nil>"
+		if reply := s.hijackAnswer(&dns.Request{Type: tt.rtype, Name: tt.rname}, ipAddrs); reply != nil {
+			out = reply.String()
+		}
+		if out != tt.out {
+			t.Errorf("#%d: hijackAnswer(%s, %s) = %q, want %q", i, tt.rname, tt.ipAddrs, out, tt.out)
+		}
+	}
+}
+
+func TestHijackModePerSource(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: "0.0.0.0:53", HijackMode: "zero"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{Hosts: []string{"192.0.2.1 ads1", "192.0.2.1 host1"}, Hijack: true, HijackMode: "hosts"},
+			{Hosts: []string{"192.0.2.2 malware1", "192.0.2.2 host1"}, Hijack: true, HijackMode: "nxdomain"},
+			{Hosts: []string{"192.0.2.3 tracker1"}, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := dns.NewProxy(cache.New(0, nil), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, proxy: proxy}
+	proxy.Handler = s.handle
+	s.loadHosts()
+
+	var tests = []struct {
+		name   string
+		rcode  int
+		answer string
+	}{
+		{"ads1.", mdns.RcodeSuccess, "ads1.\t3600\tIN\tA\t192.0.2.1"},
+		{"malware1.", mdns.RcodeNameError, ""},
+		{"host1.", mdns.RcodeNameError, ""}, // Last source wins
+		{"tracker1.", mdns.RcodeSuccess, "tracker1.\t3600\tIN\tA\t0.0.0.0"},
+	}
+	for i, tt := range tests {
+		m := mdns.Msg{}
+		m.SetQuestion(tt.name, mdns.TypeA)
+		res, err := proxy.Resolve(&m, net.IPv4(192, 0, 2, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %d, want %d", i, got, tt.rcode)
+		}
+		var answers []string
+		for _, rr := range res.Msg.Answer {
+			answers = append(answers, rr.String())
+		}
+		if got := strings.Join(answers, "\n"); got != tt.answer {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, tt.answer)
+		}
+	}
+}
+
+func TestHijackPrecedence(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: "0.0.0.0:53", HijackMode: "hosts"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			// Allowlist is loaded before the blocklist, but still takes precedence
+			{Hosts: []string{"0.0.0.0 good.example.com", "0.0.0.0 *.example.org", "0.0.0.0 good.example.net"}},
+			{
+				Hosts: []string{
+					"192.0.2.1 *.example.com",
+					"192.0.2.2 bad.example.org",
+					"192.0.2.3 *.example.net",
+					"192.0.2.4 bad.example.net",
+					"192.0.2.5 *.good.example.net",
+				},
+				Hijack: true,
+			},
+			{Hosts: []string{"0.0.0.0 *.allowed.example.com"}},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, overrides: make(map[string]bool)}
+	s.loadHosts()
+
+	var tests = []struct {
+		name string
+		out  string
+	}{
+		{"good.example.com", ""},                                       // Exact allow > wildcard block
+		{"foo.allowed.example.com", ""},                                // Wildcard allow > wildcard block
+		{"bad.example.org", ""},                                        // Wildcard allow > exact block
+		{"good.example.net", ""},                                       // Exact allow > wildcard block
+		{"bad.example.net", "bad.example.net\t3600\tIN\tA\t192.0.2.4"}, // Exact block > wildcard block
+		{"foo.example.net", "foo.example.net\t3600\tIN\tA\t192.0.2.3"}, // Wildcard block
+		{"foo.good.example.net", "foo.good.example.net\t3600\tIN\tA\t192.0.2.5"},
+		{"foo.example.com", "foo.example.com\t3600\tIN\tA\t192.0.2.1"},
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: tt.name})
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%q) = %q, want %q", i, tt.name, got, tt.out)
+		}
+	}
+
+	// Runtime overrides take precedence over everything
+	if err := s.Block("good.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "good.example.com"}); reply == nil {
+		t.Error("want hijacked reply for blocked override")
+	}
+}
+
+func TestHijackPriority(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: "0.0.0.0:53", HijackMode: "hosts"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{Hosts: []string{"192.0.2.1 blocked.example.com", "192.0.2.2 *.example.org"}, Hijack: true, Priority: 10},
+			{Hosts: []string{"0.0.0.0 blocked.example.com", "0.0.0.0 allowed.example.com", "0.0.0.0 foo.example.org"}},
+			{Hosts: []string{"192.0.2.3 allowed.example.com", "192.0.2.4 *.example.net"}, Hijack: true, Priority: -1},
+			{Hosts: []string{"0.0.0.0 *.example.net"}, Priority: -2},
+			{Hosts: []string{"192.0.2.5 mode.example.com"}, Hijack: true, Priority: 1},
+			{Hosts: []string{"192.0.2.6 mode.example.com"}, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, overrides: make(map[string]bool)}
+	results := s.loadHosts()
+
+	var tests = []struct {
+		name string
+		out  string
+	}{
+		{"blocked.example.com", "blocked.example.com\t3600\tIN\tA\t192.0.2.1"}, // Higher priority block > exact allow
+		{"foo.example.org", "foo.example.org\t3600\tIN\tA\t192.0.2.2"},         // Higher priority wildcard block > exact allow
+		{"allowed.example.com", ""},                                            // Higher priority allow > exact block
+		{"foo.example.net", "foo.example.net\t3600\tIN\tA\t192.0.2.4"},         // Higher priority block > wildcard allow
+		{"mode.example.com", "mode.example.com\t3600\tIN\tA\t192.0.2.5"},       // Higher priority block is loaded last
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: tt.name})
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%q) = %q, want %q", i, tt.name, got, tt.out)
+		}
+	}
+
+	// Results are reported in configuration order
+	entries := []int{2, 1, 2, 0, 1, 1}
+	if len(results) != len(entries) {
+		t.Fatalf("len(results) = %d, want %d", len(results), len(entries))
+	}
+	for i, want := range entries {
+		if got := results[i].Entries; got != want {
+			t.Errorf("#%d: Entries = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestHijackPattern(t *testing.T) {
+	config := Config{
+		DNS: DNSOptions{
+			Listen:              "0.0.0.0:53",
+			BlockPatternStrings: []string{`\.(zip|mov)$`},
+		},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts:    []Hosts{{Hosts: []string{"0.0.0.0 allowed.zip"}}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, overrides: map[string]bool{"override.zip": false}}
+	s.loadHosts()
+
+	var tests = []struct {
+		rtype    uint16
+		name     string
+		hijacked bool
+		out      string
+	}{
+		{dns.TypeA, "example.zip.", true, "example.zip.\t3600\tIN\tA\t0.0.0.0"},
+		{dns.TypeAAAA, "www.example.mov.", true, "www.example.mov.\t3600\tIN\tAAAA\t::"},
+		{dns.TypeA, "Example.ZIP.", true, "Example.ZIP.\t3600\tIN\tA\t0.0.0.0"},
+		{mdns.TypeMX, "example.zip.", true, ""},                                 // Type not applicable to mode
+		{dns.TypeA, "allowed.zip.", true, "allowed.zip.\t3600\tIN\tA\t0.0.0.0"}, // Allowlist does not apply
+		{dns.TypeA, "override.zip.", false, ""},                                 // Allowed by override
+		{dns.TypeA, "example.com.", false, ""},
+		{dns.TypeA, "zip.example.com.", false, ""},
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.name})
+		if hijacked := reply != nil; hijacked != tt.hijacked {
+			t.Errorf("#%d: hijacked %q = %t, want %t", i, tt.name, hijacked, tt.hijacked)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%q) = %q, want %q", i, tt.name, got, tt.out)
+		}
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	var tests = []struct {
+		onFailure string
+		out       map[string]string
+	}{
+		{"", map[string]string{
+			"badhost4":  "",
+			"goodhost1": "",
+			"badhost1":  "badhost1\t3600\tIN\tA\t0.0.0.0",
+			"allowed1":  "",
+		}},
+		{"allow", map[string]string{
+			"badhost4":  "",
+			"goodhost1": "",
+			"badhost1":  "badhost1\t3600\tIN\tA\t0.0.0.0", // Blocked by override
+			"allowed1":  "",
+		}},
+		{"block", map[string]string{
+			"badhost4":  "badhost4\t3600\tIN\tA\t0.0.0.0",
+			"goodhost1": "goodhost1\t3600\tIN\tA\t0.0.0.0",
+			"badhost1":  "badhost1\t3600\tIN\tA\t0.0.0.0",
+			"allowed1":  "", // Allowed by override
+		}},
+	}
+	for i, tt := range tests {
+		file, err := tempFile(t, hostsFile2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file)
+		config := newConfig()
+		config.Hosts = []Hosts{
+			{URL: "file://" + file, Hijack: true, OnFailure: tt.onFailure},
+			{Hosts: []string{"0.0.0.0 goodhost1"}},
+		}
+		if err := config.load(); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Config: config, overrides: map[string]bool{"badhost1": true, "allowed1": false}}
+		s.loadHosts()
+		if reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "goodhost1"}); reply != nil {
+			t.Errorf("#%d: hijack(%q) = %q, want no reply while source is loaded", i, "goodhost1", reply)
+		}
+
+		// Source fails to load on next reload
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		s.loadHosts()
+		for name, want := range tt.out {
+			reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: name})
+			if reply == nil {
+				reply = &dns.Reply{}
+			}
+			if got := reply.String(); got != want {
+				t.Errorf("#%d: hijack(%q) = %q, want %q", i, name, got, want)
+			}
+		}
+
+		// Policy no longer applies once source loads again
+		if err := os.WriteFile(file, []byte(hostsFile2), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s.loadHosts()
+		if reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "goodhost1"}); reply != nil {
+			t.Errorf("#%d: hijack(%q) = %q, want no reply after source recovered", i, "goodhost1", reply)
+		}
+	}
+}
+
+func TestHijackTTL(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackTTL: 5 * time.Minute}},
+		hosts: hosts.Hosts{
+			"badhost1": []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}},
+		},
+	}
+	for _, mode := range []int{HijackZero, HijackHosts} {
+		s.Config.DNS.hijackMode = mode
+		reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "badhost1"})
+		if reply == nil {
+			t.Fatalf("mode %d: expected hijacked reply", mode)
+		}
+		if got, want := strings.Fields(reply.String())[1], "300"; got != want {
+			t.Errorf("mode %d: TTL = %s, want %s", mode, got, want)
+		}
+	}
+}
+
+func TestLoadRecords(t *testing.T) {
+	file, err := tempFile(t, "host2.example.com. 60 IN A 192.0.2.2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	config := newConfig()
+	config.Records = []Records{
+		{Records: []string{"host1.example.com. 60 IN A 192.0.2.1"}},
+		{URL: "file://" + file},
+		{Records: []string{"192.0.2.4 host4.example.com"}, Format: "hosts"},
+		{Records: []string{"host5.example.com. IN A 192.0.2.5", "host6.example.com. 30 IN A 192.0.2.6"}, TTLString: "5m"},
+		{Records: []string{"192.0.2.7 host7.example.com"}, Format: "hosts", TTLString: "10s"},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config}
+	s.loadRecords()
+	var tests = []struct {
+		name string
+		out  string
+	}{
+		{"host1.example.com.", "host1.example.com.\t60\tIN\tA\t192.0.2.1"},
+		{"host2.example.com.", "host2.example.com.\t60\tIN\tA\t192.0.2.2"},
+		{"host3.example.com.", ""},
+		{"host4.example.com.", "host4.example.com.\t3600\tIN\tA\t192.0.2.4"},
+		{"host5.example.com.", "host5.example.com.\t300\tIN\tA\t192.0.2.5"},
+		{"host6.example.com.", "host6.example.com.\t30\tIN\tA\t192.0.2.6"},
+		{"host7.example.com.", "host7.example.com.\t10\tIN\tA\t192.0.2.7"},
+	}
+	for i, tt := range tests {
+		reply := s.handle(&dns.Request{Type: dns.TypeA, Name: tt.name})
+		if reply == nil {
 			reply = &dns.Reply{}
 		}
-		if reply.String() != tt.out {
-			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: handle(%s) = %q, want %q", i, tt.name, got, tt.out)
+		}
+	}
+}
+
+func TestReloadRecordsAtomically(t *testing.T) {
+	oldRecords := "host1.example.com. 60 IN A 192.0.2.1\nhost1.example.com. 60 IN A 192.0.2.2\n"
+	newRecords := "host1.example.com. 60 IN A 192.0.2.3\nhost1.example.com. 60 IN A 192.0.2.4\n"
+	file, err := tempFile(t, oldRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	s := &Server{Config: Config{Records: []Records{{URL: "file://" + file}}}}
+	s.loadRecords()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			records := oldRecords
+			if i%2 == 0 {
+				records = newRecords
+			}
+			if err := os.WriteFile(file+".tmp", []byte(records), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := os.Rename(file+".tmp", file); err != nil {
+				t.Error(err)
+				return
+			}
+			s.loadRecords()
+		}
+	}()
+	want := map[string]bool{
+		"192.0.2.1 192.0.2.2": true,
+		"192.0.2.3 192.0.2.4": true,
+	}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		reply := s.handle(&dns.Request{Type: dns.TypeA, Name: "host1.example.com."})
+		if reply == nil {
+			t.Fatal("expected records to be present during reload")
+		}
+		var addrs []string
+		for _, line := range strings.Split(reply.String(), "\n") {
+			fields := strings.Fields(line)
+			addrs = append(addrs, fields[len(fields)-1])
 		}
+		if got := strings.Join(addrs, " "); !want[got] {
+			t.Fatalf("got partial record set %q", got)
+		}
+	}
+}
+
+func TestReloadWithResult(t *testing.T) {
+	file, err := tempFile(t, hostsFile2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	config := newConfig()
+	config.Records = []Records{
+		{Records: []string{"host1.example.com. 60 IN A 192.0.2.1", "host1.example.com. 60 IN A 192.0.2.2"}},
+		{URL: "file:///non-existent/records"},
+	}
+	config.Hosts = []Hosts{
+		{URL: "file://" + file, Hijack: true},
+		{Hosts: []string{"192.0.2.5 badhost5"}},
+		{URL: "file:///non-existent/hosts", Hijack: true},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config}
+	result := s.ReloadWithResult()
+	var tests = []struct {
+		source  string
+		typ     string
+		entries int
+		err     bool
+	}{
+		{"inline records", "records", 2, false},
+		{"file:///non-existent/records", "records", 0, true},
+		{"file://" + file, "hosts", 3, false},
+		{"inline hosts", "hosts", 1, false},
+		{"file:///non-existent/hosts", "hosts", 0, true},
+	}
+	if got, want := len(result.Sources), len(tests); got != want {
+		t.Fatalf("len(Sources) = %d, want %d", got, want)
+	}
+	for i, tt := range tests {
+		got := result.Sources[i]
+		if got.Source != tt.source || got.Type != tt.typ || got.Entries != tt.entries || (got.Err != nil) != tt.err {
+			t.Errorf("#%d: Sources[%d] = %+v, want source %s of type %s with %d entries (error = %t)",
+				i, i, got, tt.source, tt.typ, tt.entries, tt.err)
+		}
+	}
+	if err := result.Err(); err == nil || !strings.HasPrefix(err.Error(), "file:///non-existent/records: ") {
+		t.Errorf("Err() = %v, want error for file:///non-existent/records", err)
+	}
+
+	// Reloading hosts only
+	hostsResult := s.ReloadHostsWithResult()
+	if got, want := len(hostsResult.Sources), 3; got != want {
+		t.Fatalf("len(Sources) = %d, want %d", got, want)
+	}
+	for i, got := range hostsResult.Sources {
+		if want := result.Sources[i+2]; got.Source != want.Source || got.Type != "hosts" || got.Entries != want.Entries {
+			t.Errorf("#%d: Sources[%d] = %+v, want %+v", i, i, got, want)
+		}
+	}
+
+	// Successful reload
+	s.Config.Records = s.Config.Records[:1]
+	s.Config.Hosts = s.Config.Hosts[:2]
+	if err := s.ReloadWithResult().Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
+
+func TestSources(t *testing.T) {
+	file, err := tempFile(t, hostsFile2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	config := newConfig()
+	config.Hosts = []Hosts{
+		{URL: "file://" + file, Hijack: true},
+		{Hosts: []string{"192.0.2.5 badhost5"}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config}
+	if got := s.Sources(); len(got) != 0 {
+		t.Fatalf("Sources() = %+v, want none before loading", got)
+	}
+	start := time.Now()
+	s.ReloadWithResult()
+	sources := s.Sources()
+	if got, want := len(sources), 2; got != want {
+		t.Fatalf("len(Sources()) = %d, want %d", got, want)
+	}
+	loadedAt := sources[0].LoadedAt
+	if sources[0].Source != "file://"+file || sources[0].Entries != 3 || loadedAt.Before(start) {
+		t.Errorf("Sources()[0] = %+v, want source loaded with 3 entries", sources[0])
+	}
+
+	// Failed load keeps the time of the last successful load
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadWithResult()
+	sources = s.Sources()
+	if sources[0].Err == nil || sources[0].Entries != 0 || !sources[0].LoadedAt.Equal(loadedAt) {
+		t.Errorf("Sources()[0] = %+v, want failed source last loaded at %s", sources[0], loadedAt)
+	}
+	if sources[1].Source != "inline hosts" || sources[1].LoadedAt.Before(loadedAt) {
+		t.Errorf("Sources()[1] = %+v, want reloaded inline hosts", sources[1])
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	file, err := tempFile(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackMode: HijackZero, HostsOverrideFile: file}},
+		hosts: hosts.Hosts{
+			"badhost1": []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}},
+		},
+	}
+	if err := s.readOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	hijacked := func(name string) bool { return s.hijack(&dns.Request{Type: dns.TypeA, Name: name + "."}) != nil }
+
+	if err := s.Block("goodhost1."); err != nil {
+		t.Fatal(err)
+	}
+	if !hijacked("goodhost1") {
+		t.Errorf("expected goodhost1 to be hijacked")
+	}
+	if err := s.Allow("badhost1"); err != nil {
+		t.Fatal(err)
+	}
+	if hijacked("badhost1") {
+		t.Errorf("expected badhost1 to not be hijacked")
+	}
+
+	// Overrides are persisted
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "allow badhost1\nblock goodhost1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	s.overrides = nil
+	if err := s.readOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	if !hijacked("goodhost1") || hijacked("badhost1") {
+		t.Errorf("expected overrides to be restored, got %+v", s.overrides)
+	}
+
+	// Overrides are rolled back if they cannot be persisted
+	s.Config.DNS.HostsOverrideFile = filepath.Join(file, "overrides")
+	if err := s.Block("badhost1"); err == nil {
+		t.Error("expected error")
+	}
+	if err := s.Block("goodhost2"); err == nil {
+		t.Error("expected error")
+	}
+	if hijacked("badhost1") || hijacked("goodhost2") {
+		t.Errorf("expected failed overrides to be rolled back, got %+v", s.overrides)
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Reloader is the interface for types that need to act on a reload signal.
@@ -14,17 +15,29 @@ type Reloader interface {
 	Reload()
 }
 
+// Maintainer is the interface for types that toggle maintenance mode on a signal.
+type Maintainer interface {
+	ToggleMaintenance() bool
+}
+
 // Handler represents a signal handler and holds references to types that should act on operating system signals.
 type Handler struct {
-	signal    chan os.Signal
-	reloaders []Reloader
-	closers   []io.Closer
-	wg        sync.WaitGroup
+	signal      chan os.Signal
+	reloaders   []Reloader
+	maintainers []Maintainer
+	closers     []io.Closer
+	debounce    time.Duration
+	wg          sync.WaitGroup
 }
 
 // NewHandler creates a new handler for handling operating system signals.
-func NewHandler(c chan os.Signal) *Handler {
-	h := &Handler{signal: c}
+func NewHandler(c chan os.Signal) *Handler { return NewHandlerWithDebounce(c, 0) }
+
+// NewHandlerWithDebounce creates a new handler for handling operating system signals, where reload signals received
+// within debounce of the first one are coalesced into a single reload. The reload happens when debounce has passed. A
+// zero debounce reloads immediately on every signal.
+func NewHandlerWithDebounce(c chan os.Signal, debounce time.Duration) *Handler {
+	h := &Handler{signal: c, debounce: debounce}
 	signal.Notify(h.signal)
 	h.wg.Add(1)
 	go h.readSignal()
@@ -34,9 +47,16 @@ func NewHandler(c chan os.Signal) *Handler {
 // OnReload registers a reloader to call for the signal SIGHUP.
 func (h *Handler) OnReload(r Reloader) { h.reloaders = append(h.reloaders, r) }
 
-// OnClose registers a closer to call for signals SIGTERM and SIGINT.
+// OnMaintenance registers a maintainer to call for the signal SIGUSR1.
+func (h *Handler) OnMaintenance(m Maintainer) { h.maintainers = append(h.maintainers, m) }
+
+// OnClose registers a closer to call for signals SIGTERM and SIGINT. Closers are called in the order they are
+// registered, such that a component can be registered before the components it depends on.
 func (h *Handler) OnClose(c io.Closer) { h.closers = append(h.closers, c) }
 
+// Closers returns the registered closers in the order they are called.
+func (h *Handler) Closers() []io.Closer { return append([]io.Closer(nil), h.closers...) }
+
 // Close stops handling any new signals and completes processing of pending signals before returning.
 func (h *Handler) Close() error {
 	signal.Stop(h.signal)
@@ -45,17 +65,51 @@ func (h *Handler) Close() error {
 	return nil
 }
 
+func (h *Handler) reload() {
+	for _, r := range h.reloaders {
+		r.Reload()
+	}
+}
+
 func (h *Handler) readSignal() {
 	defer h.wg.Done()
-	for sig := range h.signal {
+	var pendingReload <-chan time.Time
+	for {
+		var sig os.Signal
+		select {
+		case <-pendingReload:
+			pendingReload = nil
+			h.reload()
+			continue
+		case s, ok := <-h.signal:
+			if !ok {
+				if pendingReload != nil {
+					h.reload()
+				}
+				return
+			}
+			sig = s
+		}
 		switch sig {
 		case syscall.SIGHUP:
-			log.Printf("received signal %s: reloading", sig)
-			for _, r := range h.reloaders {
-				r.Reload()
+			if h.debounce == 0 {
+				log.Printf("received signal %s: reloading", sig)
+				h.reload()
+			} else if pendingReload == nil {
+				log.Printf("received signal %s: reloading in %s", sig, h.debounce)
+				pendingReload = time.After(h.debounce)
+			}
+		case syscall.SIGUSR1:
+			for _, m := range h.maintainers {
+				state := "disabled"
+				if m.ToggleMaintenance() {
+					state = "enabled"
+				}
+				log.Printf("received signal %s: maintenance mode %s", sig, state)
 			}
 		case syscall.SIGTERM, syscall.SIGINT:
 			log.Printf("received signal %s: shutting down", sig)
+			pendingReload = nil
 			for _, c := range h.closers {
 				if err := c.Close(); err != nil {
 					log.Printf("close of %T failed: %s", c, err)
@@ -2,6 +2,7 @@ package signal
 
 import (
 	"os"
+	"reflect"
 	"sync"
 	"syscall"
 	"testing"
@@ -9,15 +10,24 @@ import (
 )
 
 type reloaderCloser struct {
-	mu       sync.RWMutex
-	reloaded bool
-	closed   bool
+	mu          sync.RWMutex
+	reloaded    bool
+	reloads     int
+	maintenance bool
+	closed      bool
 }
 
 func (rc *reloaderCloser) Reload() {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 	rc.reloaded = true
+	rc.reloads++
+}
+func (rc *reloaderCloser) ToggleMaintenance() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.maintenance = !rc.maintenance
+	return rc.maintenance
 }
 func (rc *reloaderCloser) Close() error {
 	rc.mu.Lock()
@@ -30,6 +40,11 @@ func (rc *reloaderCloser) isReloaded() bool {
 	defer rc.mu.RUnlock()
 	return rc.reloaded
 }
+func (rc *reloaderCloser) isMaintenance() bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.maintenance
+}
 func (rc *reloaderCloser) isClosed() bool {
 	rc.mu.RLock()
 	defer rc.mu.RUnlock()
@@ -40,6 +55,7 @@ func (rc *reloaderCloser) reset() {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 	rc.reloaded = false
+	rc.maintenance = false
 	rc.closed = false
 }
 
@@ -48,6 +64,7 @@ func TestHandler(t *testing.T) {
 
 	rc := &reloaderCloser{}
 	h.OnReload(rc)
+	h.OnMaintenance(rc)
 	h.OnClose(rc)
 
 	var tests = []struct {
@@ -55,6 +72,7 @@ func TestHandler(t *testing.T) {
 		value  func() bool
 	}{
 		{syscall.SIGHUP, rc.isReloaded},
+		{syscall.SIGUSR1, rc.isMaintenance},
 		{syscall.SIGTERM, rc.isClosed},
 		{syscall.SIGINT, rc.isClosed},
 	}
@@ -71,3 +89,66 @@ func TestHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlerDebounce(t *testing.T) {
+	h := NewHandlerWithDebounce(make(chan os.Signal, 1), 50*time.Millisecond)
+	rc := &reloaderCloser{}
+	h.OnReload(rc)
+	for i := 0; i < 10; i++ {
+		h.signal <- syscall.SIGHUP
+	}
+	ts := time.Now()
+	for !rc.isReloaded() {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatal("timed out waiting for reload")
+		}
+	}
+	// Signals received after the reload trigger another reload
+	h.signal <- syscall.SIGHUP
+	h.Close()
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if got, want := rc.reloads, 2; got != want {
+		t.Errorf("reloads = %d, want %d", got, want)
+	}
+}
+
+type orderedCloser struct {
+	name   string
+	closed *[]string
+	mu     *sync.Mutex
+}
+
+func (c orderedCloser) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.closed = append(*c.closed, c.name)
+	return nil
+}
+
+func TestHandlerCloseOrder(t *testing.T) {
+	h := NewHandler(make(chan os.Signal, 1))
+	var (
+		mu     sync.Mutex
+		closed []string
+	)
+	names := []string{"proxy", "http", "cache", "database", "server"}
+	for _, name := range names {
+		h.OnClose(orderedCloser{name: name, closed: &closed, mu: &mu})
+	}
+	var registered []string
+	for _, c := range h.Closers() {
+		registered = append(registered, c.(orderedCloser).name)
+	}
+	if !reflect.DeepEqual(registered, names) {
+		t.Errorf("Closers() = %q, want %q", registered, names)
+	}
+	h.signal <- syscall.SIGTERM
+	h.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(closed, names) {
+		t.Errorf("closed %q, want %q", closed, names)
+	}
+}
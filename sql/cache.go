@@ -15,7 +15,7 @@ const (
 
 type query struct {
 	op    int
-	key   uint32
+	key   uint64
 	value cache.Value
 }
 
@@ -49,12 +49,12 @@ func (c *Cache) Close() error {
 
 // Set queues a write associating value with key. Set is non-blocking, but read operations wait for any pending writes
 // to complete before reading.
-func (c *Cache) Set(key uint32, value cache.Value) {
+func (c *Cache) Set(key uint64, value cache.Value) {
 	c.enqueue(query{op: setOp, key: key, value: value})
 }
 
 // Evict queues a removal of key. As Set, Evict is non-blocking.
-func (c *Cache) Evict(key uint32) { c.enqueue(query{op: removeOp, key: key}) }
+func (c *Cache) Evict(key uint64) { c.enqueue(query{op: removeOp, key: key}) }
 
 // Reset queues removal of all entries. As Set, Reset is non-blocking.
 func (c *Cache) Reset() { c.enqueue(query{op: resetOp}) }
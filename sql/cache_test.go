@@ -13,7 +13,7 @@ func TestCache(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	data2 := "2 1578680472 00000100000100000000000003777777076578616d706c6503636f6d0000010001"
+	data2 := "v2 1 18446744073709551615 1578680472 00000100000100000000000003777777076578616d706c6503636f6d0000010001"
 	v2, err := cache.Unpack(data2)
 	if err != nil {
 		t.Fatal(err)
@@ -49,6 +49,16 @@ func TestCache(t *testing.T) {
 	if got, want := len(values), 1; got != want {
 		t.Fatalf("len(values) = %d, want %d", got, want)
 	}
+	if got, want := values[0], v2; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Keys exceeding the range of a signed integer can be removed
+	c.Evict(v2.Key)
+	values = c.Read()
+	if got, want := len(values), 0; got != want {
+		t.Fatalf("len(values) = %d, want %d", got, want)
+	}
 
 	// Replacing existing value changes order
 	c.Reset()
@@ -18,11 +18,16 @@ const (
 
 // Logger is a logger that logs DNS requests to a SQL database.
 type Logger struct {
+	// DiscardAnswers discards the answers of DNS requests, such that only their metadata is logged.
+	DiscardAnswers bool
+
 	mode   int
 	queue  chan LogEntry
 	client *Client
 	wg     sync.WaitGroup
 	now    func() time.Time
+	// Number of log entries read at a time when exporting
+	batchSize int
 }
 
 // LogEntry represents a log entry for a DNS request.
@@ -53,10 +58,11 @@ type LogEvent struct {
 // NewLogger creates a new logger. Persisted entries are kept according to ttl.
 func NewLogger(client *Client, mode int, ttl time.Duration) *Logger {
 	l := &Logger{
-		client: client,
-		queue:  make(chan LogEntry, 1024),
-		now:    time.Now,
-		mode:   mode,
+		client:    client,
+		queue:     make(chan LogEntry, 1024),
+		now:       time.Now,
+		mode:      mode,
+		batchSize: 1000,
 	}
 	if mode != LogDiscard {
 		go l.readQueue(ttl)
@@ -78,6 +84,9 @@ func (l *Logger) Record(remoteAddr net.IP, hijacked bool, qtype uint16, question
 	if l.mode == LogHijacked && !hijacked {
 		return
 	}
+	if l.DiscardAnswers {
+		answers = nil
+	}
 	l.wg.Add(1)
 	l.queue <- LogEntry{
 		Time:       l.now(),
@@ -95,6 +104,33 @@ func (l *Logger) Read(n int) ([]LogEntry, error) {
 	if err != nil {
 		return nil, err
 	}
+	return groupLogEntries(entries), nil
+}
+
+// Export calls fn for each log entry recorded at or after since, in the order the entries were recorded. Entries are
+// read from the database in batches, so the log is never held in memory in its entirety. Export stops at the first
+// error returned by fn.
+func (l *Logger) Export(since time.Time, fn func(LogEntry) error) error {
+	var id int64
+	for {
+		entries, err := l.client.readLogAfter(since.Unix(), id, l.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		for _, le := range groupLogEntries(entries) {
+			if err := fn(le); err != nil {
+				return err
+			}
+		}
+		id = entries[len(entries)-1].ID
+	}
+}
+
+// groupLogEntries merges rows belonging to the same log entry, where each row contains a single answer.
+func groupLogEntries(entries []logEntry) []LogEntry {
 	ids := make(map[int64]*LogEntry)
 	logEntries := make([]LogEntry, 0, len(entries))
 	for _, le := range entries {
@@ -115,7 +151,7 @@ func (l *Logger) Read(n int) ([]LogEntry, error) {
 			entry.Answers = append(entry.Answers, le.Answer)
 		}
 	}
-	return logEntries, nil
+	return logEntries
 }
 
 // Stats returns logger statistics. Events will be merged together according to resolution. A zero duration disables
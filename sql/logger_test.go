@@ -24,6 +24,31 @@ func TestRecord(t *testing.T) {
 	}
 }
 
+func TestRecordDiscardAnswers(t *testing.T) {
+	for _, discard := range []bool{false, true} {
+		logger := NewLogger(testClient(), LogAll, 0)
+		logger.DiscardAnswers = discard
+		logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", "192.0.2.1", "192.0.2.2")
+		if err := logger.Close(); err != nil { // Flush
+			t.Fatal(err)
+		}
+		entries, err := logger.Read(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("len(entries) = %d, want 1", len(entries))
+		}
+		var want []string
+		if !discard {
+			want = []string{"192.0.2.2", "192.0.2.1"}
+		}
+		if got := entries[0].Answers; !reflect.DeepEqual(got, want) {
+			t.Errorf("Answers = %q, want %q (discard = %t)", got, want, discard)
+		}
+	}
+}
+
 func TestMode(t *testing.T) {
 	badHost := "badhost1."
 	goodHost := "goodhost1."
@@ -94,6 +119,36 @@ func TestAnswerMerging(t *testing.T) {
 	}
 }
 
+func TestExport(t *testing.T) {
+	logger := NewLogger(testClient(), LogAll, 0)
+	logger.batchSize = 2
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, question := range []string{"1.example.com.", "2.example.com.", "3.example.com.", "4.example.com."} {
+		logger.now = func() time.Time { return now.Add(time.Duration(i) * time.Minute) }
+		logger.Record(net.IPv4(192, 0, 2, 100), false, 1, question, "192.0.2.1", "192.0.2.2")
+		if err := logger.Close(); err != nil { // Flush to record in order
+			t.Fatal(err)
+		}
+	}
+	var got []LogEntry
+	if err := logger.Export(now.Add(time.Minute), func(le LogEntry) error {
+		got = append(got, le)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var questions []string
+	for _, le := range got {
+		questions = append(questions, le.Question)
+		if want := []string{"192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(le.Answers, want) {
+			t.Errorf("Answers = %q, want %q for %s", le.Answers, want, le.Question)
+		}
+	}
+	if want := []string{"2.example.com.", "3.example.com.", "4.example.com."}; !reflect.DeepEqual(questions, want) {
+		t.Errorf("Export(%s) = %q, want %q", now.Add(time.Minute), questions, want)
+	}
+}
+
 func TestLogPruning(t *testing.T) {
 	logger := NewLogger(testClient(), LogAll, time.Hour)
 	defer logger.Close()
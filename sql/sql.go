@@ -99,7 +99,7 @@ type logEvent struct {
 }
 
 type cacheEntry struct {
-	Key  uint32 `db:"key"`
+	Key  int64  `db:"key"`
 	Data string `db:"data"`
 }
 
@@ -150,6 +150,31 @@ ORDER BY time DESC, rr_answer.id DESC
 	return entries, err
 }
 
+func (c *Client) readLogAfter(since int64, id int64, n int) ([]logEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	query := `
+SELECT log.id AS id,
+       time,
+       remote_addr.addr AS remote_addr,
+       hijacked,
+       type,
+       rr_question.name AS question,
+       IFNULL(rr_answer.name, "") AS answer
+FROM log
+INNER JOIN remote_addr ON remote_addr.id = log.remote_addr_id
+INNER JOIN rr_question ON rr_question.id = rr_question_id
+INNER JOIN rr_type ON rr_type.id = rr_type_id
+LEFT  JOIN log_rr_answer ON log_rr_answer.log_id = log.id
+LEFT  JOIN rr_answer ON rr_answer.id = log_rr_answer.rr_answer_id
+WHERE log.id IN (SELECT id FROM log WHERE time >= $1 AND id > $2 ORDER BY id ASC LIMIT $3)
+ORDER BY log.id ASC, rr_answer.id ASC
+`
+	var entries []logEntry
+	err := c.db.Select(&entries, query, since, id, n)
+	return entries, err
+}
+
 func getOrInsert(tx *sqlx.Tx, table, column string, value interface{}) (int64, error) {
 	var id int64
 	err := tx.Get(&id, "SELECT id FROM "+table+" WHERE "+column+" = ?", value)
@@ -280,7 +305,7 @@ func (c *Client) readLogStats() (logStats, error) {
 	return stats, nil
 }
 
-func (c *Client) writeCacheValue(key uint32, data string) error {
+func (c *Client) writeCacheValue(key uint64, data string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	tx, err := c.db.Beginx()
@@ -288,16 +313,17 @@ func (c *Client) writeCacheValue(key uint32, data string) error {
 		return nil
 	}
 	defer tx.Rollback()
-	if _, err := tx.Exec("DELETE FROM cache WHERE key = $1", key); err != nil {
+	// Keys are stored as signed integers, as SQLite does not support unsigned 64-bit integers
+	if _, err := tx.Exec("DELETE FROM cache WHERE key = $1", int64(key)); err != nil {
 		return err
 	}
-	if _, err := tx.Exec("INSERT INTO cache (key, data) VALUES ($1, $2)", key, data); err != nil {
+	if _, err := tx.Exec("INSERT INTO cache (key, data) VALUES ($1, $2)", int64(key), data); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func (c *Client) removeCacheValue(key uint32) error {
+func (c *Client) removeCacheValue(key uint64) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	tx, err := c.db.Beginx()
@@ -305,7 +331,7 @@ func (c *Client) removeCacheValue(key uint32) error {
 		return nil
 	}
 	defer tx.Rollback()
-	if _, err := tx.Exec("DELETE FROM cache WHERE key = $1", key); err != nil {
+	if _, err := tx.Exec("DELETE FROM cache WHERE key = $1", int64(key)); err != nil {
 		return err
 	}
 	return tx.Commit()